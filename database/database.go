@@ -5,6 +5,7 @@ import (
 	"ethereum-service/internal/repository"
 	"ethereum-service/model"
 	"fmt"
+	"log"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -32,11 +33,37 @@ func DbInit() {
 	err = connection.AutoMigrate(&model.Payment{})
 	err = connection.AutoMigrate(&model.PaymentState{})
 	err = connection.AutoMigrate(&model.Account{})
+	err = connection.AutoMigrate(&model.Block{})
+	err = connection.AutoMigrate(&model.OutgoingTransaction{})
+	err = connection.AutoMigrate(&model.Notification{})
+	createIndexes(connection)
 
 	repository.InitPayment(DB)
 	repository.InitAccount(DB)
+	repository.InitBlock(DB)
+	repository.InitOutgoingTransaction(DB)
+	repository.InitNotification(DB)
 
 	if err != nil {
 		return
 	}
 }
+
+/*
+	Indexes which can't be declared on the models: the pagination order of the payment search, the case-insensitive address filters
+	and the idempotency keys, which are unique per merchant wallet. The former non-unique index of the idempotency keys is replaced by it.
+*/
+func createIndexes(connection *gorm.DB) {
+	indexes := []string{
+		"CREATE INDEX IF NOT EXISTS idx_payments_created_at_id ON payments (created_at, id)",
+		"CREATE INDEX IF NOT EXISTS idx_payments_lower_merchant_wallet ON payments (lower(merchant_wallet))",
+		"CREATE INDEX IF NOT EXISTS idx_accounts_lower_address ON accounts (lower(address))",
+		"DROP INDEX IF EXISTS idx_payments_idempotency_key",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_merchant_idempotency_key ON payments (lower(merchant_wallet), idempotency_key) WHERE idempotency_key <> ''",
+	}
+	for _, index := range indexes {
+		if err := connection.Exec(index).Error; err != nil {
+			log.Printf("Unable to create index: %v", err)
+		}
+	}
+}
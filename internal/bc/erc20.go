@@ -0,0 +1,305 @@
+package bc
+
+import (
+	"context"
+	"errors"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/logging"
+	"ethereum-service/model"
+	"ethereum-service/utils"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/sirupsen/logrus"
+)
+
+// only the parts of the ERC-20 standard which are needed to receive and forward tokens
+const erc20ABI = `[
+	{"constant":true,"inputs":[{"name":"owner","type":"address"}],"name":"balanceOf","outputs":[{"name":"","type":"uint256"}],"type":"function"},
+	{"constant":false,"inputs":[{"name":"to","type":"address"},{"name":"value","type":"uint256"}],"name":"transfer","outputs":[{"name":"","type":"bool"}],"type":"function"},
+	{"anonymous":false,"inputs":[{"indexed":true,"name":"from","type":"address"},{"indexed":true,"name":"to","type":"address"},{"indexed":false,"name":"value","type":"uint256"}],"name":"Transfer","type":"event"}
+]`
+
+// used when the gas estimation of a token transfer fails
+const tokenTransferGasLimit = uint64(100000)
+
+var (
+	erc20                  = mustParseABI(erc20ABI)
+	TransferEventSignature = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+	NoGasStation           = errors.New("no gas station configured")
+	GasFundingPending      = errors.New("gas funding isn't mined yet")
+)
+
+type TokenTransfer struct {
+	Token  common.Address
+	From   common.Address
+	To     common.Address
+	Value  *big.Int
+	TxHash common.Hash
+	// LogIndex index of the Transfer event in the block
+	LogIndex uint
+}
+
+func mustParseABI(definition string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(definition))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+func GetTokenBalanceAt(client *config.Client, token common.Address, address common.Address) (*big.Int, error) {
+	return getTokenBalanceAtBlock(client, token, address, nil)
+}
+
+func getTokenBalanceAtBlock(client *config.Client, token common.Address, address common.Address, blockNr *big.Int) (*big.Int, error) {
+	data, err := erc20.Pack("balanceOf", address)
+	if err != nil {
+		return nil, err
+	}
+	result, err := client.CallContract(context.Background(), ethereum.CallMsg{To: &token, Data: data}, blockNr)
+	if err != nil {
+		return nil, err
+	}
+	values, err := erc20.Unpack("balanceOf", result)
+	if err != nil {
+		return nil, err
+	}
+	return values[0].(*big.Int), nil
+}
+
+/*
+	Subtracts the token remainder, because these tokens were already on the address before the payment was created.
+*/
+func GetUserTokenBalanceAt(client *config.Client, token common.Address, address common.Address, remainder *big.Int) (*big.Int, error) {
+	realBalance, err := GetTokenBalanceAt(client, token, address)
+	if err != nil {
+		return nil, err
+	}
+	return realBalance.Sub(realBalance, remainder), nil
+}
+
+/*
+	Filters the Transfer events of the given tokens in a block, which were sent to one of the recipients.
+*/
+func GetTokenTransfers(client *config.Client, blockHash common.Hash, tokens []common.Address, recipients []common.Address) ([]TokenTransfer, error) {
+	if len(tokens) == 0 || len(recipients) == 0 {
+		return nil, nil
+	}
+	recipientTopics := make([]common.Hash, 0, len(recipients))
+	for _, r := range recipients {
+		recipientTopics = append(recipientTopics, common.BytesToHash(r.Bytes()))
+	}
+	logs, err := client.FilterLogs(context.Background(), ethereum.FilterQuery{
+		BlockHash: &blockHash,
+		Addresses: tokens,
+		Topics:    [][]common.Hash{{TransferEventSignature}, nil, recipientTopics},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var transfers []TokenTransfer
+	for _, l := range logs {
+		transfer, err := parseTransferLog(l)
+		if err != nil {
+			logrus.WithError(err).WithField(logging.TxHash, l.TxHash.String()).Warn("Unable to parse transfer log")
+			continue
+		}
+		transfers = append(transfers, transfer)
+	}
+	return transfers, nil
+}
+
+/*
+	Collects the token transfers of a block for all open token payments.
+*/
+func GetPaymentTokenTransfers(client *config.Client, blockHash common.Hash, payments []model.Payment) ([]TokenTransfer, error) {
+	var tokens []common.Address
+	var recipients []common.Address
+	seenTokens := make(map[common.Address]bool)
+	for _, p := range payments {
+		if !p.IsTokenPayment() {
+			continue
+		}
+		token := common.HexToAddress(p.TokenContract)
+		if !seenTokens[token] {
+			seenTokens[token] = true
+			tokens = append(tokens, token)
+		}
+		recipients = append(recipients, common.HexToAddress(p.Account.Address))
+	}
+	return GetTokenTransfers(client, blockHash, tokens, recipients)
+}
+
+func parseTransferLog(l types.Log) (TokenTransfer, error) {
+	if len(l.Topics) != 3 || l.Topics[0] != TransferEventSignature {
+		return TokenTransfer{}, fmt.Errorf("log %v is no Transfer event", l.TxHash)
+	}
+	values, err := erc20.Unpack("Transfer", l.Data)
+	if err != nil {
+		return TokenTransfer{}, err
+	}
+	return TokenTransfer{
+		Token:    l.Address,
+		From:     common.BytesToAddress(l.Topics[1].Bytes()),
+		To:       common.BytesToAddress(l.Topics[2].Bytes()),
+		Value:    values[0].(*big.Int),
+		TxHash:   l.TxHash,
+		LogIndex: l.Index,
+	}, nil
+}
+
+func packTransfer(to common.Address, amount *big.Int) ([]byte, error) {
+	return erc20.Pack("transfer", to, amount)
+}
+
+// GetTransferRecipient
+/*
+	Returns the recipient of the transaction. For a token transfer it is the recipient of the tokens, not the token contract.
+*/
+func GetTransferRecipient(tx *types.Transaction) (common.Address, error) {
+	data := tx.Data()
+	if len(data) == 0 {
+		if tx.To() == nil {
+			return common.Address{}, errors.New("transaction has no recipient")
+		}
+		return *tx.To(), nil
+	}
+	method, err := erc20.MethodById(data[:4])
+	if err != nil || method.Name != "transfer" {
+		return common.Address{}, fmt.Errorf("transaction isn't a token transfer")
+	}
+	args, err := method.Inputs.Unpack(data[4:])
+	if err != nil {
+		return common.Address{}, err
+	}
+	return args[0].(common.Address), nil
+}
+
+func estimateTokenTransferGas(client *config.Client, from common.Address, token common.Address, data []byte) uint64 {
+	gasLimit, err := client.EstimateGas(context.Background(), ethereum.CallMsg{From: from, To: &token, Data: data})
+	if err != nil {
+		logrus.WithError(err).WithField(logging.Account, from.String()).Warn("Unable to estimate gas of token transfer, use default")
+		return tokenTransferGasLimit
+	}
+	return gasLimit
+}
+
+/*
+	Forwards the tokens to the merchant. An overpayment beyond the tolerance is refunded to the sender.
+	All other tokens which are left on the address (earnings and tolerated overpayments) are sent to the CHainGate wallet.
+	The gas is paid in ETH, therefore the address gets funded by the gas station if it doesn't hold enough ETH. The tokens are forwarded after the funding is mined.
+*/
+func forwardToken(client *config.Client, payment *model.Payment, fees *Fees, record Recorder) *types.Transaction {
+	token := common.HexToAddress(payment.TokenContract)
+	from := common.HexToAddress(payment.Account.Address)
+	tokenBalance, err := GetTokenBalanceAt(client, token, from)
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Unable to get token balance")
+		return nil
+	}
+
+	chainGateEarnings := utils.GetChaingateEarnings(&payment.CurrentPaymentState.PayAmount.Int)
+	finalAmount := big.NewInt(0).Sub(payment.GetActiveAmount(), chainGateEarnings)
+	overpayment := GetRefundableOverpayment(payment, big.NewInt(0).Sub(tokenBalance, payment.GetTokenRemainder()))
+	earnings := big.NewInt(0).Sub(tokenBalance, finalAmount)
+	earnings.Sub(earnings, overpayment)
+
+	data, err := packTransfer(common.HexToAddress(payment.MerchantWallet), finalAmount)
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Unable to pack token transfer")
+		return nil
+	}
+	gasLimit := estimateTokenTransferGas(client, from, token, data)
+	transfers := int64(1)
+	if earnings.Sign() > 0 {
+		transfers++
+	}
+	if overpayment.Sign() > 0 {
+		transfers++
+	}
+	requiredGas := big.NewInt(0).Mul(fees.Cost(gasLimit), big.NewInt(transfers))
+	err = fundGas(client, from, requiredGas, record)
+	if errors.Is(err, GasFundingPending) {
+		logging.WithPayment(payment).Info("Token forward waits until the gas funding is mined")
+		return nil
+	}
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Unable to fund gas for token forward")
+		return nil
+	}
+
+	signedTx := makeTransaction(client, &payment.Account, fees, big.NewInt(0), token, data, gasLimit, recordOf(record, model.Forward, fees))
+	if signedTx == nil {
+		return nil
+	}
+	payment.ForwardingTransactionHash = signedTx.Hash().String()
+
+	if overpayment.Sign() > 0 && sendRefund(client, payment, fees, common.HexToAddress(payment.SenderAddress), overpayment, gasLimit, record) == nil {
+		logging.WithPayment(payment).Error("Unable to refund token overpayment. Try again next block")
+		payment.RefundStatus = model.RefundOpen
+	}
+	if earnings.Sign() > 0 {
+		data, err = packTransfer(common.HexToAddress(config.Opts.TargetWallet), earnings)
+		if err != nil {
+			logging.WithPayment(payment).WithError(err).Error("Unable to pack token transfer")
+			return signedTx
+		}
+		if makeTransaction(client, &payment.Account, fees, big.NewInt(0), token, data, gasLimit, recordOf(record, model.Earnings, fees)) == nil {
+			logging.WithPayment(payment).Error("Unable to forward token earnings")
+		}
+	}
+	return signedTx
+}
+
+/*
+	Sends the missing ETH for the gas from the gas station to the address. The funding is recorded like the transactions of the payment and the tracker follows it.
+	Returns GasFundingPending if the funding was sent, the transactions which need the gas are sent after it is mined.
+*/
+func fundGas(client *config.Client, address common.Address, requiredGas *big.Int, record Recorder) error {
+	balance, err := GetBalanceAt(client, address)
+	if err != nil {
+		return err
+	}
+	if balance.Cmp(requiredGas) >= 0 {
+		return nil
+	}
+	if config.Opts.GasStationPrivateKey == "" {
+		return NoGasStation
+	}
+	key, err := utils.GetPrivateKey(config.Opts.GasStationPrivateKey)
+	if err != nil {
+		return err
+	}
+	chainID, err := getChainID(client)
+	if err != nil {
+		return err
+	}
+	fees, err := EstimateFees(client)
+	if err != nil {
+		return err
+	}
+	signedTx, err := sendWithNonce(client, crypto.PubkeyToAddress(key.PublicKey), func(nonce uint64) (*types.Transaction, error) {
+		tx := types.NewTx(&types.DynamicFeeTx{
+			ChainID:   chainID,
+			Nonce:     nonce,
+			GasFeeCap: fees.GasFeeCap,
+			GasTipCap: fees.GasTipCap,
+			Gas:       21000,
+			To:        &address,
+			Value:     big.NewInt(0).Sub(requiredGas, balance),
+		})
+		return types.SignTx(tx, types.LatestSignerForChainID(chainID), key)
+	}, recordOf(record, model.GasFunding, fees))
+	if err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{logging.TxHash: signedTx.Hash().Hex(), logging.Account: address.String(), "value": signedTx.Value().String()}).Info("Gas funding sent")
+	return GasFundingPending
+}
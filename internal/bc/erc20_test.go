@@ -0,0 +1,53 @@
+package bc
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestParseTransferLog(t *testing.T) {
+	token := common.HexToAddress("0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48")
+	from := common.HexToAddress("0xb794f5ea0ba39494ce839613fffba74279579268")
+	to := common.HexToAddress("0xcDd9C81f1855Bfd6a309A395b53f273d539ad7aa")
+	value := big.NewInt(12500000)
+	l := types.Log{
+		Address: token,
+		Topics:  []common.Hash{TransferEventSignature, common.BytesToHash(from.Bytes()), common.BytesToHash(to.Bytes())},
+		Data:    common.LeftPadBytes(value.Bytes(), 32),
+	}
+	transfer, err := parseTransferLog(l)
+	if err != nil {
+		t.Fatalf("Unable to parse transfer log %v", err)
+	}
+	if transfer.Token != token || transfer.From != from || transfer.To != to {
+		t.Fatalf(`Transfer has the wrong addresses %+v`, transfer)
+	}
+	if transfer.Value.Cmp(value) != 0 {
+		t.Fatalf(`Transfer value is %v, but should be %v`, transfer.Value, value)
+	}
+}
+
+func TestParseTransferLogWrongEvent(t *testing.T) {
+	l := types.Log{Topics: []common.Hash{common.HexToHash("0x01")}}
+	if _, err := parseTransferLog(l); err == nil {
+		t.Fatalf("A log which isn't a Transfer event should return an error")
+	}
+}
+
+func TestPackTransfer(t *testing.T) {
+	to := common.HexToAddress("0xcDd9C81f1855Bfd6a309A395b53f273d539ad7aa")
+	data, err := packTransfer(to, big.NewInt(1))
+	if err != nil {
+		t.Fatalf("Unable to pack transfer %v", err)
+	}
+	// 4 byte method id + 2 arguments with 32 bytes
+	if len(data) != 68 {
+		t.Fatalf(`Packed transfer has %v bytes, but should have %v`, len(data), 68)
+	}
+	if common.Bytes2Hex(data[:4]) != "a9059cbb" {
+		t.Fatalf(`Packed transfer has the wrong method id %v`, common.Bytes2Hex(data[:4]))
+	}
+}
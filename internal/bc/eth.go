@@ -4,27 +4,43 @@ import (
 	"context"
 	"errors"
 	"ethereum-service/internal/config"
+	"ethereum-service/internal/logging"
 	"ethereum-service/model"
 	"ethereum-service/utils"
 	"fmt"
-	"log"
 	"math/big"
 	"time"
 
 	"github.com/CHainGate/backend/pkg/enum"
 	"github.com/ethereum/go-ethereum"
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/sirupsen/logrus"
 )
 
 var BlockFailed = errors.New("block failed")
 
+// Recorder stores the signed transactions before they are broadcast
+type Recorder interface {
+	// Record stores the transaction of the kind and its estimated fees. If it fails, the transaction isn't sent.
+	Record(tx *types.Transaction, kind model.OutgoingTransactionKind, fees *Fees) error
+	// Sent is called with the result of the first broadcast of a recorded transaction, err is nil if the node accepted it
+	Sent(tx *types.Transaction, err error)
+}
+
+// kindRecorder records the transactions of one kind with the fees they were signed with
+type kindRecorder struct {
+	Recorder
+	kind model.OutgoingTransactionKind
+	fees *Fees
+}
+
 /*
 	Subtracts the remainder, because this is the CHainGateEarnings
 */
-func GetUserBalanceAt(client *ethclient.Client, address common.Address, remainder *big.Int) (*big.Int, error) {
+func GetUserBalanceAt(client *config.Client, address common.Address, remainder *big.Int) (*big.Int, error) {
 	realBalance, err := GetBalanceAt(client, address)
 	if err != nil {
 		return nil, err
@@ -36,27 +52,29 @@ func GetUserBalanceAt(client *ethclient.Client, address common.Address, remainde
 /*
    Never use this Method to check if the user has paid enough, because it doesn't factor in the *Remainder*
 */
-func GetBalanceAt(client *ethclient.Client, address common.Address) (*big.Int, error) {
-	return client.BalanceAt(context.Background(), address, nil)
+func GetBalanceAt(client *config.Client, address common.Address) (*big.Int, error) {
+	balance, err := client.BalanceAt(context.Background(), address, nil)
+	return balance, err
 }
 
 /*
 	Theoretically the best way to check it is, that you check the transaction receipt. Because the user can pay multiple times we would need to check multiple tx's.
     Because there is no limit and the user could spam with a lot of tx's and run out of API-calls to infura.
     Therefore, this method checks the block. If older blocks gets reverted this is also not valid anymore.
+    A node can still return an uncled block by its hash, therefore the hash of the canonical block with the same number is compared.
 */
-func IsBlockConfirmed(client *ethclient.Client, blockHash common.Hash) (bool, error) {
-	block, err := client.BlockByHash(context.Background(), blockHash)
-	if err != nil {
-		return false, err
-	}
+func IsBlockConfirmed(client *config.Client, blockNr *big.Int, blockHash common.Hash) (bool, error) {
+	header, err := client.HeaderByNumber(context.Background(), blockNr)
 	if err == ethereum.NotFound {
 		return false, nil
 	}
-	return block != nil, nil
+	if err != nil {
+		return false, err
+	}
+	return header.Hash() == blockHash, nil
 }
 
-func IsTxConfirmed(client *ethclient.Client, txHash common.Hash, blockNr *big.Int) (bool, error) {
+func IsTxConfirmed(client *config.Client, txHash common.Hash, blockNr *big.Int) (bool, error) {
 	tx, err := client.TransactionReceipt(context.Background(), txHash)
 	if err != nil {
 		return false, err
@@ -71,19 +89,61 @@ func IsTxConfirmed(client *ethclient.Client, txHash common.Hash, blockNr *big.In
 /*
 	Check safely is paid, because it checks the balance on the address. Makes an API-Call to Ethereum.
 */
-func IsPaidOnChain(payment *model.Payment, client *ethclient.Client) (bool, *big.Int) {
+func IsPaidOnChain(payment *model.Payment, client *config.Client) (bool, *big.Int) {
+	return IsPaidOnChainAt(payment, client, nil)
+}
+
+/*
+	Same as IsPaidOnChain, but with the balance at the given block. nil is the latest block.
+*/
+func IsPaidOnChainAt(payment *model.Payment, client *config.Client, blockNr *big.Int) (bool, *big.Int) {
 	if client == nil {
 		client = GetClientByMode(payment.Mode)
 	}
-	balance, err := GetUserBalanceAt(client, common.HexToAddress(payment.Account.Address), &payment.Account.Remainder.Int)
+	balance, err := GetPaymentBalanceAtBlock(client, payment, blockNr)
 	if err != nil {
-		log.Printf("Error by getting balance %v", err)
+		logging.WithPayment(payment).WithError(err).Error("Error by getting balance")
 	}
 	return payment.IsPaid(balance), balance
 }
 
+/*
+	Returns the balance the user has paid in the currency of the payment. ETH or the ERC-20 token.
+*/
+func GetPaymentBalanceAt(client *config.Client, payment *model.Payment) (*big.Int, error) {
+	return GetPaymentBalanceAtBlock(client, payment, nil)
+}
+
+/*
+	Same as GetPaymentBalanceAt, but at the state of the given block. nil is the latest block.
+*/
+func GetPaymentBalanceAtBlock(client *config.Client, payment *model.Payment, blockNr *big.Int) (*big.Int, error) {
+	address := common.HexToAddress(payment.Account.Address)
+	var balance *big.Int
+	var err error
+	var remainder *big.Int
+	if payment.IsTokenPayment() {
+		balance, err = getTokenBalanceAtBlock(client, common.HexToAddress(payment.TokenContract), address, blockNr)
+		remainder = payment.GetTokenRemainder()
+	} else {
+		balance, err = client.BalanceAt(context.Background(), address, blockNr)
+		remainder = &payment.Account.Remainder.Int
+	}
+	if err != nil {
+		return nil, err
+	}
+	return balance.Sub(balance, remainder), nil
+}
+
 func CheckIfExpired(payment *model.Payment) bool {
-	return payment.CreatedAt.Add(15 * time.Minute).Before(time.Now())
+	return CheckIfExpiredAt(payment, time.Now())
+}
+
+/*
+	Returns if the payment was expired at the given time, e.g. the timestamp of a block.
+*/
+func CheckIfExpiredAt(payment *model.Payment, at time.Time) bool {
+	return payment.GetExpiresAt().Before(at)
 }
 
 func CheckIfAmountIsTooLowMode(mode enum.Mode, final *big.Int) error {
@@ -91,27 +151,46 @@ func CheckIfAmountIsTooLowMode(mode enum.Mode, final *big.Int) error {
 	return CheckIfAmountIsTooLow(client, final)
 }
 
-func CheckIfAmountIsTooLow(client *ethclient.Client, final *big.Int) error {
-	fees := big.NewInt(0)
-	var gasPrice *big.Int
-	var err error
-	if config.Chain == nil {
-		gasPrice, err = client.SuggestGasPrice(context.Background())
-		if err != nil {
-			log.Println(err)
-		}
-	} else {
-		gasPrice = config.Chain.GasPrice
+func CheckIfAmountIsTooLow(client *config.Client, final *big.Int) error {
+	fees, err := EstimateFees(client)
+	if err != nil {
+		return err
 	}
 
-	if fees.Mul(gasPrice, big.NewInt(21000*2)).Cmp(final) > 0 {
-		return fmt.Errorf("requested amount is too low. Fees are: %v", fees)
+	if cost := fees.Cost(21000 * 2); cost.Cmp(final) > 0 {
+		return fmt.Errorf("requested amount is too low. Fees are: %v", cost)
 	}
 	return nil
 }
 
-func GetClientByMode(mode enum.Mode) *ethclient.Client {
-	var client *ethclient.Client
+func CheckIfTokenAmountIsTooLowMode(mode enum.Mode, final *big.Int, decimals uint8, tokensPerEth float64) error {
+	client := GetClientByMode(mode)
+	return CheckIfTokenAmountIsTooLow(client, final, decimals, tokensPerEth)
+}
+
+// CheckIfTokenAmountIsTooLow
+/*
+	The gas of a token forward is paid in ETH by the gas station, so the CHainGate earnings of a token payment have to cover it.
+	The gas of the forward and of the transfer of the earnings is converted into the token with tokensPerEth.
+*/
+func CheckIfTokenAmountIsTooLow(client *config.Client, final *big.Int, decimals uint8, tokensPerEth float64) error {
+	fees, err := EstimateFees(client)
+	if err != nil {
+		return err
+	}
+
+	cost := fees.Cost(tokenTransferGasLimit * 2)
+	ethCost, _ := utils.GetETHFromWEI(cost).Float64()
+	tokenAmount := ethCost * tokensPerEth
+	tokenCost := utils.GetBaseUnitFromAmount(&tokenAmount, decimals)
+	if earnings := utils.GetChaingateEarnings(final); earnings.Cmp(tokenCost) < 0 {
+		return fmt.Errorf("requested amount is too low. Fees are: %v", tokenCost)
+	}
+	return nil
+}
+
+func GetClientByMode(mode enum.Mode) *config.Client {
+	var client *config.Client
 	switch mode {
 	case enum.Main:
 		client = config.ClientMain
@@ -121,133 +200,204 @@ func GetClientByMode(mode enum.Mode) *ethclient.Client {
 	return client
 }
 
-func Forward(client *ethclient.Client, payment *model.Payment) *types.Transaction {
+func getChainID(client *config.Client) (*big.Int, error) {
+	if config.Chain != nil {
+		return config.Chain.ChainId, nil
+	}
+	chainID, err := client.NetworkID(context.Background())
+	return chainID, err
+}
+
+// Forward
+/*
+	Sends the payment to the merchant. The transaction is broadcast, but not waited until it is mined.
+	An overpayment beyond the tolerance is refunded to the sender with the next transaction. If the refund can't be sent, it stays open and RefundOverpayment sends it again.
+*/
+func Forward(client *config.Client, payment *model.Payment, record Recorder) *types.Transaction {
 	toAddress := common.HexToAddress(payment.MerchantWallet)
-	var gasPrice *big.Int
-	var err error
-	if config.Chain == nil {
-		gasPrice, err = client.SuggestGasPrice(context.Background())
-		if err != nil {
-			log.Printf("Couldn't get suggested gasPrice %v", err)
-		}
-	} else {
-		gasPrice = config.Chain.GasPrice
+	fees, err := EstimateFees(client)
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Couldn't estimate fees")
+		return nil
+	}
+	if payment.IsTokenPayment() {
+		return forwardToken(client, payment, fees, record)
+	}
+	received, err := GetPaymentBalanceAt(client, payment)
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Unable to get balance for forward")
+		return nil
 	}
 	chainGateEarnings := utils.GetChaingateEarnings(&payment.CurrentPaymentState.PayAmount.Int)
-	fees := big.NewInt(0).Mul(big.NewInt(21000), gasPrice)
-	feesAndChangateEarnings := big.NewInt(0).Add(fees, chainGateEarnings)
+	feesAndChangateEarnings := big.NewInt(0).Add(fees.ExpectedCost(21000), chainGateEarnings)
 	finalAmount := big.NewInt(0).Sub(payment.GetActiveAmount(), feesAndChangateEarnings)
+	refundAmount := getOverpaymentRefund(payment, received, fees)
 
-	signedTx := makeTransaction(client, &payment.Account, gasPrice, finalAmount, toAddress)
+	required := big.NewInt(0).Add(finalAmount, fees.Cost(21000))
+	if refundAmount.Sign() > 0 {
+		required.Add(required, refundAmount)
+		required.Add(required, fees.Cost(21000))
+	}
+	uncovered, err := coverFeeHeadroom(client, common.HexToAddress(payment.Account.Address), required, record)
+	if errors.Is(err, GasFundingPending) {
+		logging.WithPayment(payment).Info("Forward waits until the gas funding is mined")
+		return nil
+	}
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Unable to cover the fee cap of the forward")
+		return nil
+	}
+	finalAmount.Sub(finalAmount, uncovered)
+
+	signedTx := makeTransaction(client, &payment.Account, fees, finalAmount, toAddress, nil, 21000, recordOf(record, model.Forward, fees))
 
 	if signedTx != nil {
 		payment.ForwardingTransactionHash = signedTx.Hash().String()
+		if refundAmount.Sign() > 0 && sendRefund(client, payment, fees, common.HexToAddress(payment.SenderAddress), refundAmount, 21000, record) == nil {
+			logging.WithPayment(payment).Error("Unable to refund overpayment. Try again next block")
+			payment.RefundStatus = model.RefundOpen
+		}
 	}
 
 	return signedTx
 }
 
-func ForwardEarnings(client *ethclient.Client, account *model.Account, fees *big.Int, gasPrice *big.Int) *types.Transaction {
-	finalAmount := big.NewInt(0).Sub(&account.Remainder.Int, fees)
+func ForwardEarnings(client *config.Client, account *model.Account, fees *Fees, record Recorder) *types.Transaction {
+	finalAmount := big.NewInt(0).Sub(&account.Remainder.Int, fees.Cost(21000))
 	toAddress := common.HexToAddress(config.Opts.TargetWallet)
-	return makeTransaction(client, account, gasPrice, finalAmount, toAddress)
+	return makeTransaction(client, account, fees, finalAmount, toAddress, nil, 21000, recordOf(record, model.Earnings, fees))
 }
 
-func makeTransaction(client *ethclient.Client, account *model.Account, gasPrice *big.Int, finalAmount *big.Int, toAddress common.Address) *types.Transaction {
-	gasTipCap, err := client.SuggestGasTipCap(context.Background())
-	if err != nil {
-		log.Println(err)
+func recordOf(r Recorder, kind model.OutgoingTransactionKind, fees *Fees) *kindRecorder {
+	if r == nil {
 		return nil
 	}
+	return &kindRecorder{Recorder: r, kind: kind, fees: fees}
+}
 
-	var chainID *big.Int
-	if config.Chain == nil {
-		chainID, err = client.NetworkID(context.Background())
-		if err != nil {
-			log.Println(err)
-			return nil
-		}
-	} else {
-		chainID = config.Chain.ChainId
-	}
-
-	gasLimit := uint64(21000)
-
-	tx := types.NewTx(&types.DynamicFeeTx{
-		ChainID:   chainID,
-		Nonce:     account.Nonce,
-		GasFeeCap: gasPrice,  //gasPrice,     // maximum price per unit of gas that the transaction is willing to pay
-		GasTipCap: gasTipCap, //tipCap,       // maximum amount above the baseFee of a block that the transaction is willing to pay to be included
-		Gas:       gasLimit,
-		To:        &toAddress,
-		Value:     finalAmount,
-	})
-
-	key, err := utils.GetPrivateKey(account.PrivateKey)
-	if err != nil {
-		log.Println(err)
+func (r *kindRecorder) record(tx *types.Transaction) error {
+	if r == nil {
 		return nil
 	}
-	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(chainID), key)
-	if err != nil {
-		log.Println(err)
-		return nil
+	return r.Record(tx, r.kind, r.fees)
+}
+
+// sent reports the result of the broadcast of the recorded transaction and returns the error
+func (r *kindRecorder) sent(tx *types.Transaction, err error) error {
+	if r != nil && tx != nil {
+		r.Sent(tx, err)
 	}
+	return err
+}
 
-	// TODO: "Unable to send Transaction already known" can happen when the block before is still waiting on line 204
-	err = client.SendTransaction(context.Background(), signedTx)
+/*
+	Signs and sends a transaction from the account. data is only set for contract calls, e.g. an ERC-20 transfer.
+	The transaction is recorded before it is sent. The account remainder is updated when the transaction is mined.
+*/
+func makeTransaction(client *config.Client, account *model.Account, fees *Fees, finalAmount *big.Int, toAddress common.Address, data []byte, gasLimit uint64, record *kindRecorder) *types.Transaction {
+	chainID, err := getChainID(client)
 	if err != nil {
-		log.Printf("Unable to send Transaction %v", err)
+		logrus.WithError(err).WithField(logging.Account, account.Address).Error("Unable to get chain id")
 		return nil
 	}
 
-	// TODO: Because we wait here there is a possibility, that the transaction is tried to send twice and it returns a "Unable to send Transaction already known"
-	_, err = bind.WaitMined(context.Background(), client, signedTx)
+	key, err := account.GetPrivateKey()
 	if err != nil {
-		log.Printf("Can't wait until transaction is mined %v", err)
+		logrus.WithError(err).WithField(logging.Account, account.Address).Error("Unable to get private key")
 		return nil
 	}
-
-	finalBalanceOnChaingateWallet, err := GetBalanceAt(client, common.HexToAddress(account.Address))
+	signedTx, err := sendWithNonce(client, common.HexToAddress(account.Address), func(nonce uint64) (*types.Transaction, error) {
+		tx := types.NewTx(&types.DynamicFeeTx{
+			ChainID:   chainID,
+			Nonce:     nonce,
+			GasFeeCap: fees.GasFeeCap, // maximum price per unit of gas that the transaction is willing to pay
+			GasTipCap: fees.GasTipCap, // maximum amount above the baseFee of a block that the transaction is willing to pay to be included
+			Gas:       gasLimit,
+			To:        &toAddress,
+			Value:     finalAmount,
+			Data:      data,
+		})
+		return types.SignTx(tx, types.LatestSignerForChainID(chainID), key)
+	}, record)
 	if err != nil {
-		log.Printf("Unable to get Balance of chaingate wallet %v", err)
+		logrus.WithError(err).WithField(logging.Account, account.Address).Error("Unable to send transaction")
 		return nil
 	}
-	fmt.Printf("tx sent: %s\n", signedTx.Hash().Hex())
-	account.Remainder = model.NewBigInt(finalBalanceOnChaingateWallet)
-	account.Nonce = account.Nonce + 1
+
+	logrus.WithFields(logrus.Fields{logging.TxHash: signedTx.Hash().Hex(), logging.Account: account.Address, "fees": fees.String()}).Info("Transaction sent")
+	account.Nonce = signedTx.Nonce() + 1
 	return signedTx
 }
 
 /*
-	returns true when the earning were forwarded and the corresponding transaction
+	Returns the fee, which was paid by the mined transaction. The effective gas price depends on the base fee of the block.
 */
-func CheckForwardEarnings(client *ethclient.Client, account *model.Account) (bool, *types.Transaction) {
-	var err error
-	var gasPrice *big.Int
-	if config.Chain == nil {
-		gasPrice, err = client.SuggestGasPrice(context.Background())
+func GetPaidFee(client *config.Client, tx *types.Transaction, receipt *types.Receipt) (*big.Int, error) {
+	header, err := client.HeaderByNumber(context.Background(), receipt.BlockNumber)
+	if err != nil {
+		return nil, err
+	}
+	gasPrice := tx.GasPrice()
+	if header.BaseFee != nil {
+		tip, err := tx.EffectiveGasTip(header.BaseFee)
 		if err != nil {
-			log.Println(err)
+			return nil, err
 		}
-	} else {
-		gasPrice = config.Chain.GasPrice
+		gasPrice = big.NewInt(0).Add(header.BaseFee, tip)
 	}
+	return big.NewInt(0).Mul(big.NewInt(int64(receipt.GasUsed)), gasPrice), nil
+}
+
+// Broadcast
+/*
+	Sends an already signed transaction again. A transaction which is already known by the node isn't an error.
+*/
+func Broadcast(client *config.Client, tx *types.Transaction) error {
+	err := client.SendTransaction(context.Background(), tx)
+	if err != nil && !isTxError(err, core.ErrAlreadyKnown) {
+		return err
+	}
+	return nil
+}
 
-	fees := big.NewInt(0).Mul(big.NewInt(21000), gasPrice)
+/*
+	The nonce of the transaction was used by another transaction, so it can never be mined.
+*/
+func IsNonceUsed(err error) bool {
+	return err != nil && isTxError(err, core.ErrNonceTooLow)
+}
+
+// IsRejected
+/*
+	The node rejected the transaction, e.g. because the address can't pay it. A connection error isn't a rejection, the node may have received the transaction anyway.
+*/
+func IsRejected(err error) bool {
+	var rpcErr rpc.Error
+	return errors.As(err, &rpcErr) || errors.Is(err, NonceRetriesExceeded)
+}
+
+/*
+	returns true when the earning were forwarded and the corresponding transaction
+*/
+func CheckForwardEarnings(client *config.Client, account *model.Account, record Recorder) (bool, *types.Transaction) {
+	fees, err := EstimateFees(client)
+	if err != nil {
+		logrus.WithError(err).WithField(logging.Account, account.Address).Error("Couldn't estimate fees")
+		return false, nil
+	}
 
 	factor := new(big.Int)
 	factor, ok := factor.SetString(config.Opts.FeeFactor, 10)
 	if !ok {
-		fmt.Println("SetString: error")
+		logrus.WithField("fee_factor", config.Opts.FeeFactor).Error("FEE_FACTOR isn't a number")
 		return false, nil
 	}
 
-	earningsForwardThreshold := big.NewInt(0).Mul(fees, factor)
+	earningsForwardThreshold := big.NewInt(0).Mul(fees.Cost(21000), factor)
 	if earningsForwardThreshold.Cmp(&account.Remainder.Int) > 0 {
 		return false, nil
 	}
 
-	tx := ForwardEarnings(client, account, fees, gasPrice)
+	tx := ForwardEarnings(client, account, fees, record)
 	return true, tx
 }
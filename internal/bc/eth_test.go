@@ -2,6 +2,7 @@ package bc
 
 import (
 	"context"
+	"errors"
 	"ethereum-service/internal/config"
 	"ethereum-service/internal/testutils"
 	"ethereum-service/model"
@@ -13,7 +14,7 @@ import (
 	"github.com/CHainGate/backend/pkg/enum"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/core/types"
 )
 
 func TestSingleForward(t *testing.T) {
@@ -23,6 +24,44 @@ func TestSingleForward(t *testing.T) {
 	CreateForward(t, client, chaingateAcc, payAmount, 1)
 }
 
+// refundFailingRecorder records every transaction except refunds
+type refundFailingRecorder struct{}
+
+func (refundFailingRecorder) Record(tx *types.Transaction, kind model.OutgoingTransactionKind, fees *Fees) error {
+	if kind == model.Refund {
+		return errors.New("refund can't be recorded")
+	}
+	return nil
+}
+
+func (refundFailingRecorder) Sent(tx *types.Transaction, err error) {}
+
+func TestForwardLeavesFailedRefundOpen(t *testing.T) {
+	config.ReadOpts()
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	chaingateAcc, payAmount := SetupFirstPayment(t, client, genesisAcc)
+	txOverpayment := testutils.CreateInitialPayment(client, genesisAcc, payAmount, chaingateAcc.Address)
+	if _, err := bind.WaitMined(context.Background(), client, txOverpayment); err != nil {
+		t.Fatalf("Can't wait until transaction is mined %v", err)
+	}
+
+	p := testutils.GetPaidPayment()
+	p.MerchantWallet = model.CreateAccount(enum.Main).Address
+	p.SenderAddress = genesisAcc.Address
+	p.CurrentPaymentState.PayAmount = model.NewBigInt(payAmount)
+	p.Account = *chaingateAcc
+
+	if tx := Forward(client, &p, refundFailingRecorder{}); tx == nil {
+		t.Fatalf("Forward wasn't sent")
+	}
+	if p.RefundTransactionHash != "" {
+		t.Fatalf("Refund shouldn't be sent, but %v was sent", p.RefundTransactionHash)
+	}
+	if p.RefundStatus != model.RefundOpen {
+		t.Fatalf("Refund status is %v, should be %v", p.RefundStatus, model.RefundOpen)
+	}
+}
+
 func TestIsFalsyPaidOnChain(t *testing.T) {
 	config.ReadOpts()
 	_, client := testutils.CustomChainSetup(t)
@@ -49,6 +88,24 @@ func TestIsPaidOnChain(t *testing.T) {
 	}
 }
 
+func TestClientReportsCalls(t *testing.T) {
+	config.ReadOpts()
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	var methods []string
+	config.OnRPCCall(func(method string, err error) {
+		methods = append(methods, method)
+	})
+	if _, err := GetBalanceAt(client, common.HexToAddress(genesisAcc.Address)); err != nil {
+		t.Fatalf("Unable to get balance %v", err)
+	}
+	if _, err := estimateGasTipCap(client); err != nil {
+		t.Fatalf("Unable to estimate tip %v", err)
+	}
+	if len(methods) < 2 || methods[0] != "eth_getBalance" || methods[1] != "eth_feeHistory" {
+		t.Fatalf("The calls weren't reported, reported methods are %v", methods)
+	}
+}
+
 // https://rpc.info/
 func TestGetClientByMode(t *testing.T) {
 	config.CreateMainClientConnection("https://mainnet.infura.io/v3/9aa3d95b3bc440fa88ea12eaa4456161")
@@ -82,7 +139,7 @@ func TestCheckForwardEarnings(t *testing.T) {
 		t.Fatalf("Can't wait until transaction is mined %v", err)
 	}
 	p.Account.Remainder = model.NewBigInt(overpayAmount)
-	check, tx := CheckForwardEarnings(client, &p.Account)
+	check, tx := CheckForwardEarnings(client, &p.Account, nil)
 	if !check {
 		t.Fatalf("Money should be forwarded, but function says no")
 	}
@@ -125,7 +182,19 @@ func TestCheckIfAmountIsTooLowCorrect(t *testing.T) {
 	}
 }
 
-func CreateForward(t *testing.T, client *ethclient.Client, chaingateAcc *model.Account, payAmount *big.Int, iteration uint64) model.Payment {
+func TestCheckIfTokenAmountIsTooLow(t *testing.T) {
+	config.ReadOpts()
+	_, client := testutils.CustomChainSetup(t)
+	// 1 USDC (6 decimals) at 2000 USDC per ETH doesn't cover the gas of the forward
+	if CheckIfTokenAmountIsTooLow(client, big.NewInt(1000000), 6, 2000) == nil {
+		t.Fatalf("The token amount should be too low")
+	}
+	if err := CheckIfTokenAmountIsTooLow(client, big.NewInt(1000000000000), 6, 2000); err != nil {
+		t.Fatalf("The token amount should be accepted, but %v", err)
+	}
+}
+
+func CreateForward(t *testing.T, client *config.Client, chaingateAcc *model.Account, payAmount *big.Int, iteration uint64) model.Payment {
 	shouldChainGateEarnings := big.NewInt(1000000000000)
 	merchantAcc := model.CreateAccount(enum.Main)
 	p := testutils.GetPaidPayment()
@@ -138,7 +207,18 @@ func CreateForward(t *testing.T, client *ethclient.Client, chaingateAcc *model.A
 		t.Fatalf(`Balance on generated wallet %v, should be %v`, fromBalance, payAmount)
 	}
 
-	Forward(client, &p)
+	tx := Forward(client, &p, nil)
+	if tx == nil {
+		t.Fatalf("Forward wasn't sent")
+	}
+	if _, err = bind.WaitMined(context.Background(), client, tx); err != nil {
+		t.Fatalf("Can't wait until transaction is mined %v", err)
+	}
+	remainder, err := GetBalanceAt(client, common.HexToAddress(chaingateAcc.Address))
+	if err != nil {
+		t.Fatalf("Can't get balance %v", err)
+	}
+	p.Account.Remainder = model.NewBigInt(remainder)
 
 	if p.Account.Used == false {
 		t.Fatalf(`The used wallet is: %v, should be %v`, p.Account.Used, false)
@@ -179,7 +259,7 @@ func CreateForward(t *testing.T, client *ethclient.Client, chaingateAcc *model.A
 	return p
 }
 
-func SetupFirstPayment(t *testing.T, client *ethclient.Client, genesisAcc *model.Account) (*model.Account, *big.Int) {
+func SetupFirstPayment(t *testing.T, client *config.Client, genesisAcc *model.Account) (*model.Account, *big.Int) {
 	cgAcc := model.CreateAccount(enum.Main)
 	payAmount := big.NewInt(100000000000000)
 	txInitial := testutils.CreateInitialPayment(client, genesisAcc, payAmount, cgAcc.Address)
@@ -0,0 +1,112 @@
+package bc
+
+import (
+	"context"
+	"ethereum-service/internal/config"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// baseFeeMultiplier the fee cap covers the base fee even after several full blocks (+12.5% each)
+const baseFeeMultiplier = 2
+
+// Fees breakdown of the fees per gas of a transaction
+type Fees struct {
+	BaseFee   *big.Int
+	GasTipCap *big.Int
+	GasFeeCap *big.Int
+}
+
+type feeHistory struct {
+	Reward       [][]*hexutil.Big `json:"reward"`
+	BaseFee      []*hexutil.Big   `json:"baseFeePerGas"`
+	GasUsedRatio []float64        `json:"gasUsedRatio"`
+}
+
+// Cost maximal fee of a transaction with the gas limit
+func (f *Fees) Cost(gasLimit uint64) *big.Int {
+	return big.NewInt(0).Mul(f.GasFeeCap, big.NewInt(int64(gasLimit)))
+}
+
+// ExpectedCost fee of a transaction with the gas limit at the current base fee. The chain only charges this, not the fee cap.
+func (f *Fees) ExpectedCost(gasLimit uint64) *big.Int {
+	gasPrice := big.NewInt(0).Add(f.BaseFee, f.GasTipCap)
+	if gasPrice.Cmp(f.GasFeeCap) > 0 {
+		gasPrice = f.GasFeeCap
+	}
+	return big.NewInt(0).Mul(gasPrice, big.NewInt(int64(gasLimit)))
+}
+
+func (f *Fees) String() string {
+	return fmt.Sprintf("base fee %v, tip cap %v, fee cap %v", f.BaseFee, f.GasTipCap, f.GasFeeCap)
+}
+
+// EstimateFees
+/*
+	Estimates the EIP-1559 fees from the base fee of the latest header and the tips paid in the last FeeHistoryBlocks blocks.
+	The tip is the median of the FeeTipPercentile of these blocks. The fee cap is twice the base fee plus the tip.
+	A configured chain (see config.ChainConfig) has fixed fees, its GasPrice is used as fee cap and tip cap.
+*/
+func EstimateFees(client *config.Client) (*Fees, error) {
+	if config.Chain != nil && config.Chain.GasPrice != nil {
+		return &Fees{BaseFee: big.NewInt(0), GasTipCap: config.Chain.GasPrice, GasFeeCap: config.Chain.GasPrice}, nil
+	}
+	header, err := client.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if header.BaseFee == nil {
+		// chain without EIP-1559, the gas price is paid completely
+		gasPrice, err := client.SuggestGasPrice(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return &Fees{BaseFee: big.NewInt(0), GasTipCap: gasPrice, GasFeeCap: gasPrice}, nil
+	}
+
+	gasTipCap, err := estimateGasTipCap(client)
+	if err != nil {
+		return nil, err
+	}
+	return &Fees{
+		BaseFee:   header.BaseFee,
+		GasTipCap: gasTipCap,
+		GasFeeCap: big.NewInt(0).Add(big.NewInt(0).Mul(header.BaseFee, big.NewInt(baseFeeMultiplier)), gasTipCap),
+	}, nil
+}
+
+/*
+	Returns the median tip of the last blocks. Empty blocks are ignored, because they don't tell anything about the tips.
+	If the node doesn't support eth_feeHistory or no block contained transactions, the tip suggested by the node is used.
+*/
+func estimateGasTipCap(client *config.Client) (*big.Int, error) {
+	var history feeHistory
+	err := client.CallContext(context.Background(), &history, "eth_feeHistory", hexutil.Uint64(config.Opts.FeeHistoryBlocks), "latest", []float64{float64(config.Opts.FeeTipPercentile)})
+	if err == nil {
+		if tip := medianReward(history); tip != nil {
+			return tip, nil
+		}
+	}
+	tip, err := client.SuggestGasTipCap(context.Background())
+	return tip, err
+}
+
+func medianReward(history feeHistory) *big.Int {
+	var rewards []*big.Int
+	for i, reward := range history.Reward {
+		if len(reward) == 0 || i >= len(history.GasUsedRatio) || history.GasUsedRatio[i] == 0 {
+			continue
+		}
+		rewards = append(rewards, reward[0].ToInt())
+	}
+	if len(rewards) == 0 {
+		return nil
+	}
+	sort.Slice(rewards, func(i, j int) bool {
+		return rewards[i].Cmp(rewards[j]) < 0
+	})
+	return rewards[len(rewards)/2]
+}
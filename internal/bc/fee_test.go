@@ -0,0 +1,72 @@
+package bc
+
+import (
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/testutils"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+func TestMedianReward(t *testing.T) {
+	history := feeHistory{
+		Reward:       [][]*hexutil.Big{{(*hexutil.Big)(big.NewInt(3))}, {(*hexutil.Big)(big.NewInt(0))}, {(*hexutil.Big)(big.NewInt(1))}, {(*hexutil.Big)(big.NewInt(2))}},
+		GasUsedRatio: []float64{0.5, 0, 0.1, 0.9},
+	}
+	// the empty block is ignored
+	if tip := medianReward(history); tip.Cmp(big.NewInt(2)) != 0 {
+		t.Fatalf(`expected 2, got %v`, tip)
+	}
+	if tip := medianReward(feeHistory{Reward: [][]*hexutil.Big{{(*hexutil.Big)(big.NewInt(0))}}, GasUsedRatio: []float64{0}}); tip != nil {
+		t.Fatalf(`expected no tip without transactions, got %v`, tip)
+	}
+}
+
+func TestEstimateFees(t *testing.T) {
+	config.ReadOpts()
+	_, client := testutils.CustomChainSetup(t)
+	chain := config.Chain
+	config.Chain = &config.ChainConfig{ChainId: chain.ChainId}
+	defer func() { config.Chain = chain }()
+
+	fees, err := EstimateFees(client)
+	if err != nil {
+		t.Fatalf("Unable to estimate fees %v", err)
+	}
+	if fees.BaseFee.Sign() <= 0 || fees.GasTipCap.Sign() <= 0 {
+		t.Fatalf(`expected a base fee and a tip, got %v`, fees)
+	}
+	expectedFeeCap := big.NewInt(0).Add(big.NewInt(0).Mul(fees.BaseFee, big.NewInt(2)), fees.GasTipCap)
+	if fees.GasFeeCap.Cmp(expectedFeeCap) != 0 {
+		t.Fatalf(`expected fee cap %v, got %v`, expectedFeeCap, fees.GasFeeCap)
+	}
+	if fees.Cost(21000).Cmp(big.NewInt(0).Mul(expectedFeeCap, big.NewInt(21000))) != 0 {
+		t.Fatalf(`expected cost of %v gas, got %v`, 21000, fees.Cost(21000))
+	}
+}
+
+func TestEstimateFeesFixedGasPrice(t *testing.T) {
+	config.ReadOpts()
+	config.Chain = &config.ChainConfig{ChainId: big.NewInt(1337), GasPrice: big.NewInt(1000)}
+	// the fixed fees don't need a client
+	fees, err := EstimateFees(nil)
+	if err != nil {
+		t.Fatalf("Unable to estimate fees %v", err)
+	}
+	if fees.GasFeeCap.Cmp(config.Chain.GasPrice) != 0 || fees.GasTipCap.Cmp(config.Chain.GasPrice) != 0 {
+		t.Fatalf(`expected fee cap %v, got %v`, config.Chain.GasPrice, fees)
+	}
+}
+
+func TestExpectedCost(t *testing.T) {
+	fees := &Fees{BaseFee: big.NewInt(100), GasTipCap: big.NewInt(2), GasFeeCap: big.NewInt(202)}
+	if cost := fees.ExpectedCost(21000); cost.Cmp(big.NewInt(102*21000)) != 0 {
+		t.Fatalf(`expected cost %v, got %v`, 102*21000, cost)
+	}
+	// the base fee rose above the fee cap, the fee cap is charged
+	fees.BaseFee = big.NewInt(300)
+	if cost := fees.ExpectedCost(21000); cost.Cmp(fees.Cost(21000)) != 0 {
+		t.Fatalf(`expected cost %v, got %v`, fees.Cost(21000), cost)
+	}
+}
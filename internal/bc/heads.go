@@ -0,0 +1,212 @@
+package bc
+
+import (
+	"context"
+	"errors"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/logging"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+type HeadSourceState int
+
+const (
+	Connecting HeadSourceState = iota
+	Subscribed
+	Polling
+	Reconnecting
+)
+
+func (s HeadSourceState) String() string {
+	return [...]string{"connecting", "subscribed", "polling", "reconnecting"}[s]
+}
+
+// HeadSourceStatus current state of a head source for monitoring
+type HeadSourceStatus struct {
+	Mode         enum.Mode
+	State        HeadSourceState
+	LastHeadNr   *big.Int
+	LastHeadAt   time.Time
+	LastError    string
+	Reconnects   int
+	StateChanged time.Time
+}
+
+// HeadSource
+/*
+	Delivers the new heads of a chain. It subscribes to new heads and reconnects with exponential backoff, if the subscription breaks.
+	If the endpoint doesn't support subscriptions (HTTP), the head is polled instead.
+*/
+type HeadSource struct {
+	client       *config.Client
+	pollInterval time.Duration
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	lock         sync.RWMutex
+	status       HeadSourceStatus
+}
+
+var (
+	headSourcesLock sync.RWMutex
+	headSources     = make(map[enum.Mode]*HeadSource)
+)
+
+func NewHeadSource(client *config.Client, mode enum.Mode) *HeadSource {
+	s := &HeadSource{
+		client:       client,
+		pollInterval: time.Duration(config.Opts.HeadPollInterval) * time.Second,
+		minBackoff:   time.Second,
+		maxBackoff:   time.Duration(config.Opts.HeadMaxBackoff) * time.Second,
+		status:       HeadSourceStatus{Mode: mode, State: Connecting, StateChanged: time.Now()},
+	}
+	headSourcesLock.Lock()
+	headSources[mode] = s
+	headSourcesLock.Unlock()
+	return s
+}
+
+// GetHeadSourceStatus
+/*
+	Returns the status of the head source of the mode. The second value is false if no head source runs in this mode.
+*/
+func GetHeadSourceStatus(mode enum.Mode) (HeadSourceStatus, bool) {
+	headSourcesLock.RLock()
+	defer headSourcesLock.RUnlock()
+	s, ok := headSources[mode]
+	if !ok {
+		return HeadSourceStatus{}, false
+	}
+	return s.Status(), true
+}
+
+func (s *HeadSource) Status() HeadSourceStatus {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.status
+}
+
+/*
+	Calls handle for every new head until the context is cancelled. Errors never stop the head source.
+*/
+func (s *HeadSource) Run(ctx context.Context, handle func(*types.Header)) {
+	backoff := s.minBackoff
+	for ctx.Err() == nil {
+		err := s.subscribeHeads(ctx, handle)
+		if errors.Is(err, rpc.ErrNotificationsUnsupported) {
+			logging.WithMode(s.status.Mode).WithField("poll_interval", s.pollInterval.String()).Warn("Subscriptions are not supported, poll heads")
+			s.pollHeads(ctx, handle)
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if s.Status().State == Subscribed {
+			backoff = s.minBackoff
+		}
+		s.setReconnecting(err)
+		logging.WithMode(s.status.Mode).WithError(err).WithField("backoff", backoff.String()).Warn("Head subscription failed, reconnect")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+/*
+	Delivers the heads of one subscription. Returns the error which ended the subscription.
+*/
+func (s *HeadSource) subscribeHeads(ctx context.Context, handle func(*types.Header)) error {
+	headers := make(chan *types.Header)
+	sub, err := s.client.SubscribeNewHead(ctx, headers)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	s.setState(Subscribed)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-sub.Err():
+			if err == nil {
+				err = errors.New("subscription closed")
+			}
+			return err
+		case header := <-headers:
+			s.setHead(header)
+			handle(header)
+		}
+	}
+}
+
+/*
+	Polls the head and delivers it, if it changed. HandleNewHead backfills the blocks between two polls.
+*/
+func (s *HeadSource) pollHeads(ctx context.Context, handle func(*types.Header)) {
+	s.setState(Polling)
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	var lastHash string
+	for {
+		header, err := s.client.HeaderByNumber(ctx, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logging.WithMode(s.status.Mode).WithError(err).Warn("Error in polling head")
+			s.setError(err)
+		} else if header.Hash().String() != lastHash {
+			lastHash = header.Hash().String()
+			s.setHead(header)
+			handle(header)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *HeadSource) setState(state HeadSourceState) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status.State = state
+	s.status.StateChanged = time.Now()
+}
+
+func (s *HeadSource) setError(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status.LastError = err.Error()
+}
+
+func (s *HeadSource) setReconnecting(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status.LastError = err.Error()
+	s.status.Reconnects++
+	s.status.State = Reconnecting
+	s.status.StateChanged = time.Now()
+}
+
+func (s *HeadSource) setHead(header *types.Header) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status.LastHeadNr = header.Number
+	s.status.LastHeadAt = time.Now()
+}
@@ -0,0 +1,66 @@
+package bc
+
+import (
+	"context"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/testutils"
+	"testing"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func waitForHead(t *testing.T, heads chan *types.Header, number int64) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case header := <-heads:
+			if header.Number.Int64() == number {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Head %v wasn't delivered", number)
+		}
+	}
+}
+
+func TestHeadSourceSubscription(t *testing.T) {
+	config.ReadOpts()
+	client, insertBlocks := testutils.NewReorgTestChain(t, 2, 2, 3)
+	source := NewHeadSource(client, enum.Test)
+	heads := make(chan *types.Header, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go source.Run(ctx, func(header *types.Header) { heads <- header })
+
+	for source.Status().State != Subscribed {
+		time.Sleep(10 * time.Millisecond)
+	}
+	insertBlocks()
+	waitForHead(t, heads, 5)
+
+	status, ok := GetHeadSourceStatus(enum.Test)
+	if !ok || status.State != Subscribed || status.LastHeadNr.Int64() != 5 {
+		t.Fatalf(`Head source status is %+v`, status)
+	}
+}
+
+func TestHeadSourcePolling(t *testing.T) {
+	config.ReadOpts()
+	client, insertBlocks := testutils.NewReorgTestChain(t, 2, 2, 3)
+	source := NewHeadSource(client, enum.Test)
+	source.pollInterval = 10 * time.Millisecond
+	heads := make(chan *types.Header, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go source.pollHeads(ctx, func(header *types.Header) { heads <- header })
+
+	waitForHead(t, heads, 2)
+	insertBlocks()
+	waitForHead(t, heads, 5)
+
+	if state := source.Status().State; state != Polling {
+		t.Fatalf(`Head source state is %v, but should be %v`, state, Polling)
+	}
+}
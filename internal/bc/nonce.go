@@ -0,0 +1,150 @@
+package bc
+
+import (
+	"context"
+	"errors"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/logging"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+)
+
+const maxNonceRetries = 3
+
+var NonceRetriesExceeded = errors.New("no valid nonce found for transaction")
+
+// accountNonce next nonce of an address. The lock serializes the sends of the address.
+type accountNonce struct {
+	lock   sync.Mutex
+	next   uint64
+	known  bool
+	lastTx common.Hash
+}
+
+type nonceKey struct {
+	chainID string
+	address common.Address
+}
+
+var (
+	noncesLock sync.Mutex
+	nonces     = make(map[nonceKey]*accountNonce)
+)
+
+func getAccountNonce(client *config.Client, address common.Address) (*accountNonce, error) {
+	chainID, err := getChainID(client)
+	if err != nil {
+		return nil, err
+	}
+	key := nonceKey{chainID: chainID.String(), address: address}
+	noncesLock.Lock()
+	defer noncesLock.Unlock()
+	n, ok := nonces[key]
+	if !ok {
+		n = &accountNonce{}
+		nonces[key] = n
+	}
+	return n, nil
+}
+
+/*
+	Returns the next nonce. The pending nonce of the node is used, if it is higher than the local one (e.g. after a restart or a transaction sent by somebody else).
+	A higher local nonce is only kept while the node still knows our last transaction, otherwise it was dropped and its nonce would leave a gap.
+*/
+func (n *accountNonce) reconcile(client *config.Client, address common.Address) (uint64, error) {
+	pending, err := client.PendingNonceAt(context.Background(), address)
+	if err != nil {
+		return 0, err
+	}
+	if n.known && n.next > pending {
+		_, _, err := client.TransactionByHash(context.Background(), n.lastTx)
+		if err == nil {
+			return n.next, nil
+		}
+		logrus.WithFields(logrus.Fields{logging.Account: address.String(), logging.TxHash: n.lastTx.String(), "nonce": n.next, "pending_nonce": pending}).Warn("Last transaction is unknown, reset nonce")
+	}
+	n.next = pending
+	n.known = true
+	return n.next, nil
+}
+
+// sendWithNonce
+/*
+	Signs the transaction with the next nonce of the address and sends it. Only one transaction per address is sent at a time.
+	If the node rejects the nonce, it is reconciled with the pending nonce and the transaction is signed again.
+	record is called with every signed transaction before it is sent. If it fails, the transaction isn't sent.
+	The result of the broadcast is reported to record as well, so a transaction which the node rejected isn't taken as sent.
+*/
+func sendWithNonce(client *config.Client, address common.Address, sign func(nonce uint64) (*types.Transaction, error), record *kindRecorder) (*types.Transaction, error) {
+	n, err := getAccountNonce(client, address)
+	if err != nil {
+		return nil, err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	// the last recorded transaction, which wasn't accepted by the node
+	var recorded *types.Transaction
+	for i := 0; i < maxNonceRetries; i++ {
+		nonce, err := n.reconcile(client, address)
+		if err != nil {
+			return nil, record.sent(recorded, err)
+		}
+		signedTx, err := sign(nonce)
+		if err != nil {
+			return nil, record.sent(recorded, err)
+		}
+		if err = record.record(signedTx); err != nil {
+			return nil, err
+		}
+		recorded = signedTx
+		err = client.SendTransaction(context.Background(), signedTx)
+		switch {
+		case err == nil || isTxError(err, core.ErrAlreadyKnown):
+			n.next = nonce + 1
+			n.lastTx = signedTx.Hash()
+			record.sent(signedTx, nil)
+			return signedTx, nil
+		case isTxError(err, core.ErrNonceTooLow) || isTxError(err, core.ErrReplaceUnderpriced):
+			logrus.WithFields(logrus.Fields{logging.Account: address.String(), "nonce": nonce}).Warn("Nonce is already used, retry with the next one")
+			n.next = nonce + 1
+		case isTxError(err, core.ErrNonceTooHigh):
+			logrus.WithFields(logrus.Fields{logging.Account: address.String(), "nonce": nonce}).Warn("Nonce is too high, reset to pending nonce")
+			n.known = false
+		default:
+			return nil, record.sent(signedTx, err)
+		}
+	}
+	return nil, record.sent(recorded, NonceRetriesExceeded)
+}
+
+// the errors of the node are only returned as message over rpc
+func isTxError(err error, target error) bool {
+	return strings.Contains(err.Error(), target.Error())
+}
+
+/*
+	Sends a transaction, which replaces a pending transaction with the same nonce. The next nonce doesn't change.
+*/
+func replaceTransaction(client *config.Client, address common.Address, tx *types.Transaction) error {
+	n, err := getAccountNonce(client, address)
+	if err != nil {
+		return err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	err = client.SendTransaction(context.Background(), tx)
+	if err != nil && !isTxError(err, core.ErrAlreadyKnown) {
+		return err
+	}
+	if n.known && n.next == tx.Nonce()+1 {
+		n.lastTx = tx.Hash()
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package bc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/testutils"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func signTestTransfer(key *ecdsa.PrivateKey, nonce uint64) (*types.Transaction, error) {
+	to := common.HexToAddress("0xcDd9C81f1855Bfd6a309A395b53f273d539ad7aa")
+	tx := types.NewTx(&types.DynamicFeeTx{
+		ChainID:   config.Chain.ChainId,
+		Nonce:     nonce,
+		GasFeeCap: config.Chain.GasPrice,
+		GasTipCap: big.NewInt(1),
+		Gas:       21000,
+		To:        &to,
+		Value:     big.NewInt(1),
+	})
+	return types.SignTx(tx, types.LatestSignerForChainID(config.Chain.ChainId), key)
+}
+
+func TestSendWithNonceConcurrent(t *testing.T) {
+	config.ReadOpts()
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	key, _ := genesisAcc.GetPrivateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey)
+
+	var wg sync.WaitGroup
+	txs := make([]*types.Transaction, 5)
+	for i := range txs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tx, err := sendWithNonce(client, address, func(nonce uint64) (*types.Transaction, error) {
+				return signTestTransfer(key, nonce)
+			}, nil)
+			if err != nil {
+				t.Errorf("Unable to send transaction %v", err)
+				return
+			}
+			txs[i] = tx
+		}(i)
+	}
+	wg.Wait()
+
+	used := make(map[uint64]bool)
+	for _, tx := range txs {
+		if tx == nil {
+			t.FailNow()
+		}
+		if used[tx.Nonce()] {
+			t.Fatalf(`Nonce %v was used twice`, tx.Nonce())
+		}
+		used[tx.Nonce()] = true
+		if _, err := bind.WaitMined(context.Background(), client, tx); err != nil {
+			t.Fatalf("Can't wait until transaction is mined %v", err)
+		}
+	}
+}
+
+func TestSendWithNonceExternalTransaction(t *testing.T) {
+	config.ReadOpts()
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	key, _ := genesisAcc.GetPrivateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	send := func(nonce uint64) (*types.Transaction, error) {
+		return signTestTransfer(key, nonce)
+	}
+
+	first, err := sendWithNonce(client, address, send, nil)
+	if err != nil {
+		t.Fatalf("Unable to send transaction %v", err)
+	}
+	// a transaction which isn't sent over the nonce manager, e.g. from another instance
+	external, err := signTestTransfer(key, first.Nonce()+1)
+	if err != nil {
+		t.Fatalf("Unable to sign transaction %v", err)
+	}
+	if err = client.SendTransaction(context.Background(), external); err != nil {
+		t.Fatalf("Unable to send transaction %v", err)
+	}
+
+	next, err := sendWithNonce(client, address, send, nil)
+	if err != nil {
+		t.Fatalf("Unable to send transaction %v", err)
+	}
+	if next.Nonce() != first.Nonce()+2 {
+		t.Fatalf(`Nonce is %v, but should be %v`, next.Nonce(), first.Nonce()+2)
+	}
+}
+
+func TestReconcileDroppedTransaction(t *testing.T) {
+	config.ReadOpts()
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	address := common.HexToAddress(genesisAcc.Address)
+	pending, err := client.PendingNonceAt(context.Background(), address)
+	if err != nil {
+		t.Fatalf("Unable to get pending nonce %v", err)
+	}
+
+	n := &accountNonce{known: true, next: pending + 3, lastTx: common.HexToHash("0x01")}
+	nonce, err := n.reconcile(client, address)
+	if err != nil {
+		t.Fatalf("Unable to reconcile nonce %v", err)
+	}
+	if nonce != pending {
+		t.Fatalf(`Nonce is %v, but should be the pending nonce %v`, nonce, pending)
+	}
+}
@@ -0,0 +1,62 @@
+package bc
+
+import (
+	"context"
+	"ethereum-service/internal/config"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// only the parts of the Chainlink AggregatorV3Interface which are needed to read the latest price
+const aggregatorABI = `[
+	{"inputs":[],"name":"decimals","outputs":[{"name":"","type":"uint8"}],"stateMutability":"view","type":"function"},
+	{"inputs":[],"name":"latestRoundData","outputs":[{"name":"roundId","type":"uint80"},{"name":"answer","type":"int256"},{"name":"startedAt","type":"uint256"},{"name":"updatedAt","type":"uint256"},{"name":"answeredInRound","type":"uint80"}],"stateMutability":"view","type":"function"}
+]`
+
+var aggregator = mustParseABI(aggregatorABI)
+
+// RoundData latest round of an aggregator. Answer has Decimals decimals, UpdatedAt is in unix seconds.
+type RoundData struct {
+	RoundId         *big.Int
+	Answer          *big.Int
+	StartedAt       *big.Int
+	UpdatedAt       *big.Int
+	AnsweredInRound *big.Int
+	Decimals        uint8
+}
+
+/*
+	Reads the latest round and the decimals of the answer from a Chainlink-style aggregator contract.
+*/
+func GetLatestRoundData(ctx context.Context, client *config.Client, aggregatorAddress common.Address) (*RoundData, error) {
+	decimals, err := callAggregator(ctx, client, aggregatorAddress, "decimals")
+	if err != nil {
+		return nil, err
+	}
+	round, err := callAggregator(ctx, client, aggregatorAddress, "latestRoundData")
+	if err != nil {
+		return nil, err
+	}
+	return &RoundData{
+		RoundId:         round[0].(*big.Int),
+		Answer:          round[1].(*big.Int),
+		StartedAt:       round[2].(*big.Int),
+		UpdatedAt:       round[3].(*big.Int),
+		AnsweredInRound: round[4].(*big.Int),
+		Decimals:        decimals[0].(uint8),
+	}, nil
+}
+
+func callAggregator(ctx context.Context, client *config.Client, aggregatorAddress common.Address, method string) ([]interface{}, error) {
+	data, err := aggregator.Pack(method)
+	if err != nil {
+		return nil, err
+	}
+	result, err := client.CallContract(ctx, ethereum.CallMsg{To: &aggregatorAddress, Data: data}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return aggregator.Unpack(method, result)
+}
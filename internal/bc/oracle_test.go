@@ -0,0 +1,29 @@
+package bc
+
+import (
+	"context"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/testutils"
+	"math/big"
+	"testing"
+)
+
+func TestGetLatestRoundData(t *testing.T) {
+	config.ReadOpts()
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	answer := big.NewInt(300012345678)
+	aggregatorAddress := testutils.DeployMockAggregator(client, genesisAcc, 8, testutils.MockRound{RoundId: 7, Answer: answer, StartedAt: 1650000000, UpdatedAt: 1650000012, AnsweredInRound: 7})
+	round, err := GetLatestRoundData(context.Background(), client, aggregatorAddress)
+	if err != nil {
+		t.Fatalf("Unable to get latest round %v", err)
+	}
+	if round.Decimals != 8 {
+		t.Fatalf(`Aggregator has %v decimals, but should have %v`, round.Decimals, 8)
+	}
+	if round.RoundId.Int64() != 7 || round.AnsweredInRound.Int64() != 7 || round.UpdatedAt.Int64() != 1650000012 {
+		t.Fatalf(`Round is wrong %+v`, round)
+	}
+	if round.Answer.Cmp(answer) != 0 {
+		t.Fatalf(`Answer is %v, but should be %v`, round.Answer, answer)
+	}
+}
@@ -0,0 +1,267 @@
+package bc
+
+import (
+	"errors"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/logging"
+	"ethereum-service/model"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+)
+
+var NothingToRefund = errors.New("no funds to refund")
+
+// GetSender
+/*
+	Returns the address which signed the transaction.
+*/
+func GetSender(tx *types.Transaction) (common.Address, error) {
+	return types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+}
+
+// GetRefundableOverpayment
+/*
+	Returns the amount which was received more than the pay amount. An overpayment within OverpaymentTolerance percent of the pay amount is kept and 0 is returned.
+	Without a known sender nothing can be refunded, e.g. when the payment was only recovered from the balance at startup.
+*/
+func GetRefundableOverpayment(payment *model.Payment, received *big.Int) *big.Int {
+	if payment.SenderAddress == "" || received == nil {
+		return big.NewInt(0)
+	}
+	overpayment := big.NewInt(0).Sub(received, payment.GetActiveAmount())
+	tolerance := big.NewInt(0).Mul(payment.GetActiveAmount(), big.NewInt(config.Opts.OverpaymentTolerance))
+	tolerance.Div(tolerance, big.NewInt(100))
+	if overpayment.Cmp(tolerance) <= 0 {
+		return big.NewInt(0)
+	}
+	return overpayment
+}
+
+/*
+	Returns the ETH which is refunded to the sender for the overpayment. The expected fee of the refund is paid from the refunded ETH, so nothing is refunded if the overpayment doesn't cover it.
+*/
+func getOverpaymentRefund(payment *model.Payment, received *big.Int, fees *Fees) *big.Int {
+	overpayment := GetRefundableOverpayment(payment, received)
+	if overpayment.Sign() == 0 {
+		return overpayment
+	}
+	finalAmount := big.NewInt(0).Sub(overpayment, fees.ExpectedCost(21000))
+	if finalAmount.Sign() <= 0 {
+		logging.WithPayment(payment).WithField("overpayment", overpayment.String()).Info("Overpayment doesn't cover the fees of a refund")
+		return big.NewInt(0)
+	}
+	return finalAmount
+}
+
+/*
+	Makes sure the address holds the required wei, i.e. the sent values plus the fee caps of the transactions.
+	The sender is only charged the expected fee, the headroom up to the fee cap is covered by the CHainGate earnings on the address or else by the gas station.
+	Without a gas station the part which isn't covered is returned, so it is charged from the sent amount instead.
+	Returns GasFundingPending, while the funding of the gas station isn't mined.
+*/
+func coverFeeHeadroom(client *config.Client, address common.Address, required *big.Int, record Recorder) (*big.Int, error) {
+	balance, err := GetBalanceAt(client, address)
+	if err != nil {
+		return nil, err
+	}
+	missing := big.NewInt(0).Sub(required, balance)
+	if missing.Sign() <= 0 {
+		return big.NewInt(0), nil
+	}
+	err = fundGas(client, address, required, record)
+	if errors.Is(err, NoGasStation) {
+		logrus.WithField(logging.Account, address.String()).WithField("uncovered", missing.String()).Warn("No gas station to cover the fee cap, the headroom is charged from the amount")
+		return missing, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return big.NewInt(0), nil
+}
+
+// GetRefundRecipients
+/*
+	Splits the received funds of an unpaid payment between its senders by their contributions, capped by the received funds.
+	A payment without recorded contributions (e.g. created before they were recorded) is refunded completely to the last sender.
+	Funds beyond the contributions have no known sender, they stay on the address as remainder.
+*/
+func GetRefundRecipients(payment *model.Payment, received *big.Int) []model.SenderAmount {
+	amounts := payment.GetSenderAmounts()
+	if len(amounts) == 0 {
+		if payment.SenderAddress == "" {
+			return nil
+		}
+		return []model.SenderAmount{{Sender: payment.SenderAddress, Amount: big.NewInt(0).Set(received)}}
+	}
+	left := big.NewInt(0).Set(received)
+	var recipients []model.SenderAmount
+	for _, a := range amounts {
+		amount := a.Amount
+		if amount.Cmp(left) > 0 {
+			amount = big.NewInt(0).Set(left)
+		}
+		if amount.Sign() <= 0 {
+			break
+		}
+		recipients = append(recipients, model.SenderAmount{Sender: a.Sender, Amount: amount})
+		left.Sub(left, amount)
+	}
+	return recipients
+}
+
+// RefundPayment
+/*
+	Sends the received funds of an expired or failed payment back to its senders (see GetRefundRecipients). Senders in refunded already have a refund and are skipped.
+	The expected fee of an ETH refund is paid from the refunded amount, the headroom up to the fee cap is covered by CHainGate.
+	Tokens are refunded completely, the gas is funded by the gas station like for a forward.
+	Returns NothingToRefund, if no sender is left to refund or the funds don't cover the fees.
+	If a refund can't be sent, the refunds before it stay recorded and an error is returned, so the rest is sent with the next try.
+*/
+func RefundPayment(client *config.Client, payment *model.Payment, refunded map[common.Address]bool, record Recorder) error {
+	received, err := GetPaymentBalanceAt(client, payment)
+	if err != nil {
+		return err
+	}
+	if received.Sign() <= 0 {
+		return NothingToRefund
+	}
+	var recipients []model.SenderAmount
+	for _, r := range GetRefundRecipients(payment, received) {
+		if !refunded[common.HexToAddress(r.Sender)] {
+			recipients = append(recipients, r)
+		}
+	}
+	if len(recipients) == 0 {
+		return NothingToRefund
+	}
+	fees, err := EstimateFees(client)
+	if err != nil {
+		return err
+	}
+	from := common.HexToAddress(payment.Account.Address)
+
+	gasLimits := make([]uint64, len(recipients))
+	required := big.NewInt(0)
+	for i, r := range recipients {
+		gasLimits[i] = 21000
+		if payment.IsTokenPayment() {
+			data, err := packTransfer(common.HexToAddress(r.Sender), r.Amount)
+			if err != nil {
+				return err
+			}
+			gasLimits[i] = estimateTokenTransferGas(client, from, common.HexToAddress(payment.TokenContract), data)
+		} else {
+			r.Amount.Sub(r.Amount, fees.ExpectedCost(gasLimits[i]))
+			if r.Amount.Sign() <= 0 {
+				continue
+			}
+			required.Add(required, r.Amount)
+		}
+		required.Add(required, fees.Cost(gasLimits[i]))
+	}
+
+	if payment.IsTokenPayment() {
+		if err = fundGas(client, from, required, record); err != nil {
+			return err
+		}
+	} else {
+		uncovered, err := coverFeeHeadroom(client, from, required, record)
+		if err != nil {
+			return err
+		}
+		// without a gas station the uncovered headroom is charged from the last refund
+		last := recipients[len(recipients)-1].Amount
+		last.Sub(last, uncovered)
+	}
+
+	sent := 0
+	for i, r := range recipients {
+		if r.Amount.Sign() <= 0 {
+			logging.WithPayment(payment).WithField("sender", r.Sender).Info("Contribution doesn't cover the fees of a refund")
+			continue
+		}
+		if sendRefund(client, payment, fees, common.HexToAddress(r.Sender), r.Amount, gasLimits[i], record) == nil {
+			return fmt.Errorf("unable to refund %v to %v", r.Amount, r.Sender)
+		}
+		sent++
+	}
+	if sent == 0 {
+		return NothingToRefund
+	}
+	return nil
+}
+
+// RefundOverpayment
+/*
+	Sends the overpayment of a paid payment to the sender again, after its refund with the forward failed.
+	The overpayment is taken from the received amount of the payment, the fees are estimated again like for the first refund.
+	Returns NothingToRefund, if the overpayment doesn't cover the fees anymore.
+*/
+func RefundOverpayment(client *config.Client, payment *model.Payment, record Recorder) error {
+	fees, err := EstimateFees(client)
+	if err != nil {
+		return err
+	}
+	from := common.HexToAddress(payment.Account.Address)
+	to := common.HexToAddress(payment.SenderAddress)
+	received := &payment.CurrentPaymentState.AmountReceived.Int
+
+	var amount *big.Int
+	var gasLimit uint64 = 21000
+	if payment.IsTokenPayment() {
+		amount = GetRefundableOverpayment(payment, received)
+		if amount.Sign() == 0 {
+			return NothingToRefund
+		}
+		data, err := packTransfer(to, amount)
+		if err != nil {
+			return err
+		}
+		gasLimit = estimateTokenTransferGas(client, from, common.HexToAddress(payment.TokenContract), data)
+		if err = fundGas(client, from, fees.Cost(gasLimit), record); err != nil {
+			return err
+		}
+	} else {
+		amount = getOverpaymentRefund(payment, received, fees)
+		if amount.Sign() == 0 {
+			return NothingToRefund
+		}
+		uncovered, err := coverFeeHeadroom(client, from, big.NewInt(0).Add(amount, fees.Cost(gasLimit)), record)
+		if err != nil {
+			return err
+		}
+		amount.Sub(amount, uncovered)
+		if amount.Sign() <= 0 {
+			return NothingToRefund
+		}
+	}
+	if sendRefund(client, payment, fees, to, amount, gasLimit, record) == nil {
+		return fmt.Errorf("unable to refund %v to %v", amount, payment.SenderAddress)
+	}
+	return nil
+}
+
+/*
+	Sends the amount back to the sender. ETH is sent directly, tokens with a transfer of the token contract.
+*/
+func sendRefund(client *config.Client, payment *model.Payment, fees *Fees, to common.Address, amount *big.Int, gasLimit uint64, record Recorder) *types.Transaction {
+	var signedTx *types.Transaction
+	if payment.IsTokenPayment() {
+		data, err := packTransfer(to, amount)
+		if err != nil {
+			logging.WithPayment(payment).WithError(err).Error("Unable to pack token refund")
+			return nil
+		}
+		signedTx = makeTransaction(client, &payment.Account, fees, big.NewInt(0), common.HexToAddress(payment.TokenContract), data, gasLimit, recordOf(record, model.Refund, fees))
+	} else {
+		signedTx = makeTransaction(client, &payment.Account, fees, amount, to, nil, gasLimit, recordOf(record, model.Refund, fees))
+	}
+	if signedTx != nil {
+		payment.RefundTransactionHash = signedTx.Hash().String()
+	}
+	return signedTx
+}
@@ -0,0 +1,73 @@
+package bc
+
+import (
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/testutils"
+	"ethereum-service/model"
+	"math/big"
+	"testing"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestGetRefundableOverpayment(t *testing.T) {
+	config.ReadOpts()
+	p := testutils.GetWaitingPayment()
+	p.SenderAddress = model.CreateAccount(enum.Main).Address
+	payAmount := p.GetActiveAmount()
+	tolerance := big.NewInt(0).Div(big.NewInt(0).Mul(payAmount, big.NewInt(config.Opts.OverpaymentTolerance)), big.NewInt(100))
+
+	withinTolerance := big.NewInt(0).Add(payAmount, tolerance)
+	if overpayment := GetRefundableOverpayment(&p, withinTolerance); overpayment.Sign() != 0 {
+		t.Fatalf("An overpayment within the tolerance shouldn't be refunded, but %v is refunded", overpayment)
+	}
+	received := big.NewInt(0).Mul(payAmount, big.NewInt(2))
+	if overpayment := GetRefundableOverpayment(&p, received); overpayment.Cmp(payAmount) != 0 {
+		t.Fatalf("%v should be refunded, but %v is refunded", payAmount, overpayment)
+	}
+	p.SenderAddress = ""
+	if overpayment := GetRefundableOverpayment(&p, received); overpayment.Sign() != 0 {
+		t.Fatalf("Without a sender nothing can be refunded, but %v is refunded", overpayment)
+	}
+}
+
+func TestCoverFeeHeadroomWithoutGasStation(t *testing.T) {
+	config.ReadOpts()
+	config.Opts.GasStationPrivateKey = ""
+	_, client := testutils.CustomChainSetup(t)
+	account := model.CreateAccount(enum.Main)
+	required := big.NewInt(21000)
+	uncovered, err := coverFeeHeadroom(client, common.HexToAddress(account.Address), required, nil)
+	if err != nil {
+		t.Fatalf("Unable to cover the headroom %v", err)
+	}
+	// the empty address can't cover anything, so the whole required amount is charged from the amount
+	if uncovered.Cmp(required) != 0 {
+		t.Fatalf(`expected %v to be uncovered, got %v`, required, uncovered)
+	}
+}
+
+func TestGetRefundRecipients(t *testing.T) {
+	p := testutils.GetPartiallyPayment()
+	first := model.CreateAccount(enum.Main).Address
+	second := model.CreateAccount(enum.Main).Address
+	p.AddContribution(first, big.NewInt(100), "0x1", 0, 1)
+	p.AddContribution(second, big.NewInt(50), "0x2", 0, 2)
+	p.AddContribution(first, big.NewInt(30), "0x3", 0, 3)
+	p.AddContribution(first, big.NewInt(30), "0x3", 0, 3)
+
+	recipients := GetRefundRecipients(&p, big.NewInt(180))
+	if len(recipients) != 2 || recipients[0].Sender != first || recipients[0].Amount.Cmp(big.NewInt(130)) != 0 || recipients[1].Sender != second || recipients[1].Amount.Cmp(big.NewInt(50)) != 0 {
+		t.Fatalf("130 should be refunded to %v and 50 to %v, but got %v", first, second, recipients)
+	}
+	recipients = GetRefundRecipients(&p, big.NewInt(150))
+	if len(recipients) != 2 || recipients[1].Amount.Cmp(big.NewInt(20)) != 0 {
+		t.Fatalf("The balance should be refunded up to the contributions, but got %v", recipients)
+	}
+	p.RemoveContributionsAfter(1)
+	recipients = GetRefundRecipients(&p, big.NewInt(100))
+	if len(recipients) != 1 || recipients[0].Sender != first {
+		t.Fatalf("The contributions of removed blocks shouldn't be refunded, but got %v", recipients)
+	}
+}
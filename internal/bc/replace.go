@@ -0,0 +1,112 @@
+package bc
+
+import (
+	"errors"
+	"ethereum-service/internal/config"
+	"ethereum-service/model"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+var (
+	FeeCapExceeded    = errors.New("bumped fee cap exceeds the maximal fee cap")
+	FeeExceedsAmount  = errors.New("bumped fee exceeds the amount of the transaction")
+	minFeeBumpPercent = int64(10)
+)
+
+// BumpFee
+/*
+	Signs the transaction again with the same nonce and higher fees, so it replaces the pending one.
+	Both fees are raised by at least FeeBumpPercent, but never below the current estimation.
+	ETH transfers pay the higher fee from their value. For contract calls (e.g. token transfers) the additional gas is funded by the gas station
+	and recorded with fund. The fee is bumped after the funding is mined, until then GasFundingPending is returned.
+	record is called with the replacement before it is sent. If it fails, the replacement isn't sent.
+*/
+func BumpFee(client *config.Client, account *model.Account, tx *types.Transaction, record func(tx *types.Transaction, fees *Fees) error, fund Recorder) (*types.Transaction, error) {
+	fees, err := getBumpedFees(client, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	value := tx.Value()
+	additionalFee := big.NewInt(0).Sub(fees.Cost(tx.Gas()), big.NewInt(0).Mul(tx.GasFeeCap(), big.NewInt(int64(tx.Gas()))))
+	from := common.HexToAddress(account.Address)
+	if value.Sign() > 0 {
+		value = big.NewInt(0).Sub(value, additionalFee)
+		if value.Sign() <= 0 {
+			return nil, FeeExceedsAmount
+		}
+	} else {
+		if err = fundGas(client, from, fees.Cost(tx.Gas()), fund); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := account.GetPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	replacement, err := types.SignTx(types.NewTx(&types.DynamicFeeTx{
+		ChainID:   tx.ChainId(),
+		Nonce:     tx.Nonce(),
+		GasFeeCap: fees.GasFeeCap,
+		GasTipCap: fees.GasTipCap,
+		Gas:       tx.Gas(),
+		To:        tx.To(),
+		Value:     value,
+		Data:      tx.Data(),
+	}), types.LatestSignerForChainID(tx.ChainId()), key)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil {
+		if err = record(replacement, fees); err != nil {
+			return nil, err
+		}
+	}
+	if err = replaceTransaction(client, from, replacement); err != nil {
+		return nil, err
+	}
+	return replacement, nil
+}
+
+func getBumpedFees(client *config.Client, tx *types.Transaction) (*Fees, error) {
+	percent := config.Opts.FeeBumpPercent
+	if percent < minFeeBumpPercent {
+		percent = minFeeBumpPercent
+	}
+	estimated, err := EstimateFees(client)
+	if err != nil {
+		return nil, err
+	}
+	fees := &Fees{
+		BaseFee:   estimated.BaseFee,
+		GasFeeCap: bumpByPercent(tx.GasFeeCap(), percent),
+		GasTipCap: bumpByPercent(tx.GasTipCap(), percent),
+	}
+	if estimated.GasFeeCap.Cmp(fees.GasFeeCap) > 0 {
+		fees.GasFeeCap = estimated.GasFeeCap
+	}
+	if estimated.GasTipCap.Cmp(fees.GasTipCap) > 0 {
+		fees.GasTipCap = estimated.GasTipCap
+	}
+	if fees.GasTipCap.Cmp(fees.GasFeeCap) > 0 {
+		fees.GasFeeCap = fees.GasTipCap
+	}
+
+	maxGasFeeCap := big.NewInt(0).Mul(big.NewInt(config.Opts.MaxGasFeeCapGwei), big.NewInt(params.GWei))
+	if fees.GasFeeCap.Cmp(maxGasFeeCap) > 0 {
+		return nil, FeeCapExceeded
+	}
+	return fees, nil
+}
+
+// rounds up, so the replacement is always accepted by the node
+func bumpByPercent(value *big.Int, percent int64) *big.Int {
+	bumped := big.NewInt(0).Mul(value, big.NewInt(100+percent))
+	bumped.Add(bumped, big.NewInt(99))
+	return bumped.Div(bumped, big.NewInt(100))
+}
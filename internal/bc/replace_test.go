@@ -0,0 +1,91 @@
+package bc
+
+import (
+	"context"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/testutils"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestBumpByPercent(t *testing.T) {
+	if bumpByPercent(big.NewInt(100), 10).Cmp(big.NewInt(110)) != 0 {
+		t.Fatalf(`expected 110`)
+	}
+	// rounded up, a bump of 10% must never be below 10%
+	if bumpByPercent(big.NewInt(15), 10).Cmp(big.NewInt(17)) != 0 {
+		t.Fatalf(`expected 17`)
+	}
+}
+
+func TestBumpFee(t *testing.T) {
+	config.ReadOpts()
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	key, _ := genesisAcc.GetPrivateKey()
+	nonce, err := client.PendingNonceAt(context.Background(), crypto.PubkeyToAddress(key.PublicKey))
+	if err != nil {
+		t.Fatalf("Unable to get nonce %v", err)
+	}
+	tx, err := signTestTransfer(key, nonce)
+	if err != nil {
+		t.Fatalf("Unable to sign transaction %v", err)
+	}
+	tx, err = types.SignTx(types.NewTx(&types.DynamicFeeTx{
+		ChainID:   tx.ChainId(),
+		Nonce:     tx.Nonce(),
+		GasFeeCap: tx.GasFeeCap(),
+		GasTipCap: tx.GasTipCap(),
+		Gas:       tx.Gas(),
+		To:        tx.To(),
+		Value:     big.NewInt(1000000000000000000),
+	}), types.LatestSignerForChainID(tx.ChainId()), key)
+	if err != nil {
+		t.Fatalf("Unable to sign transaction %v", err)
+	}
+
+	var recorded *types.Transaction
+	replacement, err := BumpFee(client, genesisAcc, tx, func(replacement *types.Transaction, fees *Fees) error {
+		recorded = replacement
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatalf("Unable to bump fee %v", err)
+	}
+	if recorded == nil || recorded.Hash() != replacement.Hash() {
+		t.Fatalf(`replacement wasn't recorded before it was sent`)
+	}
+	if replacement.Nonce() != tx.Nonce() {
+		t.Fatalf(`expected nonce %v, got %v`, tx.Nonce(), replacement.Nonce())
+	}
+	expectedFeeCap := bumpByPercent(tx.GasFeeCap(), 10)
+	if replacement.GasFeeCap().Cmp(expectedFeeCap) != 0 {
+		t.Fatalf(`expected fee cap %v, got %v`, expectedFeeCap, replacement.GasFeeCap())
+	}
+	// the higher fee is paid from the value
+	maxCost := big.NewInt(0).Add(tx.Value(), big.NewInt(0).Mul(tx.GasFeeCap(), big.NewInt(int64(tx.Gas()))))
+	if replacement.Cost().Cmp(maxCost) != 0 {
+		t.Fatalf(`expected cost %v, got %v`, maxCost, replacement.Cost())
+	}
+	if _, err = bind.WaitMined(context.Background(), client, replacement); err != nil {
+		t.Fatalf("Can't wait until transaction is mined %v", err)
+	}
+}
+
+func TestBumpFeeExceedsMaxFeeCap(t *testing.T) {
+	config.ReadOpts()
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	key, _ := genesisAcc.GetPrivateKey()
+	tx, _ := signTestTransfer(key, 0)
+
+	maxGasFeeCap := config.Opts.MaxGasFeeCapGwei
+	config.Opts.MaxGasFeeCapGwei = 0
+	defer func() { config.Opts.MaxGasFeeCapGwei = maxGasFeeCap }()
+
+	if _, err := BumpFee(client, genesisAcc, tx, nil, nil); err != FeeCapExceeded {
+		t.Fatalf(`expected %v, got %v`, FeeCapExceeded, err)
+	}
+}
@@ -6,19 +6,29 @@ import (
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
 )
 
+// ChainConfig fixed chain values of a local chain. GasPrice is used as fee cap instead of the estimated one.
 type ChainConfig struct {
 	ChainId  *big.Int
 	GasPrice *big.Int
 }
 
 var (
-	ClientMain *ethclient.Client
-	ClientTest *ethclient.Client
+	ClientMain *Client
+	ClientTest *Client
 	Chain      *ChainConfig
 )
 
+// NewClient
+/*
+	Creates the client and keeps its rpc client for the calls, which ethclient doesn't support (e.g. eth_feeHistory).
+*/
+func NewClient(c *rpc.Client) *Client {
+	return &Client{Client: ethclient.NewClient(c), rpc: c}
+}
+
 func CreateTestClientConnection(connectionURITest string) {
 	var err error
 	ClientTest, err = createClient(connectionURITest)
@@ -35,12 +45,12 @@ func CreateMainClientConnection(connectionURIMain string) {
 	}
 }
 
-func createClient(connectionURI string) (*ethclient.Client, error) {
-	client, err := ethclient.Dial(connectionURI)
+func createClient(connectionURI string) (*Client, error) {
+	c, err := rpc.Dial(connectionURI)
 	if err != nil {
 		log.Fatal(err)
 	} else {
 		fmt.Printf("Connection works with %s ", connectionURI)
 	}
-	return client, err
+	return NewClient(c), err
 }
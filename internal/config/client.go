@@ -0,0 +1,154 @@
+package config
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+var rpcCallCallbacks []func(method string, err error)
+
+// OnRPCCall
+/*
+	Registers a callback, which is called after every call of a Client with the JSON-RPC method and its error.
+	Callbacks have to be registered before the clients are used.
+*/
+func OnRPCCall(callback func(method string, err error)) {
+	rpcCallCallbacks = append(rpcCallCallbacks, callback)
+}
+
+func rpcCalled(method string, err error) {
+	for _, callback := range rpcCallCallbacks {
+		callback(method, err)
+	}
+}
+
+// Client
+/*
+	Client of an ethereum node, which reports every call to the OnRPCCall callbacks.
+	Methods of the ethclient.Client, which the service doesn't use, aren't reported.
+*/
+type Client struct {
+	*ethclient.Client
+	rpc *rpc.Client
+}
+
+// CallContext calls a JSON-RPC method, which ethclient doesn't support (e.g. eth_feeHistory)
+func (c *Client) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	err := c.rpc.CallContext(ctx, result, method, args...)
+	rpcCalled(method, err)
+	return err
+}
+
+func (c *Client) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	balance, err := c.Client.BalanceAt(ctx, account, blockNumber)
+	rpcCalled("eth_getBalance", err)
+	return balance, err
+}
+
+func (c *Client) BlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error) {
+	block, err := c.Client.BlockByHash(ctx, hash)
+	rpcCalled("eth_getBlockByHash", err)
+	return block, err
+}
+
+func (c *Client) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	block, err := c.Client.BlockByNumber(ctx, number)
+	rpcCalled("eth_getBlockByNumber", err)
+	return block, err
+}
+
+func (c *Client) BlockNumber(ctx context.Context) (uint64, error) {
+	number, err := c.Client.BlockNumber(ctx)
+	rpcCalled("eth_blockNumber", err)
+	return number, err
+}
+
+func (c *Client) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	result, err := c.Client.CallContract(ctx, msg, blockNumber)
+	rpcCalled("eth_call", err)
+	return result, err
+}
+
+func (c *Client) CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error) {
+	code, err := c.Client.CodeAt(ctx, account, blockNumber)
+	rpcCalled("eth_getCode", err)
+	return code, err
+}
+
+func (c *Client) EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error) {
+	gas, err := c.Client.EstimateGas(ctx, msg)
+	rpcCalled("eth_estimateGas", err)
+	return gas, err
+}
+
+func (c *Client) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	logs, err := c.Client.FilterLogs(ctx, q)
+	rpcCalled("eth_getLogs", err)
+	return logs, err
+}
+
+func (c *Client) HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error) {
+	header, err := c.Client.HeaderByHash(ctx, hash)
+	rpcCalled("eth_getBlockByHash", err)
+	return header, err
+}
+
+func (c *Client) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	header, err := c.Client.HeaderByNumber(ctx, number)
+	rpcCalled("eth_getBlockByNumber", err)
+	return header, err
+}
+
+func (c *Client) NetworkID(ctx context.Context) (*big.Int, error) {
+	id, err := c.Client.NetworkID(ctx)
+	rpcCalled("net_version", err)
+	return id, err
+}
+
+func (c *Client) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	nonce, err := c.Client.PendingNonceAt(ctx, account)
+	rpcCalled("eth_getTransactionCount", err)
+	return nonce, err
+}
+
+func (c *Client) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	err := c.Client.SendTransaction(ctx, tx)
+	rpcCalled("eth_sendRawTransaction", err)
+	return err
+}
+
+func (c *Client) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	sub, err := c.Client.SubscribeNewHead(ctx, ch)
+	rpcCalled("eth_subscribe", err)
+	return sub, err
+}
+
+func (c *Client) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	price, err := c.Client.SuggestGasPrice(ctx)
+	rpcCalled("eth_gasPrice", err)
+	return price, err
+}
+
+func (c *Client) SuggestGasTipCap(ctx context.Context) (*big.Int, error) {
+	tip, err := c.Client.SuggestGasTipCap(ctx)
+	rpcCalled("eth_maxPriorityFeePerGas", err)
+	return tip, err
+}
+
+func (c *Client) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	tx, isPending, err := c.Client.TransactionByHash(ctx, hash)
+	rpcCalled("eth_getTransactionByHash", err)
+	return tx, isPending, err
+}
+
+func (c *Client) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	receipt, err := c.Client.TransactionReceipt(ctx, txHash)
+	rpcCalled("eth_getTransactionReceipt", err)
+	return receipt, err
+}
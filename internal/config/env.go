@@ -17,9 +17,47 @@ type OptsType struct {
 	FeeFactor                  string
 	IncomingBlockConfirmations int64
 	OutgoingTxConfirmations    int64
+	FeeBumpBlocks              int64
+	FeeBumpPercent             int64
+	MaxGasFeeCapGwei           int64
+	MaxBroadcastAttempts       int64
+	FeeHistoryBlocks           int64
+	FeeTipPercentile           int64
+	BlockHistoryDepth          int64
+	BackfillBatchSize          int64
+	IdempotencyWindow          int64
+	PaymentExpiry              int64
+	MaxPaymentExpiry           int64
+	PartialPaymentExtension    int64
+	OverpaymentTolerance       int64
+	LatePaymentGracePeriod     int64
+	LatePaymentReopen          bool
+	NotificationInterval       int64
+	NotificationMaxBackoff     int64
+	NotificationMaxAttempts    int64
+	PriceSources               string
+	PriceCacheTTL              int64
+	PriceMaxStaleness          int64
+	PriceMaxDeviation          float64
+	PriceFeedMaxAge            int64
+	HeadPollInterval           int64
+	HeadMaxBackoff             int64
+	HeadMaxAge                 int64
+	HealthCheckTimeout         int64
 	PrivateKeySecret           string
+	HDMnemonic                 string
 	ProxyBaseUrl               string
 	BackendBaseUrl             string
+	BackendSigningKeyId        string
+	BackendSigningSecret       string
+	BackendSigningDisabled     bool
+	MainTokens                 string
+	TestTokens                 string
+	MainPriceFeeds             string
+	TestPriceFeeds             string
+	GasStationPrivateKey       string
+	LogLevel                   string
+	LogFormat                  string
 	DBOpts                     DBOpts
 }
 
@@ -44,6 +82,22 @@ func lookupInt64Env(key string, defaultValue int64) int64 {
 	return v
 }
 
+func lookupFloat64Env(key string, defaultValue float64) float64 {
+	v, err := strconv.ParseFloat(lookupEnv(key), 64)
+	if err != nil {
+		return defaultValue
+	}
+	return v
+}
+
+func lookupBoolEnv(key string, defaultValue bool) bool {
+	v, err := strconv.ParseBool(lookupEnv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return v
+}
+
 func lookupEnv(key string, defaultValues ...string) string {
 	if val, ok := os.LookupEnv(key); ok {
 		return val
@@ -71,7 +125,42 @@ func ReadOpts() {
 		flag.StringVar(&o.FeeFactor, "FEE_FACTOR", lookupEnv("FEE_FACTOR", "100"), "How many times the earnings should be higher than the fees to forward the earnings")
 		flag.Int64Var(&o.IncomingBlockConfirmations, "INCOMING_BLOCK_CONFIRMATIONS", lookupInt64Env("INCOMING_BLOCK_CONFIRMATIONS", 12), "How many confirmations should be waited until the block will be counted as confirmed")
 		flag.Int64Var(&o.OutgoingTxConfirmations, "OUTGOING_TX_CONFIRMATIONS", lookupInt64Env("OUTGOING_TX_CONFIRMATIONS", 3), "How many confirmations should be waited until the tx of the payment will be counted as finished")
+		flag.Int64Var(&o.FeeBumpBlocks, "FEE_BUMP_BLOCKS", lookupInt64Env("FEE_BUMP_BLOCKS", 10), "After how many blocks a pending outgoing tx is replaced with a higher fee")
+		flag.Int64Var(&o.FeeBumpPercent, "FEE_BUMP_PERCENT", lookupInt64Env("FEE_BUMP_PERCENT", 10), "How many percent the fees of a replaced tx are increased, nodes require at least 10")
+		flag.Int64Var(&o.MaxGasFeeCapGwei, "MAX_GAS_FEE_CAP_GWEI", lookupInt64Env("MAX_GAS_FEE_CAP_GWEI", 500), "Maximal fee cap in gwei, an outgoing tx isn't replaced with a higher fee")
+		flag.Int64Var(&o.MaxBroadcastAttempts, "MAX_BROADCAST_ATTEMPTS", lookupInt64Env("MAX_BROADCAST_ATTEMPTS", 10), "After how many failed broadcasts an outgoing tx is given up")
+		flag.Int64Var(&o.FeeHistoryBlocks, "FEE_HISTORY_BLOCKS", lookupInt64Env("FEE_HISTORY_BLOCKS", 10), "From how many blocks the tip of an outgoing tx is estimated")
+		flag.Int64Var(&o.FeeTipPercentile, "FEE_TIP_PERCENTILE", lookupInt64Env("FEE_TIP_PERCENTILE", 50), "Percentile of the tips in a block, which is used to estimate the tip of an outgoing tx")
+		flag.Int64Var(&o.IdempotencyWindow, "IDEMPOTENCY_WINDOW", lookupInt64Env("IDEMPOTENCY_WINDOW", 24), "How many hours a payment request with the same idempotency key returns the created payment")
+		flag.Int64Var(&o.PaymentExpiry, "PAYMENT_EXPIRY", lookupInt64Env("PAYMENT_EXPIRY", 900), "Seconds until a payment without expires_in expires")
+		flag.Int64Var(&o.MaxPaymentExpiry, "MAX_PAYMENT_EXPIRY", lookupInt64Env("MAX_PAYMENT_EXPIRY", 86400), "Maximal expires_in of a payment request in seconds")
+		flag.Int64Var(&o.PartialPaymentExtension, "PARTIAL_PAYMENT_EXTENSION", lookupInt64Env("PARTIAL_PAYMENT_EXTENSION", 0), "Seconds the expiry of a payment is extended, when the first funds arrive. 0 disables the extension")
+		flag.Int64Var(&o.OverpaymentTolerance, "OVERPAYMENT_TOLERANCE", lookupInt64Env("OVERPAYMENT_TOLERANCE", 1), "Percent of the pay amount, which a shopper can overpay without getting a refund")
+		flag.Int64Var(&o.LatePaymentGracePeriod, "LATE_PAYMENT_GRACE_PERIOD", lookupInt64Env("LATE_PAYMENT_GRACE_PERIOD", 3600), "Seconds the account of an expired, cancelled or refunded payment is watched for late payments. 0 releases the account immediately")
+		flag.BoolVar(&o.LatePaymentReopen, "LATE_PAYMENT_REOPEN", lookupBoolEnv("LATE_PAYMENT_REOPEN", true), "Reopen an expired payment as paid, if a late payment covers the pay amount. Otherwise late funds are refunded")
+		flag.Int64Var(&o.NotificationInterval, "NOTIFICATION_INTERVAL", lookupInt64Env("NOTIFICATION_INTERVAL", 5), "Seconds between two runs of the dispatcher of the backend notifications, also the first retry delay")
+		flag.Int64Var(&o.NotificationMaxBackoff, "NOTIFICATION_MAX_BACKOFF", lookupInt64Env("NOTIFICATION_MAX_BACKOFF", 3600), "Maximal seconds between two attempts to deliver a notification to the backend")
+		flag.Int64Var(&o.NotificationMaxAttempts, "NOTIFICATION_MAX_ATTEMPTS", lookupInt64Env("NOTIFICATION_MAX_ATTEMPTS", 20), "Attempts to deliver a notification before it is dead-lettered")
+		flag.StringVar(&o.PriceSources, "PRICE_SOURCES", lookupEnv("PRICE_SOURCES", "proxy"), "Comma separated price sources. The first source with a fresh rate is used, the others are fallbacks and cross-checks")
+		flag.Int64Var(&o.PriceCacheTTL, "PRICE_CACHE_TTL", lookupInt64Env("PRICE_CACHE_TTL", 30), "Seconds a rate is cached per currency pair. 0 disables the cache")
+		flag.Int64Var(&o.PriceMaxStaleness, "PRICE_MAX_STALENESS", lookupInt64Env("PRICE_MAX_STALENESS", 300), "Maximal age in seconds of a rate, an older rate is ignored")
+		flag.Float64Var(&o.PriceMaxDeviation, "PRICE_MAX_DEVIATION", lookupFloat64Env("PRICE_MAX_DEVIATION", 2), "Maximal deviation in percent between the rates of the price sources, no payment is created if they disagree more")
+		flag.Int64Var(&o.PriceFeedMaxAge, "PRICE_FEED_MAX_AGE", lookupInt64Env("PRICE_FEED_MAX_AGE", 3600), "Maximal age in seconds of the latest round of a price feed, usually the heartbeat of the feed")
+		flag.Int64Var(&o.BlockHistoryDepth, "BLOCK_HISTORY_DEPTH", lookupInt64Env("BLOCK_HISTORY_DEPTH", 64), "How many processed blocks are kept to detect chain reorganizations")
+		flag.Int64Var(&o.BackfillBatchSize, "BACKFILL_BATCH_SIZE", lookupInt64Env("BACKFILL_BATCH_SIZE", 100), "How many missed blocks are fetched at once, before they are processed")
+		flag.Int64Var(&o.HeadPollInterval, "HEAD_POLL_INTERVAL", lookupInt64Env("HEAD_POLL_INTERVAL", 12), "Seconds between two head polls, if the endpoint doesn't support subscriptions")
+		flag.Int64Var(&o.HeadMaxBackoff, "HEAD_MAX_BACKOFF", lookupInt64Env("HEAD_MAX_BACKOFF", 60), "Maximal seconds to wait until the head subscription is reconnected")
+		flag.Int64Var(&o.HeadMaxAge, "HEAD_MAX_AGE", lookupInt64Env("HEAD_MAX_AGE", 120), "Maximal seconds without a processed block, until /healthz and /readyz fail")
+		flag.Int64Var(&o.HealthCheckTimeout, "HEALTH_CHECK_TIMEOUT", lookupInt64Env("HEALTH_CHECK_TIMEOUT", 5), "Seconds until a check of /healthz or /readyz fails")
 		flag.StringVar(&o.PrivateKeySecret, "PRIVATE_KEY_SECRET", lookupEnv("PRIVATE_KEY_SECRET", "secret16byte1234"), "Secret for decrypting private keys")
+		flag.StringVar(&o.MainTokens, "MAIN_TOKENS", lookupEnv("MAIN_TOKENS", "USDC:0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48:6,USDT:0xdAC17F958D2ee523a2206206994597C13D831ec7:6,DAI:0x6B175474E89094C44Da98b954EedeAC495271d0F:18"), "Accepted ERC-20 tokens on mainnet as SYMBOL:CONTRACT:DECIMALS, comma separated")
+		flag.StringVar(&o.TestTokens, "TEST_TOKENS", lookupEnv("TEST_TOKENS"), "Accepted ERC-20 tokens on testnet as SYMBOL:CONTRACT:DECIMALS, comma separated")
+		flag.StringVar(&o.MainPriceFeeds, "MAIN_PRICE_FEEDS", lookupEnv("MAIN_PRICE_FEEDS", "ETH/USD:0x5f4eC3Df9cbd43714FE2740f5E3616155c5b8419"), "Chainlink aggregators on mainnet as BASE/QUOTE:AGGREGATOR, comma separated")
+		flag.StringVar(&o.TestPriceFeeds, "TEST_PRICE_FEEDS", lookupEnv("TEST_PRICE_FEEDS"), "Chainlink aggregators on testnet as BASE/QUOTE:AGGREGATOR, comma separated")
+		flag.StringVar(&o.GasStationPrivateKey, "GAS_STATION_PRIVATE_KEY", lookupEnv("GAS_STATION_PRIVATE_KEY"), "Encrypted private key of the wallet which pays the gas for token forwards")
+		flag.StringVar(&o.HDMnemonic, "HD_MNEMONIC", lookupEnv("HD_MNEMONIC"), "BIP-39 mnemonic of the master seed. New accounts are derived from it when it is set")
+		flag.StringVar(&o.LogLevel, "LOG_LEVEL", lookupEnv("LOG_LEVEL", "info"), "Minimal level of the logs: debug, info, warn or error")
+		flag.StringVar(&o.LogFormat, "LOG_FORMAT", lookupEnv("LOG_FORMAT", "text"), "Format of the logs: text or json")
 		flag.StringVar(&o.DBOpts.DbHost, "DB_HOST", lookupEnv("DB_HOST"), "Database Host")
 		flag.StringVar(&o.DBOpts.DbUser, "DB_USER", lookupEnv("DB_USER"), "Database User")
 		flag.StringVar(&o.DBOpts.DbPassword, "DB_PASSWORD", lookupEnv("DB_PASSWORD"), "Database Password")
@@ -79,6 +168,9 @@ func ReadOpts() {
 		flag.StringVar(&o.DBOpts.DbPort, "DB_PORT", lookupEnv("DB_PORT"), "Database Port")
 		flag.StringVar(&o.ProxyBaseUrl, "PROXY_BASE_URL", lookupEnv("PROXY_BASE_URL", "http://localhost:8001/api"), "Proxy base url")
 		flag.StringVar(&o.BackendBaseUrl, "BACKEND_BASE_URL", lookupEnv("BACKEND_BASE_URL", "http://localhost:8000/api/internal"), "Backend base url")
+		flag.StringVar(&o.BackendSigningKeyId, "BACKEND_SIGNING_KEY_ID", lookupEnv("BACKEND_SIGNING_KEY_ID", "1"), "Id of the signing secret, so the backend can accept the old and the new secret during a rotation")
+		flag.StringVar(&o.BackendSigningSecret, "BACKEND_SIGNING_SECRET", lookupEnv("BACKEND_SIGNING_SECRET"), "Shared secret to sign the calls to the backend with HMAC-SHA256. The service doesn't start without it, unless BACKEND_SIGNING_DISABLED is set")
+		flag.BoolVar(&o.BackendSigningDisabled, "BACKEND_SIGNING_DISABLED", lookupBoolEnv("BACKEND_SIGNING_DISABLED", false), "Send the calls to the backend unsigned, e.g. for a local backend")
 		Opts = o
 	}
 }
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// PriceFeed aggregator contract with the price of one Base in Quote, e.g. ETH/USD
+type PriceFeed struct {
+	Base       string
+	Quote      string
+	Aggregator common.Address
+}
+
+/*
+	Returns the price feed of the currency pair for the mode. The pair is also found in the reversed order, e.g. USD/ETH returns the ETH/USD feed.
+*/
+func GetPriceFeed(mode enum.Mode, base string, quote string) (PriceFeed, bool) {
+	var feedOpts string
+	switch mode {
+	case enum.Main:
+		feedOpts = Opts.MainPriceFeeds
+	case enum.Test:
+		feedOpts = Opts.TestPriceFeeds
+	}
+	feeds, err := ParsePriceFeeds(feedOpts)
+	if err != nil {
+		return PriceFeed{}, false
+	}
+	if feed, ok := feeds[feedPair(base, quote)]; ok {
+		return feed, true
+	}
+	feed, ok := feeds[feedPair(quote, base)]
+	return feed, ok
+}
+
+// ParsePriceFeeds
+/*
+	Parses a price feed list in the format BASE/QUOTE:AGGREGATOR,BASE/QUOTE:AGGREGATOR
+*/
+func ParsePriceFeeds(feedOpts string) (map[string]PriceFeed, error) {
+	feeds := make(map[string]PriceFeed)
+	for _, entry := range strings.Split(feedOpts, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid price feed entry %q", entry)
+		}
+		pair := strings.Split(parts[0], "/")
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return nil, fmt.Errorf("invalid price feed pair %q", parts[0])
+		}
+		if !common.IsHexAddress(parts[1]) {
+			return nil, fmt.Errorf("invalid price feed aggregator %q", parts[1])
+		}
+		feed := PriceFeed{
+			Base:       strings.ToUpper(pair[0]),
+			Quote:      strings.ToUpper(pair[1]),
+			Aggregator: common.HexToAddress(parts[1]),
+		}
+		feeds[feedPair(feed.Base, feed.Quote)] = feed
+	}
+	return feeds, nil
+}
+
+func feedPair(base string, quote string) string {
+	return strings.ToUpper(base) + "/" + strings.ToUpper(quote)
+}
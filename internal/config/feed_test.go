@@ -0,0 +1,47 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/CHainGate/backend/pkg/enum"
+)
+
+func TestParsePriceFeeds(t *testing.T) {
+	feeds, err := ParsePriceFeeds("eth/usd:0x5f4eC3Df9cbd43714FE2740f5E3616155c5b8419, USDC/USD:0x8fFfFfd4AfB6115b954Bd326cbe7B4BA576818f6")
+	if err != nil {
+		t.Fatalf("Unable to parse price feeds %v", err)
+	}
+	if len(feeds) != 2 {
+		t.Fatalf(`There should be %v price feeds, but there are %v`, 2, len(feeds))
+	}
+	feed := feeds["ETH/USD"]
+	if feed.Base != "ETH" || feed.Quote != "USD" || feed.Aggregator.Hex() != "0x5f4eC3Df9cbd43714FE2740f5E3616155c5b8419" {
+		t.Fatalf(`ETH/USD price feed is wrong %+v`, feed)
+	}
+}
+
+func TestParsePriceFeedsInvalid(t *testing.T) {
+	if _, err := ParsePriceFeeds("ETH/USD:0xinvalid"); err == nil {
+		t.Fatalf("An invalid aggregator address should return an error")
+	}
+	if _, err := ParsePriceFeeds("ETHUSD:0x5f4eC3Df9cbd43714FE2740f5E3616155c5b8419"); err == nil {
+		t.Fatalf("A pair without quote should return an error")
+	}
+}
+
+func TestGetPriceFeed(t *testing.T) {
+	ReadOpts()
+	mainPriceFeeds := Opts.MainPriceFeeds
+	Opts.MainPriceFeeds = "ETH/USD:0x5f4eC3Df9cbd43714FE2740f5E3616155c5b8419"
+	defer func() { Opts.MainPriceFeeds = mainPriceFeeds }()
+	feed, ok := GetPriceFeed(enum.Main, "usd", "eth")
+	if !ok {
+		t.Fatalf("The ETH/USD price feed should be found for USD/ETH")
+	}
+	if feed.Base != "ETH" || feed.Quote != "USD" {
+		t.Fatalf(`Price feed is wrong %+v`, feed)
+	}
+	if _, ok = GetPriceFeed(enum.Test, "USD", "ETH"); ok {
+		t.Fatalf("There should be no price feed on testnet")
+	}
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const NativeCurrency = "ETH"
+
+type Token struct {
+	Symbol   string
+	Contract common.Address
+	Decimals uint8
+}
+
+/*
+	Returns the accepted ERC-20 token with the given symbol for the mode.
+*/
+func GetToken(mode enum.Mode, symbol string) (Token, bool) {
+	var tokenOpts string
+	switch mode {
+	case enum.Main:
+		tokenOpts = Opts.MainTokens
+	case enum.Test:
+		tokenOpts = Opts.TestTokens
+	}
+	tokens, err := ParseTokens(tokenOpts)
+	if err != nil {
+		return Token{}, false
+	}
+	token, ok := tokens[strings.ToUpper(symbol)]
+	return token, ok
+}
+
+// ParseTokens
+/*
+	Parses a token list in the format SYMBOL:CONTRACT:DECIMALS,SYMBOL:CONTRACT:DECIMALS
+*/
+func ParseTokens(tokenOpts string) (map[string]Token, error) {
+	tokens := make(map[string]Token)
+	for _, entry := range strings.Split(tokenOpts, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid token entry %q", entry)
+		}
+		if !common.IsHexAddress(parts[1]) {
+			return nil, fmt.Errorf("invalid token contract %q", parts[1])
+		}
+		decimals, err := strconv.ParseUint(parts[2], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token decimals %q", parts[2])
+		}
+		symbol := strings.ToUpper(parts[0])
+		tokens[symbol] = Token{
+			Symbol:   symbol,
+			Contract: common.HexToAddress(parts[1]),
+			Decimals: uint8(decimals),
+		}
+	}
+	return tokens, nil
+}
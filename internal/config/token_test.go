@@ -0,0 +1,45 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/CHainGate/backend/pkg/enum"
+)
+
+func TestParseTokens(t *testing.T) {
+	tokens, err := ParseTokens("usdc:0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48:6, DAI:0x6B175474E89094C44Da98b954EedeAC495271d0F:18")
+	if err != nil {
+		t.Fatalf("Unable to parse tokens %v", err)
+	}
+	if len(tokens) != 2 {
+		t.Fatalf(`There should be %v tokens, but there are %v`, 2, len(tokens))
+	}
+	if tokens["USDC"].Decimals != 6 {
+		t.Fatalf(`USDC should have %v decimals, but has %v`, 6, tokens["USDC"].Decimals)
+	}
+	if tokens["DAI"].Contract.Hex() != "0x6B175474E89094C44Da98b954EedeAC495271d0F" {
+		t.Fatalf(`DAI has the wrong contract %v`, tokens["DAI"].Contract.Hex())
+	}
+}
+
+func TestParseTokensInvalid(t *testing.T) {
+	if _, err := ParseTokens("USDC:0xinvalid:6"); err == nil {
+		t.Fatalf("An invalid contract address should return an error")
+	}
+	if _, err := ParseTokens("USDC:0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48"); err == nil {
+		t.Fatalf("A missing decimal entry should return an error")
+	}
+}
+
+func TestGetToken(t *testing.T) {
+	token, ok := GetToken(enum.Main, "usdt")
+	if !ok {
+		t.Fatalf("USDT should be accepted on mainnet")
+	}
+	if token.Symbol != "USDT" {
+		t.Fatalf(`Token symbol is %v, but should be %v`, token.Symbol, "USDT")
+	}
+	if _, ok = GetToken(enum.Main, "ETH"); ok {
+		t.Fatalf("ETH is no token")
+	}
+}
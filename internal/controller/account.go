@@ -4,6 +4,8 @@ import (
 	"errors"
 	"ethereum-service/internal/repository"
 	"ethereum-service/model"
+	"ethereum-service/utils"
+	"sync"
 
 	"github.com/CHainGate/backend/pkg/enum"
 
@@ -14,12 +16,23 @@ func GetAccount(mode enum.Mode) (model.Account, error) {
 	return getFreeAccount(mode)
 }
 
+// accountLock prevents that the same free account or derivation index is handed out twice in this instance
+var accountLock sync.Mutex
+
+// derivationAttempts how often a derivation index is allocated, if other instances take it in the meantime
+const derivationAttempts = 3
+
 func getFreeAccount(mode enum.Mode) (model.Account, error) {
+	accountLock.Lock()
+	defer accountLock.Unlock()
 	result, acc := repository.Account.GetFree(mode)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			acc = model.CreateAccount(mode)
-			repository.Account.Create(acc)
+			var err error
+			acc, err = createAccount(mode)
+			if err != nil {
+				return model.Account{}, err
+			}
 		} else {
 			return model.Account{}, result.Error
 		}
@@ -27,8 +40,36 @@ func getFreeAccount(mode enum.Mode) (model.Account, error) {
 		acc.Used = true
 		err := repository.Account.Update(acc)
 		if err != nil {
-			return model.Account{}, result.Error
+			return model.Account{}, err
 		}
 	}
 	return *acc, nil
 }
+
+/*
+	Creates and stores a new account. The unique derivation index protects an index against other instances,
+	so if one of them takes the next index in the meantime, the next one is allocated again.
+*/
+func createAccount(mode enum.Mode) (*model.Account, error) {
+	if !utils.IsHDWalletEnabled() {
+		acc := model.CreateAccount(mode)
+		return acc, repository.Account.Create(acc)
+	}
+	for attempt := 1; ; attempt++ {
+		index, err := repository.Account.GetNextDerivationIndex()
+		if err != nil {
+			return nil, err
+		}
+		acc, err := model.CreateHDAccount(mode, index)
+		if err != nil {
+			return nil, err
+		}
+		err = repository.Account.Create(acc)
+		if err == nil {
+			return acc, nil
+		}
+		if !errors.Is(err, model.DuplicateDerivationIndex) || attempt == derivationAttempts {
+			return nil, err
+		}
+	}
+}
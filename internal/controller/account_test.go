@@ -1,9 +1,11 @@
 package controller
 
 import (
+	"errors"
 	"ethereum-service/internal/config"
 	"ethereum-service/internal/repository"
 	"ethereum-service/internal/testutils"
+	"ethereum-service/model"
 	"testing"
 
 	"github.com/CHainGate/backend/pkg/enum"
@@ -20,3 +22,68 @@ func TestGetAccount(t *testing.T) {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
+
+func TestGetAccountHD(t *testing.T) {
+	config.ReadOpts()
+	config.Opts.HDMnemonic = "test test test test test test test test test test test junk"
+	defer func() { config.Opts.HDMnemonic = "" }()
+	mock, gormDb := testutils.NewMock()
+	repository.InitAccount(gormDb)
+	mock = testutils.SetupGetNoFreeAccount(mock)
+	mock = testutils.SetupGetNextDerivationIndex(mock, 0)
+	mock = testutils.SetupCreateHDAccount(mock, 0)
+	acc, err := GetAccount(enum.Main)
+	if err != nil {
+		t.Fatalf("Unable to get account %v", err)
+	}
+	if acc.Address != "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266" {
+		t.Fatalf(`Account has address %v, but should have %v`, acc.Address, "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266")
+	}
+	if acc.PrivateKey != "" {
+		t.Fatalf("The private key of a HD account shouldn't be stored")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetAccountHDDuplicateIndex(t *testing.T) {
+	config.ReadOpts()
+	config.Opts.HDMnemonic = "test test test test test test test test test test test junk"
+	defer func() { config.Opts.HDMnemonic = "" }()
+	mock, gormDb := testutils.NewMock()
+	repository.InitAccount(gormDb)
+	mock = testutils.SetupGetNoFreeAccount(mock)
+	// another instance takes the index 0 in the meantime
+	mock = testutils.SetupGetNextDerivationIndex(mock, 0)
+	mock = testutils.SetupCreateHDAccountDuplicate(mock, 0)
+	mock = testutils.SetupGetNextDerivationIndex(mock, 1)
+	mock = testutils.SetupCreateHDAccount(mock, 1)
+	acc, err := GetAccount(enum.Main)
+	if err != nil {
+		t.Fatalf("Unable to get account %v", err)
+	}
+	if acc.Address != "0x70997970C51812dc3A010C7d01b50e0d17dc79C8" {
+		t.Fatalf(`Account has address %v, but should have %v`, acc.Address, "0x70997970C51812dc3A010C7d01b50e0d17dc79C8")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetAccountHDIndexExhausted(t *testing.T) {
+	config.ReadOpts()
+	config.Opts.HDMnemonic = "test test test test test test test test test test test junk"
+	defer func() { config.Opts.HDMnemonic = "" }()
+	mock, gormDb := testutils.NewMock()
+	repository.InitAccount(gormDb)
+	mock = testutils.SetupGetNoFreeAccount(mock)
+	// the next index would be hardened
+	mock = testutils.SetupGetNextDerivationIndex(mock, 0x80000000)
+	if _, err := GetAccount(enum.Main); !errors.Is(err, model.InvalidDerivationIndex) {
+		t.Fatalf("expected %v, got %v", model.InvalidDerivationIndex, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
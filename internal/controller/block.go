@@ -0,0 +1,338 @@
+package controller
+
+import (
+	"context"
+	"ethereum-service/internal/bc"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/logging"
+	"ethereum-service/internal/metrics"
+	"ethereum-service/internal/repository"
+	"ethereum-service/model"
+	"math/big"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+)
+
+// blockProcessedCallbacks are called after a block is processed and stored, e.g. by the health checks
+var blockProcessedCallbacks []func(mode enum.Mode, number *big.Int)
+
+// OnBlockProcessed
+/*
+	Registers a callback, which is called after each processed block. It has to be registered before the heads are processed and must not block.
+*/
+func OnBlockProcessed(callback func(mode enum.Mode, number *big.Int)) {
+	blockProcessedCallbacks = append(blockProcessedCallbacks, callback)
+}
+
+// HandleNewHead
+/*
+	Processes all blocks between the last processed block and the new head in order.
+	Blocks which were missed because the service was down or the subscription was broken are backfilled first.
+	If a parent hash doesn't match the processed block with the same number, the chain was reorganized.
+	In this case the payments are rewound to the common ancestor and the canonical blocks are processed again.
+*/
+func HandleNewHead(client *config.Client, header *types.Header, mode enum.Mode) {
+	metrics.SetHead(mode, header.Number)
+	if !backfillMissed(client, header, mode) {
+		return
+	}
+	handleHeader(client, header, mode, true)
+}
+
+/*
+	Processes the blocks between the last processed block and the header in batches of BackfillBatchSize blocks in order.
+	Every processed block is stored, so if a batch fails, the next head continues after the last processed block.
+	Returns false if a block couldn't be processed.
+*/
+func backfillMissed(client *config.Client, header *types.Header, mode enum.Mode) bool {
+	for {
+		missed, err := getMissedHeaders(client, header, mode, config.Opts.BackfillBatchSize)
+		if err != nil {
+			logging.WithBlock(mode, header.Number).WithError(err).Error("Error in getting missed headers")
+			return false
+		}
+		if len(missed) == 0 {
+			return true
+		}
+		logging.WithBlock(mode, header.Number).WithFields(logrus.Fields{"from": missed[0].Number.Uint64(), "to": missed[len(missed)-1].Number.Uint64()}).Info("Backfill missed blocks")
+		for _, h := range missed {
+			if !handleHeader(client, h, mode, false) {
+				return false
+			}
+		}
+	}
+}
+
+// Backfill
+/*
+	Processes all blocks which arrived since the last processed block before the live headers are handled.
+	Returns false if no block was processed yet in this mode, in this case there is nothing to backfill from.
+*/
+func Backfill(client *config.Client, mode enum.Mode) bool {
+	latest, err := repository.Block.GetLatest(mode)
+	if err != nil {
+		logging.WithMode(mode).WithError(err).Error("Error in getting last processed block")
+		return false
+	}
+	if latest == nil {
+		return false
+	}
+	head, err := client.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		logging.WithMode(mode).WithError(err).Error("Error in getting head")
+		return true
+	}
+	logging.WithBlock(mode, &latest.Number.Int).WithField("head", head.Number.Uint64()).Info("Backfill from the last processed block")
+	HandleNewHead(client, head, mode)
+	return true
+}
+
+/*
+	Processes the header and the not yet processed ancestors of it. Only the live head is checked against the current time,
+	all other blocks with their timestamp (see ProcessBlock).
+	The confirming payments and the outgoing transactions are only checked once at the live head, which covers the backfilled blocks before it.
+	Returns false if the block couldn't be processed.
+*/
+func handleHeader(client *config.Client, header *types.Header, mode enum.Mode, live bool) bool {
+	headers, ancestor, err := getNewCanonicalHeaders(client, header, mode)
+	if err != nil {
+		logging.WithBlock(mode, header.Number).WithError(err).Error("Error in getting new canonical headers")
+		return false
+	}
+
+	if ancestor != nil {
+		logging.WithBlock(mode, ancestor.Number).Warn("Chain reorganization detected. Rewind to the common ancestor")
+		rewindPayments(client, mode, ancestor)
+		err = repository.Block.DeleteFrom(mode, big.NewInt(0).Add(ancestor.Number, big.NewInt(1)))
+		if err != nil {
+			logging.WithBlock(mode, ancestor.Number).WithError(err).Error("Couldn't delete orphaned blocks")
+		}
+	}
+
+	for _, h := range headers {
+		block, err := client.BlockByHash(context.Background(), h.Hash())
+		if err != nil {
+			// the block isn't stored, therefore it will be processed again with the next head
+			logging.WithBlock(mode, h.Number).WithError(err).Error("Error in getting BlockByHash")
+			return false
+		}
+		at := time.Unix(int64(block.Time()), 0)
+		if live && block.Hash() == header.Hash() {
+			at = time.Now()
+		}
+		ProcessBlock(client, block, mode, at)
+		err = repository.Block.Create(&model.Block{
+			Mode:       mode,
+			Number:     model.NewBigInt(block.Number()),
+			Hash:       block.Hash().String(),
+			ParentHash: block.ParentHash().String(),
+		})
+		if err != nil {
+			logging.WithBlock(mode, block.Number()).WithError(err).Error("Couldn't write block to database")
+		} else {
+			metrics.SetProcessedBlock(mode, block.Number())
+			for _, callback := range blockProcessedCallbacks {
+				callback(mode, block.Number())
+			}
+		}
+	}
+
+	if live {
+		hash := header.Hash()
+		CheckConfirming(client, header.Number, mode, &hash)
+	}
+
+	oldest := big.NewInt(0).Sub(header.Number, big.NewInt(config.Opts.BlockHistoryDepth))
+	if oldest.Sign() > 0 {
+		err = repository.Block.DeleteBefore(mode, oldest)
+		if err != nil {
+			logging.WithBlock(mode, oldest).WithError(err).Error("Couldn't delete old blocks")
+		}
+	}
+	return true
+}
+
+/*
+	Checks the block for incoming payments.
+	The payments are checked against their expiry at the given time and with their balance at the block, so a missed block is checked like it would have been live.
+*/
+func ProcessBlock(client *config.Client, block *types.Block, mode enum.Mode, at time.Time) {
+	payments := repository.Payment.GetOpenByMode(mode)
+	watched := repository.Payment.GetWatched(mode)
+	hash := block.Hash()
+	tokenTransfers, err := bc.GetPaymentTokenTransfers(client, hash, append(append([]model.Payment{}, payments...), watched...))
+	if err != nil {
+		logging.WithBlock(mode, block.Number()).WithError(err).Error("Error in getting token transfers")
+	}
+	for _, p := range payments {
+		for _, value := range getIncomingValues(&p, block, tokenTransfers) {
+			CheckBalanceNotify(&p, value, block.Number(), &hash)
+		}
+		checkPaymentAt(&p, at, block.Number(), &hash, nil)
+
+	}
+	watchLatePayments(client, block, watched, tokenTransfers)
+}
+
+/*
+	Returns the values of the transactions and token transfers of the block to the account of the payment. The sender of the last one is set on the payment.
+	Each value is added as contribution of its sender, so a refund can be split between the senders.
+	A transfer which is already a contribution isn't returned, e.g. when the block is processed again after it couldn't be stored.
+*/
+func getIncomingValues(p *model.Payment, block *types.Block, tokenTransfers []bc.TokenTransfer) []*big.Int {
+	var values []*big.Int
+	if p.IsTokenPayment() {
+		for _, t := range tokenTransfers {
+			if t.Token == common.HexToAddress(p.TokenContract) && t.To == common.HexToAddress(p.Account.Address) {
+				if !p.AddContribution(t.From.Hex(), t.Value, t.TxHash.String(), t.LogIndex, block.NumberU64()) {
+					logging.WithPayment(p).WithFields(logrus.Fields{logging.Block: block.NumberU64(), logging.TxHash: t.TxHash.String()}).Info("Token transfer is already counted")
+					continue
+				}
+				p.SenderAddress = t.From.Hex()
+				values = append(values, t.Value)
+				logging.WithPayment(p).WithFields(logrus.Fields{logging.Block: block.NumberU64(), logging.TxHash: t.TxHash.String(), "value": t.Value.String()}).Info("Incoming token transfer")
+			}
+		}
+		return values
+	}
+	for _, tx := range block.Transactions() {
+		if tx.To() != nil && tx.To().Hex() == p.Account.Address {
+			entry := logging.WithPayment(p).WithFields(logrus.Fields{logging.Block: block.NumberU64(), logging.TxHash: tx.Hash().String()})
+			if sender, err := bc.GetSender(tx); err == nil {
+				if !p.AddContribution(sender.Hex(), tx.Value(), tx.Hash().String(), 0, block.NumberU64()) {
+					entry.Info("Transaction is already counted")
+					continue
+				}
+				p.SenderAddress = sender.Hex()
+			} else {
+				entry.WithError(err).Warn("Unable to get sender")
+			}
+			values = append(values, tx.Value())
+			entry.WithField("value", tx.Value().String()).Info("Incoming transaction")
+		}
+	}
+	return values
+}
+
+/*
+	Returns up to limit headers of the blocks between the last processed block and the header in ascending order.
+	If a header can't be fetched, the headers before it are returned, so they are processed and the rest is fetched again with the next batch.
+*/
+func getMissedHeaders(client *config.Client, header *types.Header, mode enum.Mode, limit int64) ([]*types.Header, error) {
+	latest, err := repository.Block.GetLatest(mode)
+	if err != nil || latest == nil {
+		return nil, err
+	}
+	var headers []*types.Header
+	for nr := big.NewInt(0).Add(&latest.Number.Int, big.NewInt(1)); nr.Cmp(header.Number) < 0 && int64(len(headers)) < limit; nr.Add(nr, big.NewInt(1)) {
+		h, err := client.HeaderByNumber(context.Background(), nr)
+		if err != nil {
+			if len(headers) > 0 {
+				logging.WithBlock(mode, nr).WithError(err).Warn("Error in getting missed header. Process the batch up to it")
+				return headers, nil
+			}
+			return nil, err
+		}
+		headers = append(headers, h)
+	}
+	return headers, nil
+}
+
+/*
+	Walks back from the header over the parent hashes until it reaches a processed block. Returns the headers which aren't processed yet in ascending order.
+	The common ancestor is only returned if processed blocks got orphaned.
+*/
+func getNewCanonicalHeaders(client *config.Client, header *types.Header, mode enum.Mode) ([]*types.Header, *types.Header, error) {
+	latest, err := repository.Block.GetLatest(mode)
+	if err != nil {
+		return nil, nil, err
+	}
+	if latest == nil {
+		return []*types.Header{header}, nil, nil
+	}
+
+	depth := big.NewInt(config.Opts.BlockHistoryDepth)
+	if big.NewInt(0).Sub(header.Number, &latest.Number.Int).Cmp(depth) > 0 {
+		// the missed blocks are backfilled before, so the head can only be this far ahead, if the backfill is skipped
+		logging.WithBlock(mode, header.Number).WithField("processed", latest.Number.Uint64()).Warn("Head is too far ahead of the last processed block. Only the head is processed")
+		return []*types.Header{header}, nil, nil
+	}
+	oldest := big.NewInt(0).Sub(&latest.Number.Int, depth)
+
+	var headers []*types.Header
+	reorganized := false
+	current := header
+	for {
+		processed, err := repository.Block.GetByNumber(mode, current.Number)
+		if err != nil {
+			return nil, nil, err
+		}
+		if processed != nil {
+			if processed.Hash == current.Hash().String() {
+				break
+			}
+			reorganized = true
+		}
+		headers = append([]*types.Header{current}, headers...)
+
+		if current.Number.Cmp(oldest) <= 0 || current.Number.Sign() == 0 {
+			logging.WithBlock(mode, header.Number).WithField("depth", config.Opts.BlockHistoryDepth).Warn("Chain reorganization is deeper than the block history. Only the head is processed")
+			return []*types.Header{header}, nil, nil
+		}
+		current, err = client.HeaderByHash(context.Background(), current.ParentHash)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if reorganized {
+		return headers, current, nil
+	}
+	return headers, nil, nil
+}
+
+/*
+	Resets the payments, which received funds in orphaned blocks, to their balance at the common ancestor.
+	The funds are counted again, when the canonical blocks are processed.
+*/
+func rewindPayments(client *config.Client, mode enum.Mode, ancestor *types.Header) {
+	payments := repository.Payment.GetReceiving(mode)
+	for _, p := range payments {
+		if p.CurrentPaymentState.IsPaid() && p.LastReceivingBlockNr.Cmp(ancestor.Number) <= 0 {
+			continue
+		}
+		balance, err := bc.GetPaymentBalanceAtBlock(client, &p, ancestor.Number)
+		if err != nil {
+			logging.WithPayment(&p).WithField(logging.Block, ancestor.Number.Uint64()).WithError(err).Error("Error by getting balance at block")
+			continue
+		}
+		state := getRewindState(&p, balance)
+		if state == p.CurrentPaymentState.StateID && balance.Cmp(&p.CurrentPaymentState.AmountReceived.Int) == 0 {
+			continue
+		}
+		logging.WithPayment(&p).WithFields(logrus.Fields{logging.Block: ancestor.Number.Uint64(), "from": model.StateName(p.CurrentPaymentState.StateID), "to": model.StateName(state)}).Warn("Rewind payment")
+		p.RemoveContributionsAfter(ancestor.Number.Uint64())
+		if state == enum.Paid {
+			p.LastReceivingBlockNr = model.NewBigInt(ancestor.Number)
+			p.LastReceivingBlockHash = ancestor.Hash().String()
+		} else {
+			p.LastReceivingBlockNr = model.NewBigIntFromInt(0)
+			p.LastReceivingBlockHash = ""
+		}
+		updateState(&p, balance, state)
+	}
+}
+
+func getRewindState(payment *model.Payment, balance *big.Int) enum.State {
+	if payment.IsPaid(balance) {
+		return enum.Paid
+	}
+	if balance.Sign() > 0 {
+		return enum.PartiallyPaid
+	}
+	return enum.Waiting
+}
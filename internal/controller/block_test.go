@@ -0,0 +1,285 @@
+package controller
+
+import (
+	"context"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/repository"
+	"ethereum-service/internal/testutils"
+	"ethereum-service/model"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/google/uuid"
+)
+
+func recordCanonicalBlocks(t *testing.T, client *config.Client, from int64, to int64) {
+	for i := from; i <= to; i++ {
+		header, err := client.HeaderByNumber(context.Background(), big.NewInt(i))
+		if err != nil {
+			t.Fatalf("Unable to get header %v: %v", i, err)
+		}
+		_ = repository.Block.Create(&model.Block{
+			Mode:       enum.Test,
+			Number:     model.NewBigInt(header.Number),
+			Hash:       header.Hash().String(),
+			ParentHash: header.ParentHash.String(),
+		})
+	}
+}
+
+func TestGetNewCanonicalHeadersReorg(t *testing.T) {
+	config.ReadOpts()
+	repository.Block = testutils.NewBlockRepositoryMock()
+	client, insertFork := testutils.NewReorgTestChain(t, 5, 2, 4)
+	recordCanonicalBlocks(t, client, 1, 5)
+
+	fork := insertFork()
+	head := fork[len(fork)-1].Header()
+	headers, ancestor, err := getNewCanonicalHeaders(client, head, enum.Test)
+	if err != nil {
+		t.Fatalf("Unable to get new canonical headers %v", err)
+	}
+	if ancestor == nil || ancestor.Number.Int64() != 2 {
+		t.Fatalf(`Common ancestor is %v, but should be block 2`, ancestor)
+	}
+	if len(headers) != 4 {
+		t.Fatalf(`Got %v new headers, but should be %v`, len(headers), 4)
+	}
+	for i, h := range headers {
+		if h.Hash() != fork[i].Hash() {
+			t.Fatalf(`Header %v is %v, but should be %v`, i, h.Hash(), fork[i].Hash())
+		}
+	}
+}
+
+func TestGetNewCanonicalHeadersWithoutReorg(t *testing.T) {
+	config.ReadOpts()
+	repository.Block = testutils.NewBlockRepositoryMock()
+	client, _ := testutils.NewReorgTestChain(t, 5, 0, 0)
+	recordCanonicalBlocks(t, client, 1, 3)
+
+	head, err := client.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Unable to get head %v", err)
+	}
+	headers, ancestor, err := getNewCanonicalHeaders(client, head, enum.Test)
+	if err != nil {
+		t.Fatalf("Unable to get new canonical headers %v", err)
+	}
+	if ancestor != nil {
+		t.Fatalf(`No common ancestor should be returned without reorganization, got %v`, ancestor.Number)
+	}
+	if len(headers) != 2 || headers[0].Number.Int64() != 4 || headers[1].Number.Int64() != 5 {
+		t.Fatalf(`The blocks 4 and 5 should be returned, got %v headers`, len(headers))
+	}
+
+	recordCanonicalBlocks(t, client, 4, 5)
+	headers, _, err = getNewCanonicalHeaders(client, head, enum.Test)
+	if err != nil {
+		t.Fatalf("Unable to get new canonical headers %v", err)
+	}
+	if len(headers) != 0 {
+		t.Fatalf(`An already processed head shouldn't return headers, got %v`, len(headers))
+	}
+}
+
+func TestGetRewindState(t *testing.T) {
+	payment := model.Payment{}
+	payment.CurrentPaymentState.PayAmount = model.NewBigIntFromInt(100)
+	tests := []struct {
+		balance int64
+		state   enum.State
+	}{
+		{0, enum.Waiting},
+		{50, enum.PartiallyPaid},
+		{100, enum.Paid},
+		{150, enum.Paid},
+	}
+	for _, test := range tests {
+		if state := getRewindState(&payment, big.NewInt(test.balance)); state != test.state {
+			t.Fatalf(`State for balance %v is %v, but should be %v`, test.balance, state, test.state)
+		}
+	}
+}
+
+func TestGetMissedHeaders(t *testing.T) {
+	config.ReadOpts()
+	repository.Block = testutils.NewBlockRepositoryMock()
+	client, _ := testutils.NewReorgTestChain(t, 6, 0, 0)
+
+	head, err := client.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Unable to get head %v", err)
+	}
+	missed, err := getMissedHeaders(client, head, enum.Test, 100)
+	if err != nil {
+		t.Fatalf("Unable to get missed headers %v", err)
+	}
+	if len(missed) != 0 {
+		t.Fatalf(`Without a processed block nothing should be backfilled, got %v headers`, len(missed))
+	}
+
+	recordCanonicalBlocks(t, client, 1, 2)
+	missed, err = getMissedHeaders(client, head, enum.Test, 100)
+	if err != nil {
+		t.Fatalf("Unable to get missed headers %v", err)
+	}
+	if len(missed) != 3 {
+		t.Fatalf(`Got %v missed headers, but should be %v`, len(missed), 3)
+	}
+	for i, h := range missed {
+		if h.Number.Int64() != int64(i+3) {
+			t.Fatalf(`Missed header %v is block %v, but should be %v`, i, h.Number, i+3)
+		}
+	}
+
+	missed, err = getMissedHeaders(client, head, enum.Test, 2)
+	if err != nil {
+		t.Fatalf("Unable to get missed headers %v", err)
+	}
+	if len(missed) != 2 || missed[0].Number.Int64() != 3 || missed[1].Number.Int64() != 4 {
+		t.Fatalf(`A batch of 2 should be the blocks 3 and 4, got %v headers`, len(missed))
+	}
+}
+
+/*
+	Chain with a full payment and the second half of a partial payment in block 3. The fork on top of block 2 removes them.
+	Returns the client, the function which inserts the fork and the payments as they were stored before the reorganization.
+*/
+func setupReorgedPayments(t *testing.T) (*config.Client, func() []*types.Block, model.Payment, model.Payment) {
+	payAmount := big.NewInt(1000000000000000)
+	half := big.NewInt(500000000000000)
+	paid := newReorgPayment(payAmount)
+	partially := newReorgPayment(payAmount)
+	client, insertFork := testutils.NewReorgTestChainWithTransfers(t, 4, 2, 3,
+		testutils.ChainTransfer{Block: 1, To: common.HexToAddress(partially.Account.Address), Value: half},
+		testutils.ChainTransfer{Block: 3, To: common.HexToAddress(paid.Account.Address), Value: payAmount},
+		testutils.ChainTransfer{Block: 3, To: common.HexToAddress(partially.Account.Address), Value: half},
+	)
+	receiving, err := client.HeaderByNumber(context.Background(), big.NewInt(3))
+	if err != nil {
+		t.Fatalf("Unable to get header %v", err)
+	}
+	for _, p := range []*model.Payment{&paid, &partially} {
+		p.UpdatePaymentState(enum.Paid, payAmount)
+		p.LastReceivingBlockNr = model.NewBigInt(receiving.Number)
+		p.LastReceivingBlockHash = receiving.Hash().String()
+	}
+	return client, insertFork, paid, partially
+}
+
+func newReorgPayment(payAmount *big.Int) model.Payment {
+	acc := model.CreateAccount(enum.Test)
+	acc.ID = uuid.New()
+	p := model.Payment{
+		Base:                 model.Base{ID: uuid.New(), CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		Account:              *acc,
+		AccountID:            acc.ID,
+		Mode:                 enum.Test,
+		ForwardingBlockNr:    model.NewBigIntFromInt(0),
+		LastReceivingBlockNr: model.NewBigIntFromInt(0),
+	}
+	p.AddNewPaymentState(enum.Waiting, big.NewInt(0), payAmount)
+	return p
+}
+
+func assertRewound(t *testing.T, payments *testutils.PaymentRepositoryMock, id uuid.UUID, state enum.State, received *big.Int) {
+	p, err := payments.GetByID(id)
+	if err != nil {
+		t.Fatalf("Unable to get payment %v", err)
+	}
+	if p.CurrentPaymentState.StateID != state {
+		t.Fatalf(`Payment is %v, but should be %v`, model.StateName(p.CurrentPaymentState.StateID), model.StateName(state))
+	}
+	if p.CurrentPaymentState.AmountReceived.Cmp(received) != 0 {
+		t.Fatalf(`Received amount is %v, but should be %v`, p.CurrentPaymentState.AmountReceived.String(), received)
+	}
+	if p.LastReceivingBlockNr.Sign() != 0 || p.LastReceivingBlockHash != "" {
+		t.Fatalf(`The receiving block should be reset, got %v %v`, p.LastReceivingBlockNr.String(), p.LastReceivingBlockHash)
+	}
+}
+
+func TestRewindPayments(t *testing.T) {
+	config.ReadOpts()
+	client, insertFork, paid, partially := setupReorgedPayments(t)
+	payments := testutils.NewPaymentRepositoryMock(paid, partially)
+	repository.Payment = payments
+
+	fork := insertFork()
+	ancestor, err := client.HeaderByHash(context.Background(), fork[0].ParentHash())
+	if err != nil {
+		t.Fatalf("Unable to get common ancestor %v", err)
+	}
+	rewindPayments(client, enum.Test, ancestor)
+
+	assertRewound(t, payments, paid.ID, enum.Waiting, big.NewInt(0))
+	assertRewound(t, payments, partially.ID, enum.PartiallyPaid, big.NewInt(500000000000000))
+	if len(payments.Notifications) != 2 {
+		t.Fatalf(`Got %v notifications, but the backend should be notified about both rewound payments`, len(payments.Notifications))
+	}
+}
+
+func TestHandleNewHeadReorg(t *testing.T) {
+	config.ReadOpts()
+	client, insertFork, paid, partially := setupReorgedPayments(t)
+	payments := testutils.NewPaymentRepositoryMock(paid, partially)
+	repository.Payment = payments
+	repository.Block = testutils.NewBlockRepositoryMock()
+	repository.OutgoingTransaction = testutils.NewOutgoingTransactionRepositoryMock()
+	recordCanonicalBlocks(t, client, 1, 4)
+	var processed []uint64
+	OnBlockProcessed(func(mode enum.Mode, number *big.Int) {
+		processed = append(processed, number.Uint64())
+	})
+
+	fork := insertFork()
+	head := fork[len(fork)-1].Header()
+	HandleNewHead(client, head, enum.Test)
+	if len(processed) != 3 || processed[0] != 3 || processed[2] != 5 {
+		t.Fatalf(`The blocks 3 to 5 of the fork should be reported as processed, got %v`, processed)
+	}
+
+	assertRewound(t, payments, paid.ID, enum.Waiting, big.NewInt(0))
+	assertRewound(t, payments, partially.ID, enum.PartiallyPaid, big.NewInt(500000000000000))
+	latest, err := repository.Block.GetLatest(enum.Test)
+	if err != nil || latest == nil {
+		t.Fatalf("Unable to get latest block %v", err)
+	}
+	if latest.Hash != head.Hash().String() {
+		t.Fatalf(`Latest processed block is %v, but should be the head of the fork %v`, latest.Hash, head.Hash())
+	}
+	for i := int64(3); i <= 4; i++ {
+		block, _ := repository.Block.GetByNumber(enum.Test, big.NewInt(i))
+		if block == nil || block.Hash != fork[i-3].Hash().String() {
+			t.Fatalf(`Block %v should be replaced by the block of the fork`, i)
+		}
+	}
+}
+
+func TestGetIncomingValuesCountsTransferOnce(t *testing.T) {
+	config.ReadOpts()
+	payAmount := big.NewInt(1000000000000000)
+	p := newReorgPayment(payAmount)
+	client, _ := testutils.NewReorgTestChainWithTransfers(t, 2, 1, 1,
+		testutils.ChainTransfer{Block: 1, To: common.HexToAddress(p.Account.Address), Value: payAmount},
+	)
+	block, err := client.BlockByNumber(context.Background(), big.NewInt(1))
+	if err != nil {
+		t.Fatalf("Unable to get block %v", err)
+	}
+
+	if values := getIncomingValues(&p, block, nil); len(values) != 1 || values[0].Cmp(payAmount) != 0 {
+		t.Fatalf(`Incoming values are %v, but should be %v`, values, payAmount)
+	}
+	// the block is processed again, e.g. because it couldn't be stored the first time
+	if values := getIncomingValues(&p, block, nil); len(values) != 0 {
+		t.Fatalf(`The transfer was counted again: %v`, values)
+	}
+	if len(p.Contributions) != 1 {
+		t.Fatalf(`Got %v contributions, but the transfer should be added once`, len(p.Contributions))
+	}
+}
@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"ethereum-service/internal/bc"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/logging"
+	"ethereum-service/internal/repository"
+	"ethereum-service/model"
+	"math/big"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	The account of an expired, cancelled or refunded payment isn't released immediately, because a shopper can still send the funds after the expiry.
+	Until WatchedUntil, incoming funds are recorded against the ended payment. When the grace period is over, late funds are refunded
+	and the account is released.
+*/
+func watchLatePayments(client *config.Client, block *types.Block, watched []model.Payment, tokenTransfers []bc.TokenTransfer) {
+	hash := block.Hash()
+	for i := range watched {
+		p := &watched[i]
+		if len(getIncomingValues(p, block, tokenTransfers)) > 0 {
+			handleLatePayment(client, p, block.Number(), &hash)
+		} else if p.WatchedUntil.Before(time.Now()) {
+			endLatePaymentWatch(client, p)
+		}
+	}
+}
+
+/*
+	Keeps the account of the ending payment used for LatePaymentGracePeriod seconds, so late funds are recorded against it.
+	Returns false without a grace period, then the account has to be released right away.
+*/
+func startLatePaymentWatch(payment *model.Payment) bool {
+	if config.Opts.LatePaymentGracePeriod <= 0 {
+		return false
+	}
+	watchedUntil := time.Now().Add(time.Duration(config.Opts.LatePaymentGracePeriod) * time.Second)
+	payment.WatchedUntil = &watchedUntil
+	return true
+}
+
+/*
+	Releases the account of the refunded payment or watches it for late payments first, like the account of a cancelled or expired one.
+	The balance on the address becomes the remainder either way, so only new funds count as late payment. The senders of the refunded funds are forgotten,
+	so late funds are refunded to their own sender and not to the original payers. The refund of late funds releases the account right away.
+*/
+func releaseOrWatch(client *config.Client, payment *model.Payment) {
+	if payment.CurrentPaymentState.StateID == model.LatePaid || !startLatePaymentWatch(payment) {
+		releaseAccount(client, payment)
+		return
+	}
+	payment.Contributions = nil
+	payment.SenderAddress = ""
+	writeRemainder(client, payment)
+}
+
+/*
+	Funds arrived on the account of an expired payment. If they cover the pay amount and reopening is enabled, the payment continues as paid.
+	Otherwise they are recorded as late paid.
+*/
+func handleLatePayment(client *config.Client, payment *model.Payment, blockNr *big.Int, blockHash *common.Hash) {
+	received, err := bc.GetPaymentBalanceAt(client, payment)
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Error in getting late payment")
+		return
+	}
+	entry := logging.WithPayment(payment).WithField("received", received.String())
+	if blockNr != nil {
+		entry = entry.WithField(logging.Block, blockNr.Uint64())
+	}
+	entry.Info("Late payment for expired payment")
+	// a cancelled payment isn't reopened, the shopper abandoned it
+	if config.Opts.LatePaymentReopen && payment.CurrentPaymentState.StateID == enum.Expired && payment.IsPaid(received) {
+		payment.WatchedUntil = nil
+		Pay(payment, received, blockNr, blockHash)
+		return
+	}
+	updateState(payment, received, model.LatePaid)
+}
+
+/*
+	The grace period of the expired payment is over. Late funds are refunded to the sender, otherwise the account is released.
+	Late funds without a known sender stay on the address as remainder.
+*/
+func endLatePaymentWatch(client *config.Client, payment *model.Payment) {
+	received, err := bc.GetPaymentBalanceAt(client, payment)
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Warn("Error in getting late payment. Try again next block")
+		return
+	}
+	payment.WatchedUntil = nil
+	if received.Sign() > 0 && payment.SenderAddress != "" {
+		logging.WithPayment(payment).WithFields(logrus.Fields{"received": received.String(), "sender": payment.SenderAddress}).Info("Late payment is refunded")
+		payment.RefundStatus = model.RefundOpen
+		repository.Payment.UpdatePaymentState(payment)
+		return
+	}
+	releaseAccount(client, payment)
+	repository.Payment.UpdatePaymentState(payment)
+}
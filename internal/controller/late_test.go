@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"context"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/repository"
+	"ethereum-service/internal/testutils"
+	"ethereum-service/model"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+)
+
+func TestLatePaymentReopensPayment(t *testing.T) {
+	config.ReadOpts()
+	mock, gormDb := testutils.NewMock()
+	repository.InitPayment(gormDb)
+	p := testutils.GetExpiredPayment()
+	watchedUntil := time.Now().Add(time.Hour)
+	p.WatchedUntil = &watchedUntil
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	amount := &p.CurrentPaymentState.PayAmount.Int
+	mock = testutils.SetupUpdatePaymentStateToPaid(mock, amount)
+	tx := testutils.CreateInitialPayment(client, genesisAcc, amount, p.Account.Address)
+	if _, err := bind.WaitMined(context.Background(), client, tx); err != nil {
+		t.Fatalf("Can't wait until transaction is mined %v", err)
+	}
+
+	handleLatePayment(client, &p, nil, nil)
+	if p.CurrentPaymentState.StateID != enum.Paid {
+		t.Fatalf("Payment is in the wrong state. Payment is \"%v\", but should be \"%v\"", model.StateName(p.CurrentPaymentState.StateID), enum.Paid.String())
+	}
+	if p.WatchedUntil != nil {
+		t.Fatalf("The reopened payment is still watched until %v", p.WatchedUntil)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLatePaymentIsRefunded(t *testing.T) {
+	config.ReadOpts()
+	mock, gormDb := testutils.NewMock()
+	repository.InitPayment(gormDb)
+	p := testutils.GetExpiredPayment()
+	watchedUntil := time.Now().Add(time.Hour)
+	p.WatchedUntil = &watchedUntil
+	p.SenderAddress = model.CreateAccount(enum.Main).Address
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	received := big.NewInt(0).Div(&p.CurrentPaymentState.PayAmount.Int, big.NewInt(2))
+	mock = testutils.SetupLatePayment(mock, p, received)
+	tx := testutils.CreateInitialPayment(client, genesisAcc, received, p.Account.Address)
+	if _, err := bind.WaitMined(context.Background(), client, tx); err != nil {
+		t.Fatalf("Can't wait until transaction is mined %v", err)
+	}
+
+	handleLatePayment(client, &p, nil, nil)
+	if p.CurrentPaymentState.StateID != model.LatePaid || p.WatchedUntil == nil {
+		t.Fatalf("Payment is in the wrong state. Payment is \"%v\", but should be \"%v\"", model.StateName(p.CurrentPaymentState.StateID), model.StateName(model.LatePaid))
+	}
+
+	// the grace period is over, the genesis block has no incoming funds
+	over := time.Now().Add(-time.Minute)
+	p.WatchedUntil = &over
+	genesis, err := client.BlockByNumber(context.Background(), big.NewInt(0))
+	if err != nil {
+		t.Fatalf("Unable to get block %v", err)
+	}
+	watched := []model.Payment{p}
+	watchLatePayments(client, genesis, watched, nil)
+	if watched[0].RefundStatus != model.RefundOpen || watched[0].WatchedUntil != nil || !watched[0].Account.Used {
+		t.Fatalf("The late payment should be refunded, but refund is \"%v\" and watched until %v", watched[0].RefundStatus, watched[0].WatchedUntil)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"context"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/logging"
+	"ethereum-service/internal/metrics"
+	"ethereum-service/internal/repository"
+	"ethereum-service/internal/service"
+	"ethereum-service/model"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// notificationBatchSize notifications which are delivered in one run of the dispatcher
+const notificationBatchSize = 100
+
+// dispatcherWakeup starts the next run of the dispatcher before the interval is over, e.g. after a new state
+var dispatcherWakeup = make(chan struct{}, 1)
+
+func wakeDispatcher() {
+	select {
+	case dispatcherWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// RunNotificationDispatcher
+/*
+	Delivers the notifications of the outbox to the backend every NotificationInterval seconds and after every new state, until the context is cancelled.
+*/
+func RunNotificationDispatcher(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(config.Opts.NotificationInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		for DispatchNotifications() > 0 {
+			// the next notifications of the delivered payments are due right away
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-dispatcherWakeup:
+		}
+	}
+}
+
+// DispatchNotifications
+/*
+	Delivers the due notifications. Only the oldest undelivered notification of a payment is due, so the backend gets the states of a payment in order.
+	The notifications after a dead one wait until it is replayed.
+	Returns the number of delivered notifications.
+*/
+func DispatchNotifications() int {
+	delivered := 0
+	for _, n := range repository.Notification.GetDue(time.Now(), notificationBatchSize) {
+		if deliverNotification(&n) {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+/*
+	Sends the notification to the backend. If it fails, it is tried again with exponential backoff until it is dead after NotificationMaxAttempts.
+*/
+func deliverNotification(n *model.Notification) bool {
+	err := service.SendState(n.PaymentID, n.PayCurrency, n.GetPaymentState(), n.TxHash)
+	n.Attempts++
+	if err == nil {
+		now := time.Now()
+		n.Status = model.NotificationDelivered
+		n.DeliveredAt = &now
+	} else if int64(n.Attempts) >= config.Opts.NotificationMaxAttempts {
+		logrus.WithFields(logrus.Fields{logging.PaymentID: n.PaymentID.String(), "notification": n.ID.String(), "attempts": n.Attempts}).WithError(err).Error("Notification is dead")
+		n.Status = model.NotificationDead
+		n.LastError = err.Error()
+		metrics.NotificationFailed(true)
+	} else {
+		n.NextAttemptAt = time.Now().Add(notificationBackoff(n.Attempts))
+		n.LastError = err.Error()
+		metrics.NotificationFailed(false)
+	}
+	if err := repository.Notification.Update(n); err != nil {
+		logrus.WithFields(logrus.Fields{logging.PaymentID: n.PaymentID.String(), "notification": n.ID.String()}).WithError(err).Error("Couldn't write notification")
+	}
+	return err == nil
+}
+
+func notificationBackoff(attempts int) time.Duration {
+	backoff := time.Duration(config.Opts.NotificationInterval) * time.Second
+	maxBackoff := time.Duration(config.Opts.NotificationMaxBackoff) * time.Second
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+// ReplayNotifications
+/*
+	Queues the dead notifications of the payment again, e.g. after the backend was fixed. They are delivered in their original order, followed by the notifications which waited behind them.
+*/
+func ReplayNotifications(paymentID uuid.UUID) ([]model.Notification, error) {
+	if _, err := repository.Payment.GetByID(paymentID); err != nil {
+		return nil, err
+	}
+	notifications := repository.Notification.GetByPayment(paymentID, model.NotificationDead)
+	for i := range notifications {
+		n := &notifications[i]
+		n.Status = model.NotificationPending
+		n.Attempts = 0
+		n.NextAttemptAt = time.Now()
+		if err := repository.Notification.Update(n); err != nil {
+			return nil, err
+		}
+	}
+	wakeDispatcher()
+	return notifications, nil
+}
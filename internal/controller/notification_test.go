@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/repository"
+	"ethereum-service/internal/testutils"
+	"ethereum-service/model"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"gopkg.in/h2non/gock.v1"
+)
+
+func TestDispatchNotificationsInOrder(t *testing.T) {
+	config.ReadOpts()
+	defer gock.Off() // Flush pending mocks after test execution
+	notifications := testutils.NewNotificationRepositoryMock()
+	repository.Notification = notifications
+	p := testutils.GetWaitingPayment()
+	partiallyPaid := model.NewNotification(&p, p.UpdatePaymentState(enum.PartiallyPaid, big.NewInt(10)), "")
+	partiallyPaid.CreatedAt = time.Now().Add(-time.Minute)
+	paid := model.NewNotification(&p, p.UpdatePaymentState(enum.Paid, &p.CurrentPaymentState.PayAmount.Int), "")
+	paid.CreatedAt = time.Now()
+	notifications.Add(partiallyPaid)
+	notifications.Add(paid)
+
+	// the backend is unreachable, the later state waits for the earlier one
+	gock.New("http://localhost:8000").
+		Put("/api/internal/payment/webhook").
+		Reply(500)
+	if delivered := DispatchNotifications(); delivered != 0 {
+		t.Fatalf("No notification should be delivered, but %v were", delivered)
+	}
+	first := notifications.Get(partiallyPaid.ID)
+	if first.Status != model.NotificationPending || first.Attempts != 1 || !first.NextAttemptAt.After(time.Now()) {
+		t.Fatalf("The failed notification should be retried later, but is \"%v\" after %v attempts at %v", first.Status, first.Attempts, first.NextAttemptAt)
+	}
+	if second := notifications.Get(paid.ID); second.Attempts != 0 {
+		t.Fatalf("The later notification was sent before the earlier one")
+	}
+
+	// the backend is reachable again
+	first.NextAttemptAt = time.Now()
+	notifications.Update(&first)
+	gock.New("http://localhost:8000").
+		Put("/api/internal/payment/webhook").
+		Times(2).
+		Reply(200)
+	for DispatchNotifications() > 0 {
+	}
+	for _, n := range []*model.Notification{partiallyPaid, paid} {
+		if stored := notifications.Get(n.ID); stored.Status != model.NotificationDelivered {
+			t.Fatalf("Notification of state %v should be delivered, but is \"%v\"", model.StateName(stored.StateID), stored.Status)
+		}
+	}
+	if !gock.IsDone() {
+		t.Fatalf("Both notifications should have been sent, but there are open requests")
+	}
+}
+
+func TestDispatchNotificationsDeadLetter(t *testing.T) {
+	config.ReadOpts()
+	defer gock.Off() // Flush pending mocks after test execution
+	notifications := testutils.NewNotificationRepositoryMock()
+	repository.Notification = notifications
+	mock, gormDb := testutils.NewMock()
+	repository.InitPayment(gormDb)
+	p := testutils.GetPaidPayment()
+	n := model.NewNotification(&p, p.CurrentPaymentState, "")
+	n.CreatedAt = time.Now().Add(-time.Minute)
+	n.Attempts = int(config.Opts.NotificationMaxAttempts) - 1
+	notifications.Add(n)
+	later := model.NewNotification(&p, p.UpdatePaymentState(enum.Confirmed, &p.CurrentPaymentState.AmountReceived.Int), "")
+	later.CreatedAt = time.Now()
+	notifications.Add(later)
+
+	gock.New("http://localhost:8000").
+		Put("/api/internal/payment/webhook").
+		Reply(500)
+	DispatchNotifications()
+	if dead := notifications.Get(n.ID); dead.Status != model.NotificationDead || dead.LastError == "" {
+		t.Fatalf("Notification should be dead after %v attempts, but is \"%v\"", dead.Attempts, dead.Status)
+	}
+	// the backend is reachable again, but the later state waits behind the dead one
+	gock.New("http://localhost:8000").
+		Put("/api/internal/payment/webhook").
+		Times(2).
+		Reply(200)
+	if delivered := DispatchNotifications(); delivered != 0 {
+		t.Fatalf("The notification after a dead one shouldn't be delivered, but %v were", delivered)
+	}
+
+	mock = testutils.SetupGetPaymentByID(mock, p)
+	replayed, err := ReplayNotifications(p.ID)
+	if err != nil {
+		t.Fatalf("Unable to replay notifications %v", err)
+	}
+	if stored := notifications.Get(n.ID); len(replayed) != 1 || stored.Status != model.NotificationPending || stored.Attempts != 0 {
+		t.Fatalf("The dead notification should be pending again, but is \"%v\" after %v attempts", stored.Status, stored.Attempts)
+	}
+	for DispatchNotifications() > 0 {
+	}
+	for _, notification := range []*model.Notification{n, later} {
+		if stored := notifications.Get(notification.ID); stored.Status != model.NotificationDelivered {
+			t.Fatalf("Notification of state %v should be delivered after the replay, but is \"%v\"", model.StateName(stored.StateID), stored.Status)
+		}
+	}
+	if !gock.IsDone() {
+		t.Fatalf("Both notifications should have been sent, but there are open requests")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
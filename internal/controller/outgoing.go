@@ -0,0 +1,488 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"ethereum-service/internal/bc"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/logging"
+	"ethereum-service/internal/metrics"
+	"ethereum-service/internal/repository"
+	"ethereum-service/model"
+	"math/big"
+	"sync"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+)
+
+var trackingLock sync.Mutex
+
+// outgoingRecorder records the transactions of a payment. A transaction which is signed again (e.g. with a new nonce) updates its record.
+type outgoingRecorder struct {
+	payment *model.Payment
+	txs     map[recordKey]*model.OutgoingTransaction
+}
+
+// recordKey a payment can have several transactions of a kind to different recipients, e.g. the refunds to each sender
+type recordKey struct {
+	kind      model.OutgoingTransactionKind
+	recipient common.Address
+}
+
+func newOutgoingRecorder(payment *model.Payment) *outgoingRecorder {
+	return &outgoingRecorder{payment: payment, txs: make(map[recordKey]*model.OutgoingTransaction)}
+}
+
+func (r *outgoingRecorder) Record(tx *types.Transaction, kind model.OutgoingTransactionKind, fees *bc.Fees) error {
+	logging.WithPayment(r.payment).WithFields(logrus.Fields{logging.TxHash: tx.Hash().String(), "kind": string(kind), "fees": fees.String()}).Info("Record outgoing transaction")
+	recipient, err := bc.GetTransferRecipient(tx)
+	if err != nil {
+		return err
+	}
+	key := recordKey{kind: kind, recipient: recipient}
+	outgoing, ok := r.txs[key]
+	if !ok {
+		outgoing = &model.OutgoingTransaction{
+			Mode:        r.payment.Mode,
+			PaymentID:   &r.payment.ID,
+			Payment:     r.payment,
+			AccountID:   &r.payment.Account.ID,
+			Account:     &r.payment.Account,
+			Kind:        kind,
+			Status:      model.TxSigned,
+			FromAddress: r.payment.Account.Address,
+		}
+		if kind == model.GasFunding {
+			// the gas station isn't an account of the service
+			sender, err := bc.GetSender(tx)
+			if err != nil {
+				return err
+			}
+			outgoing.AccountID = nil
+			outgoing.Account = nil
+			outgoing.FromAddress = sender.Hex()
+		}
+	}
+	if err := outgoing.SetTransaction(tx); err != nil {
+		return err
+	}
+	outgoing.BaseFee = model.NewBigInt(fees.BaseFee)
+	if ok {
+		return repository.OutgoingTransaction.Update(outgoing)
+	}
+	if err := repository.OutgoingTransaction.Create(outgoing); err != nil {
+		return err
+	}
+	r.txs[key] = outgoing
+	return nil
+}
+
+/*
+	A transaction which the node rejected is marked as failed, so it isn't broadcast again and the payment doesn't continue with it.
+	After a connection error the transaction stays signed, the tracker broadcasts it again.
+*/
+func (r *outgoingRecorder) Sent(tx *types.Transaction, err error) {
+	var outgoing *model.OutgoingTransaction
+	for _, o := range r.txs {
+		if o.Hash == tx.Hash().String() {
+			outgoing = o
+		}
+	}
+	if outgoing == nil {
+		return
+	}
+	switch {
+	case err == nil:
+		outgoing.Status = model.TxSent
+		outgoing.Error = ""
+	case bc.IsRejected(err):
+		logging.WithOutgoing(outgoing).WithError(err).Warn("Outgoing transaction was rejected")
+		outgoing.Status = model.TxFailed
+		outgoing.Error = err.Error()
+	default:
+		logging.WithOutgoing(outgoing).WithError(err).Warn("Unable to send outgoing transaction. The tracker broadcasts it again")
+		outgoing.Error = err.Error()
+	}
+	if err := repository.OutgoingTransaction.Update(outgoing); err != nil {
+		logging.WithOutgoing(outgoing).WithError(err).Error("Couldn't write outgoing transaction to database")
+	}
+}
+
+// isRecorded a transaction of the kind is recorded and wasn't rejected, it may still wait to be broadcast
+func (r *outgoingRecorder) isRecorded(kind model.OutgoingTransactionKind) bool {
+	for key, outgoing := range r.txs {
+		if key.kind == kind && outgoing.Status != model.TxFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// isSent a transaction of the kind was accepted by the node
+func (r *outgoingRecorder) isSent(kind model.OutgoingTransactionKind) bool {
+	for key, outgoing := range r.txs {
+		if key.kind == kind && outgoing.Status == model.TxSent {
+			return true
+		}
+	}
+	return false
+}
+
+// TrackOutgoingTransactions
+/*
+	Follows the recorded transactions until they are confirmed. Transactions which the node doesn't know are broadcast again.
+	When the forward of a payment is mined, the payment is forwarded and the earnings are sent. When a gas funding is mined, the forward which waits for it is sent.
+*/
+func TrackOutgoingTransactions(client *config.Client, currentBlockNr *big.Int, mode enum.Mode, blockHash *common.Hash) {
+	trackingLock.Lock()
+	defer trackingLock.Unlock()
+	txs := repository.OutgoingTransaction.GetOpen(mode)
+	for i := range txs {
+		trackOutgoingTransaction(client, &txs[i], currentBlockNr, blockHash)
+	}
+}
+
+func trackOutgoingTransaction(client *config.Client, outgoing *model.OutgoingTransaction, currentBlockNr *big.Int, blockHash *common.Hash) {
+	tx, err := outgoing.GetTransaction()
+	if err != nil {
+		logging.WithOutgoing(outgoing).WithError(err).Error("Unable to decode outgoing transaction")
+		return
+	}
+	tx, receipt, err := getMinedTransaction(client, outgoing, tx)
+	if errors.Is(err, ethereum.NotFound) {
+		if outgoing.Status == model.TxMined {
+			logging.WithOutgoing(outgoing).Warn("Outgoing transaction isn't mined anymore. Potential reverted block")
+			outgoing.Status = model.TxSent
+		}
+		rebroadcast(client, outgoing, tx, currentBlockNr, blockHash)
+		return
+	}
+	if err != nil {
+		logging.WithOutgoing(outgoing).WithError(err).Warn("Error in getting receipt. Try again next block")
+		return
+	}
+	if receipt.Status == types.ReceiptStatusFailed {
+		failOutgoingTransaction(client, outgoing, bc.BlockFailed.Error(), currentBlockNr, blockHash)
+		return
+	}
+
+	if outgoing.Status != model.TxMined {
+		fee, err := bc.GetPaidFee(client, tx, receipt)
+		if err != nil {
+			logging.WithOutgoing(outgoing).WithError(err).Error("Unable to get fee")
+			return
+		}
+		outgoing.SetMined(receipt.BlockNumber, fee)
+		if err = repository.OutgoingTransaction.Update(outgoing); err != nil {
+			logging.WithOutgoing(outgoing).WithError(err).Error("Couldn't write outgoing transaction to database")
+			return
+		}
+		metrics.OutgoingMined(outgoing.Mode, outgoing.Kind, receipt.GasUsed, fee)
+		handleMinedTransaction(client, outgoing)
+		return
+	}
+
+	hasEnoughConfirmations := big.NewInt(0).Add(receipt.BlockNumber, big.NewInt(config.Opts.OutgoingTxConfirmations)).Cmp(currentBlockNr) <= 0
+	if hasEnoughConfirmations {
+		outgoing.Status = model.TxConfirmed
+		if err = repository.OutgoingTransaction.Update(outgoing); err != nil {
+			logging.WithOutgoing(outgoing).WithError(err).Error("Couldn't write outgoing transaction to database")
+		}
+	}
+}
+
+/*
+	Returns the receipt of the transaction. If the transaction was replaced, a replaced transaction can be mined instead. It becomes the transaction of the record then.
+*/
+func getMinedTransaction(client *config.Client, outgoing *model.OutgoingTransaction, tx *types.Transaction) (*types.Transaction, *types.Receipt, error) {
+	receipt, err := client.TransactionReceipt(context.Background(), tx.Hash())
+	if !errors.Is(err, ethereum.NotFound) {
+		return tx, receipt, err
+	}
+	replacedTxs, decodeErr := outgoing.GetReplacedTransactions()
+	if decodeErr != nil {
+		logging.WithOutgoing(outgoing).WithError(decodeErr).Error("Unable to decode replaced transactions")
+		return tx, nil, err
+	}
+	for _, replacedTx := range replacedTxs {
+		replacedReceipt, replacedErr := client.TransactionReceipt(context.Background(), replacedTx.Hash())
+		if replacedErr != nil {
+			continue
+		}
+		logging.WithOutgoing(outgoing).WithField("replaced_tx_hash", replacedTx.Hash().String()).Info("Replaced transaction was mined")
+		if replacedErr = outgoing.SetTransaction(replacedTx); replacedErr != nil {
+			return tx, nil, replacedErr
+		}
+		return replacedTx, replacedReceipt, nil
+	}
+	return tx, nil, err
+}
+
+/*
+	Sends the transaction again, if the node doesn't know it (e.g. after a crash before it was sent or when it was dropped).
+	A transaction which is pending for FeeBumpBlocks is replaced with higher fees. After MaxBroadcastAttempts failed broadcasts in a row the transaction fails.
+*/
+func rebroadcast(client *config.Client, outgoing *model.OutgoingTransaction, tx *types.Transaction, currentBlockNr *big.Int, blockHash *common.Hash) {
+	_, _, err := client.TransactionByHash(context.Background(), tx.Hash())
+	if err == nil {
+		if outgoing.GetPendingBlocks(currentBlockNr).Cmp(big.NewInt(config.Opts.FeeBumpBlocks)) >= 0 {
+			bumpFee(client, outgoing, tx, currentBlockNr)
+			return
+		}
+		if outgoing.Status == model.TxSigned || outgoing.SentBlockNr == nil || outgoing.SentBlockNr.Sign() == 0 {
+			outgoing.Status = model.TxSent
+			outgoing.SentBlockNr = model.NewBigInt(currentBlockNr)
+			if err = repository.OutgoingTransaction.Update(outgoing); err != nil {
+				logging.WithOutgoing(outgoing).WithError(err).Error("Couldn't write outgoing transaction to database")
+			}
+		}
+		return
+	}
+
+	err = bc.Broadcast(client, tx)
+	if bc.IsNonceUsed(err) {
+		failOutgoingTransaction(client, outgoing, err.Error(), currentBlockNr, blockHash)
+		return
+	}
+	if err != nil {
+		outgoing.BroadcastAttempts++
+		if outgoing.BroadcastAttempts >= config.Opts.MaxBroadcastAttempts {
+			failOutgoingTransaction(client, outgoing, err.Error(), currentBlockNr, blockHash)
+			return
+		}
+		logging.WithOutgoing(outgoing).WithError(err).WithField("attempts", outgoing.BroadcastAttempts).Warn("Unable to broadcast. Try again next block")
+		outgoing.Error = err.Error()
+	} else {
+		logging.WithOutgoing(outgoing).WithField(logging.Block, currentBlockNr.Uint64()).Info("Outgoing transaction broadcast")
+		outgoing.Status = model.TxSent
+		outgoing.SentBlockNr = model.NewBigInt(currentBlockNr)
+		outgoing.BroadcastAttempts = 0
+		outgoing.Error = ""
+	}
+	if err = repository.OutgoingTransaction.Update(outgoing); err != nil {
+		logging.WithOutgoing(outgoing).WithError(err).Error("Couldn't write outgoing transaction to database")
+	}
+}
+
+/*
+	Replaces the pending transaction with the same nonce and higher fees. The replacement is recorded before it is sent.
+	If the fee can't be bumped (e.g. the maximal fee cap is reached), it is tried again after another FeeBumpBlocks.
+	The fee of a token transfer is bumped with the next block after the gas funding for it is mined.
+*/
+func bumpFee(client *config.Client, outgoing *model.OutgoingTransaction, tx *types.Transaction, currentBlockNr *big.Int) {
+	if outgoing.Account == nil {
+		logging.WithOutgoing(outgoing).Warn("Outgoing transaction has no account, fee can't be bumped")
+		return
+	}
+	var fund bc.Recorder
+	if outgoing.Payment != nil {
+		if isGasFundingPending(outgoing.Payment) {
+			return
+		}
+		fund = newOutgoingRecorder(outgoing.Payment)
+	}
+	replacement, err := bc.BumpFee(client, outgoing.Account, tx, func(replacement *types.Transaction, fees *bc.Fees) error {
+		if err := outgoing.Replace(replacement); err != nil {
+			return err
+		}
+		outgoing.BaseFee = model.NewBigInt(fees.BaseFee)
+		outgoing.Status = model.TxSent
+		outgoing.SentBlockNr = model.NewBigInt(currentBlockNr)
+		outgoing.Error = ""
+		return repository.OutgoingTransaction.Update(outgoing)
+	}, fund)
+	if errors.Is(err, bc.GasFundingPending) {
+		logging.WithOutgoing(outgoing).Info("Fee is bumped after the gas funding is mined")
+		return
+	}
+	if err != nil {
+		logging.WithOutgoing(outgoing).WithError(err).Warn("Unable to bump fee")
+		outgoing.Error = err.Error()
+		outgoing.SentBlockNr = model.NewBigInt(currentBlockNr)
+		if err = repository.OutgoingTransaction.Update(outgoing); err != nil {
+			logging.WithOutgoing(outgoing).WithError(err).Error("Couldn't write outgoing transaction to database")
+		}
+		return
+	}
+	logging.WithOutgoing(outgoing).WithFields(logrus.Fields{"replaced_tx_hash": tx.Hash().String(), "fee_cap": replacement.GasFeeCap().String()}).Info("Outgoing transaction replaced")
+
+	payment := outgoing.Payment
+	if outgoing.Kind == model.Forward && payment != nil {
+		payment.ForwardingTransactionHash = outgoing.Hash
+		repository.Payment.UpdatePaymentState(payment)
+	}
+}
+
+func handleMinedTransaction(client *config.Client, outgoing *model.OutgoingTransaction) {
+	payment := outgoing.Payment
+	if payment == nil {
+		return
+	}
+	account := &payment.Account
+	switch outgoing.Kind {
+	case model.Forward:
+		balance, err := bc.GetBalanceAt(client, common.HexToAddress(account.Address))
+		if err != nil {
+			logging.WithPayment(payment).WithError(err).Error("Unable to get balance of chaingate wallet")
+			return
+		}
+		account.Remainder = model.NewBigInt(balance)
+		// account needs to explicit be updated, because the payment alone isn't enough. GORM tries to create a new one and fails.
+		if err := repository.Account.Update(account); err != nil {
+			logging.WithPayment(payment).WithError(err).Error("Couldn't write wallet to database")
+		}
+		payment.ForwardingTransactionHash = outgoing.Hash
+		if updateState(payment, nil, enum.Forwarded) != nil {
+			return
+		}
+		if payment.IsTokenPayment() {
+			// the token earnings are sent together with the forward
+			return
+		}
+		if isRefundPending(payment) {
+			// the balance still contains the refund, the earnings are checked when it is mined
+			return
+		}
+		checkForwardEarnings(client, payment)
+	case model.Refund:
+		if payment.RefundStatus == model.RefundSent {
+			if !isRefundPending(payment) {
+				// the refunds to all senders are mined
+				refunded(client, payment)
+			}
+			return
+		}
+		overpaymentRefunded(client, payment)
+	case model.GasFunding:
+		// a forward which waited for the gas is sent now, refunds and replacements are sent again with the next block
+		if payment.CurrentPaymentState.StateID == enum.Paid {
+			confirm(client, payment)
+		}
+	case model.Earnings:
+		remainder := big.NewInt(0).Sub(&account.Remainder.Int, outgoing.GetFee())
+		if !payment.IsTokenPayment() {
+			remainder.Sub(remainder, &outgoing.Value.Int)
+		}
+		account.Remainder = model.NewBigInt(remainder)
+		if err := repository.Account.Update(account); err != nil {
+			logging.WithPayment(payment).WithError(err).Error("Couldn't write wallet to database")
+		}
+	}
+}
+
+/*
+	The overpayment of a paid payment is refunded or stays on the address. If the forward is already mined, the balance is taken as remainder
+	and the ETH earnings are forwarded, otherwise this happens when the forward is mined.
+*/
+func overpaymentRefunded(client *config.Client, payment *model.Payment) {
+	if !isForwardMined(payment) {
+		return
+	}
+	account := &payment.Account
+	balance, err := bc.GetBalanceAt(client, common.HexToAddress(account.Address))
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Unable to get balance of chaingate wallet")
+		return
+	}
+	account.Remainder = model.NewBigInt(balance)
+	if err := repository.Account.Update(account); err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Couldn't write wallet to database")
+	}
+	if !payment.IsTokenPayment() {
+		checkForwardEarnings(client, payment)
+	}
+}
+
+func checkForwardEarnings(client *config.Client, payment *model.Payment) {
+	account := &payment.Account
+	forwarded, _ := bc.CheckForwardEarnings(client, account, newOutgoingRecorder(payment))
+	if forwarded {
+		if err := repository.Account.Update(account); err != nil {
+			logging.WithPayment(payment).WithError(err).Error("Couldn't write wallet to database")
+		}
+	}
+}
+
+/*
+	A refund is pending until all refunds of the payment are mined. A failed refund which waits to be sent again is pending as well.
+*/
+func isRefundPending(payment *model.Payment) bool {
+	if payment.RefundStatus == model.RefundOpen {
+		return true
+	}
+	refunds, err := repository.OutgoingTransaction.GetAllActiveByPayment(payment.ID, model.Refund)
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Error in getting refund")
+		return true
+	}
+	for _, refund := range refunds {
+		if refund.Status != model.TxMined && refund.Status != model.TxConfirmed {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Transactions which need the gas of a funding wait until it is mined, so the gas station doesn't fund the address twice.
+*/
+func isGasFundingPending(payment *model.Payment) bool {
+	fundings, err := repository.OutgoingTransaction.GetAllActiveByPayment(payment.ID, model.GasFunding)
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Error in getting gas funding")
+		return true
+	}
+	for _, funding := range fundings {
+		if funding.Status == model.TxSigned || funding.Status == model.TxSent {
+			return true
+		}
+	}
+	return false
+}
+
+func isForwardMined(payment *model.Payment) bool {
+	forward, err := repository.OutgoingTransaction.GetActiveByPayment(payment.ID, model.Forward)
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Error in getting forward")
+		return false
+	}
+	return forward != nil && (forward.Status == model.TxMined || forward.Status == model.TxConfirmed)
+}
+
+/*
+	A failed forward is tried again, if the funds are still on the address. Otherwise, the payment fails.
+	A failed refund is opened again, so the refund job sends it again. An overpayment stays open until its refund is mined, so it isn't taken as earnings.
+*/
+func failOutgoingTransaction(client *config.Client, outgoing *model.OutgoingTransaction, reason string, currentBlockNr *big.Int, blockHash *common.Hash) {
+	logging.WithOutgoing(outgoing).WithField("reason", reason).Warn("Outgoing transaction failed")
+	outgoing.Status = model.TxFailed
+	outgoing.Error = reason
+	if err := repository.OutgoingTransaction.Update(outgoing); err != nil {
+		logging.WithOutgoing(outgoing).WithError(err).Error("Couldn't write outgoing transaction to database")
+		return
+	}
+	payment := outgoing.Payment
+	if outgoing.Kind == model.Refund && payment != nil && payment.RefundStatus != model.RefundDone {
+		// the refund is sent again with the next block
+		payment.RefundStatus = model.RefundOpen
+		repository.Payment.UpdatePaymentState(payment)
+		return
+	}
+	if outgoing.Kind != model.Forward || payment == nil {
+		return
+	}
+	paid, balance := bc.IsPaidOnChain(payment, client)
+	if paid {
+		Pay(payment, balance, currentBlockNr, blockHash)
+		return
+	}
+	finalBalanceOnChaingateWallet, err := bc.GetBalanceAt(client, common.HexToAddress(payment.Account.Address))
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Error in getting balance in final recovery")
+	}
+	Fail(payment, finalBalanceOnChaingateWallet)
+}
@@ -0,0 +1,192 @@
+package controller
+
+import (
+	"context"
+	"ethereum-service/internal/bc"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/repository"
+	"ethereum-service/internal/testutils"
+	"ethereum-service/model"
+	"math/big"
+	"testing"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func signOutgoingTestTransfer(t *testing.T, genesisAcc *model.Account, nonce uint64, gasFeeCap *big.Int) *types.Transaction {
+	key, _ := genesisAcc.GetPrivateKey()
+	to := common.HexToAddress(config.Opts.TargetWallet)
+	tx, err := types.SignTx(types.NewTx(&types.DynamicFeeTx{
+		ChainID:   config.Chain.ChainId,
+		Nonce:     nonce,
+		GasFeeCap: gasFeeCap,
+		GasTipCap: big.NewInt(1),
+		Gas:       21000,
+		To:        &to,
+		Value:     big.NewInt(1),
+	}), types.LatestSignerForChainID(config.Chain.ChainId), key)
+	if err != nil {
+		t.Fatalf("Unable to sign transaction %v", err)
+	}
+	return tx
+}
+
+func TestTrackOutgoingTransactionRebroadcast(t *testing.T) {
+	config.ReadOpts()
+	outgoing := testutils.NewOutgoingTransactionRepositoryMock()
+	repository.OutgoingTransaction = outgoing
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	nonce, err := client.PendingNonceAt(context.Background(), common.HexToAddress(genesisAcc.Address))
+	if err != nil {
+		t.Fatalf("Unable to get nonce %v", err)
+	}
+	tx := signOutgoingTestTransfer(t, genesisAcc, nonce, config.Chain.GasPrice)
+	// recorded, but the service crashed before it was sent
+	recorded := &model.OutgoingTransaction{Mode: enum.Main, Kind: model.Earnings, Status: model.TxSigned}
+	_ = recorded.SetTransaction(tx)
+	_ = outgoing.Create(recorded)
+
+	TrackOutgoingTransactions(client, big.NewInt(1), enum.Main, nil)
+	if status := outgoing.GetAll()[0].Status; status != model.TxSent {
+		t.Fatalf("Outgoing transaction is %v, but should be %v", status, model.TxSent)
+	}
+
+	receipt, err := bind.WaitMined(context.Background(), client, tx)
+	if err != nil {
+		t.Fatalf("Can't wait until transaction is mined %v", err)
+	}
+	TrackOutgoingTransactions(client, receipt.BlockNumber, enum.Main, &receipt.BlockHash)
+	mined := outgoing.GetAll()[0]
+	if mined.Status != model.TxMined || mined.BlockNr.Cmp(receipt.BlockNumber) != 0 {
+		t.Fatalf("Outgoing transaction is %v in block %v, but should be %v in block %v", mined.Status, mined.BlockNr, model.TxMined, receipt.BlockNumber)
+	}
+	if mined.GetFee().Sign() <= 0 {
+		t.Fatalf("The fee of the mined transaction is %v", mined.GetFee())
+	}
+}
+
+func TestFailedOverpaymentRefundIsSentAgain(t *testing.T) {
+	config.ReadOpts()
+	outgoing := testutils.NewOutgoingTransactionRepositoryMock()
+	repository.OutgoingTransaction = outgoing
+	mock, gormDb := testutils.NewMock()
+	repository.InitPayment(gormDb)
+	repository.InitAccount(gormDb)
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	p := testutils.GetForwardedPayment()
+	p.SenderAddress = model.CreateAccount(enum.Main).Address
+	overpayment := big.NewInt(0).Set(&p.CurrentPaymentState.PayAmount.Int)
+	received := big.NewInt(0).Add(&p.CurrentPaymentState.PayAmount.Int, overpayment)
+	p.CurrentPaymentState.AmountReceived = model.NewBigInt(received)
+	// the forward is mined, the overpayment and the earnings are left on the address
+	tx := testutils.CreateInitialPayment(client, genesisAcc, overpayment, p.Account.Address)
+	if _, err := bind.WaitMined(context.Background(), client, tx); err != nil {
+		t.Fatalf("Can't wait until transaction is mined %v", err)
+	}
+	mock = testutils.SetupRetryOverpaymentRefund(mock, p)
+
+	failed := &model.OutgoingTransaction{Mode: enum.Main, Kind: model.Refund, Status: model.TxSent, PaymentID: &p.ID, Payment: &p}
+	_ = outgoing.Create(failed)
+	failOutgoingTransaction(client, failed, "dropped", big.NewInt(1), nil)
+	if p.RefundStatus != model.RefundOpen || !isRefundOpen(&p) || !isRefundPending(&p) {
+		t.Fatalf("The overpayment refund should be open again, but is \"%v\"", p.RefundStatus)
+	}
+
+	refundPayment(client, &p)
+	txs := outgoing.GetAll()
+	if p.RefundStatus != "" || len(txs) != 2 || txs[1].Kind != model.Refund || txs[1].Status == model.TxFailed {
+		t.Fatalf("The overpayment should be refunded again, but the refund is \"%v\" and %v transactions are recorded", p.RefundStatus, len(txs))
+	}
+	refund, _ := txs[1].GetTransaction()
+	expected := big.NewInt(0).Sub(overpayment, big.NewInt(0).Mul(config.Chain.GasPrice, big.NewInt(21000)))
+	if *refund.To() != common.HexToAddress(p.SenderAddress) || refund.Value().Cmp(expected) != 0 {
+		t.Fatalf("Refund sends %v to %v, but should send %v to %v", refund.Value(), refund.To(), expected, p.SenderAddress)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTrackOutgoingTransactionReplacedMined(t *testing.T) {
+	config.ReadOpts()
+	outgoing := testutils.NewOutgoingTransactionRepositoryMock()
+	repository.OutgoingTransaction = outgoing
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	nonce, err := client.PendingNonceAt(context.Background(), common.HexToAddress(genesisAcc.Address))
+	if err != nil {
+		t.Fatalf("Unable to get nonce %v", err)
+	}
+	tx := signOutgoingTestTransfer(t, genesisAcc, nonce, config.Chain.GasPrice)
+	if err = client.SendTransaction(context.Background(), tx); err != nil {
+		t.Fatalf("Unable to send transaction %v", err)
+	}
+	receipt, err := bind.WaitMined(context.Background(), client, tx)
+	if err != nil {
+		t.Fatalf("Can't wait until transaction is mined %v", err)
+	}
+
+	// the replacement came too late, the replaced transaction was mined
+	recorded := &model.OutgoingTransaction{Mode: enum.Main, Kind: model.Earnings, Status: model.TxSent}
+	_ = recorded.SetTransaction(tx)
+	_ = recorded.Replace(signOutgoingTestTransfer(t, genesisAcc, nonce, big.NewInt(0).Mul(config.Chain.GasPrice, big.NewInt(2))))
+	_ = outgoing.Create(recorded)
+
+	TrackOutgoingTransactions(client, receipt.BlockNumber, enum.Main, &receipt.BlockHash)
+	mined := outgoing.GetAll()[0]
+	if mined.Status != model.TxMined || mined.Hash != tx.Hash().String() {
+		t.Fatalf("Outgoing transaction is %v with hash %v, but should be %v with hash %v", mined.Status, mined.Hash, model.TxMined, tx.Hash())
+	}
+}
+
+func TestRejectedOutgoingTransactionFails(t *testing.T) {
+	config.ReadOpts()
+	outgoing := testutils.NewOutgoingTransactionRepositoryMock()
+	repository.OutgoingTransaction = outgoing
+	_, client := testutils.CustomChainSetup(t)
+	p := testutils.GetForwardedPayment()
+	// the account has no funds, so the node rejects the transfer
+	p.Account = *model.CreateAccount(enum.Main)
+	p.Account.Remainder = model.NewBigIntFromInt(1000000000000000000)
+	fees, err := bc.EstimateFees(client)
+	if err != nil {
+		t.Fatalf("Unable to estimate fees %v", err)
+	}
+
+	recorder := newOutgoingRecorder(&p)
+	if tx := bc.ForwardEarnings(client, &p.Account, fees, recorder); tx != nil {
+		t.Fatalf("Transaction %v was sent without funds", tx.Hash())
+	}
+	if recorder.isRecorded(model.Earnings) || recorder.isSent(model.Earnings) {
+		t.Fatalf("Rejected transaction is taken as recorded")
+	}
+	if status := outgoing.GetAll()[0].Status; status != model.TxFailed {
+		t.Fatalf("Outgoing transaction is %v, but should be %v", status, model.TxFailed)
+	}
+}
+
+func TestTrackOutgoingTransactionBroadcastAttempts(t *testing.T) {
+	config.ReadOpts()
+	maxBroadcastAttempts := config.Opts.MaxBroadcastAttempts
+	config.Opts.MaxBroadcastAttempts = 2
+	defer func() { config.Opts.MaxBroadcastAttempts = maxBroadcastAttempts }()
+	outgoing := testutils.NewOutgoingTransactionRepositoryMock()
+	repository.OutgoingTransaction = outgoing
+	_, client := testutils.CustomChainSetup(t)
+	// the account has no funds, so every broadcast is rejected
+	tx := signOutgoingTestTransfer(t, model.CreateAccount(enum.Main), 0, config.Chain.GasPrice)
+	recorded := &model.OutgoingTransaction{Mode: enum.Main, Kind: model.Earnings, Status: model.TxSigned}
+	_ = recorded.SetTransaction(tx)
+	_ = outgoing.Create(recorded)
+
+	TrackOutgoingTransactions(client, big.NewInt(1), enum.Main, nil)
+	if tracked := outgoing.GetAll()[0]; tracked.Status != model.TxSigned || tracked.BroadcastAttempts != 1 {
+		t.Fatalf("Outgoing transaction is %v after %v attempts, but should be %v after 1 attempt", tracked.Status, tracked.BroadcastAttempts, model.TxSigned)
+	}
+	TrackOutgoingTransactions(client, big.NewInt(2), enum.Main, nil)
+	if status := outgoing.GetAll()[0].Status; status != model.TxFailed {
+		t.Fatalf("Outgoing transaction is %v, but should be %v", status, model.TxFailed)
+	}
+}
@@ -1,25 +1,116 @@
 package controller
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"ethereum-service/internal/bc"
 	"ethereum-service/internal/config"
+	"ethereum-service/internal/logging"
+	"ethereum-service/internal/metrics"
 	"ethereum-service/internal/repository"
 	"ethereum-service/internal/service"
 	"ethereum-service/model"
 	"ethereum-service/utils"
 	"fmt"
-	"log"
 	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/CHainGate/backend/pkg/enum"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
 )
 
-func CreatePayment(mode enum.Mode, priceAmount float64, priceCurrency string, wallet string) (*model.Payment, *big.Int, error) {
+var (
+	PaymentNotCancellable = errors.New("only waiting payments can be cancelled")
+	FundsReceived         = errors.New("the payment already received funds, they need to be refunded")
+	IdempotencyConflict   = errors.New("the idempotency key was already used for a different payment request")
+	IdempotencyInProgress = errors.New("a payment request with the same idempotency key is processed at the moment")
+	InvalidExpiry         = errors.New("the expiry of a payment can't be negative or longer than MAX_PAYMENT_EXPIRY")
+)
+
+// payments which are forwarded at the moment
+var confirming sync.Map
+
+// idempotency keys per merchant wallet of the payments which are created at the moment in this instance
+var creating sync.Map
+
+// CreatePayment
+/*
+	Creates a payment on a free account. It expires after expiresIn seconds, or after PaymentExpiry seconds if expiresIn is 0.
+	If an idempotency key is given and the merchant wallet already created a payment with it within the IdempotencyWindow, that payment is returned.
+	The same key with a different request is rejected with IdempotencyConflict. The key is unique per merchant wallet in the database,
+	so if another instance creates the payment in the meantime, the account is freed again and that payment is returned.
+	The price is converted with a quote, which is stored on the payment and locked for its whole lifetime. If the conversion fails, service.ConversionFailed is returned.
+*/
+func CreatePayment(mode enum.Mode, priceAmount float64, priceCurrency string, wallet string, payCurrency string, expiresIn int64, idempotencyKey string) (*model.Payment, *big.Int, error) {
+	if expiresIn < 0 || expiresIn > config.Opts.MaxPaymentExpiry {
+		return nil, nil, InvalidExpiry
+	}
+	if expiresIn == 0 {
+		expiresIn = config.Opts.PaymentExpiry
+	}
+	requestHash := getRequestHash(mode, priceAmount, priceCurrency, wallet, payCurrency, expiresIn)
+	if idempotencyKey != "" {
+		creatingKey := strings.ToLower(wallet) + "|" + idempotencyKey
+		if _, running := creating.LoadOrStore(creatingKey, true); running {
+			return nil, nil, IdempotencyInProgress
+		}
+		defer creating.Delete(creatingKey)
+
+		existing, err := getIdempotentPayment(wallet, idempotencyKey, requestHash)
+		if err != nil || existing != nil {
+			return existing, getActiveAmount(existing), err
+		}
+	}
+
+	var token config.Token
+	isToken := false
+	if payCurrency != "" && !strings.EqualFold(payCurrency, config.NativeCurrency) {
+		var ok bool
+		token, ok = config.GetToken(mode, payCurrency)
+		if !ok {
+			return nil, nil, fmt.Errorf("pay currency %s is not supported", payCurrency)
+		}
+		isToken = true
+	}
+
+	// the quote is locked before an account is allocated, so a failed conversion doesn't use an account
+	payCurrencySymbol := config.NativeCurrency
+	if isToken {
+		payCurrencySymbol = token.Symbol
+	}
+	quote, err := service.GetQuote(model.Payment{Mode: mode, PriceAmount: priceAmount, PriceCurrency: priceCurrency, PayCurrency: payCurrencySymbol})
+	if err != nil {
+		return nil, nil, err
+	}
+	var final *big.Int
+	if isToken {
+		final = utils.GetBaseUnitFromAmount(&quote.Amount, token.Decimals)
+		// the rate of ETH converts the gas of the forward into the token
+		ethRate, err := service.GetRate(mode, priceCurrency, config.NativeCurrency)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = bc.CheckIfTokenAmountIsTooLowMode(mode, final, token.Decimals, quote.Rate/ethRate.Rate)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		final = utils.GetWEIFromETH(&quote.Amount)
+		err = bc.CheckIfAmountIsTooLowMode(mode, final)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	acc, err := GetAccount(mode)
 
 	if err != nil {
@@ -32,36 +123,124 @@ func CreatePayment(mode enum.Mode, priceAmount float64, priceCurrency string, wa
 		Account:        acc,
 		PriceAmount:    priceAmount,
 		PriceCurrency:  priceCurrency,
+		PayCurrency:    payCurrencySymbol,
 		MerchantWallet: wallet,
+		IdempotencyKey: idempotencyKey,
+		RequestHash:    requestHash,
 	}
 
 	payment.ID = uuid.New()
+	expiresAt := time.Now().Add(time.Duration(expiresIn) * time.Second)
+	payment.ExpiresAt = &expiresAt
+	payment.SetQuote(quote)
 
-	val := service.GetETHAmount(payment)
-	final := utils.GetWEIFromETH(val)
-	err = bc.CheckIfAmountIsTooLowMode(mode, final)
-	if err != nil {
-		return nil, nil, err
+	if isToken {
+		payment.TokenContract = token.Contract.Hex()
+		payment.TokenDecimals = token.Decimals
+		client := bc.GetClientByMode(mode)
+		tokenRemainder, err := bc.GetTokenBalanceAt(client, token.Contract, common.HexToAddress(acc.Address))
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to get token balance of address")
+		}
+		payment.TokenRemainder = model.NewBigInt(tokenRemainder)
 	}
 
 	_, err = repository.Payment.Create(&payment, final)
+	if errors.Is(err, model.DuplicateIdempotencyKey) {
+		freeAccount(&payment, &acc.Remainder.Int)
+		existing, err := getIdempotentPayment(wallet, idempotencyKey, requestHash)
+		if err == nil && existing == nil {
+			err = IdempotencyConflict
+		}
+		return existing, getActiveAmount(existing), err
+	}
+	if err != nil {
+		freeAccount(&payment, &acc.Remainder.Int)
+		return nil, nil, err
+	}
+	metrics.PaymentCreated(mode)
 
 	return &payment, final, nil
 }
 
+/*
+	Returns the payment, which the merchant wallet created with the idempotency key within the IdempotencyWindow, or nil if there is none.
+	A payment with the key before the window releases the key, so it can be used for a new payment.
+*/
+func getIdempotentPayment(wallet string, idempotencyKey string, requestHash string) (*model.Payment, error) {
+	since := time.Now().Add(-time.Duration(config.Opts.IdempotencyWindow) * time.Hour)
+	existing, err := repository.Payment.GetByIdempotencyKey(wallet, idempotencyKey, since)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, repository.Payment.ReleaseIdempotencyKey(wallet, idempotencyKey, since)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if existing.RequestHash != requestHash {
+		return nil, IdempotencyConflict
+	}
+	return existing, nil
+}
+
+func getActiveAmount(payment *model.Payment) *big.Int {
+	if payment == nil {
+		return nil
+	}
+	return payment.GetActiveAmount()
+}
+
+/*
+	Identifies the content of a payment request, so a repeated request can be distinguished from a different one with the same idempotency key.
+*/
+func getRequestHash(mode enum.Mode, priceAmount float64, priceCurrency string, wallet string, payCurrency string, expiresIn int64) string {
+	request := fmt.Sprintf("%v|%v|%v|%v|%v|%v", mode, strconv.FormatFloat(priceAmount, 'f', -1, 64), strings.ToLower(priceCurrency), strings.ToLower(wallet), strings.ToLower(payCurrency), expiresIn)
+	hash := sha256.Sum256([]byte(request))
+	return hex.EncodeToString(hash[:])
+}
+
+func GetPayment(id uuid.UUID) (*model.Payment, error) {
+	return repository.Payment.GetByID(id)
+}
+
+const (
+	defaultPaymentPageSize = 50
+	maxPaymentPageSize     = 200
+)
+
+/*
+	Searches the payments. Without a limit, a page has defaultPaymentPageSize payments. The limit is capped at maxPaymentPageSize.
+*/
+func SearchPayments(filter model.PaymentFilter) ([]model.Payment, *model.PaymentCursor, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = defaultPaymentPageSize
+	}
+	if filter.Limit > maxPaymentPageSize {
+		filter.Limit = maxPaymentPageSize
+	}
+	return repository.Payment.Search(filter)
+}
+
 // CheckPayment
 /*
   Checks if payment is expired. If it is expired it first checks the balance to make sure it isn't paid.
   Care for internal transactions.
 */
 func CheckPayment(payment *model.Payment, blockNr *big.Int, txHash *common.Hash, balance *big.Int) {
-	if bc.CheckIfExpired(payment) {
+	checkPaymentAt(payment, time.Now(), blockNr, txHash, balance)
+}
+
+/*
+	Same as CheckPayment, but the expiry is checked at the given time, e.g. the timestamp of a backfilled block. Without a balance, the balance at the block is taken.
+*/
+func checkPaymentAt(payment *model.Payment, at time.Time, blockNr *big.Int, txHash *common.Hash, balance *big.Int) {
+	if bc.CheckIfExpiredAt(payment, at) {
 		if balance == nil {
 			var err error
 			client := bc.GetClientByMode(payment.Mode)
-			balance, err = bc.GetUserBalanceAt(client, common.HexToAddress(payment.Account.Address), &payment.Account.Remainder.Int)
+			balance, err = bc.GetPaymentBalanceAtBlock(client, payment, blockNr)
 			if err != nil {
-				log.Printf("Error by getting balance %v", err)
+				logging.WithPayment(payment).WithError(err).Error("Error by getting balance")
+				return
 			}
 		}
 		if payment.IsPaid(balance) {
@@ -77,20 +256,19 @@ func CheckBalanceNotify(payment *model.Payment, txValue *big.Int, blockNr *big.I
 	if payment.IsPaid(balance) {
 		var paid bool
 		// Check if the whole amount is still correct no potential reversed tx
-		paid, balance = bc.IsPaidOnChain(payment, nil)
+		paid, balance = bc.IsPaidOnChainAt(payment, nil, blockNr)
 		if paid {
 			Pay(payment, balance, blockNr, blockHash)
 		} else {
 			Fail(payment, balance)
 		}
 	} else {
-		updateState(payment, balance, enum.PartiallyPaid)
-		log.Printf("PAYMENT partly paid")
-		log.Printf("Current Payment: %s \n Expected Payment: %s", balance.String(), payment.GetActiveAmount().String())
+		partiallyPay(payment, balance)
+		logging.WithPayment(payment).WithFields(logrus.Fields{"balance": balance.String(), "expected": payment.GetActiveAmount().String()}).Info("Payment partly paid")
 	}
 }
 
-func CheckIncomingBlocks(client *ethclient.Client, currentBlockNr *big.Int, mode enum.Mode) {
+func CheckIncomingBlocks(client *config.Client, currentBlockNr *big.Int, mode enum.Mode) {
 	payments := repository.Payment.GetConfirming(mode)
 	for _, p := range payments {
 		hasBlockEnoughConfirmations := big.NewInt(0).Add(&p.LastReceivingBlockNr.Int, big.NewInt(config.Opts.IncomingBlockConfirmations)).Cmp(currentBlockNr) <= 0
@@ -101,7 +279,7 @@ func CheckIncomingBlocks(client *ethclient.Client, currentBlockNr *big.Int, mode
 	}
 }
 
-func CheckOutgoingTx(client *ethclient.Client, currentBlockNr *big.Int, mode enum.Mode, blockHash *common.Hash) {
+func CheckOutgoingTx(client *config.Client, currentBlockNr *big.Int, mode enum.Mode, blockHash *common.Hash) {
 	payments := repository.Payment.GetFinishing(mode)
 	for _, p := range payments {
 		var txHash common.Hash
@@ -113,10 +291,12 @@ func CheckOutgoingTx(client *ethclient.Client, currentBlockNr *big.Int, mode enu
 			isConfirmed, err = bc.IsTxConfirmed(client, common.HexToHash(p.ForwardingTransactionHash), currentBlockNr)
 		}
 
-		if isConfirmed {
+		if isConfirmed && isRefundOpen(&p) {
+			logging.WithPayment(&p).Debug("Refund isn't confirmed yet")
+		} else if isConfirmed {
 			finish(&p)
 		} else if err == utils.BlockFailed {
-			log.Printf("Potential reverted Block. Checkout blockNr: %v, Acc Address: %v", txHash, p.Account.Address)
+			logging.WithPayment(&p).WithField(logging.TxHash, txHash.String()).Warn("Forward failed. Potential reverted block")
 			// Check if still enough funds on the address, because the tx could be mined again already
 			paid, balance := bc.IsPaidOnChain(&p, client)
 			if paid {
@@ -124,40 +304,42 @@ func CheckOutgoingTx(client *ethclient.Client, currentBlockNr *big.Int, mode enu
 			} else {
 				finalBalanceOnChaingateWallet, err := bc.GetBalanceAt(client, common.HexToAddress(p.Account.Address))
 				if err != nil {
-					log.Printf("Error in getting balance in final recovery. Acc Address: %v", p.Account.Address)
+					logging.WithPayment(&p).WithError(err).Error("Error in getting balance in final recovery")
 				}
 				Fail(&p, finalBalanceOnChaingateWallet)
 			}
 		} else if err != nil {
-			log.Printf("Error in confirming tx. Acc Address: %v. Try again next confirming round", p.Account.Address)
+			logging.WithPayment(&p).WithField(logging.TxHash, txHash.String()).WithError(err).Warn("Error in confirming tx. Try again next confirming round")
 		}
 	}
 }
 
-func CheckConfirming(client *ethclient.Client, currentBlockNr *big.Int, mode enum.Mode, blockHash *common.Hash) {
+func CheckConfirming(client *config.Client, currentBlockNr *big.Int, mode enum.Mode, blockHash *common.Hash) {
 	go CheckIncomingBlocks(client, currentBlockNr, mode)
+	go TrackOutgoingTransactions(client, currentBlockNr, mode, blockHash)
 	go CheckOutgoingTx(client, currentBlockNr, mode, blockHash)
+	go RefundPayments(client, mode)
 }
 
-func HandleConfirming(client *ethclient.Client, payment *model.Payment) *types.Transaction {
+func HandleConfirming(client *config.Client, payment *model.Payment) *types.Transaction {
 	var isConfirmed bool
 	var err error
 	// When no Tx hash is set do no confirming. This can happen when the service does a recovery and only check the open balances
 	if payment.LastReceivingBlockHash == "" {
 		isConfirmed = true
 	} else {
-		isConfirmed, err = bc.IsBlockConfirmed(client, common.HexToHash(payment.LastReceivingBlockHash))
+		isConfirmed, err = bc.IsBlockConfirmed(client, &payment.LastReceivingBlockNr.Int, common.HexToHash(payment.LastReceivingBlockHash))
 	}
 
 	if isConfirmed {
 		return confirm(client, payment)
 	} else if err != nil {
-		log.Printf("Error in getting balance. Acc Address: %v. Try again next confirming round", payment.Account.Address)
+		logging.WithPayment(payment).WithError(err).Warn("Error in confirming block. Try again next confirming round")
 	} else {
-		log.Printf("Block doesn't exist anymore. Potential reverted Tx. Checkout blockNr: %v, Acc Address: %v", payment.LastReceivingBlockNr, payment.Account.Address)
+		logging.WithPayment(payment).WithField(logging.Block, payment.LastReceivingBlockNr.Uint64()).Warn("Block doesn't exist anymore. Potential reverted tx")
 		finalBalanceOnChaingateWallet, err := bc.GetBalanceAt(client, common.HexToAddress(payment.Account.Address))
 		if err != nil {
-			log.Printf("Error in getting balance in final recovery. Acc Address: %v", payment.Account.Address)
+			logging.WithPayment(payment).WithError(err).Error("Error in getting balance in final recovery")
 			return nil
 		}
 		Fail(payment, finalBalanceOnChaingateWallet)
@@ -166,8 +348,11 @@ func HandleConfirming(client *ethclient.Client, payment *model.Payment) *types.T
 }
 
 func Pay(payment *model.Payment, balance *big.Int, blockNr *big.Int, blockHash *common.Hash) bool {
-	log.Printf("PAYMENT REACHED!!!!")
-	log.Printf("Current Payment: %s \n Expected Payment: %s", balance.String(), payment.GetActiveAmount().String())
+	entry := logging.WithPayment(payment).WithFields(logrus.Fields{"balance": balance.String(), "expected": payment.GetActiveAmount().String()})
+	if blockNr != nil {
+		entry = entry.WithField(logging.Block, blockNr.Uint64())
+	}
+	entry.Info("Payment reached")
 	if blockNr != nil {
 		payment.LastReceivingBlockNr = model.NewBigInt(blockNr)
 	} else {
@@ -183,97 +368,234 @@ func Pay(payment *model.Payment, balance *big.Int, blockNr *big.Int, blockHash *
 }
 
 func Expire(payment *model.Payment, balance *big.Int) {
-	payment.Account.Remainder = model.NewBigInt(balance)
-	payment.Account.Used = false
-	if repository.Account.Update(&payment.Account) != nil {
-		log.Printf("Couldn't write wallet to database: %+v\n", &payment.Account)
+	endUnpaid(payment, balance, enum.Expired)
+}
+
+func Fail(payment *model.Payment, balance *big.Int) {
+	endUnpaid(payment, balance, enum.Failed)
+}
+
+// CancelPayment
+/*
+	Cancels a waiting payment, e.g. when the shopper abandoned the checkout. The account is watched for late payments like on expiry.
+	A payment which already received funds isn't cancelled, because the funds have to be refunded.
+	The state is only written if it is still waiting, so a payment which received funds in a block in the meantime isn't cancelled.
+*/
+func CancelPayment(id uuid.UUID) (*model.Payment, error) {
+	payment, err := repository.Payment.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if payment.CurrentPaymentState.StateID != enum.Waiting {
+		return payment, PaymentNotCancellable
+	}
+	client := bc.GetClientByMode(payment.Mode)
+	received, err := bc.GetPaymentBalanceAt(client, payment)
+	if err != nil {
+		return payment, err
+	}
+	if received.Sign() > 0 {
+		return payment, FundsReceived
+	}
+	balance, err := bc.GetBalanceAt(client, common.HexToAddress(payment.Account.Address))
+	if err != nil {
+		return payment, err
+	}
+	watched := startLatePaymentWatch(payment)
+	err = updateStateIf(payment, nil, model.Cancelled, *payment.CurrentPaymentStateId)
+	if errors.Is(err, model.StateChanged) {
+		return payment, PaymentNotCancellable
 	}
-	if updateState(payment, nil, enum.Expired) != nil {
+	if err != nil {
+		return payment, err
+	}
+	if !watched {
+		freeAccount(payment, balance)
+	}
+	return payment, nil
+}
+
+/*
+	Ends the payment and releases its account for the next payment. The balance on the address stays as remainder.
+*/
+func release(payment *model.Payment, balance *big.Int, state enum.State) {
+	freeAccount(payment, balance)
+	if updateState(payment, nil, state) != nil {
 		return
 	}
 }
 
-func Fail(payment *model.Payment, balance *big.Int) {
-	payment.Account.Remainder = model.NewBigInt(balance)
-	payment.Account.Used = false
-	if repository.Account.Update(&payment.Account) != nil {
-		log.Printf("Couldn't write wallet to database: %+v\n\n", &payment.Account)
+/*
+	Releases the account of the ended payment for the next payment. The balance on the address stays as remainder.
+*/
+func freeAccount(payment *model.Payment, balance *big.Int) {
+	if !payment.IsTokenPayment() {
+		payment.Account.Remainder = model.NewBigInt(balance)
 	}
-	if updateState(payment, nil, enum.Failed) != nil {
-		return
+	payment.Account.Used = false
+	if err := repository.Account.Update(&payment.Account); err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Couldn't write wallet to database")
 	}
 }
 
-func confirm(client *ethclient.Client, payment *model.Payment) *types.Transaction {
-	if updateState(payment, nil, enum.Confirmed) != nil {
+/*
+	Records and broadcasts the forward. The payment is forwarded by the tracker, when the forward is mined.
+	If the forward is already recorded (e.g. after a crash), it isn't sent again. The payment is only confirmed after the node accepted the forward.
+*/
+func confirm(client *config.Client, payment *model.Payment) *types.Transaction {
+	if _, running := confirming.LoadOrStore(payment.ID, true); running {
 		return nil
 	}
-	tx := bc.Forward(client, payment)
-	if tx == nil {
-		balance, err := bc.GetBalanceAt(client, common.HexToAddress(payment.Account.Address))
-		if err != nil {
+	defer confirming.Delete(payment.ID)
+
+	forward, err := repository.OutgoingTransaction.GetActiveByPayment(payment.ID, model.Forward)
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Error in getting forward")
+		return nil
+	}
+	var tx *types.Transaction
+	if forward != nil && forward.Status == model.TxSigned {
+		logging.WithPayment(payment).WithField(logging.TxHash, forward.Hash).Info("Forward isn't accepted by the node yet. Try again next confirming round")
+		return nil
+	} else if forward != nil {
+		logging.WithPayment(payment).WithField(logging.TxHash, forward.Hash).Info("Forward is already recorded")
+		tx, _ = forward.GetTransaction()
+		if payment.CurrentPaymentState.StateID == enum.Paid && hasRefund(payment) {
+			// the state of the recorded refund couldn't be written before
+			if updateState(payment, nil, model.OverpaidRefunded) != nil {
+				return nil
+			}
+		}
+	} else {
+		if isGasFundingPending(payment) {
+			logging.WithPayment(payment).Info("Forward waits until the gas funding is mined")
+			return nil
+		}
+		recorder := newOutgoingRecorder(payment)
+		tx = bc.Forward(client, payment, recorder)
+		if !recorder.isSent(model.Forward) {
+			logging.WithPayment(payment).Warn("Unable to forward payment. Try again next confirming round")
 			return nil
 		}
-		// TODO: The payment shouldn't fail, when the error message is: "Unable to send Transaction already known"
-		Fail(payment, balance)
+		// account needs to explicit be updated, because the payment alone isn't enough. GORM tries to create a new one and fails.
+		if err = repository.Account.Update(&payment.Account); err != nil {
+			logging.WithPayment(payment).WithError(err).Error("Couldn't write wallet to database")
+		}
+		if recorder.isRecorded(model.Refund) {
+			logging.WithPayment(payment).WithFields(logrus.Fields{logging.TxHash: payment.RefundTransactionHash, "sender": payment.SenderAddress}).Info("Overpayment is refunded")
+			if updateState(payment, nil, model.OverpaidRefunded) != nil {
+				return nil
+			}
+		}
+	}
+	if updateState(payment, nil, enum.Confirmed) != nil {
 		return nil
 	}
-	// account needs to explicit be updated, because the payment alone isn't enough. GORM tries to create a new one and fails.
-	if repository.Account.Update(&payment.Account) != nil {
-		log.Printf("Couldn't write wallet to database: %+v\n\n", &payment.Account)
+	return tx
+}
+
+/*
+	The account of a payment is only released when its refund is done, because the refunded funds are still on the address until then.
+	A failed refund which waits to be sent again is open as well.
+*/
+func isRefundOpen(payment *model.Payment) bool {
+	if payment.RefundStatus == model.RefundOpen {
+		return true
 	}
-	if updateState(payment, nil, enum.Forwarded) != nil {
-		return nil
+	refunds, err := repository.OutgoingTransaction.GetAllActiveByPayment(payment.ID, model.Refund)
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Error in getting refund")
+		return true
 	}
-	forwarded, _ := bc.CheckForwardEarnings(client, &payment.Account)
-	if forwarded {
-		// account needs to explicit be updated, because the payment alone isn't enough. GORM tries to create a new one and fails.
-		if repository.Account.Update(&payment.Account) != nil {
-			log.Printf("Couldn't write wallet to database: %+v\n\n", &payment.Account)
+	for _, refund := range refunds {
+		if refund.Status != model.TxConfirmed {
+			return true
 		}
 	}
-	return tx
+	return false
+}
+
+func hasRefund(payment *model.Payment) bool {
+	refund, err := repository.OutgoingTransaction.GetActiveByPayment(payment.ID, model.Refund)
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Error in getting refund")
+		return false
+	}
+	return refund != nil
 }
 
 func finish(payment *model.Payment) {
 	payment.Account.Used = false
-	if repository.Account.Update(&payment.Account) != nil {
-		log.Printf("Couldn't write wallet to database: %+v\n", &payment.Account)
+	if err := repository.Account.Update(&payment.Account); err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Couldn't write wallet to database")
 	}
 	updateState(payment, nil, enum.Finished)
 }
 
-func CheckBalanceStartup(client *ethclient.Client, payment *model.Payment) {
-	balance, err := bc.GetUserBalanceAt(client, common.HexToAddress(payment.Account.Address), &payment.Account.Remainder.Int)
+func CheckBalanceStartup(client *config.Client, payment *model.Payment) {
+	balance, err := bc.GetPaymentBalanceAt(client, payment)
 	if err != nil {
-		log.Printf("Error by getting balance %v", err)
+		logging.WithPayment(payment).WithError(err).Error("Error by getting balance")
 	}
 
+	entry := logging.WithPayment(payment).WithFields(logrus.Fields{"balance": balance.String(), "expected": payment.GetActiveAmount().String()})
 	if payment.IsPaid(balance) {
-		log.Printf("PAYMENT REACHED!!!!")
-		log.Printf("Current Payment: %s \n Expected Payment: %s", balance.String(), payment.GetActiveAmount().String())
+		entry.Info("Payment reached")
 		if updateState(payment, balance, enum.Paid) != nil {
 			return
 		}
 	} else if payment.IsNewlyPartlyPaid(balance) {
-		log.Printf("PAYMENT partly paid")
-		log.Printf("Current Payment: %s \n Expected Payment: %s", balance.String(), payment.GetActiveAmount().String())
-		updateState(payment, balance, enum.PartiallyPaid)
+		entry.Info("Payment partly paid")
+		partiallyPay(payment, balance)
 	} else {
-		log.Printf("PAYMENT still not reached Address: %s", payment.Account.Address)
-		log.Printf("Current Payment: %s WEI, %s ETH", balance.String(), utils.GetETHFromWEI(balance).Text('f', 18))
-		log.Printf("Expected Payment: %s WEI, %s ETH", payment.GetActiveAmount().String(), utils.GetETHFromWEI(payment.GetActiveAmount()).Text('f', 18))
-		log.Printf("Please pay additional: %s WEI, %s ETH", big.NewInt(0).Sub(payment.GetActiveAmount(), balance).String(), big.NewFloat(0.0).Sub(utils.GetETHFromWEI(payment.GetActiveAmount()), utils.GetETHFromWEI(balance)).Text('f', 18))
+		entry.WithField("missing", big.NewInt(0).Sub(payment.GetActiveAmount(), balance).String()).Info("Payment still not reached")
 		CheckPayment(payment, nil, nil, balance)
 	}
 }
 
+/*
+	Sets the payment to PartiallyPaid. When the first funds arrive, the expiry is extended by PartialPaymentExtension seconds, so the shopper has time to pay the rest.
+*/
+func partiallyPay(payment *model.Payment, balance *big.Int) error {
+	if payment.CurrentPaymentState.StateID == enum.Waiting && config.Opts.PartialPaymentExtension > 0 {
+		payment.ExtendExpiry(time.Duration(config.Opts.PartialPaymentExtension) * time.Second)
+	}
+	return updateState(payment, balance, enum.PartiallyPaid)
+}
+
+/*
+	Sets the new state of the payment and stores it together with the notification of the backend, which is delivered by the dispatcher.
+*/
 func updateState(payment *model.Payment, balance *big.Int, state enum.State) error {
+	return writeState(payment, balance, state, repository.Payment.UpdatePaymentStateAndNotify)
+}
+
+/*
+	Sets the new state like updateState, but only if the stored state of the payment is still the current one (see UpdatePaymentStateIfCurrent).
+*/
+func updateStateIf(payment *model.Payment, balance *big.Int, state enum.State, currentStateID uuid.UUID) error {
+	return writeState(payment, balance, state, func(payment *model.Payment, notification *model.Notification) error {
+		return repository.Payment.UpdatePaymentStateIfCurrent(payment, currentStateID, notification)
+	})
+}
+
+func writeState(payment *model.Payment, balance *big.Int, state enum.State, write func(*model.Payment, *model.Notification) error) error {
+	previous := payment.CurrentPaymentState
 	newState := payment.UpdatePaymentState(state, balance)
-	err := service.SendState(payment.ID, newState, payment.ForwardingTransactionHash)
+	txHash := payment.ForwardingTransactionHash
+	if state == model.OverpaidRefunded || state == model.Refunded {
+		txHash = payment.RefundTransactionHash
+	}
+	err := write(payment, model.NewNotification(payment, newState, txHash))
 	if err != nil {
-		return nil
+		logging.WithPayment(payment).WithField("state", model.StateName(state)).WithError(err).Error("Couldn't write state")
+		return err
 	}
-	repository.Payment.UpdatePaymentState(payment)
-	return err
+	logging.WithPayment(payment).WithFields(logrus.Fields{"from": model.StateName(previous.StateID), "to": model.StateName(state), logging.TxHash: txHash}).Info("Payment state changed")
+	metrics.StateChanged(payment.Mode, previous.StateID, state, previous.CreatedAt)
+	if state == enum.Finished {
+		metrics.PaymentFinished(payment.Mode, payment.GetStateReachedAt(enum.Paid))
+	}
+	wakeDispatcher()
+	return nil
 }
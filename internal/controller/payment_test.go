@@ -3,9 +3,11 @@ package controller
 import (
 	"context"
 	"crypto/ecdsa"
+	"errors"
 	"ethereum-service/internal/bc"
 	"ethereum-service/internal/config"
 	"ethereum-service/internal/repository"
+	"ethereum-service/internal/service"
 	"ethereum-service/internal/testutils"
 	"ethereum-service/model"
 	"ethereum-service/utils"
@@ -16,11 +18,13 @@ import (
 	"time"
 
 	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
 	"gopkg.in/h2non/gock.v1"
 )
 
@@ -30,36 +34,62 @@ func TestCreatePayment(t *testing.T) {
 		ChainId:  big.NewInt(1337),
 		GasPrice: big.NewInt(params.InitialBaseFee),
 	}
-	expectedPayAmountFloat := 0.0001
+	rate := 0.000001
+	expectedPayAmountFloat := 100.0 * rate
 	expectedPayAmountBigInt := utils.GetWEIFromETH(&expectedPayAmountFloat)
 	mock, gormDb := testutils.NewMock()
 	defer gock.Off() // Flush pending mocks after test execution
 	gock.New("http://localhost:8001").
 		Get("/api/price-conversion").
 		Reply(200).
-		JSON(map[string]float64{"Price": expectedPayAmountFloat})
+		JSON(map[string]float64{"Price": rate})
 	repository.InitAccount(gormDb)
 	repository.InitPayment(gormDb)
 	mock = testutils.SetupGetFreeAccount(mock)
 	mock = testutils.SetupUpdateAccount(mock, 0)
 	mock = testutils.SetupCreatePaymentWithoutIdCheck(mock)
-	p, _, _ := CreatePayment(enum.Main, 100.0, "USD", model.CreateAccount(enum.Main).Address)
+	p, _, _ := CreatePayment(enum.Main, 100.0, "USD", model.CreateAccount(enum.Main).Address, "", 0, "")
 	if p.CurrentPaymentState.StateID != enum.Waiting {
 		t.Fatalf("Payment is in the wrong state. Payment is \"%v\", but should be \"%v\"", p.CurrentPaymentState.StateID, enum.Waiting.String())
 	}
 	if p.CurrentPaymentState.PayAmount.Int.Cmp(expectedPayAmountBigInt) != 0 {
 		t.Fatalf("Payment has the wrong amount. Payment is \"%v\", but should be \"%v\"", p.CurrentPaymentState.PayAmount.Int.String(), expectedPayAmountBigInt.String())
 	}
+	if p.ExpiresAt == nil || p.ExpiresAt.Before(time.Now().Add(time.Duration(config.Opts.PaymentExpiry-1)*time.Second)) {
+		t.Fatalf("Payment should expire in %v seconds, but expires at %v", config.Opts.PaymentExpiry, p.ExpiresAt)
+	}
+	if p.QuoteId == "" || p.QuotedAt == nil || p.QuoteRate != rate {
+		t.Fatalf("Payment should have the quote of the conversion, but has rate %v from %v", p.QuoteRate, p.QuoteSource)
+	}
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
 
+func TestCreatePaymentConversionFailed(t *testing.T) {
+	config.ReadOpts()
+	// the rate of TestCreatePayment isn't cached
+	config.Opts.PriceCacheTTL = 0
+	defer func() { config.Opts.PriceCacheTTL = 30 }()
+	mock, gormDb := testutils.NewMock()
+	defer gock.Off() // Flush pending mocks after test execution
+	gock.New("http://localhost:8001").
+		Get("/api/price-conversion").
+		Reply(503)
+	repository.InitAccount(gormDb)
+	repository.InitPayment(gormDb)
+	// no account is allocated
+	_, _, err := CreatePayment(enum.Main, 100.0, "USD", model.CreateAccount(enum.Main).Address, "", 0, "")
+	if !errors.Is(err, service.ConversionFailed) {
+		t.Fatalf("Payment creation should fail with the conversion, but got %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestCheckBalanceNotifyPartially(t *testing.T) {
 	config.ReadOpts()
-	gock.New("http://localhost:8000").
-		Put("/api/internal/payment/webhook").
-		Reply(200)
 	p := testutils.GetWaitingPayment()
 	CheckBalanceNotify(&p, big.NewInt(10), nil, nil)
 	if p.CurrentPaymentState.StateID != enum.PartiallyPaid {
@@ -67,10 +97,27 @@ func TestCheckBalanceNotifyPartially(t *testing.T) {
 	}
 }
 
+func TestCheckBalanceNotifyPartiallyExtendsExpiry(t *testing.T) {
+	config.ReadOpts()
+	config.Opts.PartialPaymentExtension = 600
+	defer func() { config.Opts.PartialPaymentExtension = 0 }()
+	p := testutils.GetWaitingPayment()
+	expiresAt := p.GetExpiresAt()
+	CheckBalanceNotify(&p, big.NewInt(10), nil, nil)
+	if extended := p.GetExpiresAt().Sub(expiresAt); extended != 10*time.Minute {
+		t.Fatalf("Expiry should be extended by 10m, but was extended by %v", extended)
+	}
+}
+
+func TestCreatePaymentExpiryTooLong(t *testing.T) {
+	config.ReadOpts()
+	_, _, err := CreatePayment(enum.Main, 100.0, "USD", model.CreateAccount(enum.Main).Address, "", config.Opts.MaxPaymentExpiry+1, "")
+	if err != InvalidExpiry {
+		t.Fatalf("expected %v, got %v", InvalidExpiry, err)
+	}
+}
+
 func TestCheckBalanceFalselyNotifyPaid(t *testing.T) {
-	gock.New("http://localhost:8000").
-		Put("/api/internal/payment/webhook").
-		Reply(200)
 	config.ReadOpts()
 	config.Chain = &config.ChainConfig{
 		ChainId:  big.NewInt(1337),
@@ -98,10 +145,6 @@ func TestCheckBalanceFalselyNotifyPaid(t *testing.T) {
 }
 
 func TestCheckBalanceNotifyPaid(t *testing.T) {
-	defer gock.Off() // Flush pending mocks after test execution
-	gock.New("http://localhost:8000").
-		Put("/api/internal/payment/webhook").
-		Reply(200)
 	config.ReadOpts()
 	config.Chain = &config.ChainConfig{
 		ChainId:  big.NewInt(1337),
@@ -130,10 +173,6 @@ func TestCheckBalanceNotifyPaid(t *testing.T) {
 }
 
 func TestCheckPaymentPaidBeforeExpire(t *testing.T) {
-	defer gock.Off() // Flush pending mocks after test execution
-	gock.New("http://localhost:8000").
-		Put("/api/internal/payment/webhook").
-		Reply(200)
 	config.ReadOpts()
 	config.Chain = &config.ChainConfig{
 		ChainId:  big.NewInt(1337),
@@ -163,10 +202,6 @@ func TestCheckPaymentPaidBeforeExpire(t *testing.T) {
 }
 
 func TestCheckPaymentExpire(t *testing.T) {
-	defer gock.Off() // Flush pending mocks after test execution
-	gock.New("http://localhost:8000").
-		Put("/api/internal/payment/webhook").
-		Reply(200)
 	config.ReadOpts()
 	config.Chain = &config.ChainConfig{
 		ChainId:  big.NewInt(1337),
@@ -180,25 +215,237 @@ func TestCheckPaymentExpire(t *testing.T) {
 	repository.InitAccount(gormDb)
 	p := testutils.GetWaitingPayment()
 	p.CreatedAt = p.CreatedAt.Add(time.Duration(-16) * time.Minute)
-	mock = testutils.SetupUpdateAccountFree(mock, 0)
 	mock = testutils.SetupUpdatePaymentStateToExpired(mock)
 	CheckPayment(&p, nil, nil, big.NewInt(0))
 	if p.CurrentPaymentState.StateID != enum.Expired {
 		t.Fatalf("Payment is in the wrong state. Payment is \"%v\", but should be \"%v\"", p.CurrentPaymentState.StateID, enum.Expired.String())
 	}
-	if p.Account.Used {
-		t.Fatalf("Accound is still used. Account is \"%v\", but should be \"%v\"", p.Account.Used, false)
+	// the account is watched for late payments
+	if !p.Account.Used || p.WatchedUntil == nil {
+		t.Fatalf("Account should be watched for late payments, but is used \"%v\" and watched until %v", p.Account.Used, p.WatchedUntil)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCreatePaymentIdempotent(t *testing.T) {
+	config.ReadOpts()
+	mock, gormDb := testutils.NewMock()
+	repository.InitPayment(gormDb)
+	wp := testutils.GetWaitingPayment()
+	wp.IdempotencyKey = "order-1"
+	wp.RequestHash = getRequestHash(wp.Mode, wp.PriceAmount, wp.PriceCurrency, wp.MerchantWallet, "", config.Opts.PaymentExpiry)
+	mock = testutils.SetupGetPaymentByIdempotencyKey(mock, wp)
+
+	// no account is allocated for the repeated request
+	p, final, err := CreatePayment(wp.Mode, wp.PriceAmount, wp.PriceCurrency, wp.MerchantWallet, "", 0, wp.IdempotencyKey)
+	if err != nil {
+		t.Fatalf("Unable to create payment %v", err)
+	}
+	if p.ID != wp.ID || p.Account.Address != wp.Account.Address || final.Cmp(wp.GetActiveAmount()) != 0 {
+		t.Fatalf("The repeated request should return payment %v with %v, but got %v with %v", wp.ID, wp.GetActiveAmount(), p.ID, final)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCreatePaymentIdempotencyConflict(t *testing.T) {
+	config.ReadOpts()
+	mock, gormDb := testutils.NewMock()
+	repository.InitPayment(gormDb)
+	wp := testutils.GetWaitingPayment()
+	wp.IdempotencyKey = "order-2"
+	wp.RequestHash = getRequestHash(wp.Mode, wp.PriceAmount, wp.PriceCurrency, wp.MerchantWallet, "", config.Opts.PaymentExpiry)
+	mock = testutils.SetupGetPaymentByIdempotencyKey(mock, wp)
+
+	if _, _, err := CreatePayment(wp.Mode, wp.PriceAmount+1, wp.PriceCurrency, wp.MerchantWallet, "", 0, wp.IdempotencyKey); err != IdempotencyConflict {
+		t.Fatalf("expected %v, got %v", IdempotencyConflict, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// concurrentPaymentRepository another instance creates the payment with the same idempotency key right before this one
+type concurrentPaymentRepository struct {
+	*testutils.PaymentRepositoryMock
+	other model.Payment
+}
+
+func (r concurrentPaymentRepository) Create(payment *model.Payment, final *big.Int) (*model.Payment, error) {
+	r.UpdatePaymentState(&r.other)
+	return r.PaymentRepositoryMock.Create(payment, final)
+}
+
+func setupIdempotentCreation(t *testing.T) sqlmock.Sqlmock {
+	config.ReadOpts()
+	config.Chain = &config.ChainConfig{
+		ChainId:  big.NewInt(1337),
+		GasPrice: big.NewInt(params.InitialBaseFee),
+	}
+	gock.New("http://localhost:8001").
+		Get("/api/price-conversion").
+		Reply(200).
+		JSON(map[string]float64{"Price": 0.000001})
+	mock, gormDb := testutils.NewMock()
+	repository.InitAccount(gormDb)
+	mock = testutils.SetupGetFreeAccount(mock)
+	mock = testutils.SetupUpdateAccount(mock, 0)
+	return mock
+}
+
+func TestCreatePaymentIdempotencyKeyTaken(t *testing.T) {
+	mock := setupIdempotentCreation(t)
+	defer gock.Off()
+	wallet := model.CreateAccount(enum.Main).Address
+	other := testutils.GetWaitingPayment()
+	other.MerchantWallet = wallet
+	other.IdempotencyKey = "order-3"
+	other.RequestHash = getRequestHash(enum.Main, 100.0, "USD", wallet, "", config.Opts.PaymentExpiry)
+	payments := testutils.NewPaymentRepositoryMock()
+	repository.Payment = concurrentPaymentRepository{PaymentRepositoryMock: payments, other: other}
+	// the allocated account is freed again
+	mock = testutils.SetupUpdateAccountFree(mock, 0)
+
+	p, final, err := CreatePayment(enum.Main, 100.0, "USD", wallet, "", 0, other.IdempotencyKey)
+	if err != nil {
+		t.Fatalf("Unable to create payment %v", err)
+	}
+	if p.ID != other.ID || final.Cmp(other.GetActiveAmount()) != 0 {
+		t.Fatalf("The payment %v of the other instance should be returned, but got %v", other.ID, p.ID)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCreatePaymentIdempotencyKeyPerMerchant(t *testing.T) {
+	mock := setupIdempotentCreation(t)
+	defer gock.Off()
+	other := testutils.GetWaitingPayment()
+	other.IdempotencyKey = "order-4"
+	payments := testutils.NewPaymentRepositoryMock(other)
+	repository.Payment = payments
+
+	p, _, err := CreatePayment(enum.Main, 100.0, "USD", model.CreateAccount(enum.Main).Address, "", 0, other.IdempotencyKey)
+	if err != nil {
+		t.Fatalf("Unable to create payment %v", err)
+	}
+	if p.ID == other.ID {
+		t.Fatalf("The idempotency key of another merchant shouldn't return its payment")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCancelPayment(t *testing.T) {
+	config.ReadOpts()
+	_, client := testutils.CustomChainSetup(t)
+	config.ClientMain = client
+	mock, gormDb := testutils.NewMock()
+	repository.InitPayment(gormDb)
+	repository.InitAccount(gormDb)
+	wp := testutils.GetWaitingPayment()
+	mock = testutils.SetupGetPaymentByID(mock, wp)
+	mock = testutils.SetupUpdatePaymentStateToCancelled(mock, wp)
+
+	p, err := CancelPayment(wp.ID)
+	if err != nil {
+		t.Fatalf("Unable to cancel payment %v", err)
+	}
+	if p.CurrentPaymentState.StateID != model.Cancelled {
+		t.Fatalf("Payment is in the wrong state. Payment is \"%v\", but should be \"%v\"", model.StateName(p.CurrentPaymentState.StateID), model.StateName(model.Cancelled))
+	}
+	if !p.Account.Used || p.WatchedUntil == nil {
+		t.Fatalf("The account of the cancelled payment should be watched for late payments, but is used \"%v\" and watched until %v", p.Account.Used, p.WatchedUntil)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCancelPaymentStateChanged(t *testing.T) {
+	config.ReadOpts()
+	_, client := testutils.CustomChainSetup(t)
+	config.ClientMain = client
+	mock, gormDb := testutils.NewMock()
+	repository.InitPayment(gormDb)
+	repository.InitAccount(gormDb)
+	wp := testutils.GetWaitingPayment()
+	mock = testutils.SetupGetPaymentByID(mock, wp)
+	// a block paid the payment after it was loaded
+	mock = testutils.SetupCancelChangedPayment(mock, wp)
+
+	if _, err := CancelPayment(wp.ID); err != PaymentNotCancellable {
+		t.Fatalf("expected %v, got %v", PaymentNotCancellable, err)
 	}
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
 
+func TestCancelPaymentFundsReceived(t *testing.T) {
+	config.ReadOpts()
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	config.ClientMain = client
+	mock, gormDb := testutils.NewMock()
+	repository.InitPayment(gormDb)
+	repository.InitAccount(gormDb)
+	wp := testutils.GetWaitingPayment()
+	tx := testutils.CreateInitialPayment(client, genesisAcc, big.NewInt(10), wp.Account.Address)
+	if _, err := bind.WaitMined(context.Background(), client, tx); err != nil {
+		t.Fatalf("Can't wait until transaction is mined %v", err)
+	}
+	mock = testutils.SetupGetPaymentByID(mock, wp)
+
+	if _, err := CancelPayment(wp.ID); err != FundsReceived {
+		t.Fatalf("expected %v, got %v", FundsReceived, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestHoldRefund(t *testing.T) {
+	config.ReadOpts()
+	_, client := testutils.CustomChainSetup(t)
+	mock, gormDb := testutils.NewMock()
+	repository.InitPayment(gormDb)
+	repository.InitAccount(gormDb)
+	outgoing := testutils.NewOutgoingTransactionRepositoryMock()
+	repository.OutgoingTransaction = outgoing
+	p := testutils.GetPartiallyPayment()
+	p.SenderAddress = model.CreateAccount(enum.Main).Address
+	p.RefundStatus = model.RefundOpen
+	mock = testutils.SetupHoldRefund(mock, p)
+	mock = testutils.SetupGetRefundState(mock, p.ID, model.RefundOpen, true)
+
+	held, err := HoldRefund(p.ID, true)
+	if err != nil {
+		t.Fatalf("Unable to hold refund %v", err)
+	}
+	if !held.RefundHeld {
+		t.Fatalf("The refund should be held")
+	}
+	// the payment was loaded before the hold, the refund isn't sent anyway
+	refundPayment(client, &p)
+	if txs := outgoing.GetAll(); len(txs) != 0 {
+		t.Fatalf("A held refund shouldn't be sent, but %v transactions are recorded", len(txs))
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestEthClientAddressInteraction(t *testing.T) {
-	client, err := ethclient.Dial("https://cloudflare-eth.com")
+	c, err := rpc.Dial("https://cloudflare-eth.com")
 	if err != nil {
 		log.Fatal(err)
 	}
+	client := config.NewClient(c)
 	acc := model.CreateAccount(enum.Main)
 
 	address := common.HexToAddress(acc.Address)
@@ -256,13 +503,9 @@ func TestCheckBalanceCronWaiting(t *testing.T) {
 
 func TestCheckBalanceCronPartiallyPaid(t *testing.T) {
 	config.ReadOpts()
-	defer gock.Off() // Flush pending mocks after test execution
-	gock.New("http://localhost:8000").
-		Put("/api/internal/payment/webhook").
-		Reply(200)
 	mock, gormDb := testutils.NewMock()
 	repository.InitPayment(gormDb)
-	mock = testutils.SetupUpdatePaymentState(mock)
+	mock = testutils.SetupUpdatePaymentStateAndNotify(mock)
 	genesisAcc, client := testutils.CustomChainSetup(t)
 	p := testutils.GetWaitingPayment()
 	txInitial := testutils.CreateInitialPayment(client, genesisAcc, big.NewInt(10), p.Account.Address)
@@ -281,30 +524,15 @@ func TestCheckBalanceCronPartiallyPaid(t *testing.T) {
 
 func TestCheckBalanceCronPaidAndConfirmed(t *testing.T) {
 	config.ReadOpts()
-	defer gock.Off() // Flush pending mocks after test execution
-	// Paid
-	gock.New("http://localhost:8000").
-		Put("/api/internal/payment/webhook").
-		Reply(200)
-	// Forwarded
-	gock.New("http://localhost:8000").
-		Put("/api/internal/payment/webhook").
-		Reply(200)
-	// Confirmed
-	gock.New("http://localhost:8000").
-		Put("/api/internal/payment/webhook").
-		Reply(200)
-	// Finished
-	gock.New("http://localhost:8000").
-		Put("/api/internal/payment/webhook").
-		Reply(200)
 	mock, gormDb := testutils.NewMock()
 	repository.InitPayment(gormDb)
 	repository.InitAccount(gormDb)
+	repository.OutgoingTransaction = testutils.NewOutgoingTransactionRepositoryMock()
 	p := testutils.GetWaitingPayment()
 	amountAfterPayment := big.NewInt(0).Sub(&p.CurrentPaymentState.PayAmount.Int, &p.CurrentPaymentState.PayAmount.Int)
 	remainder := model.NewBigInt(big.NewInt(0).Add(amountAfterPayment, utils.GetChaingateEarnings(&p.CurrentPaymentState.PayAmount.Int)))
 	mock = testutils.SetupUpdatePaymentStateToPaid(mock, &p.CurrentPaymentState.PayAmount.Int)
+	mock = testutils.SetupUpdateAccount(mock, 1)
 	mock = testutils.SetupUpdatePaymentStateToConfirmed(mock, &p.CurrentPaymentState.PayAmount.Int)
 	mock = testutils.SetupUpdateAccountWithRemainder(mock, 1, &remainder.Int)
 	mock = testutils.SetupUpdatePaymentStateToForwarded(mock, &p.CurrentPaymentState.PayAmount.Int)
@@ -320,7 +548,11 @@ func TestCheckBalanceCronPaidAndConfirmed(t *testing.T) {
 	if p.CurrentPaymentState.StateID != enum.Paid {
 		t.Fatalf("Payment is in the wrong state. Payment is \"%v\", but should be \"%v\"", p.CurrentPaymentState.StateID, enum.Paid.String())
 	}
-	HandleConfirming(client, &p)
+	tx := HandleConfirming(client, &p)
+	if p.CurrentPaymentState.StateID != enum.Confirmed {
+		t.Fatalf("Payment is in the wrong state. Payment is \"%v\", but should be \"%v\"", p.CurrentPaymentState.StateID, enum.Confirmed.String())
+	}
+	trackMinedTransaction(t, client, tx, p.Mode)
 	if p.CurrentPaymentState.StateID != enum.Forwarded {
 		t.Fatalf("Payment is in the wrong state. Payment is \"%v\", but should be \"%v\"", p.CurrentPaymentState.StateID, enum.Forwarded.String())
 	}
@@ -338,33 +570,20 @@ func TestCheckBalanceCronPaidAndConfirmed(t *testing.T) {
 
 func TestCheckForwardEarnings(t *testing.T) {
 	config.ReadOpts()
-	defer gock.Off() // Flush pending mocks after test execution
-	// Paid
-	gock.New("http://localhost:8000").
-		Put("/api/internal/payment/webhook").
-		Reply(200)
-	// Forwarded
-	gock.New("http://localhost:8000").
-		Put("/api/internal/payment/webhook").
-		Reply(200)
-	// Confirmed
-	gock.New("http://localhost:8000").
-		Put("/api/internal/payment/webhook").
-		Reply(200)
-	// Finished
-	gock.New("http://localhost:8000").
-		Put("/api/internal/payment/webhook").
-		Reply(200)
 	mock, gormDb := testutils.NewMock()
 	repository.InitPayment(gormDb)
 	repository.InitAccount(gormDb)
+	outgoing := testutils.NewOutgoingTransactionRepositoryMock()
+	repository.OutgoingTransaction = outgoing
 	p := testutils.GetWaitingPayment()
 	overpayAmount := big.NewInt(0).Mul(&p.CurrentPaymentState.PayAmount.Int, big.NewInt(1000))
 	mock = testutils.SetupUpdatePaymentStateToPaid(mock, overpayAmount)
+	mock = testutils.SetupUpdateAccount(mock, 1)
 	mock = testutils.SetupUpdatePaymentStateToConfirmed(mock, overpayAmount)
 	mock = testutils.SetupUpdateAccount(mock, 1)
 	mock = testutils.SetupUpdatePaymentStateToForwarded(mock, overpayAmount)
 	mock = testutils.SetupUpdateAccount(mock, 2)
+	mock = testutils.SetupUpdateAccount(mock, 2)
 	mock = testutils.SetupUpdateAccountFree(mock, 2)
 	mock = testutils.SetupUpdatePaymentStateToFinished(mock, overpayAmount, 2, model.NewBigIntFromInt(0))
 	genesisAcc, client := testutils.CustomChainSetup(t)
@@ -374,10 +593,17 @@ func TestCheckForwardEarnings(t *testing.T) {
 		t.Fatalf("Can't wait until transaction is mined %v", err)
 	}
 	CheckBalanceStartup(client, &p)
-	HandleConfirming(client, &p)
+	tx := HandleConfirming(client, &p)
+	trackMinedTransaction(t, client, tx, p.Mode)
 	if p.CurrentPaymentState.StateID != enum.Forwarded {
 		t.Fatalf("Payment is in the wrong state. Payment is \"%v\", but should be \"%v\"", p.CurrentPaymentState.StateID, enum.Forwarded.String())
 	}
+	txs := outgoing.GetAll()
+	if len(txs) != 2 || txs[1].Kind != model.Earnings {
+		t.Fatalf("The earnings weren't sent, %v transactions are recorded", len(txs))
+	}
+	earnings, _ := txs[1].GetTransaction()
+	trackMinedTransaction(t, client, earnings, p.Mode)
 	finish(&p)
 	if p.CurrentPaymentState.StateID != enum.Finished {
 		t.Fatalf("Payment is in the wrong state. Payment is \"%v\", but should be \"%v\"", p.CurrentPaymentState.StateID, enum.Finished.String())
@@ -410,3 +636,112 @@ func TestCheckForwardEarnings(t *testing.T) {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
+
+func TestHandleConfirmingRefundsOverpayment(t *testing.T) {
+	config.ReadOpts()
+	mock, gormDb := testutils.NewMock()
+	repository.InitPayment(gormDb)
+	repository.InitAccount(gormDb)
+	outgoing := testutils.NewOutgoingTransactionRepositoryMock()
+	repository.OutgoingTransaction = outgoing
+	p := testutils.GetWaitingPayment()
+	p.SenderAddress = model.CreateAccount(enum.Main).Address
+	paidAmount := big.NewInt(0).Mul(&p.CurrentPaymentState.PayAmount.Int, big.NewInt(3))
+	mock = testutils.SetupUpdatePaymentStateToPaid(mock, paidAmount)
+	mock = testutils.SetupUpdateAccount(mock, 2)
+	mock = testutils.SetupRefundOverpayment(mock, paidAmount)
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	txInitial := testutils.CreateInitialPayment(client, genesisAcc, paidAmount, p.Account.Address)
+	_, err := bind.WaitMined(context.Background(), client, txInitial)
+	if err != nil {
+		t.Fatalf("Can't wait until transaction is mined %v", err)
+	}
+	CheckBalanceStartup(client, &p)
+	HandleConfirming(client, &p)
+	if p.CurrentPaymentState.StateID != enum.Confirmed {
+		t.Fatalf("Payment is in the wrong state. Payment is \"%v\", but should be \"%v\"", model.StateName(p.CurrentPaymentState.StateID), enum.Confirmed.String())
+	}
+	if refunded := p.PaymentStates[len(p.PaymentStates)-2].StateID; refunded != model.OverpaidRefunded {
+		t.Fatalf("The refund should be recorded before the payment is confirmed, but the state is \"%v\"", model.StateName(refunded))
+	}
+
+	txs := outgoing.GetAll()
+	if len(txs) != 2 || txs[1].Kind != model.Refund {
+		t.Fatalf("The overpayment wasn't refunded, %v transactions are recorded", len(txs))
+	}
+	refund, _ := txs[1].GetTransaction()
+	overpayment := big.NewInt(0).Sub(paidAmount, &p.CurrentPaymentState.PayAmount.Int)
+	expected := big.NewInt(0).Sub(overpayment, big.NewInt(0).Mul(config.Chain.GasPrice, big.NewInt(21000)))
+	if *refund.To() != common.HexToAddress(p.SenderAddress) || refund.Value().Cmp(expected) != 0 {
+		t.Fatalf("Refund sends %v to %v, but should send %v to %v", refund.Value(), refund.To(), expected, p.SenderAddress)
+	}
+	if _, err = bind.WaitMined(context.Background(), client, refund); err != nil {
+		t.Fatalf("Can't wait until refund is mined %v", err)
+	}
+	balance, _ := bc.GetBalanceAt(client, common.HexToAddress(p.SenderAddress))
+	if balance.Cmp(expected) != 0 {
+		t.Fatalf("Sender received %v, but should receive %v", balance, expected)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestExpireRefundsPartialPayment(t *testing.T) {
+	config.ReadOpts()
+	mock, gormDb := testutils.NewMock()
+	repository.InitPayment(gormDb)
+	repository.InitAccount(gormDb)
+	outgoing := testutils.NewOutgoingTransactionRepositoryMock()
+	repository.OutgoingTransaction = outgoing
+	p := testutils.GetPartiallyPayment()
+	p.SenderAddress = model.CreateAccount(enum.Main).Address
+	mock = testutils.SetupRefundPayment(mock, p)
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	received := big.NewInt(0).Div(&p.CurrentPaymentState.PayAmount.Int, big.NewInt(2))
+	txInitial := testutils.CreateInitialPayment(client, genesisAcc, received, p.Account.Address)
+	if _, err := bind.WaitMined(context.Background(), client, txInitial); err != nil {
+		t.Fatalf("Can't wait until transaction is mined %v", err)
+	}
+
+	Expire(&p, received)
+	if p.CurrentPaymentState.StateID != enum.Expired || p.RefundStatus != model.RefundOpen || !p.Account.Used {
+		t.Fatalf("Payment should be expired with an open refund, but is \"%v\" with refund \"%v\"", model.StateName(p.CurrentPaymentState.StateID), p.RefundStatus)
+	}
+	refundPayment(client, &p)
+	txs := outgoing.GetAll()
+	if p.RefundStatus != model.RefundSent || len(txs) != 1 || txs[0].Kind != model.Refund {
+		t.Fatalf("The refund wasn't sent, refund is \"%v\" and %v transactions are recorded", p.RefundStatus, len(txs))
+	}
+	refund, _ := txs[0].GetTransaction()
+	expected := big.NewInt(0).Sub(received, big.NewInt(0).Mul(config.Chain.GasPrice, big.NewInt(21000)))
+	if *refund.To() != common.HexToAddress(p.SenderAddress) || refund.Value().Cmp(expected) != 0 {
+		t.Fatalf("Refund sends %v to %v, but should send %v to %v", refund.Value(), refund.To(), expected, p.SenderAddress)
+	}
+
+	trackMinedTransaction(t, client, refund, p.Mode)
+	if p.CurrentPaymentState.StateID != model.Refunded || p.RefundStatus != model.RefundDone {
+		t.Fatalf("Payment is in the wrong state. Payment is \"%v\", but should be \"%v\"", model.StateName(p.CurrentPaymentState.StateID), model.StateName(model.Refunded))
+	}
+	// the account is watched for late payments, which are refunded to their own sender
+	if !p.Account.Used || p.WatchedUntil == nil {
+		t.Fatalf("Account should be watched for late payments after the refund")
+	}
+	if len(p.Contributions) != 0 || p.SenderAddress != "" {
+		t.Fatalf("The senders of the refunded funds should be forgotten, but %v is still the sender", p.SenderAddress)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func trackMinedTransaction(t *testing.T, client *config.Client, tx *types.Transaction, mode enum.Mode) {
+	if tx == nil {
+		t.Fatalf("Transaction wasn't sent")
+	}
+	receipt, err := bind.WaitMined(context.Background(), client, tx)
+	if err != nil {
+		t.Fatalf("Can't wait until transaction is mined %v", err)
+	}
+	TrackOutgoingTransactions(client, receipt.BlockNumber, mode, &receipt.BlockHash)
+}
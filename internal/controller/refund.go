@@ -0,0 +1,218 @@
+package controller
+
+import (
+	"errors"
+	"ethereum-service/internal/bc"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/logging"
+	"ethereum-service/internal/repository"
+	"ethereum-service/model"
+	"math/big"
+	"sync"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	RefundAlreadySent = errors.New("the refund of the payment is already sent")
+	RefundInProgress  = errors.New("the refund of the payment is sent at the moment")
+)
+
+// payments which are refunded at the moment
+var refunding sync.Map
+
+/*
+	Ends an expired or failed payment. If funds were received, they are refunded to the sender with the next block and the account stays used until the refund is mined.
+	Without a known sender, the funds stay on the address as remainder. The account of an expired payment is watched for late payments first (see watchLatePayments).
+*/
+func endUnpaid(payment *model.Payment, balance *big.Int, state enum.State) {
+	if payment.SenderAddress == "" && state == enum.Expired && startLatePaymentWatch(payment) {
+		updateState(payment, nil, state)
+		return
+	}
+	if payment.SenderAddress == "" {
+		release(payment, balance, state)
+		return
+	}
+	payment.RefundStatus = model.RefundOpen
+	updateState(payment, nil, state)
+}
+
+// RefundPayments
+/*
+	Sends the open refunds of expired and failed payments. A refund which can't be sent is tried again with the next block.
+*/
+func RefundPayments(client *config.Client, mode enum.Mode) {
+	payments := repository.Payment.GetOpenRefunds(mode)
+	for i := range payments {
+		refundPayment(client, &payments[i])
+	}
+}
+
+/*
+	Sends the refunds to the senders of the payment, which don't have one yet. The refund is sent, when every sender has one.
+	The payment is loaded before the lock is taken, so its refund state is read again under the lock, e.g. an admin may have held it in the meantime.
+*/
+func refundPayment(client *config.Client, payment *model.Payment) {
+	if _, running := refunding.LoadOrStore(payment.ID, true); running {
+		return
+	}
+	defer refunding.Delete(payment.ID)
+
+	status, held, err := repository.Payment.GetRefundState(payment.ID)
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Error in getting refund state")
+		return
+	}
+	if held || status != model.RefundOpen {
+		logging.WithPayment(payment).WithFields(logrus.Fields{"refund_status": status, "refund_held": held}).Info("Refund isn't open anymore")
+		return
+	}
+	if isGasFundingPending(payment) {
+		logging.WithPayment(payment).Info("Refund waits until the gas funding is mined")
+		return
+	}
+	if isOverpaid(payment) {
+		refundOverpayment(client, payment)
+		return
+	}
+
+	refunds, err := repository.OutgoingTransaction.GetAllActiveByPayment(payment.ID, model.Refund)
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Error in getting refund")
+		return
+	}
+	refunded := make(map[common.Address]bool)
+	for _, refund := range refunds {
+		tx, err := refund.GetTransaction()
+		if err != nil {
+			logging.WithOutgoing(&refund).WithError(err).Error("Unable to decode outgoing transaction")
+			return
+		}
+		recipient, err := bc.GetTransferRecipient(tx)
+		if err != nil {
+			logging.WithOutgoing(&refund).WithError(err).Error("Unable to get recipient of refund")
+			return
+		}
+		refunded[recipient] = true
+		payment.RefundTransactionHash = refund.Hash
+	}
+
+	recorder := newOutgoingRecorder(payment)
+	err = bc.RefundPayment(client, payment, refunded, recorder)
+	if recorder.isRecorded(model.Refund) {
+		// account needs to explicit be updated, because the payment alone isn't enough. GORM tries to create a new one and fails.
+		if updateErr := repository.Account.Update(&payment.Account); updateErr != nil {
+			logging.WithPayment(payment).WithError(updateErr).Error("Couldn't write wallet to database")
+		}
+	}
+	switch {
+	case errors.Is(err, bc.NothingToRefund) && len(refunds) == 0 && !recorder.isRecorded(model.Refund):
+		logging.WithPayment(payment).Info("Nothing to refund, the funds stay as remainder")
+		payment.RefundStatus = ""
+		releaseOrWatch(client, payment)
+		repository.Payment.UpdatePaymentState(payment)
+		return
+	case err != nil && !errors.Is(err, bc.NothingToRefund):
+		logging.WithPayment(payment).WithError(err).Warn("Unable to refund payment. Try again next block")
+		if recorder.isRecorded(model.Refund) {
+			repository.Payment.UpdatePaymentState(payment)
+		}
+		return
+	}
+	payment.RefundStatus = model.RefundSent
+	repository.Payment.UpdatePaymentState(payment)
+}
+
+/*
+	A paid payment has an open refund only if the refund of its overpayment failed.
+*/
+func isOverpaid(payment *model.Payment) bool {
+	switch payment.CurrentPaymentState.StateID {
+	case enum.Paid, model.OverpaidRefunded, enum.Confirmed, enum.Forwarded:
+		return true
+	}
+	return false
+}
+
+/*
+	Sends the refund of the overpayment again, after it failed. When the new refund is mined, the payment continues like after the first one.
+	An overpayment which doesn't cover the fees anymore stays on the address like a tolerated one.
+*/
+func refundOverpayment(client *config.Client, payment *model.Payment) {
+	recorder := newOutgoingRecorder(payment)
+	err := bc.RefundOverpayment(client, payment, recorder)
+	if err != nil && !errors.Is(err, bc.NothingToRefund) {
+		logging.WithPayment(payment).WithError(err).Warn("Unable to refund overpayment. Try again next block")
+		return
+	}
+	if recorder.isRecorded(model.Refund) {
+		// account needs to explicit be updated, because the payment alone isn't enough. GORM tries to create a new one and fails.
+		if err := repository.Account.Update(&payment.Account); err != nil {
+			logging.WithPayment(payment).WithError(err).Error("Couldn't write wallet to database")
+		}
+		logging.WithPayment(payment).WithFields(logrus.Fields{logging.TxHash: payment.RefundTransactionHash, "sender": payment.SenderAddress}).Info("Overpayment is refunded again")
+	}
+	payment.RefundStatus = ""
+	repository.Payment.UpdatePaymentState(payment)
+	if errors.Is(err, bc.NothingToRefund) {
+		logging.WithPayment(payment).Info("Overpayment doesn't cover the fees of a refund anymore, it stays on the address")
+		overpaymentRefunded(client, payment)
+	}
+}
+
+/*
+	The refund of an expired or failed payment is mined. The account is released or watched for late payments (see releaseOrWatch).
+*/
+func refunded(client *config.Client, payment *model.Payment) {
+	releaseOrWatch(client, payment)
+	payment.RefundStatus = model.RefundDone
+	updateState(payment, nil, model.Refunded)
+}
+
+func releaseAccount(client *config.Client, payment *model.Payment) {
+	payment.Account.Used = false
+	writeRemainder(client, payment)
+}
+
+/*
+	Takes the balance which is left on the address as remainder of the account, so it isn't counted as payment, and writes the account.
+*/
+func writeRemainder(client *config.Client, payment *model.Payment) {
+	account := &payment.Account
+	balance, err := bc.GetBalanceAt(client, common.HexToAddress(account.Address))
+	if err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Unable to get balance of chaingate wallet")
+	} else {
+		account.Remainder = model.NewBigInt(balance)
+	}
+	if err = repository.Account.Update(account); err != nil {
+		logging.WithPayment(payment).WithError(err).Error("Couldn't write wallet to database")
+	}
+}
+
+// HoldRefund
+/*
+	Holds the refund of a payment for a manual review or releases the hold again. A held refund isn't sent, when the payment expires or fails.
+	A refund which is already sent can't be held anymore.
+*/
+func HoldRefund(id uuid.UUID, hold bool) (*model.Payment, error) {
+	if _, running := refunding.LoadOrStore(id, true); running {
+		return nil, RefundInProgress
+	}
+	defer refunding.Delete(id)
+
+	payment, err := repository.Payment.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if payment.RefundStatus == model.RefundSent || payment.RefundStatus == model.RefundDone {
+		return payment, RefundAlreadySent
+	}
+	payment.RefundHeld = hold
+	repository.Payment.UpdatePaymentState(payment)
+	return payment, nil
+}
@@ -0,0 +1,260 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"ethereum-service/database"
+	"ethereum-service/internal/bc"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/controller"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+)
+
+const (
+	StatusOk   = "ok"
+	StatusFail = "fail"
+	// StatusWarn a failed check, which is only a detail and doesn't fail the report
+	StatusWarn = "warn"
+)
+
+// Check result of one dependency
+type Check struct {
+	Name    string                 `json:"name"`
+	Status  string                 `json:"status"`
+	Error   string                 `json:"error,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Report body of /healthz and /readyz. Status is only ok if no check failed.
+type Report struct {
+	Status string  `json:"status"`
+	Checks []Check `json:"checks"`
+}
+
+type checker struct {
+	name  string
+	check func(ctx context.Context) (map[string]interface{}, error)
+	// detailOnly the check is reported, but a failure doesn't fail the report
+	detailOnly bool
+}
+
+type processedHead struct {
+	number *big.Int
+	at     time.Time
+}
+
+var (
+	started = time.Now()
+
+	processedHeadsLock sync.RWMutex
+	processedHeads     = make(map[enum.Mode]processedHead)
+
+	modes = []enum.Mode{enum.Main, enum.Test}
+)
+
+// Register
+/*
+	Registers HeadProcessed for the processed blocks, so the controller doesn't depend on the health checks. Has to be called before the heads are processed.
+*/
+func Register() {
+	controller.OnBlockProcessed(HeadProcessed)
+}
+
+// HeadProcessed
+/*
+	Records that a block of the mode was processed. The head check fails if no block was processed for HEAD_MAX_AGE seconds.
+*/
+func HeadProcessed(mode enum.Mode, number *big.Int) {
+	processedHeadsLock.Lock()
+	defer processedHeadsLock.Unlock()
+	processedHeads[mode] = processedHead{number: number, at: time.Now()}
+}
+
+// LivenessHandler
+/*
+	Serves /healthz. Only the process itself is checked: it is ok as long as it answers. A stalled head or an unavailable dependency fails /readyz,
+	because restarting the process doesn't resolve them.
+*/
+func LivenessHandler() http.Handler {
+	return handler(livenessCheckers)
+}
+
+// ReadinessHandler
+/*
+	Serves /readyz. Checks the database, the rpc client and the processed heads of each mode and if the proxy is reachable, when it is a price source.
+	The backend is only reported, the notifications wait until it is reachable again.
+*/
+func ReadinessHandler() http.Handler {
+	return handler(readinessCheckers)
+}
+
+func handler(checkers func() []checker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := run(r.Context(), checkers())
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		if report.Status == StatusOk {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+func livenessCheckers() []checker {
+	return []checker{{name: "process", check: checkProcess}}
+}
+
+func readinessCheckers() []checker {
+	checkers := []checker{{name: "database", check: checkDatabase}}
+	for _, mode := range modes {
+		checkers = append(checkers, rpcChecker(mode), headChecker(mode))
+	}
+	backend := reachableChecker("backend", config.Opts.BackendBaseUrl)
+	backend.detailOnly = true
+	checkers = append(checkers, backend)
+	if isPriceSource("proxy") {
+		checkers = append(checkers, reachableChecker("proxy", config.Opts.ProxyBaseUrl))
+	}
+	return checkers
+}
+
+func isPriceSource(name string) bool {
+	for _, source := range strings.Split(config.Opts.PriceSources, ",") {
+		if strings.TrimSpace(source) == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Runs the checks in parallel. A check which takes longer than HEALTH_CHECK_TIMEOUT seconds fails.
+*/
+func run(ctx context.Context, checkers []checker) Report {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.Opts.HealthCheckTimeout)*time.Second)
+	defer cancel()
+
+	report := Report{Status: StatusOk, Checks: make([]Check, len(checkers))}
+	var wg sync.WaitGroup
+	for i, c := range checkers {
+		wg.Add(1)
+		go func(i int, c checker) {
+			defer wg.Done()
+			details, err := c.check(ctx)
+			report.Checks[i] = Check{Name: c.name, Status: StatusOk, Details: details}
+			if err != nil && c.detailOnly {
+				report.Checks[i].Status = StatusWarn
+				report.Checks[i].Error = err.Error()
+			} else if err != nil {
+				report.Checks[i].Status = StatusFail
+				report.Checks[i].Error = err.Error()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, c := range report.Checks {
+		if c.Status == StatusFail {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+func checkProcess(ctx context.Context) (map[string]interface{}, error) {
+	return map[string]interface{}{"uptime_seconds": int64(time.Since(started).Seconds())}, nil
+}
+
+func checkDatabase(ctx context.Context) (map[string]interface{}, error) {
+	if database.DB == nil {
+		return nil, errors.New("not connected")
+	}
+	db, err := database.DB.DB()
+	if err != nil {
+		return nil, err
+	}
+	return nil, db.PingContext(ctx)
+}
+
+func rpcChecker(mode enum.Mode) checker {
+	return checker{name: "rpc_" + modeName(mode), check: func(ctx context.Context) (map[string]interface{}, error) {
+		client := bc.GetClientByMode(mode)
+		if client == nil {
+			return nil, errors.New("not connected")
+		}
+		number, err := client.BlockNumber(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"block": number}, nil
+	}}
+}
+
+/*
+	Fails if no block was processed for HEAD_MAX_AGE seconds. Before the first block the age is counted from the start of the service.
+*/
+func headChecker(mode enum.Mode) checker {
+	return checker{name: "head_" + modeName(mode), check: func(ctx context.Context) (map[string]interface{}, error) {
+		details := make(map[string]interface{})
+		if status, ok := bc.GetHeadSourceStatus(mode); ok {
+			details["head_source"] = status.State.String()
+			details["reconnects"] = status.Reconnects
+			if status.LastError != "" {
+				details["last_error"] = status.LastError
+			}
+		}
+
+		processedHeadsLock.RLock()
+		head, ok := processedHeads[mode]
+		processedHeadsLock.RUnlock()
+		last := started
+		if ok {
+			last = head.at
+			details["block"] = head.number.Uint64()
+		}
+		age := time.Since(last)
+		details["seconds_since_head"] = int64(age.Seconds())
+		if age > time.Duration(config.Opts.HeadMaxAge)*time.Second {
+			return details, fmt.Errorf("no block processed for %v", age.Round(time.Second))
+		}
+		return details, nil
+	}}
+}
+
+/*
+	The service is reachable if it answers, e.g. a 404 of the base url. Only a server error or no answer fails.
+*/
+func reachableChecker(name string, url string) checker {
+	return checker{name: name, check: func(ctx context.Context) (map[string]interface{}, error) {
+		if url == "" {
+			return nil, errors.New("url isn't configured")
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		details := map[string]interface{}{"status_code": resp.StatusCode}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return details, fmt.Errorf("%v answers with %v", url, resp.Status)
+		}
+		return details, nil
+	}}
+}
+
+func modeName(mode enum.Mode) string {
+	return strings.ToLower(mode.String())
+}
@@ -0,0 +1,153 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/testutils"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+)
+
+func TestHeadChecker(t *testing.T) {
+	config.ReadOpts()
+	HeadProcessed(enum.Test, big.NewInt(10))
+	details, err := headChecker(enum.Test).check(context.Background())
+	if err != nil {
+		t.Fatalf("A just processed head should be ok, but is %v", err)
+	}
+	if details["block"] != uint64(10) {
+		t.Fatalf(`Block should be %v, but is %v`, 10, details["block"])
+	}
+
+	processedHeadsLock.Lock()
+	processedHeads[enum.Test] = processedHead{number: big.NewInt(10), at: time.Now().Add(-time.Duration(config.Opts.HeadMaxAge+1) * time.Second)}
+	processedHeadsLock.Unlock()
+	if _, err = headChecker(enum.Test).check(context.Background()); err == nil {
+		t.Fatalf("A stalled head should fail")
+	}
+}
+
+func TestRPCChecker(t *testing.T) {
+	config.ReadOpts()
+	_, client := testutils.CustomChainSetup(t)
+	config.ClientTest = client
+	defer func() { config.ClientTest = nil }()
+	if _, err := rpcChecker(enum.Test).check(context.Background()); err != nil {
+		t.Fatalf("The rpc client should be ok, but is %v", err)
+	}
+	config.ClientMain = nil
+	if _, err := rpcChecker(enum.Main).check(context.Background()); err == nil {
+		t.Fatalf("A missing rpc client should fail")
+	}
+}
+
+func TestReachableChecker(t *testing.T) {
+	config.ReadOpts()
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	if _, err := reachableChecker("backend", notFound.URL).check(context.Background()); err != nil {
+		t.Fatalf("A service which answers should be reachable, but is %v", err)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	if _, err := reachableChecker("backend", failing.URL).check(context.Background()); err == nil {
+		t.Fatalf("A service with a server error should fail")
+	}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	if _, err := reachableChecker("backend", closed.URL).check(context.Background()); err == nil {
+		t.Fatalf("A service which doesn't answer should fail")
+	}
+}
+
+func TestLivenessHandler(t *testing.T) {
+	config.ReadOpts()
+	// a stalled head only fails the readiness
+	processedHeadsLock.Lock()
+	processedHeads[enum.Main] = processedHead{number: big.NewInt(20), at: time.Now().Add(-time.Duration(config.Opts.HeadMaxAge+1) * time.Second)}
+	processedHeadsLock.Unlock()
+	rec := httptest.NewRecorder()
+	LivenessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf(`Status code should be %v, but is %v: %v`, http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var report Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Body isn't json %v", err)
+	}
+	if report.Status != StatusOk || len(report.Checks) != 1 || report.Checks[0].Name != "process" {
+		t.Fatalf("Report is wrong %+v", report)
+	}
+}
+
+func TestReadinessHandlerWithoutDatabase(t *testing.T) {
+	config.ReadOpts()
+	processedHeadsLock.Lock()
+	processedHeads[enum.Main] = processedHead{number: big.NewInt(20), at: time.Now().Add(-time.Duration(config.Opts.HeadMaxAge+1) * time.Second)}
+	processedHeadsLock.Unlock()
+	rec := httptest.NewRecorder()
+	ReadinessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf(`Status code should be %v, but is %v`, http.StatusServiceUnavailable, rec.Code)
+	}
+	var report Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Body isn't json %v", err)
+	}
+	if report.Checks[0].Name != "database" || report.Checks[0].Error != "not connected" {
+		t.Fatalf("Database check is wrong %+v", report.Checks[0])
+	}
+	for _, c := range report.Checks {
+		if c.Name == "head_main" && c.Status != StatusFail {
+			t.Fatalf("The stalled head should fail the readiness %+v", c)
+		}
+	}
+}
+
+func TestReadinessCheckers(t *testing.T) {
+	config.ReadOpts()
+	priceSources := config.Opts.PriceSources
+	defer func() { config.Opts.PriceSources = priceSources }()
+
+	config.Opts.PriceSources = "oracle"
+	for _, c := range readinessCheckers() {
+		if c.name == "proxy" {
+			t.Fatalf("The proxy shouldn't be checked, if it isn't a price source")
+		}
+	}
+	config.Opts.PriceSources = "oracle, proxy"
+	checked := false
+	for _, c := range readinessCheckers() {
+		checked = checked || c.name == "proxy"
+	}
+	if !checked {
+		t.Fatalf("The proxy should be checked, if it is a price source")
+	}
+}
+
+func TestRunDetailOnlyCheck(t *testing.T) {
+	config.ReadOpts()
+	report := run(context.Background(), []checker{
+		{name: "process", check: checkProcess},
+		{name: "backend", check: func(ctx context.Context) (map[string]interface{}, error) {
+			return nil, errors.New("unreachable")
+		}, detailOnly: true},
+	})
+	if report.Status != StatusOk {
+		t.Fatalf("A check which is only a detail shouldn't fail the report %+v", report)
+	}
+	if report.Checks[1].Status != StatusWarn || report.Checks[1].Error != "unreachable" {
+		t.Fatalf("The failed check should be reported %+v", report.Checks[1])
+	}
+}
@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"ethereum-service/model"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/sirupsen/logrus"
+)
+
+// field names, which are the same in every log entry, so the entries of a payment or block can be filtered
+const (
+	PaymentID = "payment_id"
+	Account   = "account"
+	Mode      = "mode"
+	Block     = "block"
+	TxHash    = "tx_hash"
+)
+
+// Init
+/*
+	Sets the level (e.g. debug, info, warn, error) and the format (text or json) of the logger.
+	The log package of the standard library (e.g. used by gorm and the generated api) writes its logs as info into this logger.
+*/
+func Init(level string, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(lvl)
+	switch strings.ToLower(format) {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case "text", "":
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	log.SetFlags(0)
+	log.SetOutput(logrus.StandardLogger().WriterLevel(logrus.InfoLevel))
+	return nil
+}
+
+func ModeName(mode enum.Mode) string {
+	return strings.ToLower(mode.String())
+}
+
+/*
+	Entry with the id, the account address and the mode of the payment.
+*/
+func WithPayment(payment *model.Payment) *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		PaymentID: payment.ID.String(),
+		Account:   payment.Account.Address,
+		Mode:      ModeName(payment.Mode),
+	})
+}
+
+/*
+	Entry with the hash, the kind and the sender of the outgoing transaction and the id of its payment.
+*/
+func WithOutgoing(outgoing *model.OutgoingTransaction) *logrus.Entry {
+	entry := logrus.WithFields(logrus.Fields{
+		TxHash:  outgoing.Hash,
+		Account: outgoing.FromAddress,
+		Mode:    ModeName(outgoing.Mode),
+		"kind":  string(outgoing.Kind),
+	})
+	if outgoing.PaymentID != nil {
+		entry = entry.WithField(PaymentID, outgoing.PaymentID.String())
+	}
+	return entry
+}
+
+func WithMode(mode enum.Mode) *logrus.Entry {
+	return logrus.WithField(Mode, ModeName(mode))
+}
+
+func WithBlock(mode enum.Mode, number *big.Int) *logrus.Entry {
+	entry := WithMode(mode)
+	if number == nil {
+		return entry
+	}
+	return entry.WithField(Block, number.Uint64())
+}
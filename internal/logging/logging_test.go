@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"ethereum-service/model"
+	"testing"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+func TestInitJson(t *testing.T) {
+	if err := Init("debug", "json"); err != nil {
+		t.Fatalf("Unable to init logger %v", err)
+	}
+	defer Init("info", "text")
+	if logrus.GetLevel() != logrus.DebugLevel {
+		t.Fatalf(`Level should be "%v", but is "%v"`, logrus.DebugLevel, logrus.GetLevel())
+	}
+	if _, ok := logrus.StandardLogger().Formatter.(*logrus.JSONFormatter); !ok {
+		t.Fatalf("Formatter should be json")
+	}
+}
+
+func TestInitInvalid(t *testing.T) {
+	if err := Init("verbose", "text"); err == nil {
+		t.Fatalf("An unknown level should return an error")
+	}
+	if err := Init("info", "xml"); err == nil {
+		t.Fatalf("An unknown format should return an error")
+	}
+}
+
+func TestWithPayment(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.StandardLogger()
+	logger.SetOutput(&out)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	defer Init("info", "text")
+
+	payment := model.Payment{Mode: enum.Main, Account: model.Account{Address: "0xcDd9C81f1855Bfd6a309A395b53f273d539ad7aa"}}
+	payment.ID = uuid.New()
+	WithPayment(&payment).Info("test")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Log entry isn't json %v", err)
+	}
+	if entry[PaymentID] != payment.ID.String() || entry[Account] != payment.Account.Address || entry[Mode] != "main" {
+		t.Fatalf("Log entry has the wrong fields %v", entry)
+	}
+}
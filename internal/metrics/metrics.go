@@ -0,0 +1,230 @@
+package metrics
+
+import (
+	"errors"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/logging"
+	"ethereum-service/internal/repository"
+	"ethereum-service/model"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/ethereum/go-ethereum"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "chaingate"
+
+var (
+	paymentsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "payments_created_total",
+		Help:      "Created payments per mode.",
+	}, []string{"mode"})
+	paymentStates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "payment_states_total",
+		Help:      "Payments which reached a state (e.g. paid, expired, failed) per mode.",
+	}, []string{"mode", "state"})
+	stateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "payment_state_duration_seconds",
+		Help:      "Seconds a payment was in a state before the transition to the next state, e.g. waiting to paid and paid to finished.",
+		Buckets:   []float64{15, 30, 60, 120, 300, 600, 900, 1800, 3600, 7200, 21600, 86400},
+	}, []string{"mode", "from", "to"})
+	paidToFinished = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "payment_paid_to_finished_seconds",
+		Help:      "Seconds from the payment being paid until it's finished, i.e. confirmed and forwarded.",
+		Buckets:   []float64{15, 30, 60, 120, 300, 600, 900, 1800, 3600, 7200, 21600, 86400},
+	}, []string{"mode"})
+	headBlock = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "head_block_number",
+		Help:      "Number of the latest head of the chain per mode.",
+	}, []string{"mode"})
+	processedBlock = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "processed_block_number",
+		Help:      "Number of the last processed block per mode.",
+	}, []string{"mode"})
+	headLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "head_lag_blocks",
+		Help:      "Blocks between the head and the last processed block per mode.",
+	}, []string{"mode"})
+	rpcCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_calls_total",
+		Help:      "Calls to the ethereum node per JSON-RPC method.",
+	}, []string{"method"})
+	rpcErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_errors_total",
+		Help:      "Failed calls to the ethereum node per JSON-RPC method. A not found result isn't an error.",
+	}, []string{"method"})
+	notificationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notification_failures_total",
+		Help:      "Failed deliveries of notifications to the backend. dead is true, if the notification isn't retried anymore.",
+	}, []string{"dead"})
+	gasUsed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outgoing_gas_used_total",
+		Help:      "Gas used by the mined outgoing transactions per mode and kind (forward, earnings, refund).",
+	}, []string{"mode", "kind"})
+	feesPaid = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outgoing_fees_wei_total",
+		Help:      "Fees in wei paid for the mined outgoing transactions per mode and kind (forward, earnings, refund).",
+	}, []string{"mode", "kind"})
+
+	registry = prometheus.NewRegistry()
+
+	headsLock sync.Mutex
+	heads     = make(map[enum.Mode]*big.Int)
+	processed = make(map[enum.Mode]*big.Int)
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		paymentsCreated, paymentStates, stateDuration, paidToFinished,
+		headBlock, processedBlock, headLag,
+		rpcCalls, rpcErrors,
+		notificationFailures, gasUsed, feesPaid,
+		&accountCollector{},
+	)
+}
+
+// Register
+/*
+	Registers RPCCall for the calls of the clients, so they don't have to count them. Has to be called before the clients are used.
+*/
+func Register() {
+	config.OnRPCCall(RPCCall)
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+func modeLabel(mode enum.Mode) string {
+	return strings.ToLower(mode.String())
+}
+
+func PaymentCreated(mode enum.Mode) {
+	paymentsCreated.WithLabelValues(modeLabel(mode)).Inc()
+}
+
+/*
+	Counts the new state and observes how long the payment was in the previous state.
+*/
+func StateChanged(mode enum.Mode, from enum.State, to enum.State, since time.Time) {
+	paymentStates.WithLabelValues(modeLabel(mode), model.StateName(to)).Inc()
+	if !since.IsZero() {
+		stateDuration.WithLabelValues(modeLabel(mode), model.StateName(from), model.StateName(to)).Observe(time.Since(since).Seconds())
+	}
+}
+
+/*
+	Observes how long the payment took from being paid until it was finished. Nothing is observed without the time it was paid.
+*/
+func PaymentFinished(mode enum.Mode, paidAt time.Time) {
+	if !paidAt.IsZero() {
+		paidToFinished.WithLabelValues(modeLabel(mode)).Observe(time.Since(paidAt).Seconds())
+	}
+}
+
+func SetHead(mode enum.Mode, number *big.Int) {
+	headsLock.Lock()
+	defer headsLock.Unlock()
+	heads[mode] = number
+	headBlock.WithLabelValues(modeLabel(mode)).Set(float64(number.Int64()))
+	updateLag(mode)
+}
+
+func SetProcessedBlock(mode enum.Mode, number *big.Int) {
+	headsLock.Lock()
+	defer headsLock.Unlock()
+	processed[mode] = number
+	processedBlock.WithLabelValues(modeLabel(mode)).Set(float64(number.Int64()))
+	updateLag(mode)
+}
+
+func updateLag(mode enum.Mode) {
+	head, last := heads[mode], processed[mode]
+	if head == nil || last == nil {
+		return
+	}
+	lag := big.NewInt(0).Sub(head, last)
+	if lag.Sign() < 0 {
+		lag.SetInt64(0)
+	}
+	headLag.WithLabelValues(modeLabel(mode)).Set(float64(lag.Int64()))
+}
+
+/*
+	Counts a call of the JSON-RPC method and its error. ethereum.NotFound is a result, e.g. of a pending transaction, and no error.
+*/
+func RPCCall(method string, err error) {
+	rpcCalls.WithLabelValues(method).Inc()
+	if err != nil && !errors.Is(err, ethereum.NotFound) {
+		rpcErrors.WithLabelValues(method).Inc()
+	}
+}
+
+func NotificationFailed(dead bool) {
+	if dead {
+		notificationFailures.WithLabelValues("true").Inc()
+		return
+	}
+	notificationFailures.WithLabelValues("false").Inc()
+}
+
+func OutgoingMined(mode enum.Mode, kind model.OutgoingTransactionKind, gas uint64, fee *big.Int) {
+	gasUsed.WithLabelValues(modeLabel(mode), string(kind)).Add(float64(gas))
+	if fee != nil {
+		wei, _ := new(big.Float).SetInt(fee).Float64()
+		feesPaid.WithLabelValues(modeLabel(mode), string(kind)).Add(wei)
+	}
+}
+
+var accountsDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "accounts"), "Accounts per mode, which are used by a payment or free.", []string{"mode", "used"}, nil)
+
+/*
+	Counts the accounts in the database on every scrape.
+*/
+type accountCollector struct{}
+
+func (c *accountCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- accountsDesc
+}
+
+func (c *accountCollector) Collect(ch chan<- prometheus.Metric) {
+	if repository.Account == nil {
+		return
+	}
+	for _, mode := range []enum.Mode{enum.Main, enum.Test} {
+		for _, used := range []bool{true, false} {
+			count, err := repository.Account.Count(mode, used)
+			if err != nil {
+				logging.WithMode(mode).WithError(err).Error("Unable to count accounts")
+				continue
+			}
+			usedLabel := "false"
+			if used {
+				usedLabel = "true"
+			}
+			ch <- prometheus.MustNewConstMetric(accountsDesc, prometheus.GaugeValue, float64(count), modeLabel(mode), usedLabel)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/ethereum/go-ethereum"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHeadLag(t *testing.T) {
+	SetHead(enum.Test, big.NewInt(100))
+	SetProcessedBlock(enum.Test, big.NewInt(97))
+	if lag := testutil.ToFloat64(headLag.WithLabelValues("test")); lag != 3 {
+		t.Fatalf(`Lag is %v, but should be %v`, lag, 3)
+	}
+	SetProcessedBlock(enum.Test, big.NewInt(100))
+	if lag := testutil.ToFloat64(headLag.WithLabelValues("test")); lag != 0 {
+		t.Fatalf(`Lag is %v, but should be %v`, lag, 0)
+	}
+}
+
+func TestRPCCall(t *testing.T) {
+	RPCCall("eth_getTransactionReceipt", nil)
+	RPCCall("eth_getTransactionReceipt", ethereum.NotFound)
+	RPCCall("eth_getTransactionReceipt", errors.New("connection refused"))
+	if calls := testutil.ToFloat64(rpcCalls.WithLabelValues("eth_getTransactionReceipt")); calls != 3 {
+		t.Fatalf(`There should be %v calls, but there are %v`, 3, calls)
+	}
+	if errs := testutil.ToFloat64(rpcErrors.WithLabelValues("eth_getTransactionReceipt")); errs != 1 {
+		t.Fatalf(`A not found result isn't an error, there should be %v error, but there are %v`, 1, errs)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	PaymentCreated(enum.Main)
+	StateChanged(enum.Main, enum.Waiting, enum.Paid, time.Now().Add(-time.Minute))
+	PaymentFinished(enum.Main, time.Now().Add(-time.Hour))
+	PaymentFinished(enum.Main, time.Time{})
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		`chaingate_payments_created_total{mode="main"} 1`,
+		`chaingate_payment_states_total{mode="main",state="paid"} 1`,
+		`chaingate_payment_state_duration_seconds_count{from="waiting",mode="main",to="paid"} 1`,
+		`chaingate_payment_paid_to_finished_seconds_count{mode="main"} 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Metrics don't contain %v:\n%v", expected, body)
+		}
+	}
+}
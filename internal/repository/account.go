@@ -27,12 +27,30 @@ func (r *AccountRepository) GetFree(mode enum.Mode) (*gorm.DB, *model.Account) {
 	return result, &acc
 }
 
-func (r *AccountRepository) Create(acc *model.Account) *model.Account {
+/*
+	Returns the next unused derivation index. Deleted accounts are included, so an index is never reused.
+*/
+func (r *AccountRepository) GetNextDerivationIndex() (int64, error) {
+	var index int64
+	result := r.DB.Unscoped().Model(&model.Account{}).Select("COALESCE(MAX(derivation_index), -1) + 1").Scan(&index)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return index, nil
+}
+
+/*
+	Creates the account. If an account with the derivation index already exists, DuplicateDerivationIndex is returned.
+*/
+func (r *AccountRepository) Create(acc *model.Account) error {
 	createAccountResult := r.DB.Create(&acc)
+	if isUniqueViolation(createAccountResult.Error, derivationIndexIndex) {
+		return model.DuplicateDerivationIndex
+	}
 	if createAccountResult.Error != nil {
 		log.Printf("Unable to create Account in db: %v", createAccountResult.Error)
 	}
-	return acc
+	return createAccountResult.Error
 }
 
 func (r *AccountRepository) Update(acc *model.Account) error {
@@ -43,3 +61,9 @@ func (r *AccountRepository) Update(acc *model.Account) error {
 	}
 	return nil
 }
+
+func (r *AccountRepository) Count(mode enum.Mode, used bool) (int64, error) {
+	var count int64
+	result := r.DB.Model(&model.Account{}).Where("used = ? AND mode = ?", used, mode).Count(&count)
+	return count, result.Error
+}
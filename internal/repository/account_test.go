@@ -1,8 +1,10 @@
 package repository
 
 import (
+	"errors"
 	"ethereum-service/internal/config"
 	"ethereum-service/internal/testutils"
+	"ethereum-service/model"
 	"testing"
 
 	"github.com/CHainGate/backend/pkg/enum"
@@ -21,6 +23,24 @@ func TestCreateAccount(t *testing.T) {
 	}
 }
 
+func TestCreateAccountDuplicateDerivationIndex(t *testing.T) {
+	config.ReadOpts()
+	config.Opts.HDMnemonic = "test test test test test test test test test test test junk"
+	defer func() { config.Opts.HDMnemonic = "" }()
+	mock, repo := NewAccountMock()
+	mock = testutils.SetupCreateHDAccountDuplicate(mock, 3)
+	acc, err := model.CreateHDAccount(enum.Main, 3)
+	if err != nil {
+		t.Fatalf("Unable to create account %v", err)
+	}
+	if err = repo.Create(acc); !errors.Is(err, model.DuplicateDerivationIndex) {
+		t.Fatalf("expected %v, got %v", model.DuplicateDerivationIndex, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestUpdateAccount(t *testing.T) {
 	mock, repo := NewAccountMock()
 	mock = testutils.SetupUpdateAccount(mock, 0)
@@ -40,6 +60,36 @@ func TestGetFreeAccount(t *testing.T) {
 	}
 }
 
+func TestGetNextDerivationIndex(t *testing.T) {
+	mock, repo := NewAccountMock()
+	mock = testutils.SetupGetNextDerivationIndex(mock, 5)
+	index, err := repo.GetNextDerivationIndex()
+	if err != nil {
+		t.Fatalf("Unable to get next derivation index %v", err)
+	}
+	if index != 5 {
+		t.Fatalf(`Next derivation index is %v, but should be %v`, index, 5)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCountAccounts(t *testing.T) {
+	mock, repo := NewAccountMock()
+	mock = testutils.SetupCountAccounts(mock, true, 3)
+	count, err := repo.Count(enum.Main, true)
+	if err != nil {
+		t.Fatalf("Unable to count accounts %v", err)
+	}
+	if count != 3 {
+		t.Fatalf(`There should be %v used accounts, but there are %v`, 3, count)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func NewAccountMock() (sqlmock.Sqlmock, *AccountRepository) {
 	mock, gormDb := testutils.NewMock()
 	return mock, &AccountRepository{DB: gormDb}
@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"errors"
+	"ethereum-service/model"
+	"math/big"
+
+	"github.com/CHainGate/backend/pkg/enum"
+
+	"gorm.io/gorm"
+)
+
+type BlockRepository struct {
+	DB *gorm.DB
+}
+
+func InitBlock(db *gorm.DB) {
+	Block = &BlockRepository{DB: db}
+}
+
+var (
+	Block model.IBlockRepository
+)
+
+func (r *BlockRepository) Create(block *model.Block) error {
+	return r.DB.Create(&block).Error
+}
+
+/*
+	Returns nil if no block was processed yet
+*/
+func (r *BlockRepository) GetLatest(mode enum.Mode) (*model.Block, error) {
+	block := model.Block{}
+	result := r.DB.Where("mode = ?", mode).Order("number desc").First(&block)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &block, nil
+}
+
+/*
+	Returns nil if the block with the number wasn't processed
+*/
+func (r *BlockRepository) GetByNumber(mode enum.Mode, number *big.Int) (*model.Block, error) {
+	block := model.Block{}
+	result := r.DB.Where("mode = ? AND number = ?", mode, model.NewBigInt(number)).First(&block)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &block, nil
+}
+
+/*
+	Deletes the block with the number and all blocks after it. Used when blocks got orphaned by a reorganization.
+*/
+func (r *BlockRepository) DeleteFrom(mode enum.Mode, number *big.Int) error {
+	return r.DB.Unscoped().Where("mode = ? AND number >= ?", mode, model.NewBigInt(number)).Delete(&model.Block{}).Error
+}
+
+/*
+	Deletes all blocks before the number, so only the recent history is kept.
+*/
+func (r *BlockRepository) DeleteBefore(mode enum.Mode, number *big.Int) error {
+	return r.DB.Unscoped().Where("mode = ? AND number < ?", mode, model.NewBigInt(number)).Delete(&model.Block{}).Error
+}
@@ -0,0 +1,25 @@
+package repository
+
+import (
+	"errors"
+
+	"github.com/jackc/pgconn"
+)
+
+// uniqueViolation error code of postgres for a violated unique index
+const uniqueViolation = "23505"
+
+const (
+	// idempotencyKeyIndex unique index of the idempotency keys per merchant wallet, it is created with the database
+	idempotencyKeyIndex = "idx_payments_merchant_idempotency_key"
+	// derivationIndexIndex unique index of the derivation indexes of the accounts
+	derivationIndexIndex = "idx_accounts_derivation_index"
+)
+
+/*
+	Returns if the error is the violation of the given unique index.
+*/
+func isUniqueViolation(err error, index string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation && pgErr.ConstraintName == index
+}
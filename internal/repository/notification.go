@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"ethereum-service/model"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type NotificationRepository struct {
+	DB *gorm.DB
+}
+
+func InitNotification(db *gorm.DB) {
+	Notification = &NotificationRepository{DB: db}
+}
+
+var (
+	Notification model.INotificationRepository
+)
+
+func (r *NotificationRepository) Update(notification *model.Notification) error {
+	return r.DB.Save(notification).Error
+}
+
+/*
+	Pending notifications, which are due and the oldest undelivered notification of their payment. A later notification waits until the earlier ones are delivered.
+	A dead notification blocks the later ones until it is replayed, otherwise the backend would get the older state after the newer one.
+*/
+func (r *NotificationRepository) GetDue(now time.Time, limit int) []model.Notification {
+	var notifications []model.Notification
+	r.DB.
+		Where("status = ? AND next_attempt_at <= ?", model.NotificationPending, now).
+		Where("NOT EXISTS (SELECT 1 FROM notifications earlier WHERE earlier.payment_id = notifications.payment_id AND earlier.status IN ? AND earlier.created_at < notifications.created_at AND earlier.deleted_at IS NULL)", []model.NotificationStatus{model.NotificationPending, model.NotificationDead}).
+		Order("created_at").
+		Limit(limit).
+		Find(&notifications)
+	return notifications
+}
+
+func (r *NotificationRepository) GetByPayment(paymentID uuid.UUID, status model.NotificationStatus) []model.Notification {
+	var notifications []model.Notification
+	r.DB.
+		Where("payment_id = ? AND status = ?", paymentID, status).
+		Order("created_at").
+		Find(&notifications)
+	return notifications
+}
@@ -0,0 +1,27 @@
+package repository
+
+import (
+	"ethereum-service/internal/testutils"
+	"ethereum-service/model"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGetDue(t *testing.T) {
+	mock, repo := NewNotificationMock()
+	now := time.Now()
+	mock.ExpectQuery("SELECT (.+) FROM \"notifications\" WHERE (.+)NOT EXISTS (.+) ORDER BY created_at LIMIT 10").
+		WithArgs(model.NotificationPending, now, model.NotificationPending, model.NotificationDead).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	repo.GetDue(now, 10)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func NewNotificationMock() (sqlmock.Sqlmock, *NotificationRepository) {
+	mock, gormDb := testutils.NewMock()
+	return mock, &NotificationRepository{DB: gormDb}
+}
@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"errors"
+	"ethereum-service/model"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type OutgoingTransactionRepository struct {
+	DB *gorm.DB
+}
+
+func InitOutgoingTransaction(db *gorm.DB) {
+	OutgoingTransaction = &OutgoingTransactionRepository{DB: db}
+}
+
+var (
+	OutgoingTransaction model.IOutgoingTransactionRepository
+)
+
+// Create the payment and the account are only references, they are updated over their own repositories
+func (r *OutgoingTransactionRepository) Create(tx *model.OutgoingTransaction) error {
+	return r.DB.Omit(clause.Associations).Create(&tx).Error
+}
+
+func (r *OutgoingTransactionRepository) Update(tx *model.OutgoingTransaction) error {
+	return r.DB.Omit(clause.Associations).Save(&tx).Error
+}
+
+/*
+	Transactions which aren't confirmed or failed yet, ordered by nonce so the transactions of an account are handled in order.
+*/
+func (r *OutgoingTransactionRepository) GetOpen(mode enum.Mode) []model.OutgoingTransaction {
+	var txs []model.OutgoingTransaction
+	r.DB.
+		Where("mode = ?", mode).
+		Where("status IN ?", []model.OutgoingTransactionStatus{model.TxSigned, model.TxSent, model.TxMined}).
+		Preload("Account").
+		Preload("Payment.Account").
+		Preload("Payment.CurrentPaymentState").
+		Order("nonce").
+		Find(&txs)
+	return txs
+}
+
+/*
+	Returns nil if the payment has no transaction of this kind, which isn't failed
+*/
+func (r *OutgoingTransactionRepository) GetActiveByPayment(paymentID uuid.UUID, kind model.OutgoingTransactionKind) (*model.OutgoingTransaction, error) {
+	tx := model.OutgoingTransaction{}
+	result := r.DB.Where("payment_id = ? AND kind = ? AND status <> ?", paymentID, kind, model.TxFailed).First(&tx)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &tx, nil
+}
+
+/*
+	All transactions of this kind of the payment, which aren't failed, e.g. the refunds to each sender.
+*/
+func (r *OutgoingTransactionRepository) GetAllActiveByPayment(paymentID uuid.UUID, kind model.OutgoingTransactionKind) ([]model.OutgoingTransaction, error) {
+	var txs []model.OutgoingTransaction
+	result := r.DB.Where("payment_id = ? AND kind = ? AND status <> ?", paymentID, kind, model.TxFailed).Order("nonce").Find(&txs)
+	return txs, result.Error
+}
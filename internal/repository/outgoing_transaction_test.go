@@ -0,0 +1,30 @@
+package repository
+
+import (
+	"ethereum-service/internal/testutils"
+	"ethereum-service/model"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+)
+
+func TestGetActiveByPaymentNotFound(t *testing.T) {
+	mock, repo := NewOutgoingTransactionMock()
+	paymentID := uuid.New()
+	mock.ExpectQuery("SELECT (.+) FROM \"outgoing_transactions\"").
+		WithArgs(paymentID, model.Forward, model.TxFailed).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	tx, err := repo.GetActiveByPayment(paymentID, model.Forward)
+	if err != nil || tx != nil {
+		t.Fatalf("No forward should be found, got %v %v", tx, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func NewOutgoingTransactionMock() (sqlmock.Sqlmock, *OutgoingTransactionRepository) {
+	mock, gormDb := testutils.NewMock()
+	return mock, &OutgoingTransactionRepository{DB: gormDb}
+}
@@ -4,8 +4,10 @@ import (
 	"ethereum-service/model"
 	"log"
 	"math/big"
+	"time"
 
 	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/google/uuid"
 
 	"gorm.io/gorm"
 )
@@ -26,9 +28,49 @@ func (r *PaymentRepository) UpdatePaymentState(payment *model.Payment) {
 	r.DB.Save(&payment)
 }
 
+/*
+	Saves the payment with its new state and the notification of the backend in one transaction, so no state is lost if the backend is unreachable.
+*/
+func (r *PaymentRepository) UpdatePaymentStateAndNotify(payment *model.Payment, notification *model.Notification) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&payment).Error; err != nil {
+			return err
+		}
+		return tx.Create(notification).Error
+	})
+}
+
+/*
+	Saves the new state like UpdatePaymentStateAndNotify, but only if the stored current state is still the one the payment was loaded with.
+	The conditional update locks the row of the payment, so a concurrent change of the state makes it fail with StateChanged.
+*/
+func (r *PaymentRepository) UpdatePaymentStateIfCurrent(payment *model.Payment, currentStateID uuid.UUID, notification *model.Notification) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&model.Payment{}).
+			Where("id = ? AND current_payment_state_id = ?", payment.ID, currentStateID).
+			Update("current_payment_state_id", currentStateID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return model.StateChanged
+		}
+		if err := tx.Save(&payment).Error; err != nil {
+			return err
+		}
+		return tx.Create(notification).Error
+	})
+}
+
+/*
+	Creates the payment with a waiting state. If the merchant already created a payment with the idempotency key, DuplicateIdempotencyKey is returned.
+*/
 func (r *PaymentRepository) Create(payment *model.Payment, finalPaymentAmount *big.Int) (*model.Payment, error) {
 	payment.AddNewPaymentState(enum.Waiting, big.NewInt(0), finalPaymentAmount)
 	result := r.DB.Create(&payment)
+	if isUniqueViolation(result.Error, idempotencyKeyIndex) {
+		return nil, model.DuplicateIdempotencyKey
+	}
 	if result.Error != nil {
 		log.Printf("Error by creating new Payment %v", result.Error)
 		return nil, result.Error
@@ -61,6 +103,128 @@ func (r *PaymentRepository) GetOpenByMode(mode enum.Mode) []model.Payment {
 	return payments
 }
 
+/*
+	Returns the payment with all its states, the oldest first. gorm.ErrRecordNotFound is returned if it doesn't exist.
+*/
+func (r *PaymentRepository) GetByID(id uuid.UUID) (*model.Payment, error) {
+	var payment model.Payment
+	result := r.DB.
+		Preload("Account").
+		Preload("CurrentPaymentState").
+		Preload("PaymentStates", func(db *gorm.DB) *gorm.DB {
+			return db.Order("created_at")
+		}).
+		First(&payment, "id = ?", id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &payment, nil
+}
+
+/*
+	Returns the payment, which the merchant wallet created with the idempotency key since the given time. gorm.ErrRecordNotFound is returned if there is none.
+*/
+func (r *PaymentRepository) GetByIdempotencyKey(wallet string, key string, since time.Time) (*model.Payment, error) {
+	var payment model.Payment
+	result := r.DB.
+		Preload("Account").
+		Preload("CurrentPaymentState").
+		Where("lower(merchant_wallet) = lower(?) AND idempotency_key = ? AND created_at >= ?", wallet, key, since).
+		First(&payment)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &payment, nil
+}
+
+/*
+	Removes the idempotency key from the payment, which the merchant wallet created with it before the given time, so the key can be used again.
+*/
+func (r *PaymentRepository) ReleaseIdempotencyKey(wallet string, key string, before time.Time) error {
+	return r.DB.Model(&model.Payment{}).
+		Where("lower(merchant_wallet) = lower(?) AND idempotency_key = ? AND created_at < ?", wallet, key, before).
+		Update("idempotency_key", "").Error
+}
+
+// Search
+/*
+	Returns a page of the payments matching the filter, ordered by their creation. The cursor of the next page is nil on the last page.
+	Addresses are compared case-insensitive, because the wallets are stored as they were requested.
+*/
+func (r *PaymentRepository) Search(filter model.PaymentFilter) ([]model.Payment, *model.PaymentCursor, error) {
+	query := r.DB.
+		Joins("Account").
+		Joins("CurrentPaymentState").
+		Preload("PaymentStates", func(db *gorm.DB) *gorm.DB {
+			return db.Order("created_at")
+		})
+	if filter.Mode != 0 {
+		query = query.Where("payments.mode = ?", filter.Mode)
+	}
+	if len(filter.States) > 0 {
+		query = query.Where("\"CurrentPaymentState\".\"state_id\" IN ?", filter.States)
+	}
+	if filter.MerchantWallet != "" {
+		query = query.Where("lower(payments.merchant_wallet) = lower(?)", filter.MerchantWallet)
+	}
+	if filter.PayAddress != "" {
+		query = query.Where("lower(\"Account\".\"address\") = lower(?)", filter.PayAddress)
+	}
+	if filter.CreatedFrom != nil {
+		query = query.Where("payments.created_at >= ?", filter.CreatedFrom)
+	}
+	if filter.CreatedTo != nil {
+		query = query.Where("payments.created_at < ?", filter.CreatedTo)
+	}
+	if filter.MinPriceAmount > 0 {
+		query = query.Where("payments.price_amount >= ?", filter.MinPriceAmount)
+	}
+	if filter.MaxPriceAmount > 0 {
+		query = query.Where("payments.price_amount <= ?", filter.MaxPriceAmount)
+	}
+
+	direction := "ASC"
+	comparison := ">"
+	if filter.Descending {
+		direction = "DESC"
+		comparison = "<"
+	}
+	if filter.Cursor != nil {
+		query = query.Where("(payments.created_at, payments.id) "+comparison+" (?, ?)", filter.Cursor.CreatedAt, filter.Cursor.ID)
+	}
+
+	var payments []model.Payment
+	result := query.
+		Order("payments.created_at " + direction).
+		Order("payments.id " + direction).
+		Limit(filter.Limit + 1).
+		Find(&payments)
+	if result.Error != nil {
+		return nil, nil, result.Error
+	}
+	if len(payments) <= filter.Limit {
+		return payments, nil, nil
+	}
+	payments = payments[:filter.Limit]
+	last := payments[len(payments)-1]
+	return payments, &model.PaymentCursor{CreatedAt: last.CreatedAt, ID: last.ID}, nil
+}
+
+/*
+	Payments which can still be affected by a chain reorganization, because they are not forwarded yet.
+*/
+func (r *PaymentRepository) GetReceiving(mode enum.Mode) []model.Payment {
+	var payments []model.Payment
+	r.DB.
+		Where("mode = ?", mode).
+		Preload("Account").
+		Preload("CurrentPaymentState").
+		Joins("CurrentPaymentState").
+		Where("\"CurrentPaymentState\".\"state_id\" IN ?", []enum.State{enum.Waiting, enum.PartiallyPaid, enum.Paid}).
+		Find(&payments)
+	return payments
+}
+
 func (r *PaymentRepository) GetConfirming(mode enum.Mode) []model.Payment {
 	var payments []model.Payment
 	r.DB.
@@ -68,7 +232,7 @@ func (r *PaymentRepository) GetConfirming(mode enum.Mode) []model.Payment {
 		Preload("Account").
 		Preload("CurrentPaymentState").
 		Joins("CurrentPaymentState").
-		Where("\"CurrentPaymentState\".\"state_id\" IN ?", []enum.State{enum.Paid}).
+		Where("\"CurrentPaymentState\".\"state_id\" IN ?", []enum.State{enum.Paid, model.OverpaidRefunded}).
 		Find(&payments)
 	return payments
 }
@@ -79,8 +243,48 @@ func (r *PaymentRepository) GetFinishing(mode enum.Mode) []model.Payment {
 		Where("mode = ?", mode).
 		Preload("Account").
 		Preload("CurrentPaymentState").
+		Preload("PaymentStates", func(db *gorm.DB) *gorm.DB {
+			return db.Order("created_at")
+		}).
 		Joins("CurrentPaymentState").
 		Where("\"CurrentPaymentState\".\"state_id\" IN ?", []enum.State{enum.Forwarded}).
 		Find(&payments)
 	return payments
 }
+
+/*
+	Expired and failed payments, whose received funds wait to be refunded, and paid payments, whose overpayment refund failed. Held refunds are left out.
+*/
+func (r *PaymentRepository) GetOpenRefunds(mode enum.Mode) []model.Payment {
+	var payments []model.Payment
+	r.DB.
+		Where("mode = ?", mode).
+		Where("refund_status = ? AND refund_held = ?", model.RefundOpen, false).
+		Preload("Account").
+		Preload("CurrentPaymentState").
+		Find(&payments)
+	return payments
+}
+
+/*
+	Returns the refund status and if the refund is held, as they are stored now. A loaded payment can be outdated, e.g. when an admin held the refund in the meantime.
+*/
+func (r *PaymentRepository) GetRefundState(id uuid.UUID) (model.RefundStatus, bool, error) {
+	var payment model.Payment
+	result := r.DB.Select("refund_status", "refund_held").First(&payment, "id = ?", id)
+	return payment.RefundStatus, payment.RefundHeld, result.Error
+}
+
+/*
+	Expired payments, whose account is still watched for late payments.
+*/
+func (r *PaymentRepository) GetWatched(mode enum.Mode) []model.Payment {
+	var payments []model.Payment
+	r.DB.
+		Where("mode = ?", mode).
+		Where("watched_until IS NOT NULL").
+		Preload("Account").
+		Preload("CurrentPaymentState").
+		Find(&payments)
+	return payments
+}
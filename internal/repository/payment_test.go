@@ -1,14 +1,19 @@
 package repository
 
 import (
+	"errors"
 	"ethereum-service/internal/config"
 	"ethereum-service/internal/testutils"
+	"ethereum-service/model"
 	"math/big"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/CHainGate/backend/pkg/enum"
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 func shutdown() {
@@ -30,6 +35,19 @@ func TestCreatePayment(t *testing.T) {
 	}
 }
 
+func TestCreatePaymentDuplicateIdempotencyKey(t *testing.T) {
+	mock, repo := NewPaymentMock()
+	mock = testutils.SetupCreatePaymentDuplicateIdempotencyKey(mock)
+	ep := testutils.GetEmptyPayment()
+	ep.IdempotencyKey = "order-1"
+	if _, err := repo.Create(&ep, big.NewInt(100000000000000)); !errors.Is(err, model.DuplicateIdempotencyKey) {
+		t.Fatalf("expected %v, got %v", model.DuplicateIdempotencyKey, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestGetAllPayments(t *testing.T) {
 	config.ReadOpts()
 	mock, repo := NewPaymentMock()
@@ -50,9 +68,95 @@ func TestGetOpenByMode(t *testing.T) {
 	}
 }
 
+func TestGetByID(t *testing.T) {
+	config.ReadOpts()
+	mock, repo := NewPaymentMock()
+	wp := testutils.GetWaitingPayment()
+	mock = testutils.SetupGetPaymentByID(mock, wp)
+	payment, err := repo.GetByID(wp.ID)
+	if err != nil {
+		t.Fatalf("Unable to get payment %v", err)
+	}
+	if payment.ID != wp.ID || len(payment.PaymentStates) != 1 || payment.CurrentPaymentState.StateID != wp.CurrentPaymentState.StateID {
+		t.Fatalf("Wrong payment %+v", payment)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetByIDNotFound(t *testing.T) {
+	mock, repo := NewPaymentMock()
+	id := uuid.New()
+	mock.ExpectQuery("SELECT (.+) FROM \"payments\"").
+		WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	if _, err := repo.GetByID(id); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("expected %v, got %v", gorm.ErrRecordNotFound, err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	config.ReadOpts()
+	mock, repo := NewPaymentMock()
+	wp := testutils.GetWaitingPayment()
+	ca := wp.Account
+	created := time.Now()
+	olderID := uuid.New()
+	paymentRows := sqlmock.NewRows([]string{"id", "created_at", "account_id", "merchant_wallet", "mode", "price_amount", "price_currency", "current_payment_state_id", "Account__id", "Account__address", "CurrentPaymentState__id", "CurrentPaymentState__state_id"}).
+		AddRow(wp.ID, created, ca.ID, wp.MerchantWallet, wp.Mode, wp.PriceAmount, wp.PriceCurrency, wp.CurrentPaymentStateId, ca.ID, ca.Address, wp.CurrentPaymentStateId, enum.Waiting).
+		AddRow(olderID, created.Add(-time.Second), ca.ID, wp.MerchantWallet, wp.Mode, wp.PriceAmount, wp.PriceCurrency, wp.CurrentPaymentStateId, ca.ID, ca.Address, wp.CurrentPaymentStateId, enum.Waiting)
+	mock.ExpectQuery("SELECT (.+) FROM \"payments\" LEFT JOIN \"accounts\" \"Account\" (.+) WHERE payments.mode = (.+) AND \"CurrentPaymentState\".\"state_id\" IN (.+) AND lower\\(\"Account\".\"address\"\\) = lower(.+) ORDER BY payments.created_at DESC,payments.id DESC LIMIT 2").
+		WithArgs(enum.Main, enum.Waiting, enum.PartiallyPaid, ca.Address).
+		WillReturnRows(paymentRows)
+	mock.ExpectQuery("SELECT (.+) FROM \"payment_states\" WHERE \"payment_states\".\"payment_id\" IN (.+) ORDER BY created_at").
+		WithArgs(wp.ID, olderID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payment_id", "state_id"}).AddRow(wp.CurrentPaymentStateId, wp.ID, enum.Waiting))
+
+	payments, next, err := repo.Search(model.PaymentFilter{
+		Mode:       enum.Main,
+		States:     []enum.State{enum.Waiting, enum.PartiallyPaid},
+		PayAddress: ca.Address,
+		Descending: true,
+		Limit:      1,
+	})
+	if err != nil {
+		t.Fatalf("Unable to search payments %v", err)
+	}
+	if len(payments) != 1 || payments[0].ID != wp.ID || payments[0].Account.Address != ca.Address || len(payments[0].PaymentStates) != 1 {
+		t.Fatalf("Wrong page %+v", payments)
+	}
+	if next == nil || next.ID != wp.ID {
+		t.Fatalf("The cursor should point to the last payment of the page, but is %+v", next)
+	}
+	decoded, err := model.DecodePaymentCursor(next.Encode())
+	if err != nil || decoded.ID != next.ID || !decoded.CreatedAt.Equal(next.CreatedAt) {
+		t.Fatalf("Cursor %+v was decoded to %+v: %v", next, decoded, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSearchAfterCursor(t *testing.T) {
+	mock, repo := NewPaymentMock()
+	cursor := &model.PaymentCursor{CreatedAt: time.Now(), ID: uuid.New()}
+	mock.ExpectQuery("SELECT (.+) FROM \"payments\" (.+) WHERE \\(payments.created_at, payments.id\\) > \\((.+)\\) (.+) ORDER BY payments.created_at ASC,payments.id ASC LIMIT 51").
+		WithArgs(cursor.CreatedAt, cursor.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	payments, next, err := repo.Search(model.PaymentFilter{Limit: 50, Cursor: cursor})
+	if err != nil || len(payments) != 0 || next != nil {
+		t.Fatalf("expected an empty last page, got %v payments, cursor %v: %v", len(payments), next, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestGetConfirming(t *testing.T) {
 	mock, repo := NewPaymentMock()
-	mock = testutils.SetupModePayments(mock, enum.Main, enum.Paid)
+	mock = testutils.SetupModePayments(mock, enum.Main, enum.Paid, model.OverpaidRefunded)
 	repo.GetConfirming(enum.Main)
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -61,7 +165,7 @@ func TestGetConfirming(t *testing.T) {
 
 func TestGetFinishing(t *testing.T) {
 	mock, repo := NewPaymentMock()
-	mock = testutils.SetupModePayments(mock, enum.Main, enum.Forwarded)
+	mock = testutils.SetupFinishingPayments(mock, enum.Main)
 	repo.GetFinishing(enum.Main)
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -79,6 +183,19 @@ func TestUpdatePaymentState(t *testing.T) {
 	}
 }
 
+func TestUpdatePaymentStateAndNotify(t *testing.T) {
+	mock, repo := NewPaymentMock()
+	mock = testutils.SetupUpdatePaymentStateAndNotify(mock)
+	wp := testutils.GetWaitingPayment()
+	state := wp.UpdatePaymentState(enum.PartiallyPaid, big.NewInt(10))
+	if err := repo.UpdatePaymentStateAndNotify(&wp, model.NewNotification(&wp, state, "")); err != nil {
+		t.Fatalf("Unable to update payment state %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func NewPaymentMock() (sqlmock.Sqlmock, *PaymentRepository) {
 	mock, gormDb := testutils.NewMock()
 	return mock, &PaymentRepository{DB: gormDb}
@@ -4,27 +4,43 @@ import (
 	"context"
 	"ethereum-service/backendClientApi"
 	"ethereum-service/internal/config"
+	"ethereum-service/internal/logging"
 	"ethereum-service/model"
-	"fmt"
-	"os"
 
 	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 )
 
-func SendState(paymentId uuid.UUID, state model.PaymentState, txHash string) error {
-	paymentUpdateDto := *backendClientApi.NewPaymentUpdateDto(paymentId.String(), state.PayAmount.String(), "ETH", state.AmountReceived.String(), state.StateID.String()) // PaymentUpdateDto |  (optional)
+// stateDetailHeader state of this service, which the backend doesn't know, besides the backend state in the payload
+const stateDetailHeader = "X-Chaingate-State-Detail"
+
+// SendState
+/*
+	Sends the state to the backend. The states of this service are sent as their backend state with the state in the header stateDetailHeader.
+*/
+func SendState(paymentId uuid.UUID, payCurrency string, state model.PaymentState, txHash string) error {
+	backendState := state.GetBackendState()
+	paymentUpdateDto := *backendClientApi.NewPaymentUpdateDto(paymentId.String(), state.PayAmount.String(), payCurrency, state.AmountReceived.String(), backendState.String()) // PaymentUpdateDto |  (optional)
 	paymentUpdateDto.TxHash = &txHash
 
 	configuration := backendClientApi.NewConfiguration()
+	// the backend doesn't know the states of this service, they are sent as detail of the backend state
+	if backendState != state.StateID {
+		configuration.AddDefaultHeader(stateDetailHeader, model.StateName(state.StateID))
+	}
 	configuration.Servers[0].URL = config.Opts.BackendBaseUrl
+	configuration.HTTPClient = newBackendClient(config.Opts.BackendSigningKeyId, config.Opts.BackendSigningSecret, config.Opts.BackendSigningDisabled)
 	apiClient := backendClientApi.NewAPIClient(configuration)
 	resp, err := apiClient.PaymentUpdateApi.UpdatePayment(context.Background()).PaymentUpdateDto(paymentUpdateDto).Execute()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error when calling `PaymentUpdateApi.UpdatePayment``: %v\n", err)
-		fmt.Fprintf(os.Stderr, "Full HTTP response: %v\n", resp)
+		entry := logrus.WithField(logging.PaymentID, paymentId.String()).WithError(err)
+		if resp != nil {
+			entry = entry.WithField("status", resp.Status)
+		}
+		entry.Error("Error when calling PaymentUpdateApi.UpdatePayment")
 		return err
 	} else {
-		fmt.Printf("Update sent: Payment %s updated to: %s\n", paymentId.String(), state.StateID)
+		logrus.WithFields(logrus.Fields{logging.PaymentID: paymentId.String(), "state": model.StateName(state.StateID)}).Info("Update sent")
 	}
 	return nil
 }
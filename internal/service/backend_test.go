@@ -1,9 +1,18 @@
 package service
 
 import (
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"ethereum-service/backendClientApi"
 	"ethereum-service/internal/config"
 	"ethereum-service/internal/testutils"
+	"ethereum-service/model"
+	"io"
 	"math/big"
+	"net/http"
+	"strconv"
 	"testing"
 
 	"github.com/CHainGate/backend/pkg/enum"
@@ -13,6 +22,8 @@ import (
 
 func TestSendState(t *testing.T) {
 	config.ReadOpts()
+	config.Opts.BackendSigningDisabled = true
+	defer func() { config.Opts.BackendSigningDisabled = false }()
 	defer gock.Off() // Flush pending mocks after test execution
 	gock.New("http://localhost:8000").
 		Put("/api/internal/payment/webhook").
@@ -23,8 +34,97 @@ func TestSendState(t *testing.T) {
 	accountID := uuid.New()
 	paymentID := uuid.New()
 	paymentState := testutils.CreatePaymentState(accountID, paymentID, enum.PartiallyPaid, big.NewInt(10))
-	SendState(paymentID, paymentState, "")
+	SendState(paymentID, "ETH", paymentState, "")
 	if gock.IsDone() != true {
 		t.Fatalf("Request should have been sent, but there are open requests")
 	}
 }
+
+func TestSendStateOfServiceState(t *testing.T) {
+	config.ReadOpts()
+	config.Opts.BackendSigningDisabled = true
+	defer func() { config.Opts.BackendSigningDisabled = false }()
+	defer gock.Off() // Flush pending mocks after test execution
+	for _, expected := range []struct {
+		state   enum.State
+		backend string
+	}{
+		{model.Cancelled, "failed"},
+		{model.OverpaidRefunded, "paid"},
+		{model.Refunded, "expired"},
+	} {
+		gock.New("http://localhost:8000").
+			Put("/api/internal/payment/webhook").
+			AddMatcher(func(req *http.Request, _ *gock.Request) (bool, error) {
+				var dto backendClientApi.PaymentUpdateDto
+				if err := json.NewDecoder(req.Body).Decode(&dto); err != nil {
+					return false, err
+				}
+				return dto.PaymentState == expected.backend && req.Header.Get(stateDetailHeader) == model.StateName(expected.state), nil
+			}).
+			Reply(200)
+
+		paymentID := uuid.New()
+		payment := model.Payment{CurrentPaymentState: testutils.CreatePaymentState(uuid.New(), paymentID, enum.Expired, big.NewInt(10))}
+		paymentState := payment.UpdatePaymentState(expected.state, nil)
+		if err := SendState(paymentID, "ETH", paymentState, ""); err != nil {
+			t.Fatalf("%v should be sent as %v, but got %v", model.StateName(expected.state), expected.backend, err)
+		}
+	}
+	if gock.IsDone() != true {
+		t.Fatalf("Request should have been sent, but there are open requests")
+	}
+}
+
+func TestSendStateSigned(t *testing.T) {
+	config.ReadOpts()
+	config.Opts.BackendSigningKeyId = "2"
+	config.Opts.BackendSigningSecret = "backend-secret"
+	defer func() { config.Opts.BackendSigningSecret = "" }()
+	defer gock.Off() // Flush pending mocks after test execution
+	gock.New("http://localhost:8000").
+		Put("/api/internal/payment/webhook").
+		MatchHeader(SignatureKeyIdHeader, "^2$").
+		AddMatcher(func(req *http.Request, _ *gock.Request) (bool, error) {
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				return false, err
+			}
+			timestamp, err := strconv.ParseInt(req.Header.Get(SignatureTimestampHeader), 10, 64)
+			if err != nil {
+				return false, err
+			}
+			signature, err := hex.DecodeString(req.Header.Get(SignatureHeader))
+			if err != nil {
+				return false, err
+			}
+			expected, _ := hex.DecodeString(Sign([]byte("backend-secret"), timestamp, http.MethodPut, "/api/internal/payment/webhook", body))
+			if !hmac.Equal(signature, expected) {
+				return false, errors.New("invalid signature")
+			}
+			return true, nil
+		}).
+		Reply(200)
+
+	paymentID := uuid.New()
+	paymentState := testutils.CreatePaymentState(uuid.New(), paymentID, enum.Finished, big.NewInt(10))
+	if err := SendState(paymentID, "ETH", paymentState, ""); err != nil {
+		t.Fatalf("Signed state wasn't accepted %v", err)
+	}
+	if gock.IsDone() != true {
+		t.Fatalf("Request should have been sent, but there are open requests")
+	}
+}
+
+func TestCheckSigning(t *testing.T) {
+	config.ReadOpts()
+	config.Opts.BackendSigningSecret = ""
+	if err := CheckSigning(); err != NoSigningSecret {
+		t.Fatalf("expected %v, got %v", NoSigningSecret, err)
+	}
+	config.Opts.BackendSigningDisabled = true
+	defer func() { config.Opts.BackendSigningDisabled = false }()
+	if err := CheckSigning(); err != nil {
+		t.Fatalf("Disabled signing shouldn't need a secret, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"ethereum-service/internal/bc"
+	"ethereum-service/internal/config"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+)
+
+// oracleSource name of the price source of the Chainlink aggregators
+const oracleSource = "chainlink"
+
+// OraclePriceSource
+/*
+	Rates of the Chainlink-style aggregators in MAIN_PRICE_FEEDS and TEST_PRICE_FEEDS, read through the client of the mode.
+*/
+type OraclePriceSource struct{}
+
+func (s *OraclePriceSource) Name() string {
+	return oracleSource
+}
+
+/*
+	The answer of the latest round is normalized by the decimals of the aggregator. A feed of the reversed pair is inverted, e.g. USD/ETH of the ETH/USD feed.
+	A round which isn't complete or older than PRICE_FEED_MAX_AGE seconds is refused.
+*/
+func (s *OraclePriceSource) GetRate(ctx context.Context, mode enum.Mode, srcCurrency string, dstCurrency string) (*Rate, error) {
+	feed, ok := config.GetPriceFeed(mode, srcCurrency, dstCurrency)
+	if !ok {
+		return nil, fmt.Errorf("no price feed for %v/%v in mode %v", srcCurrency, dstCurrency, mode.String())
+	}
+	client := bc.GetClientByMode(mode)
+	if client == nil {
+		return nil, fmt.Errorf("no client in mode %v", mode.String())
+	}
+	round, err := bc.GetLatestRoundData(ctx, client, feed.Aggregator)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkRound(round); err != nil {
+		return nil, fmt.Errorf("round %v of price feed %v/%v: %w", round.RoundId, feed.Base, feed.Quote, err)
+	}
+
+	price := new(big.Float).Quo(new(big.Float).SetInt(round.Answer), new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(round.Decimals)), nil)))
+	if !strings.EqualFold(feed.Base, srcCurrency) {
+		price.Quo(big.NewFloat(1), price)
+	}
+	rate, _ := price.Float64()
+	// the rate is as old as the round and the heartbeat of the feed is usually longer than PRICE_MAX_STALENESS
+	return &Rate{
+		Source:    oracleSource,
+		Rate:      rate,
+		UpdatedAt: time.Unix(round.UpdatedAt.Int64(), 0),
+		MaxAge:    time.Duration(config.Opts.PriceFeedMaxAge) * time.Second,
+	}, nil
+}
+
+func checkRound(round *bc.RoundData) error {
+	if round.Answer.Sign() <= 0 {
+		return errors.New("answer isn't positive")
+	}
+	if round.UpdatedAt.Sign() == 0 || round.AnsweredInRound.Cmp(round.RoundId) < 0 {
+		return errors.New("round isn't complete")
+	}
+	updatedAt := time.Unix(round.UpdatedAt.Int64(), 0)
+	if time.Since(updatedAt) > time.Duration(config.Opts.PriceFeedMaxAge)*time.Second {
+		return fmt.Errorf("round of %v is stale", updatedAt)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/testutils"
+	"math"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+)
+
+/*
+	Deploys an ETH/USD aggregator with 8 decimals on the in-memory chain and configures it as the price feed on mainnet.
+*/
+func setupPriceFeed(t *testing.T, round testutils.MockRound) {
+	config.ReadOpts()
+	genesisAcc, client := testutils.CustomChainSetup(t)
+	aggregatorAddress := testutils.DeployMockAggregator(client, genesisAcc, 8, round)
+	clientMain, mainPriceFeeds := config.ClientMain, config.Opts.MainPriceFeeds
+	config.ClientMain = client
+	config.Opts.MainPriceFeeds = "ETH/USD:" + aggregatorAddress.Hex()
+	t.Cleanup(func() {
+		config.ClientMain = clientMain
+		config.Opts.MainPriceFeeds = mainPriceFeeds
+	})
+}
+
+func TestOracleGetRate(t *testing.T) {
+	// 2500.5 USD per ETH
+	// the round is older than PRICE_MAX_STALENESS, but within the heartbeat of the feed
+	updatedAt := time.Now().Add(-30 * time.Minute).Unix()
+	setupPriceFeed(t, testutils.MockRound{RoundId: 2, Answer: big.NewInt(250050000000), StartedAt: updatedAt, UpdatedAt: updatedAt, AnsweredInRound: 2})
+	rate, err := (&OraclePriceSource{}).GetRate(context.Background(), enum.Main, "ETH", "USD")
+	if err != nil {
+		t.Fatalf("Unable to get rate %v", err)
+	}
+	if rate.Rate != 2500.5 || rate.Source != oracleSource {
+		t.Fatalf("Rate is wrong %+v", rate)
+	}
+	if rate.UpdatedAt.Unix() != updatedAt {
+		t.Fatalf("Rate should be of the round at %v, but is of %v", time.Unix(updatedAt, 0), rate.UpdatedAt)
+	}
+	if err = checkRate(rate); err != nil {
+		t.Fatalf("The rate of the feed should be fresh within its heartbeat, but got %v", err)
+	}
+
+	// the price of a payment in USD is converted with the inverted feed
+	rate, err = (&OraclePriceSource{}).GetRate(context.Background(), enum.Main, "USD", "ETH")
+	if err != nil {
+		t.Fatalf("Unable to get inverted rate %v", err)
+	}
+	if math.Abs(rate.Rate-1/2500.5) > 1e-15 {
+		t.Fatalf("Inverted rate is %v, but should be %v", rate.Rate, 1/2500.5)
+	}
+
+	if _, err = (&OraclePriceSource{}).GetRate(context.Background(), enum.Test, "USD", "ETH"); err == nil {
+		t.Fatalf("There is no price feed on testnet, the rate should fail")
+	}
+}
+
+func TestOracleStaleRound(t *testing.T) {
+	updatedAt := time.Now().Add(-2 * time.Hour).Unix()
+	setupPriceFeed(t, testutils.MockRound{RoundId: 2, Answer: big.NewInt(250050000000), StartedAt: updatedAt, UpdatedAt: updatedAt, AnsweredInRound: 2})
+	if _, err := (&OraclePriceSource{}).GetRate(context.Background(), enum.Main, "USD", "ETH"); err == nil {
+		t.Fatalf("A round older than %v seconds should be refused", config.Opts.PriceFeedMaxAge)
+	}
+}
+
+func TestOracleIncompleteRound(t *testing.T) {
+	setupPriceFeed(t, testutils.MockRound{RoundId: 3, Answer: big.NewInt(250050000000), StartedAt: time.Now().Unix(), UpdatedAt: time.Now().Unix(), AnsweredInRound: 2})
+	if _, err := (&OraclePriceSource{}).GetRate(context.Background(), enum.Main, "USD", "ETH"); err == nil {
+		t.Fatalf("A round which was answered in an earlier round should be refused")
+	}
+}
+
+func TestOracleNegativeAnswer(t *testing.T) {
+	setupPriceFeed(t, testutils.MockRound{RoundId: 2, Answer: big.NewInt(-1), StartedAt: time.Now().Unix(), UpdatedAt: time.Now().Unix(), AnsweredInRound: 2})
+	if _, err := (&OraclePriceSource{}).GetRate(context.Background(), enum.Main, "USD", "ETH"); err == nil {
+		t.Fatalf("A negative answer should be refused")
+	}
+}
+
+func TestOracleCrossCheck(t *testing.T) {
+	setupPriceFeed(t, testutils.MockRound{RoundId: 2, Answer: big.NewInt(250000000000), StartedAt: time.Now().Unix(), UpdatedAt: time.Now().Unix(), AnsweredInRound: 2})
+	rateCache = make(map[rateKey]cachedRate)
+	config.Opts.PriceSources = oracleSource + ",second"
+	defer func() { config.Opts.PriceSources = proxySource }()
+	RegisterPriceSource(&fixedPriceSource{name: "second", rate: 0.0006, updatedAt: time.Now()})
+	if _, err := GetRate(enum.Main, "USD", "ETH"); !errors.Is(err, PricesDisagree) {
+		t.Fatalf("The oracle rate deviates 50%% from the second source, but got %v", err)
+	}
+
+	RegisterPriceSource(&fixedPriceSource{name: "second", rate: 0.000401, updatedAt: time.Now()})
+	rate, err := GetRate(enum.Main, "USD", "ETH")
+	if err != nil {
+		t.Fatalf("Unable to get rate %v", err)
+	}
+	if rate.Source != oracleSource {
+		t.Fatalf("The rate of the primary source %v should be used, but got the rate of %v", oracleSource, rate.Source)
+	}
+}
@@ -0,0 +1,233 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/logging"
+	"ethereum-service/model"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// priceTimeout the sources are asked concurrently, a source without a rate until then is left out
+var priceTimeout = 10 * time.Second
+
+var PricesDisagree = errors.New("the price sources disagree more than PRICE_MAX_DEVIATION")
+
+// Rate amount of the destination currency for one unit of the source currency
+type Rate struct {
+	Source string
+	Rate   float64
+	// UpdatedAt time of the rate, zero if the source doesn't tell it. A rate of unknown age isn't checked for staleness.
+	UpdatedAt time.Time
+	// MaxAge of the rate, PRICE_MAX_STALENESS if it's 0
+	MaxAge time.Duration
+}
+
+// PriceSource
+/*
+	Source of exchange rates, e.g. the proxy or an oracle. The sources are configured in PRICE_SOURCES by their name.
+	GetRate is called concurrently for all sources, a rate after the deadline of the context isn't used.
+*/
+type PriceSource interface {
+	Name() string
+	GetRate(ctx context.Context, mode enum.Mode, srcCurrency string, dstCurrency string) (*Rate, error)
+}
+
+type sourceRate struct {
+	index int
+	rate  *Rate
+}
+
+type cachedRate struct {
+	rate      Rate
+	fetchedAt time.Time
+}
+
+type rateKey struct {
+	mode        enum.Mode
+	srcCurrency string
+	dstCurrency string
+}
+
+var (
+	priceSourcesLock sync.RWMutex
+	priceSources     = map[string]PriceSource{proxySource: &ProxyPriceSource{}, oracleSource: &OraclePriceSource{}}
+
+	rateCacheLock sync.Mutex
+	rateCache     = make(map[rateKey]cachedRate)
+)
+
+/*
+	Adds a price source, which can be used in PRICE_SOURCES. A source with the same name is replaced.
+*/
+func RegisterPriceSource(source PriceSource) {
+	priceSourcesLock.Lock()
+	defer priceSourcesLock.Unlock()
+	priceSources[source.Name()] = source
+}
+
+// GetQuote
+/*
+	Converts the price of the payment into its pay currency with the rate of the price sources.
+	Returns ConversionFailed if no source has a fresh rate and PricesDisagree if the rates deviate too much.
+*/
+func GetQuote(payment model.Payment) (*model.Quote, error) {
+	if payment.PriceAmount <= 0 {
+		return nil, ConversionFailed
+	}
+	rate, err := GetRate(payment.Mode, payment.PriceCurrency, payment.GetPayCurrency())
+	if err != nil {
+		return nil, err
+	}
+	return &model.Quote{
+		Id:       uuid.New().String(),
+		Source:   rate.Source,
+		Rate:     rate.Rate,
+		Amount:   payment.PriceAmount * rate.Rate,
+		QuotedAt: time.Now(),
+	}, nil
+}
+
+// GetRate
+/*
+	Returns the rate of the currency pair. A rate is cached for PRICE_CACHE_TTL seconds.
+	All sources of PRICE_SOURCES are asked concurrently, the rate of the first source with a fresh rate is used and the others are cross-checked against it.
+	A rate which is older than PRICE_MAX_STALENESS seconds, invalid or not there within priceTimeout is ignored, so the next source is the fallback.
+*/
+func GetRate(mode enum.Mode, srcCurrency string, dstCurrency string) (*Rate, error) {
+	key := rateKey{mode: mode, srcCurrency: strings.ToUpper(srcCurrency), dstCurrency: strings.ToUpper(dstCurrency)}
+	if rate, ok := getCachedRate(key); ok {
+		return &rate, nil
+	}
+
+	rates := getRates(mode, key)
+	if len(rates) == 0 {
+		return nil, fmt.Errorf("%w: no price source has a rate for %v/%v", ConversionFailed, key.srcCurrency, key.dstCurrency)
+	}
+
+	rate := rates[0]
+	for _, other := range rates[1:] {
+		deviation := math.Abs(other.Rate-rate.Rate) / rate.Rate * 100
+		if deviation > config.Opts.PriceMaxDeviation {
+			logging.WithMode(mode).WithFields(logrus.Fields{
+				"pair":         key.pair(),
+				"source":       rate.Source,
+				"rate":         rate.Rate,
+				"other_source": other.Source,
+				"other_rate":   other.Rate,
+				"deviation":    deviation,
+			}).Error("Rates of the price sources disagree")
+			return nil, PricesDisagree
+		}
+	}
+	setCachedRate(key, *rate)
+	return rate, nil
+}
+
+/*
+	Asks the sources concurrently and returns the valid rates in the order of PRICE_SOURCES. The sources share the deadline of priceTimeout.
+*/
+func getRates(mode enum.Mode, key rateKey) []*Rate {
+	ctx, cancel := context.WithTimeout(context.Background(), priceTimeout)
+	defer cancel()
+	sources := getPriceSources()
+	// buffered, so a source answering after the deadline doesn't block
+	results := make(chan sourceRate, len(sources))
+	for i, source := range sources {
+		go func(index int, source PriceSource) {
+			rate, err := source.GetRate(ctx, mode, key.srcCurrency, key.dstCurrency)
+			if err != nil {
+				logging.WithMode(mode).WithError(err).WithFields(logrus.Fields{"source": source.Name(), "pair": key.pair()}).Warn("Price source has no rate")
+				rate = nil
+			} else if err = checkRate(rate); err != nil {
+				logging.WithMode(mode).WithError(err).WithFields(logrus.Fields{"source": source.Name(), "pair": key.pair()}).Warn("Rate of price source is ignored")
+				rate = nil
+			}
+			results <- sourceRate{index: index, rate: rate}
+		}(i, source)
+	}
+
+	ordered := make([]*Rate, len(sources))
+collect:
+	for range sources {
+		select {
+		case result := <-results:
+			ordered[result.index] = result.rate
+		case <-ctx.Done():
+			logging.WithMode(mode).WithField("pair", key.pair()).Warn("Not all price sources answered in time")
+			break collect
+		}
+	}
+	var rates []*Rate
+	for _, rate := range ordered {
+		if rate != nil {
+			rates = append(rates, rate)
+		}
+	}
+	return rates
+}
+
+func (k rateKey) pair() string {
+	return k.srcCurrency + "/" + k.dstCurrency
+}
+
+func checkRate(rate *Rate) error {
+	if rate == nil || rate.Rate <= 0 || math.IsInf(rate.Rate, 0) || math.IsNaN(rate.Rate) {
+		return errors.New("invalid rate")
+	}
+	maxStaleness := rate.MaxAge
+	if maxStaleness == 0 {
+		maxStaleness = time.Duration(config.Opts.PriceMaxStaleness) * time.Second
+	}
+	if !rate.UpdatedAt.IsZero() && time.Since(rate.UpdatedAt) > maxStaleness {
+		return fmt.Errorf("rate of %v is stale", rate.UpdatedAt)
+	}
+	return nil
+}
+
+func getPriceSources() []PriceSource {
+	priceSourcesLock.RLock()
+	defer priceSourcesLock.RUnlock()
+	var sources []PriceSource
+	for _, name := range strings.Split(config.Opts.PriceSources, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		source, ok := priceSources[name]
+		if !ok {
+			logrus.WithField("source", name).Warn("Price source is unknown")
+			continue
+		}
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+/*
+	A cached rate is only used for PRICE_CACHE_TTL seconds after it was fetched, 0 disables the cache.
+*/
+func getCachedRate(key rateKey) (Rate, bool) {
+	rateCacheLock.Lock()
+	defer rateCacheLock.Unlock()
+	cached, ok := rateCache[key]
+	if !ok || time.Since(cached.fetchedAt) >= time.Duration(config.Opts.PriceCacheTTL)*time.Second {
+		return Rate{}, false
+	}
+	return cached.rate, true
+}
+
+func setCachedRate(key rateKey, rate Rate) {
+	rateCacheLock.Lock()
+	defer rateCacheLock.Unlock()
+	rateCache[key] = cachedRate{rate: rate, fetchedAt: time.Now()}
+}
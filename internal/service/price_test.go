@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"ethereum-service/internal/config"
+	"ethereum-service/internal/testutils"
+	"testing"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+)
+
+// fixedPriceSource returns a fixed rate or error after the delay and counts the calls
+type fixedPriceSource struct {
+	name      string
+	rate      float64
+	updatedAt time.Time
+	err       error
+	delay     time.Duration
+	calls     int
+}
+
+func (s *fixedPriceSource) Name() string {
+	return s.name
+}
+
+func (s *fixedPriceSource) GetRate(ctx context.Context, mode enum.Mode, srcCurrency string, dstCurrency string) (*Rate, error) {
+	s.calls++
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &Rate{Source: s.name, Rate: s.rate, UpdatedAt: s.updatedAt}, nil
+}
+
+/*
+	Registers the sources as the only price sources with an empty cache.
+*/
+func setupPriceSources(sources ...*fixedPriceSource) {
+	config.ReadOpts()
+	rateCache = make(map[rateKey]cachedRate)
+	config.Opts.PriceSources = ""
+	for _, source := range sources {
+		RegisterPriceSource(source)
+		config.Opts.PriceSources += source.name + ","
+	}
+}
+
+func TestGetQuoteCachesRate(t *testing.T) {
+	source := &fixedPriceSource{name: "first", rate: 0.0005, updatedAt: time.Now()}
+	setupPriceSources(source)
+	defer func() { config.Opts.PriceSources = proxySource }()
+	payment := testutils.GetWaitingPayment()
+	for i := 0; i < 2; i++ {
+		quote, err := GetQuote(payment)
+		if err != nil {
+			t.Fatalf("Unable to get quote %v", err)
+		}
+		if quote.Amount != payment.PriceAmount*source.rate || quote.Source != source.name || quote.Id == "" {
+			t.Fatalf("Quote is wrong %+v", quote)
+		}
+	}
+	if source.calls != 1 {
+		t.Fatalf("The rate should be cached, but the source was called %v times", source.calls)
+	}
+}
+
+func TestGetRateFallback(t *testing.T) {
+	failing := &fixedPriceSource{name: "first", err: errors.New("unreachable")}
+	stale := &fixedPriceSource{name: "second", rate: 0.0004, updatedAt: time.Now().Add(-time.Hour)}
+	fallback := &fixedPriceSource{name: "third", rate: 0.0005, updatedAt: time.Now()}
+	setupPriceSources(failing, stale, fallback)
+	defer func() { config.Opts.PriceSources = proxySource }()
+	rate, err := GetRate(enum.Main, "USD", "ETH")
+	if err != nil {
+		t.Fatalf("Unable to get rate %v", err)
+	}
+	if rate.Source != fallback.name {
+		t.Fatalf("The rate of %v should be used, but got the rate of %v", fallback.name, rate.Source)
+	}
+}
+
+func TestGetRateSlowSource(t *testing.T) {
+	slow := &fixedPriceSource{name: "first", rate: 0.0004, updatedAt: time.Now(), delay: time.Hour}
+	fast := &fixedPriceSource{name: "second", rate: 0.0005, updatedAt: time.Now(), delay: 10 * time.Millisecond}
+	setupPriceSources(slow, fast)
+	timeout := priceTimeout
+	priceTimeout = 200 * time.Millisecond
+	defer func() {
+		config.Opts.PriceSources = proxySource
+		priceTimeout = timeout
+	}()
+	start := time.Now()
+	rate, err := GetRate(enum.Main, "USD", "ETH")
+	if err != nil {
+		t.Fatalf("Unable to get rate %v", err)
+	}
+	if rate.Source != fast.name {
+		t.Fatalf("The slow source should be left out, but got the rate of %v", rate.Source)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("The sources should share the deadline of %v, but it took %v", priceTimeout, elapsed)
+	}
+}
+
+func TestGetRateNoSource(t *testing.T) {
+	setupPriceSources(&fixedPriceSource{name: "first", err: errors.New("unreachable")})
+	defer func() { config.Opts.PriceSources = proxySource }()
+	if _, err := GetRate(enum.Main, "USD", "ETH"); !errors.Is(err, ConversionFailed) {
+		t.Fatalf("Conversion should fail, but got %v", err)
+	}
+}
+
+func TestGetRateDeviation(t *testing.T) {
+	primary := &fixedPriceSource{name: "first", rate: 0.0005, updatedAt: time.Now()}
+	close := &fixedPriceSource{name: "second", rate: 0.000505, updatedAt: time.Now()}
+	setupPriceSources(primary, close)
+	defer func() { config.Opts.PriceSources = proxySource }()
+	if _, err := GetRate(enum.Main, "USD", "ETH"); err != nil {
+		t.Fatalf("Rates within %v%% should be accepted, but got %v", config.Opts.PriceMaxDeviation, err)
+	}
+
+	far := &fixedPriceSource{name: "second", rate: 0.0006, updatedAt: time.Now()}
+	setupPriceSources(primary, far)
+	if _, err := GetRate(enum.Main, "USD", "ETH"); !errors.Is(err, PricesDisagree) {
+		t.Fatalf("Rates which deviate 20%% should be refused, but got %v", err)
+	}
+}
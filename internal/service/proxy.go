@@ -2,27 +2,55 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"ethereum-service/internal/config"
-	"ethereum-service/model"
 	"ethereum-service/proxyClientApi"
 	"fmt"
-	"os"
+	"strings"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
 )
 
-func GetETHAmount(payment model.Payment) *float64 {
-	amount := fmt.Sprintf("%g", payment.PriceAmount)
-	srcCurrency := payment.PriceCurrency
-	dstCurrency := "ETH" // string |
-	mode := "main"
+// proxySource name of the price source of the proxy service
+const proxySource = "proxy"
+
+var ConversionFailed = errors.New("unable to convert the price into the pay currency")
+
+// proxyRateTime time of the conversion in the payload of the proxy, it isn't part of the generated client
+type proxyRateTime struct {
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// ProxyPriceSource
+/*
+	Rates of the price conversion of the proxy service in the mode of the payment.
+*/
+type ProxyPriceSource struct{}
 
+func (s *ProxyPriceSource) Name() string {
+	return proxySource
+}
+
+/*
+	The time of the rate is taken from the conversion. Without it the age of the rate is unknown and it isn't checked for staleness.
+*/
+func (s *ProxyPriceSource) GetRate(ctx context.Context, mode enum.Mode, srcCurrency string, dstCurrency string) (*Rate, error) {
 	configuration := proxyClientApi.NewConfiguration()
 	configuration.Servers[0].URL = config.Opts.ProxyBaseUrl
 	apiClient := proxyClientApi.NewAPIClient(configuration)
-	resp, r, err := apiClient.ConversionApi.GetPriceConversion(context.Background()).Amount(amount).SrcCurrency(srcCurrency).DstCurrency(dstCurrency).Mode(mode).Execute()
+	resp, httpResp, err := apiClient.ConversionApi.GetPriceConversion(ctx).Amount("1").SrcCurrency(srcCurrency).DstCurrency(dstCurrency).Mode(strings.ToLower(mode.String())).Execute()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error when calling `ConversionApi.GetPriceConversion``: %v\n", err)
-		fmt.Fprintf(os.Stderr, "Full HTTP response: %v\n", r)
+		return nil, err
+	}
+	if resp == nil || resp.Price == nil {
+		return nil, fmt.Errorf("conversion of %v into %v has no price", srcCurrency, dstCurrency)
+	}
+	rate := &Rate{Source: proxySource, Rate: *resp.Price}
+	var payload proxyRateTime
+	if httpResp != nil && json.NewDecoder(httpResp.Body).Decode(&payload) == nil && payload.UpdatedAt != nil {
+		rate.UpdatedAt = *payload.UpdatedAt
 	}
-	fmt.Fprintf(os.Stdout, "Response from `ConversionApi.GetPriceConversion`: %v\n", resp)
-	return resp.Price
+	return rate, nil
 }
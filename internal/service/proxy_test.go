@@ -1,28 +1,94 @@
 package service
 
 import (
+	"context"
 	"ethereum-service/internal/config"
-	"ethereum-service/internal/testutils"
 	"testing"
+	"time"
 
+	"github.com/CHainGate/backend/pkg/enum"
 	"gopkg.in/h2non/gock.v1"
 )
 
-func TestGetETHAmount(t *testing.T) {
+func TestProxyGetRate(t *testing.T) {
 	config.ReadOpts()
-	expectedPayAmountFloat := 0.0001
+	expectedRate := 0.000001
 	defer gock.Off() // Flush pending mocks after test execution
 	gock.New("http://localhost:8001").
 		Get("/api/price-conversion").
-		MatchParam("amount", "100").
+		MatchParam("amount", "1").
 		MatchParam("dst_currency", "ETH").
 		MatchParam("mode", "main").
 		MatchParam("src_currency", "USD").
 		Reply(200).
-		JSON(map[string]float64{"Price": expectedPayAmountFloat})
-	payment := testutils.GetWaitingPayment()
-	GetETHAmount(payment)
+		JSON(map[string]interface{}{"price": expectedRate, "updated_at": "2026-10-18T10:00:00Z"})
+	rate, err := (&ProxyPriceSource{}).GetRate(context.Background(), enum.Main, "USD", "ETH")
+	if err != nil {
+		t.Fatalf("Unable to get rate %v", err)
+	}
+	if rate.Rate != expectedRate || rate.Source != proxySource {
+		t.Fatalf("Rate is wrong %+v", rate)
+	}
+	if expected := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC); !rate.UpdatedAt.Equal(expected) {
+		t.Fatalf("Rate should be updated at %v, but is of %v", expected, rate.UpdatedAt)
+	}
 	if gock.IsDone() != true {
 		t.Fatalf("Request should have been sent, but there are open requests")
 	}
 }
+
+func TestProxyGetRateTestMode(t *testing.T) {
+	config.ReadOpts()
+	defer gock.Off() // Flush pending mocks after test execution
+	gock.New("http://localhost:8001").
+		Get("/api/price-conversion").
+		MatchParam("mode", "test").
+		Reply(200).
+		JSON(map[string]float64{"Price": 0.000001})
+	if _, err := (&ProxyPriceSource{}).GetRate(context.Background(), enum.Test, "USD", "ETH"); err != nil {
+		t.Fatalf("Unable to get rate %v", err)
+	}
+	if gock.IsDone() != true {
+		t.Fatalf("Request should have been sent in test mode, but there are open requests")
+	}
+}
+
+func TestProxyGetRateFailed(t *testing.T) {
+	config.ReadOpts()
+	defer gock.Off() // Flush pending mocks after test execution
+	gock.New("http://localhost:8001").
+		Get("/api/price-conversion").
+		Reply(503)
+	if _, err := (&ProxyPriceSource{}).GetRate(context.Background(), enum.Main, "USD", "ETH"); err == nil {
+		t.Fatalf("Conversion should fail")
+	}
+
+	// a response without price
+	gock.New("http://localhost:8001").
+		Get("/api/price-conversion").
+		Reply(200).
+		JSON(map[string]string{})
+	if _, err := (&ProxyPriceSource{}).GetRate(context.Background(), enum.Main, "USD", "ETH"); err == nil {
+		t.Fatalf("Conversion without price should fail")
+	}
+}
+
+func TestProxyGetRateWithoutTime(t *testing.T) {
+	config.ReadOpts()
+	defer gock.Off() // Flush pending mocks after test execution
+	gock.New("http://localhost:8001").
+		Get("/api/price-conversion").
+		Reply(200).
+		JSON(map[string]float64{"Price": 0.000001})
+	rate, err := (&ProxyPriceSource{}).GetRate(context.Background(), enum.Main, "USD", "ETH")
+	if err != nil {
+		t.Fatalf("Unable to get rate %v", err)
+	}
+	if !rate.UpdatedAt.IsZero() {
+		t.Fatalf("Age of the rate should be unknown, but it is of %v", rate.UpdatedAt)
+	}
+	// a rate of unknown age isn't stale
+	if err = checkRate(rate); err != nil {
+		t.Fatalf("Rate of unknown age should be used %v", err)
+	}
+}
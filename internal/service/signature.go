@@ -0,0 +1,93 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"ethereum-service/internal/config"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	SignatureHeader          = "X-Chaingate-Signature"
+	SignatureTimestampHeader = "X-Chaingate-Timestamp"
+	SignatureKeyIdHeader     = "X-Chaingate-Key-Id"
+)
+
+// backendTimeout a call to the backend which takes longer is failed and retried by the dispatcher
+const backendTimeout = 30 * time.Second
+
+var NoSigningSecret = errors.New("BACKEND_SIGNING_SECRET isn't set. Set BACKEND_SIGNING_DISABLED=true to send the calls to the backend unsigned")
+
+// CheckSigning
+/*
+	Fails without a signing secret, unless the signing is disabled explicitly, so the backend doesn't get unsigned calls by accident.
+*/
+func CheckSigning() error {
+	if config.Opts.BackendSigningSecret == "" && !config.Opts.BackendSigningDisabled {
+		return NoSigningSecret
+	}
+	return nil
+}
+
+// Sign
+/*
+	HMAC-SHA256 of "<timestamp>.<method>.<path>.<body>" as hex. The timestamp is in unix seconds, so the backend can reject replayed calls.
+	The method and the escaped path bind the signature to the endpoint, so a signed body can't be sent to another one.
+*/
+func Sign(secret []byte, timestamp int64, method string, path string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "." + method + "." + path + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+	Signs every request with the secret. The key id tells the backend which secret was used, so the secret can be rotated without downtime.
+*/
+type signingTransport struct {
+	keyId  string
+	secret []byte
+	// next nil uses the current http.DefaultTransport
+	next http.RoundTripper
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	timestamp := time.Now().Unix()
+	signed := req.Clone(req.Context())
+	signed.Body = io.NopCloser(bytes.NewReader(body))
+	signed.Header.Set(SignatureTimestampHeader, strconv.FormatInt(timestamp, 10))
+	signed.Header.Set(SignatureKeyIdHeader, t.keyId)
+	signed.Header.Set(SignatureHeader, Sign(t.secret, timestamp, signed.Method, signed.URL.EscapedPath(), body))
+
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return next.RoundTrip(signed)
+}
+
+/*
+	Client for the calls to the backend. The calls are only unsigned, if the signing is disabled (see CheckSigning).
+*/
+func newBackendClient(keyId string, secret string, disabled bool) *http.Client {
+	client := &http.Client{Timeout: backendTimeout}
+	if !disabled {
+		client.Transport = &signingTransport{keyId: keyId, secret: []byte(secret)}
+	}
+	return client
+}
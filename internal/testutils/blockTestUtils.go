@@ -0,0 +1,74 @@
+package testutils
+
+import (
+	"ethereum-service/model"
+	"math/big"
+	"sync"
+
+	"github.com/CHainGate/backend/pkg/enum"
+)
+
+// BlockRepositoryMock in-memory block history for tests which process a chain
+type BlockRepositoryMock struct {
+	lock   sync.Mutex
+	blocks map[enum.Mode]map[string]model.Block
+}
+
+func NewBlockRepositoryMock() *BlockRepositoryMock {
+	return &BlockRepositoryMock{blocks: make(map[enum.Mode]map[string]model.Block)}
+}
+
+func (r *BlockRepositoryMock) Create(block *model.Block) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.blocks[block.Mode] == nil {
+		r.blocks[block.Mode] = make(map[string]model.Block)
+	}
+	r.blocks[block.Mode][block.Number.String()] = *block
+	return nil
+}
+
+func (r *BlockRepositoryMock) GetLatest(mode enum.Mode) (*model.Block, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var latest *model.Block
+	for _, b := range r.blocks[mode] {
+		if latest == nil || b.Number.Cmp(&latest.Number.Int) > 0 {
+			block := b
+			latest = &block
+		}
+	}
+	return latest, nil
+}
+
+func (r *BlockRepositoryMock) GetByNumber(mode enum.Mode, number *big.Int) (*model.Block, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	block, ok := r.blocks[mode][number.String()]
+	if !ok {
+		return nil, nil
+	}
+	return &block, nil
+}
+
+func (r *BlockRepositoryMock) DeleteFrom(mode enum.Mode, number *big.Int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for k, b := range r.blocks[mode] {
+		if b.Number.Cmp(number) >= 0 {
+			delete(r.blocks[mode], k)
+		}
+	}
+	return nil
+}
+
+func (r *BlockRepositoryMock) DeleteBefore(mode enum.Mode, number *big.Int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for k, b := range r.blocks[mode] {
+		if b.Number.Cmp(number) < 0 {
+			delete(r.blocks[mode], k)
+		}
+	}
+	return nil
+}
@@ -17,16 +17,16 @@ import (
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/eth"
 	"github.com/ethereum/go-ethereum/eth/downloader"
 	"github.com/ethereum/go-ethereum/eth/ethconfig"
-	"github.com/ethereum/go-ethereum/ethclient"
 	geth "github.com/ethereum/go-ethereum/mobile"
 	"github.com/ethereum/go-ethereum/node"
 	"github.com/ethereum/go-ethereum/params"
 )
 
-func NewTestChain(t *testing.T, auth *bind.TransactOpts) *ethclient.Client {
+func NewTestChain(t *testing.T, auth *bind.TransactOpts) *config.Client {
 	address := auth.From
 	backend, _, ethservice := NewTestBackend(t, address)
 	rpc, err := backend.Attach()
@@ -37,7 +37,7 @@ func NewTestChain(t *testing.T, auth *bind.TransactOpts) *ethclient.Client {
 	primaryMiner := ethservice.Miner()
 	go primaryMiner.Start(auth.From)
 
-	client := ethclient.NewClient(rpc)
+	client := config.NewClient(rpc)
 
 	t.Cleanup(func() {
 		client.Close()
@@ -99,7 +99,110 @@ func generateTestChain(testAddr common.Address, testBalance *big.Int) (*core.Gen
 	return genesis, blocks
 }
 
-func CustomChainSetup(t *testing.T) (*model.Account, *ethclient.Client) {
+// NewReorgTestChain
+/*
+	Creates an in-memory chain without miner with a canonical chain of length blocks.
+	The returned function inserts a fork with forkLength blocks on top of the block forkPoint.
+	If the fork is longer than the canonical chain after forkPoint, the chain gets reorganized.
+*/
+func NewReorgTestChain(t *testing.T, length int, forkPoint int, forkLength int) (*config.Client, func() []*types.Block) {
+	return NewReorgTestChainWithTransfers(t, length, forkPoint, forkLength)
+}
+
+// ChainTransfer a transfer of Value wei to To, which is mined in the canonical block Block
+type ChainTransfer struct {
+	Block int
+	To    common.Address
+	Value *big.Int
+}
+
+// NewReorgTestChainWithTransfers
+/*
+	Same as NewReorgTestChain, but the canonical chain contains the transfers. They are sent from a funded genesis account,
+	so a reorganization to the fork removes them again.
+*/
+func NewReorgTestChainWithTransfers(t *testing.T, length int, forkPoint int, forkLength int, transfers ...ChainTransfer) (*config.Client, func() []*types.Block) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("can't create sender key: %v", err)
+	}
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	db := rawdb.NewMemoryDatabase()
+	c := params.AllEthashProtocolChanges
+	genesis := &core.Genesis{
+		GasLimit:   9223372036854775807,
+		Difficulty: big.NewInt(1),
+		Config:     c,
+		Alloc:      core.GenesisAlloc{sender: {Balance: big.NewInt(0).Mul(big.NewInt(1000000000000000000), big.NewInt(1000))}},
+		ExtraData:  []byte("test genesis"),
+		Timestamp:  9000,
+		BaseFee:    big.NewInt(params.InitialBaseFee),
+	}
+	gblock := genesis.ToBlock(db)
+	engine := ethash.NewFaker()
+	signer := types.LatestSigner(c)
+	blocks, _ := core.GenerateChain(c, gblock, engine, db, length, func(i int, g *core.BlockGen) {
+		g.OffsetTime(5)
+		g.SetExtra([]byte("canonical"))
+		for _, transfer := range transfers {
+			if transfer.Block != i+1 {
+				continue
+			}
+			tx, err := types.SignTx(types.NewTransaction(g.TxNonce(sender), transfer.To, transfer.Value, params.TxGas, g.BaseFee(), nil), signer, key)
+			if err != nil {
+				t.Fatalf("can't sign transfer: %v", err)
+			}
+			g.AddTx(tx)
+		}
+	})
+	forkParent := gblock
+	if forkPoint > 0 {
+		forkParent = blocks[forkPoint-1]
+	}
+	forkBlocks, _ := core.GenerateChain(c, forkParent, engine, db, forkLength, func(i int, g *core.BlockGen) {
+		g.OffsetTime(5)
+		g.SetExtra([]byte("fork"))
+	})
+
+	n, err := node.New(&node.Config{})
+	if err != nil {
+		t.Fatalf("can't create new node: %v", err)
+	}
+	ethConfig := &ethconfig.Config{
+		SyncMode: downloader.FullSync,
+		Genesis:  genesis,
+	}
+	ethConfig.Ethash.PowMode = ethash.ModeFake
+	ethservice, err := eth.New(n, ethConfig)
+	if err != nil {
+		t.Fatalf("can't create new ethereum service: %v", err)
+	}
+	if err := n.Start(); err != nil {
+		t.Fatalf("can't start test node: %v", err)
+	}
+	if _, err := ethservice.BlockChain().InsertChain(blocks); err != nil {
+		t.Fatalf("can't import test blocks: %v", err)
+	}
+	rpc, err := n.Attach()
+	if err != nil {
+		t.Fatalf("creating rpc: %v", err)
+	}
+	client := config.NewClient(rpc)
+	t.Cleanup(func() {
+		client.Close()
+		n.Close()
+	})
+
+	insertFork := func() []*types.Block {
+		if _, err := ethservice.BlockChain().InsertChain(forkBlocks); err != nil {
+			t.Fatalf("can't import fork blocks: %v", err)
+		}
+		return forkBlocks
+	}
+	return client, insertFork
+}
+
+func CustomChainSetup(t *testing.T) (*model.Account, *config.Client) {
 	genesisAcc := model.CreateAccount(enum.Main)
 	pk, _ := utils.GetPrivateKey(genesisAcc.PrivateKey)
 	auth, _ := NewAuth(pk, context.Background())
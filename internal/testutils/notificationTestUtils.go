@@ -0,0 +1,95 @@
+package testutils
+
+import (
+	"ethereum-service/model"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// NotificationRepositoryMock in-memory outbox of the backend notifications
+type NotificationRepositoryMock struct {
+	lock          sync.Mutex
+	notifications []*model.Notification
+}
+
+func NewNotificationRepositoryMock() *NotificationRepositoryMock {
+	return &NotificationRepositoryMock{}
+}
+
+// Add stores the notification like the payment repository does with a new state
+func (r *NotificationRepositoryMock) Add(n *model.Notification) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if n.ID == uuid.Nil {
+		n.ID = uuid.New()
+	}
+	r.notifications = append(r.notifications, n)
+}
+
+func (r *NotificationRepositoryMock) Update(n *model.Notification) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, stored := range r.notifications {
+		if stored.ID == n.ID {
+			updated := *n
+			r.notifications[i] = &updated
+		}
+	}
+	return nil
+}
+
+func (r *NotificationRepositoryMock) GetDue(now time.Time, limit int) []model.Notification {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var due []model.Notification
+	seen := make(map[uuid.UUID]bool)
+	for _, n := range r.sorted() {
+		if n.Status == model.NotificationDelivered || seen[n.PaymentID] {
+			continue
+		}
+		seen[n.PaymentID] = true
+		if n.Status != model.NotificationPending {
+			// a dead notification blocks the later ones
+			continue
+		}
+		if !n.NextAttemptAt.After(now) && len(due) < limit {
+			due = append(due, *n)
+		}
+	}
+	return due
+}
+
+func (r *NotificationRepositoryMock) GetByPayment(paymentID uuid.UUID, status model.NotificationStatus) []model.Notification {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var notifications []model.Notification
+	for _, n := range r.sorted() {
+		if n.PaymentID == paymentID && n.Status == status {
+			notifications = append(notifications, *n)
+		}
+	}
+	return notifications
+}
+
+// Get the stored state of the notification
+func (r *NotificationRepositoryMock) Get(id uuid.UUID) model.Notification {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, n := range r.notifications {
+		if n.ID == id {
+			return *n
+		}
+	}
+	return model.Notification{}
+}
+
+func (r *NotificationRepositoryMock) sorted() []*model.Notification {
+	notifications := append([]*model.Notification{}, r.notifications...)
+	sort.SliceStable(notifications, func(i, j int) bool {
+		return notifications[i].CreatedAt.Before(notifications[j].CreatedAt)
+	})
+	return notifications
+}
@@ -0,0 +1,101 @@
+package testutils
+
+import (
+	"context"
+	"ethereum-service/internal/config"
+	"ethereum-service/model"
+	"ethereum-service/utils"
+	"log"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// MockRound latest round which is returned by the mock aggregator
+type MockRound struct {
+	RoundId         int64
+	Answer          *big.Int
+	StartedAt       int64
+	UpdatedAt       int64
+	AnsweredInRound int64
+}
+
+// DeployMockAggregator
+/*
+	Deploys a contract which answers decimals() and latestRoundData() of the Chainlink AggregatorV3Interface with fixed values and returns its address.
+*/
+func DeployMockAggregator(client *config.Client, genesisAcc *model.Account, decimals uint8, round MockRound) common.Address {
+	nonce, err := client.PendingNonceAt(context.Background(), common.HexToAddress(genesisAcc.Address))
+	if err != nil {
+		log.Fatal(err)
+	}
+	gasTipCap, err := client.SuggestGasTipCap(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	tx := types.NewTx(&types.DynamicFeeTx{
+		ChainID:   config.Chain.ChainId,
+		Nonce:     nonce,
+		GasFeeCap: config.Chain.GasPrice,
+		GasTipCap: gasTipCap,
+		Gas:       500000,
+		Data:      mockAggregatorCode(decimals, round),
+	})
+	pk, err := utils.GetPrivateKey(genesisAcc.PrivateKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(config.Chain.ChainId), pk)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = client.SendTransaction(context.Background(), signedTx); err != nil {
+		log.Fatal(err)
+	}
+	address, err := bind.WaitDeployed(context.Background(), client, signedTx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return address
+}
+
+/*
+	Creation code of the mock aggregator. The runtime code dispatches on the method id and returns the decimals or the round, which are part of the code.
+*/
+func mockAggregatorCode(decimals uint8, round MockRound) []byte {
+	roundData := make([]byte, 0, 5*32)
+	for _, value := range []*big.Int{big.NewInt(round.RoundId), round.Answer, big.NewInt(round.StartedAt), big.NewInt(round.UpdatedAt), big.NewInt(round.AnsweredInRound)} {
+		// int256 in two's complement, so a negative answer can be tested
+		roundData = append(roundData, math.U256Bytes(new(big.Int).Set(value))...)
+	}
+
+	const decimalsLabel, roundLabel, roundDataOffset = 31, 73, 87
+	runtime := []byte{
+		byte(vm.PUSH1), 0x00, byte(vm.CALLDATALOAD), byte(vm.PUSH1), 0xe0, byte(vm.SHR),
+		byte(vm.DUP1), byte(vm.PUSH4), 0x31, 0x3c, 0xe5, 0x67, byte(vm.EQ), byte(vm.PUSH2), 0x00, decimalsLabel, byte(vm.JUMPI),
+		byte(vm.PUSH4), 0xfe, 0xaf, 0x96, 0x8c, byte(vm.EQ), byte(vm.PUSH2), 0x00, roundLabel, byte(vm.JUMPI),
+		byte(vm.PUSH1), 0x00, byte(vm.DUP1), byte(vm.REVERT),
+		// decimals()
+		byte(vm.JUMPDEST), byte(vm.PUSH32),
+	}
+	runtime = append(runtime, common.LeftPadBytes([]byte{decimals}, 32)...)
+	runtime = append(runtime,
+		byte(vm.PUSH1), 0x00, byte(vm.MSTORE), byte(vm.PUSH1), 0x20, byte(vm.PUSH1), 0x00, byte(vm.RETURN),
+		// latestRoundData()
+		byte(vm.JUMPDEST), byte(vm.PUSH1), 0xa0, byte(vm.PUSH2), 0x00, roundDataOffset, byte(vm.PUSH1), 0x00, byte(vm.CODECOPY),
+		byte(vm.PUSH1), 0xa0, byte(vm.PUSH1), 0x00, byte(vm.RETURN),
+	)
+	runtime = append(runtime, roundData...)
+
+	// copies the runtime code behind this 15 byte prefix into the memory and returns it
+	size := len(runtime)
+	creation := []byte{
+		byte(vm.PUSH2), byte(size >> 8), byte(size), byte(vm.PUSH2), 0x00, 15, byte(vm.PUSH1), 0x00, byte(vm.CODECOPY),
+		byte(vm.PUSH2), byte(size >> 8), byte(size), byte(vm.PUSH1), 0x00, byte(vm.RETURN),
+	}
+	return append(creation, runtime...)
+}
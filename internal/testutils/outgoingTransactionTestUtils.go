@@ -0,0 +1,89 @@
+package testutils
+
+import (
+	"ethereum-service/model"
+	"sort"
+	"sync"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/google/uuid"
+)
+
+// OutgoingTransactionRepositoryMock in-memory outbox for tests which forward payments. The payment references are kept, so the tracker updates the payment of the test.
+type OutgoingTransactionRepositoryMock struct {
+	lock sync.Mutex
+	txs  []*model.OutgoingTransaction
+}
+
+func NewOutgoingTransactionRepositoryMock() *OutgoingTransactionRepositoryMock {
+	return &OutgoingTransactionRepositoryMock{}
+}
+
+func (r *OutgoingTransactionRepositoryMock) Create(tx *model.OutgoingTransaction) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if tx.ID == uuid.Nil {
+		tx.ID = uuid.New()
+	}
+	r.txs = append(r.txs, tx)
+	return nil
+}
+
+func (r *OutgoingTransactionRepositoryMock) Update(tx *model.OutgoingTransaction) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, t := range r.txs {
+		if t.ID == tx.ID {
+			r.txs[i] = tx
+		}
+	}
+	return nil
+}
+
+func (r *OutgoingTransactionRepositoryMock) GetOpen(mode enum.Mode) []model.OutgoingTransaction {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var txs []model.OutgoingTransaction
+	for _, t := range r.txs {
+		if t.Mode == mode && (t.Status == model.TxSigned || t.Status == model.TxSent || t.Status == model.TxMined) {
+			txs = append(txs, *t)
+		}
+	}
+	sort.Slice(txs, func(i, j int) bool { return txs[i].Nonce < txs[j].Nonce })
+	return txs
+}
+
+func (r *OutgoingTransactionRepositoryMock) GetActiveByPayment(paymentID uuid.UUID, kind model.OutgoingTransactionKind) (*model.OutgoingTransaction, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, t := range r.txs {
+		if t.PaymentID != nil && *t.PaymentID == paymentID && t.Kind == kind && t.Status != model.TxFailed {
+			tx := *t
+			return &tx, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *OutgoingTransactionRepositoryMock) GetAllActiveByPayment(paymentID uuid.UUID, kind model.OutgoingTransactionKind) ([]model.OutgoingTransaction, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var txs []model.OutgoingTransaction
+	for _, t := range r.txs {
+		if t.PaymentID != nil && *t.PaymentID == paymentID && t.Kind == kind && t.Status != model.TxFailed {
+			txs = append(txs, *t)
+		}
+	}
+	return txs, nil
+}
+
+// GetAll all recorded transactions in the order they were recorded
+func (r *OutgoingTransactionRepositoryMock) GetAll() []model.OutgoingTransaction {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var txs []model.OutgoingTransaction
+	for _, t := range r.txs {
+		txs = append(txs, *t)
+	}
+	return txs
+}
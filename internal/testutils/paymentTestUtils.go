@@ -0,0 +1,176 @@
+package testutils
+
+import (
+	"ethereum-service/model"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// PaymentRepositoryMock in-memory payments for tests which process a chain. The notifications of the states are kept in Notifications.
+type PaymentRepositoryMock struct {
+	lock          sync.Mutex
+	payments      map[uuid.UUID]model.Payment
+	Notifications []model.Notification
+}
+
+func NewPaymentRepositoryMock(payments ...model.Payment) *PaymentRepositoryMock {
+	r := &PaymentRepositoryMock{payments: make(map[uuid.UUID]model.Payment)}
+	for _, p := range payments {
+		r.payments[p.ID] = p
+	}
+	return r
+}
+
+func (r *PaymentRepositoryMock) UpdatePaymentState(payment *model.Payment) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.payments[payment.ID] = *payment
+}
+
+func (r *PaymentRepositoryMock) UpdatePaymentStateAndNotify(payment *model.Payment, notification *model.Notification) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.payments[payment.ID] = *payment
+	r.Notifications = append(r.Notifications, *notification)
+	return nil
+}
+
+func (r *PaymentRepositoryMock) UpdatePaymentStateIfCurrent(payment *model.Payment, currentStateID uuid.UUID, notification *model.Notification) error {
+	r.lock.Lock()
+	stored, ok := r.payments[payment.ID]
+	r.lock.Unlock()
+	if !ok || stored.CurrentPaymentStateId == nil || *stored.CurrentPaymentStateId != currentStateID {
+		return model.StateChanged
+	}
+	return r.UpdatePaymentStateAndNotify(payment, notification)
+}
+
+// Create rejects an idempotency key, which the merchant wallet already used, like the unique index does
+func (r *PaymentRepositoryMock) Create(payment *model.Payment, finalPaymentAmount *big.Int) (*model.Payment, error) {
+	if payment.IdempotencyKey != "" && len(r.find(func(p model.Payment) bool {
+		return strings.EqualFold(p.MerchantWallet, payment.MerchantWallet) && p.IdempotencyKey == payment.IdempotencyKey
+	})) > 0 {
+		return nil, model.DuplicateIdempotencyKey
+	}
+	if payment.CreatedAt.IsZero() {
+		payment.CreatedAt = time.Now()
+	}
+	payment.AddNewPaymentState(enum.Waiting, big.NewInt(0), finalPaymentAmount)
+	r.UpdatePaymentState(payment)
+	return payment, nil
+}
+
+func (r *PaymentRepositoryMock) GetAllOpen() []model.Payment {
+	return r.find(func(p model.Payment) bool {
+		return hasState(p, enum.Waiting, enum.PartiallyPaid)
+	})
+}
+
+func (r *PaymentRepositoryMock) GetOpenByMode(mode enum.Mode) []model.Payment {
+	return r.find(func(p model.Payment) bool {
+		return p.Mode == mode && hasState(p, enum.Waiting, enum.PartiallyPaid)
+	})
+}
+
+func (r *PaymentRepositoryMock) GetByID(id uuid.UUID) (*model.Payment, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	p, ok := r.payments[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &p, nil
+}
+
+func (r *PaymentRepositoryMock) Search(filter model.PaymentFilter) ([]model.Payment, *model.PaymentCursor, error) {
+	return r.find(func(p model.Payment) bool {
+		return filter.Mode == 0 || p.Mode == filter.Mode
+	}), nil, nil
+}
+
+func (r *PaymentRepositoryMock) GetByIdempotencyKey(wallet string, key string, since time.Time) (*model.Payment, error) {
+	found := r.find(func(p model.Payment) bool {
+		return strings.EqualFold(p.MerchantWallet, wallet) && p.IdempotencyKey == key && !p.CreatedAt.Before(since)
+	})
+	if len(found) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &found[0], nil
+}
+
+func (r *PaymentRepositoryMock) ReleaseIdempotencyKey(wallet string, key string, before time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for id, p := range r.payments {
+		if strings.EqualFold(p.MerchantWallet, wallet) && p.IdempotencyKey == key && p.CreatedAt.Before(before) {
+			p.IdempotencyKey = ""
+			r.payments[id] = p
+		}
+	}
+	return nil
+}
+
+func (r *PaymentRepositoryMock) GetReceiving(mode enum.Mode) []model.Payment {
+	return r.find(func(p model.Payment) bool {
+		return p.Mode == mode && hasState(p, enum.Waiting, enum.PartiallyPaid, enum.Paid)
+	})
+}
+
+func (r *PaymentRepositoryMock) GetConfirming(mode enum.Mode) []model.Payment {
+	return r.find(func(p model.Payment) bool {
+		return p.Mode == mode && hasState(p, enum.Paid, model.OverpaidRefunded)
+	})
+}
+
+func (r *PaymentRepositoryMock) GetFinishing(mode enum.Mode) []model.Payment {
+	return r.find(func(p model.Payment) bool {
+		return p.Mode == mode && hasState(p, enum.Forwarded)
+	})
+}
+
+func (r *PaymentRepositoryMock) GetOpenRefunds(mode enum.Mode) []model.Payment {
+	return r.find(func(p model.Payment) bool {
+		return p.Mode == mode && p.RefundStatus == model.RefundOpen && !p.RefundHeld
+	})
+}
+
+func (r *PaymentRepositoryMock) GetRefundState(id uuid.UUID) (model.RefundStatus, bool, error) {
+	p, err := r.GetByID(id)
+	if err != nil {
+		return "", false, err
+	}
+	return p.RefundStatus, p.RefundHeld, nil
+}
+
+func (r *PaymentRepositoryMock) GetWatched(mode enum.Mode) []model.Payment {
+	return r.find(func(p model.Payment) bool {
+		return p.Mode == mode && p.WatchedUntil != nil
+	})
+}
+
+func (r *PaymentRepositoryMock) find(match func(p model.Payment) bool) []model.Payment {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var payments []model.Payment
+	for _, p := range r.payments {
+		if match(p) {
+			payments = append(payments, p)
+		}
+	}
+	return payments
+}
+
+func hasState(p model.Payment, states ...enum.State) bool {
+	for _, s := range states {
+		if p.CurrentPaymentState.StateID == s {
+			return true
+		}
+	}
+	return false
+}
@@ -2,6 +2,7 @@ package testutils
 
 import (
 	"context"
+	"database/sql/driver"
 	"ethereum-service/internal/config"
 	"ethereum-service/model"
 	"ethereum-service/utils"
@@ -11,11 +12,11 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 
 	"github.com/CHainGate/backend/pkg/enum"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -109,6 +110,26 @@ func addFailedPaymentState(payment model.Payment) *model.Payment {
 	return addPaymentState(payment, state)
 }
 
+func addCancelledPaymentState(payment model.Payment) *model.Payment {
+	state := CreatePaymentState(payment.ID, payment.AccountID, model.Cancelled, big.NewInt(0))
+	return addPaymentState(payment, state)
+}
+
+func addOverpaidRefundedPaymentState(payment model.Payment) *model.Payment {
+	state := CreatePaymentState(payment.ID, payment.AccountID, model.OverpaidRefunded, big.NewInt(100000000000000))
+	return addPaymentState(payment, state)
+}
+
+func addRefundedPaymentState(payment model.Payment) *model.Payment {
+	state := CreatePaymentState(payment.ID, payment.AccountID, model.Refunded, big.NewInt(0))
+	return addPaymentState(payment, state)
+}
+
+func addLatePaidPaymentState(payment model.Payment) *model.Payment {
+	state := CreatePaymentState(payment.ID, payment.AccountID, model.LatePaid, big.NewInt(0))
+	return addPaymentState(payment, state)
+}
+
 func GetNewChaingateAcc() model.Account {
 	chaingateAcc = model.CreateAccount(enum.Main)
 	chaingateAcc.ID = uuid.New()
@@ -177,6 +198,20 @@ func GetFinishedPayment() model.Payment {
 	return *finishedPayment
 }
 
+// paymentColumnCount columns of the payments table, which are written by an INSERT or UPDATE
+const paymentColumnCount = 31
+
+/*
+	Arguments of an INSERT or UPDATE of the payment. Only the columns up to the price currency are checked.
+*/
+func paymentArgs(accountID driver.Value, merchantWallet driver.Value, p model.Payment) []driver.Value {
+	args := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), accountID, merchantWallet, p.Mode, p.PriceAmount, p.PriceCurrency}
+	for len(args) < paymentColumnCount {
+		args = append(args, sqlmock.AnyArg())
+	}
+	return args
+}
+
 func getPaymentRow(p model.Payment) *sqlmock.Rows {
 	return sqlmock.NewRows([]string{"id", "merchant_wallet", "mode", "price_amount", "price_currency", "current_payment_state_id", "forwarding_transaction_hash", "receiving_block_nr", "forwarding_block_nr"}).
 		AddRow(p.ID, GetMerchantAcc().Address, 1, "100", "USD", p.CurrentPaymentStateId, p.ForwardingTransactionHash, p.LastReceivingBlockNr, p.ForwardingBlockNr)
@@ -203,13 +238,13 @@ func SetupCreatePayment(mock sqlmock.Sqlmock) sqlmock.Sqlmock {
 
 	mock.ExpectBegin()
 	mock.ExpectQuery("INSERT INTO \"accounts\"").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, true, ca.Remainder, ca.Mode, ca.ID).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, true, ca.Remainder, ca.Mode, sqlmock.AnyArg(), ca.ID).
 		WillReturnRows(accRows)
 	mock.ExpectQuery("INSERT INTO \"payment_states\"").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.ID, wp.CurrentPaymentState.PayAmount, "0", enum.Waiting, sqlmock.AnyArg()).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.ID, wp.CurrentPaymentState.PayAmount, "0", enum.Waiting, sqlmock.AnyArg(), enum.Waiting).
 		WillReturnRows(stateRows)
 	mock.ExpectQuery("INSERT INTO \"payments\"").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.ID, ma.Address, ep.Mode, ep.PriceAmount, ep.PriceCurrency, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WithArgs(paymentArgs(ca.ID, ma.Address, ep)...).
 		WillReturnRows(paymentRows)
 	mock.ExpectCommit()
 	return mock
@@ -225,18 +260,30 @@ func SetupCreatePaymentWithoutIdCheck(mock sqlmock.Sqlmock) sqlmock.Sqlmock {
 
 	mock.ExpectBegin()
 	mock.ExpectQuery("INSERT INTO \"accounts\"").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, true, ca.Remainder, ca.Mode, ca.ID).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, true, ca.Remainder, ca.Mode, sqlmock.AnyArg(), ca.ID).
 		WillReturnRows(accRows)
 	mock.ExpectQuery("INSERT INTO \"payment_states\"").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.ID, wp.CurrentPaymentState.PayAmount, "0", enum.Waiting, sqlmock.AnyArg()).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.ID, wp.CurrentPaymentState.PayAmount, "0", enum.Waiting, sqlmock.AnyArg(), enum.Waiting).
 		WillReturnRows(stateRows)
 	mock.ExpectQuery("INSERT INTO \"payments\"").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.ID, sqlmock.AnyArg(), ep.Mode, ep.PriceAmount, ep.PriceCurrency, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WithArgs(paymentArgs(ca.ID, sqlmock.AnyArg(), ep)...).
 		WillReturnRows(paymentRows)
 	mock.ExpectCommit()
 	return mock
 }
 
+/*
+	The finishing payments are loaded with all their states, to know when they were paid.
+*/
+func SetupFinishingPayments(mock sqlmock.Sqlmock, mode enum.Mode) sqlmock.Sqlmock {
+	mock = SetupModePayments(mock, mode, enum.Forwarded)
+	stateRows := getPaymentStatesRow(GetChaingateAcc(), GetWaitingPayment())
+	mock.ExpectQuery("SELECT (.+) FROM \"payment_states\" WHERE \"payment_states\".\"payment_id\" = (.+) ORDER BY created_at").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(stateRows)
+	return mock
+}
+
 func SetupAllPayments(mock sqlmock.Sqlmock, modes ...enum.Mode) sqlmock.Sqlmock {
 	wp := GetWaitingPayment()
 	ma := GetMerchantAcc()
@@ -275,7 +322,96 @@ func SetupAllPayments(mock sqlmock.Sqlmock, modes ...enum.Mode) sqlmock.Sqlmock
 	return mock
 }
 
-func SetupModePayments(mock sqlmock.Sqlmock, mode enum.Mode, state enum.State) sqlmock.Sqlmock {
+func SetupGetPaymentByID(mock sqlmock.Sqlmock, wp model.Payment) sqlmock.Sqlmock {
+	ca := wp.Account
+	paymentRows := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "account_id", "merchant_wallet", "mode", "price_amount", "price_currency", "current_payment_state_id"}).
+		AddRow(wp.ID, time.Now(), time.Now(), nil, ca.ID, GetMerchantAcc().Address, wp.Mode, wp.PriceAmount, wp.PriceCurrency, wp.CurrentPaymentStateId)
+
+	mock.ExpectQuery("SELECT (.+) FROM \"payments\" WHERE id = (.+) ORDER BY").
+		WithArgs(wp.ID).
+		WillReturnRows(paymentRows)
+
+	mock.ExpectQuery("SELECT (.+) FROM \"accounts\"").
+		WithArgs(ca.ID).
+		WillReturnRows(getAccountRow(ca))
+
+	mock.ExpectQuery("SELECT (.+) FROM \"payment_states\"").
+		WithArgs(wp.CurrentPaymentStateId).
+		WillReturnRows(getPaymentStatesRow(ca, wp))
+
+	mock.ExpectQuery("SELECT (.+) FROM \"payment_states\" WHERE (.+) ORDER BY created_at").
+		WithArgs(wp.ID).
+		WillReturnRows(getPaymentStatesRow(ca, wp))
+
+	return mock
+}
+
+/*
+	The payment is loaded and saved again with the held refund.
+*/
+func SetupHoldRefund(mock sqlmock.Sqlmock, p model.Payment) sqlmock.Sqlmock {
+	mock = SetupGetPaymentByID(mock, p)
+	mockSaveAgain(mock, &p.CurrentPaymentState.AmountReceived.Int, p.Account, p)
+	return mock
+}
+
+/*
+	The failed overpayment refund of the forwarded payment is opened again and sent again by the refund job.
+*/
+func SetupRetryOverpaymentRefund(mock sqlmock.Sqlmock, fp model.Payment) sqlmock.Sqlmock {
+	ca := fp.Account
+	mockSaveForwarded(mock, ca, fp)
+	mock = SetupGetRefundState(mock, fp.ID, model.RefundOpen, false)
+	ca.Nonce = ca.Nonce + 1
+	mock = SetupUpdateAccount(mock, ca.Nonce)
+	mockSaveForwarded(mock, ca, fp)
+	return mock
+}
+
+/*
+	Saves the forwarded payment of the fixtures, whose state is stored already.
+*/
+func mockSaveForwarded(mock sqlmock.Sqlmock, ca model.Account, fp model.Payment) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO \"accounts\"").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, ca.Used, ca.Remainder, ca.Mode, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(getAccountRow(ca))
+	mock.ExpectQuery("INSERT INTO \"payment_states\"").
+		WillReturnRows(getPaymentStatesRow(ca, fp))
+	mock.ExpectExec("UPDATE").
+		WithArgs(paymentArgs(ca.ID, fp.MerchantWallet, fp)...).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func SetupGetRefundState(mock sqlmock.Sqlmock, id uuid.UUID, status model.RefundStatus, held bool) sqlmock.Sqlmock {
+	mock.ExpectQuery("SELECT \"refund_status\",\"refund_held\" FROM \"payments\" WHERE id = (.+)").
+		WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"refund_status", "refund_held"}).AddRow(status, held))
+	return mock
+}
+
+func SetupGetPaymentByIdempotencyKey(mock sqlmock.Sqlmock, wp model.Payment) sqlmock.Sqlmock {
+	ca := wp.Account
+	paymentRows := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "account_id", "merchant_wallet", "mode", "price_amount", "price_currency", "current_payment_state_id", "idempotency_key", "request_hash"}).
+		AddRow(wp.ID, time.Now(), time.Now(), nil, ca.ID, wp.MerchantWallet, wp.Mode, wp.PriceAmount, wp.PriceCurrency, wp.CurrentPaymentStateId, wp.IdempotencyKey, wp.RequestHash)
+
+	mock.ExpectQuery("SELECT (.+) FROM \"payments\" WHERE \\(lower\\(merchant_wallet\\) = lower\\((.+)\\) AND idempotency_key = (.+) AND created_at >= (.+)\\)").
+		WithArgs(wp.MerchantWallet, wp.IdempotencyKey, sqlmock.AnyArg()).
+		WillReturnRows(paymentRows)
+
+	mock.ExpectQuery("SELECT (.+) FROM \"accounts\"").
+		WithArgs(ca.ID).
+		WillReturnRows(getAccountRow(ca))
+
+	mock.ExpectQuery("SELECT (.+) FROM \"payment_states\"").
+		WithArgs(wp.CurrentPaymentStateId).
+		WillReturnRows(getPaymentStatesRow(ca, wp))
+
+	return mock
+}
+
+func SetupModePayments(mock sqlmock.Sqlmock, mode enum.Mode, states ...enum.State) sqlmock.Sqlmock {
 	wp := GetWaitingPayment()
 	ma := GetMerchantAcc()
 	ca := GetChaingateAcc()
@@ -285,8 +421,12 @@ func SetupModePayments(mock sqlmock.Sqlmock, mode enum.Mode, state enum.State) s
 		AddRow(wp.ID, time.Now(), time.Now(), time.Now(), ca.ID, ma.Address, wp.Mode, wp.PriceAmount, wp.PriceCurrency, wp.CurrentPaymentStateId,
 			wp.CurrentPaymentStateId, time.Now(), time.Now(), time.Now(), ca.ID, wp.CurrentPaymentState.PayAmount, wp.CurrentPaymentState.AmountReceived, wp.CurrentPaymentState.StateID, wp.ID)
 
+	args := []driver.Value{mode}
+	for _, state := range states {
+		args = append(args, state)
+	}
 	mock.ExpectQuery("SELECT (.+) FROM \"payments\"").
-		WithArgs(mode, state).
+		WithArgs(args...).
 		WillReturnRows(paymentRows)
 
 	accRows := getAccountRow(ca)
@@ -303,6 +443,15 @@ func SetupModePayments(mock sqlmock.Sqlmock, mode enum.Mode, state enum.State) s
 }
 
 func SetupUpdatePaymentState(mock sqlmock.Sqlmock) sqlmock.Sqlmock {
+	return setupUpdatePaymentState(mock, false)
+}
+
+// SetupUpdatePaymentStateAndNotify the partially paid state is written together with its notification
+func SetupUpdatePaymentStateAndNotify(mock sqlmock.Sqlmock) sqlmock.Sqlmock {
+	return setupUpdatePaymentState(mock, true)
+}
+
+func setupUpdatePaymentState(mock sqlmock.Sqlmock, notify bool) sqlmock.Sqlmock {
 	pp := GetPartiallyPayment()
 	ca := GetChaingateAcc()
 	stateRows := getPaymentStatesRow(ca, pp)
@@ -311,14 +460,17 @@ func SetupUpdatePaymentState(mock sqlmock.Sqlmock) sqlmock.Sqlmock {
 	mock.ExpectBegin()
 
 	mock.ExpectQuery("INSERT INTO \"accounts\"").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, ca.Used, ca.Remainder, ca.Mode, sqlmock.AnyArg()).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, ca.Used, ca.Remainder, ca.Mode, sqlmock.AnyArg(), sqlmock.AnyArg()).
 		WillReturnRows(accRows)
 	mock.ExpectQuery("INSERT INTO \"payment_states\"").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.ID, pp.CurrentPaymentState.PayAmount, pp.CurrentPaymentState.AmountReceived, pp.CurrentPaymentState.StateID, sqlmock.AnyArg()).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.ID, pp.CurrentPaymentState.PayAmount, pp.CurrentPaymentState.AmountReceived, pp.CurrentPaymentState.StateID, sqlmock.AnyArg(), pp.CurrentPaymentState.GetBackendState()).
 		WillReturnRows(stateRows)
 	mock.ExpectExec("UPDATE").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.ID, pp.MerchantWallet, pp.Mode, pp.PriceAmount, pp.PriceCurrency, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WithArgs(paymentArgs(ca.ID, pp.MerchantWallet, pp)...).
 		WillReturnResult(sqlmock.NewResult(1, 1))
+	if notify {
+		expectNotification(mock)
+	}
 	mock.ExpectCommit()
 
 	return mock
@@ -340,6 +492,8 @@ func SetupUpdatePaymentStateToConfirmed(mock sqlmock.Sqlmock, amountPaid *big.In
 	pp := GetConfirmedPayment()
 	pp.CurrentPaymentState.AmountReceived = model.NewBigInt(amountPaid)
 	ca := GetChaingateAcc()
+	// the forward is sent before the payment is confirmed
+	ca.Nonce = ca.Nonce + 1
 	stateRows := getPaymentStatesRow(ca, pp)
 	accRows := getAccountRow(ca)
 
@@ -348,10 +502,56 @@ func SetupUpdatePaymentStateToConfirmed(mock sqlmock.Sqlmock, amountPaid *big.In
 	return mock
 }
 
+/*
+	The refund is sent after the forward, so both states are written with the nonce after the refund.
+*/
+func SetupRefundOverpayment(mock sqlmock.Sqlmock, amountPaid *big.Int) sqlmock.Sqlmock {
+	ca := GetChaingateAcc()
+	ca.Nonce = ca.Nonce + 2
+	rp := addOverpaidRefundedPaymentState(GetPaidPayment())
+	rp.CurrentPaymentState.AmountReceived = model.NewBigInt(amountPaid)
+	mockRequests(mock, amountPaid, ca, getAccountRow(ca), *rp, getPaymentStatesRow(ca, *rp))
+	cp := addConfirmedPaymentState(*rp)
+	cp.CurrentPaymentState.AmountReceived = model.NewBigInt(amountPaid)
+	mockRequests(mock, amountPaid, ca, getAccountRow(ca), *cp, getPaymentStatesRow(ca, *cp))
+	return mock
+}
+
+/*
+	The partially paid payment expires with a known sender. Its account stays used until the refund is mined, then it is released without a remainder.
+*/
+func SetupRefundPayment(mock sqlmock.Sqlmock, pp model.Payment) sqlmock.Sqlmock {
+	amountReceived := &pp.CurrentPaymentState.AmountReceived.Int
+	ca := pp.Account
+	ca.Used = true
+	ep := addExpiredPaymentState(pp)
+	ep.CurrentPaymentState.AmountReceived = model.NewBigInt(amountReceived)
+	mockRequests(mock, amountReceived, ca, getAccountRow(ca), *ep, getPaymentStatesRow(ca, *ep))
+
+	// the refund state is read again under the lock
+	mock = SetupGetRefundState(mock, ep.ID, model.RefundOpen, false)
+
+	// the refund is sent, the current state is saved again with its id
+	ca.Nonce = ca.Nonce + 1
+	mock = SetupUpdateAccount(mock, ca.Nonce)
+	mockSaveAgain(mock, amountReceived, ca, *ep)
+
+	// the refund is mined, the account stays used, because it is watched for late payments
+	ca.Remainder = model.NewBigIntFromInt(0)
+	mock = SetupUpdateAccount(mock, ca.Nonce)
+	rp := addRefundedPaymentState(*ep)
+	rp.CurrentPaymentState.AmountReceived = model.NewBigInt(amountReceived)
+	mockRequests(mock, amountReceived, ca, getAccountRow(ca), *rp, getPaymentStatesRow(ca, *rp))
+	return mock
+}
+
+/*
+	The account of the expired payment stays used, because it is watched for late payments.
+*/
 func SetupUpdatePaymentStateToExpired(mock sqlmock.Sqlmock) sqlmock.Sqlmock {
 	ep := GetExpiredPayment()
 	ca := GetChaingateAcc()
-	ca.Used = false
+	ca.Used = true
 	stateRows := getPaymentStatesRow(ca, ep)
 	accRows := getAccountRow(ca)
 
@@ -360,6 +560,59 @@ func SetupUpdatePaymentStateToExpired(mock sqlmock.Sqlmock) sqlmock.Sqlmock {
 	return mock
 }
 
+/*
+	Late funds arrive for the watched expired payment. When the grace period is over, the payment is saved again with an open refund.
+*/
+func SetupLatePayment(mock sqlmock.Sqlmock, ep model.Payment, amountPaid *big.Int) sqlmock.Sqlmock {
+	ca := ep.Account
+	ca.Used = true
+	lp := addLatePaidPaymentState(ep)
+	lp.CurrentPaymentState.AmountReceived = model.NewBigInt(amountPaid)
+	mockRequests(mock, amountPaid, ca, getAccountRow(ca), *lp, getPaymentStatesRow(ca, *lp))
+	mockSaveAgain(mock, amountPaid, ca, *lp)
+	return mock
+}
+
+/*
+	The waiting payment is cancelled, if it is still waiting. Its account stays used, because it is watched for late payments.
+*/
+func SetupUpdatePaymentStateToCancelled(mock sqlmock.Sqlmock, wp model.Payment) sqlmock.Sqlmock {
+	cp := addCancelledPaymentState(wp)
+	ca := wp.Account
+	stateRows := getPaymentStatesRow(ca, *cp)
+	accRows := getAccountRow(ca)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE \"payments\" SET \"current_payment_state_id\"(.+) WHERE \\(id = (.+) AND current_payment_state_id = (.+)\\)").
+		WithArgs(wp.CurrentPaymentStateId, sqlmock.AnyArg(), wp.ID, wp.CurrentPaymentStateId).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO \"accounts\"").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, ca.Used, ca.Remainder, ca.Mode, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(accRows)
+	mock.ExpectQuery("INSERT INTO \"payment_states\"").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.ID, cp.CurrentPaymentState.PayAmount, model.NewBigIntFromInt(0), cp.CurrentPaymentState.StateID, sqlmock.AnyArg(), cp.CurrentPaymentState.GetBackendState()).
+		WillReturnRows(stateRows)
+	mock.ExpectExec("UPDATE").
+		WithArgs(paymentArgs(ca.ID, cp.MerchantWallet, *cp)...).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectNotification(mock)
+	mock.ExpectCommit()
+
+	return mock
+}
+
+/*
+	The payment received funds in the meantime, so its state isn't waiting anymore and it isn't cancelled.
+*/
+func SetupCancelChangedPayment(mock sqlmock.Sqlmock, wp model.Payment) sqlmock.Sqlmock {
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE \"payments\" SET \"current_payment_state_id\"").
+		WithArgs(wp.CurrentPaymentStateId, sqlmock.AnyArg(), wp.ID, wp.CurrentPaymentStateId).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	return mock
+}
+
 func SetupUpdatePaymentStateToFailed(mock sqlmock.Sqlmock) sqlmock.Sqlmock {
 	fp := addFailedPaymentState(GetPaidPayment())
 	ca := GetChaingateAcc()
@@ -376,13 +629,39 @@ func mockRequests(mock sqlmock.Sqlmock, amountPaid *big.Int, ca model.Account, a
 	mock.ExpectBegin()
 
 	mock.ExpectQuery("INSERT INTO \"accounts\"").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, ca.Used, ca.Remainder, ca.Mode, sqlmock.AnyArg()).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, ca.Used, ca.Remainder, ca.Mode, sqlmock.AnyArg(), sqlmock.AnyArg()).
 		WillReturnRows(accRows)
 	mock.ExpectQuery("INSERT INTO \"payment_states\"").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.ID, pp.CurrentPaymentState.PayAmount, model.NewBigInt(amountPaid), pp.CurrentPaymentState.StateID, sqlmock.AnyArg()).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.ID, pp.CurrentPaymentState.PayAmount, model.NewBigInt(amountPaid), pp.CurrentPaymentState.StateID, sqlmock.AnyArg(), pp.CurrentPaymentState.GetBackendState()).
 		WillReturnRows(stateRows)
 	mock.ExpectExec("UPDATE").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.ID, pp.MerchantWallet, pp.Mode, pp.PriceAmount, pp.PriceCurrency, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WithArgs(paymentArgs(ca.ID, pp.MerchantWallet, pp)...).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectNotification(mock)
+	mock.ExpectCommit()
+}
+
+/*
+	The notification of the backend is written in the same transaction as the new state.
+*/
+func expectNotification(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("INSERT INTO \"notifications\"").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(uuid.New()))
+}
+
+/*
+	Saves the payment with its current state, which already has an id.
+*/
+func mockSaveAgain(mock sqlmock.Sqlmock, amountPaid *big.Int, ca model.Account, pp model.Payment) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO \"accounts\"").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, ca.Used, ca.Remainder, ca.Mode, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(getAccountRow(ca))
+	mock.ExpectQuery("INSERT INTO \"payment_states\"").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.ID, pp.CurrentPaymentState.PayAmount, model.NewBigInt(amountPaid), pp.CurrentPaymentState.StateID, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(getPaymentStatesRow(ca, pp))
+	mock.ExpectExec("UPDATE").
+		WithArgs(paymentArgs(ca.ID, pp.MerchantWallet, pp)...).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 }
@@ -421,7 +700,7 @@ func SetupCreateAccount(mock sqlmock.Sqlmock) sqlmock.Sqlmock {
 
 	mock.ExpectBegin()
 	mock.ExpectQuery("INSERT INTO \"accounts\"").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, true, ca.Remainder, ca.Mode, sqlmock.AnyArg()).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, true, ca.Remainder, ca.Mode, sqlmock.AnyArg(), sqlmock.AnyArg()).
 		WillReturnRows(accRows)
 	mock.ExpectCommit()
 	return mock
@@ -432,7 +711,7 @@ func SetupUpdateAccount(mock sqlmock.Sqlmock, nonce uint64) sqlmock.Sqlmock {
 	ca.Nonce = nonce
 	mock.ExpectBegin()
 	mock.ExpectExec("UPDATE \"accounts\"").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, true, sqlmock.AnyArg(), ca.Mode, sqlmock.AnyArg()).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, true, sqlmock.AnyArg(), ca.Mode, sqlmock.AnyArg(), sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 	return mock
@@ -444,7 +723,7 @@ func SetupUpdateAccountWithRemainder(mock sqlmock.Sqlmock, nonce uint64, remaind
 	ca.Remainder = model.NewBigInt(remainder)
 	mock.ExpectBegin()
 	mock.ExpectExec("UPDATE \"accounts\"").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, true, ca.Remainder, ca.Mode, sqlmock.AnyArg()).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, true, ca.Remainder, ca.Mode, sqlmock.AnyArg(), sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 	return mock
@@ -456,7 +735,7 @@ func SetupUpdateAccountFree(mock sqlmock.Sqlmock, nonce uint64) sqlmock.Sqlmock
 	ca.Used = false
 	mock.ExpectBegin()
 	mock.ExpectExec("UPDATE \"accounts\"").
-		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, ca.Used, sqlmock.AnyArg(), ca.Mode, sqlmock.AnyArg()).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), ca.PrivateKey, ca.Address, ca.Nonce, ca.Used, sqlmock.AnyArg(), ca.Mode, sqlmock.AnyArg(), sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 	return mock
@@ -473,6 +752,45 @@ func SetupGetFreeAccount(mock sqlmock.Sqlmock) sqlmock.Sqlmock {
 	return mock
 }
 
+func SetupGetNoFreeAccount(mock sqlmock.Sqlmock) sqlmock.Sqlmock {
+	mock.ExpectQuery("SELECT (.+) FROM \"accounts\"").
+		WithArgs("false", 1).
+		WillReturnError(gorm.ErrRecordNotFound)
+	return mock
+}
+
+func SetupGetNextDerivationIndex(mock sqlmock.Sqlmock, index int64) sqlmock.Sqlmock {
+	mock.ExpectQuery("SELECT COALESCE\\(MAX\\(derivation_index\\), -1\\) \\+ 1 FROM \"accounts\"").
+		WillReturnRows(sqlmock.NewRows([]string{"index"}).AddRow(index))
+	return mock
+}
+
+func SetupCountAccounts(mock sqlmock.Sqlmock, used bool, count int64) sqlmock.Sqlmock {
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM \"accounts\" WHERE \\(used = \\$1 AND mode = \\$2\\)").
+		WithArgs(used, enum.Main).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+	return mock
+}
+
+func SetupCreateHDAccount(mock sqlmock.Sqlmock, index int64) sqlmock.Sqlmock {
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO \"accounts\"").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "", sqlmock.AnyArg(), 0, true, sqlmock.AnyArg(), 1, index).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(uuid.New()))
+	mock.ExpectCommit()
+	return mock
+}
+
+// SetupCreateHDAccountDuplicate another instance already created an account with the derivation index
+func SetupCreateHDAccountDuplicate(mock sqlmock.Sqlmock, index int64) sqlmock.Sqlmock {
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO \"accounts\"").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "", sqlmock.AnyArg(), 0, true, sqlmock.AnyArg(), 1, index).
+		WillReturnError(&pgconn.PgError{Code: "23505", ConstraintName: "idx_accounts_derivation_index"})
+	mock.ExpectRollback()
+	return mock
+}
+
 func NewMock() (sqlmock.Sqlmock, *gorm.DB) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -487,7 +805,7 @@ func NewMock() (sqlmock.Sqlmock, *gorm.DB) {
 	return mock, gormDb
 }
 
-func CreateInitialPayment(client *ethclient.Client, genesisAcc *model.Account, payAmount *big.Int, targetAddress string) *types.Transaction {
+func CreateInitialPayment(client *config.Client, genesisAcc *model.Account, payAmount *big.Int, targetAddress string) *types.Transaction {
 	nonce, err := client.PendingNonceAt(context.Background(), common.HexToAddress(genesisAcc.Address))
 	if err != nil {
 		log.Fatal(err)
@@ -548,3 +866,18 @@ func CreateInitialPayment(client *ethclient.Client, genesisAcc *model.Account, p
 
 	return signedTx
 }
+
+// SetupCreatePaymentDuplicateIdempotencyKey the insert of the payment violates the unique idempotency key of the merchant
+func SetupCreatePaymentDuplicateIdempotencyKey(mock sqlmock.Sqlmock) sqlmock.Sqlmock {
+	ca := GetChaingateAcc()
+	wp := GetWaitingPayment()
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO \"accounts\"").
+		WillReturnRows(getAccountRow(ca))
+	mock.ExpectQuery("INSERT INTO \"payment_states\"").
+		WillReturnRows(getPaymentStatesRow(ca, wp))
+	mock.ExpectQuery("INSERT INTO \"payments\"").
+		WillReturnError(&pgconn.PgError{Code: "23505", ConstraintName: "idx_payments_merchant_idempotency_key"})
+	mock.ExpectRollback()
+	return mock
+}
@@ -6,7 +6,11 @@ import (
 	"ethereum-service/internal/bc"
 	"ethereum-service/internal/config"
 	"ethereum-service/internal/controller"
+	"ethereum-service/internal/health"
+	"ethereum-service/internal/logging"
+	"ethereum-service/internal/metrics"
 	repository "ethereum-service/internal/repository"
+	"ethereum-service/internal/service"
 	"ethereum-service/openApi"
 	"ethereum-service/services"
 	"log"
@@ -16,29 +20,40 @@ import (
 	"github.com/CHainGate/backend/pkg/enum"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
 )
 
 func main() {
 	config.ReadOpts()
+	if err := logging.Init(config.Opts.LogLevel, config.Opts.LogFormat); err != nil {
+		log.Fatal(err)
+	}
+	if err := service.CheckSigning(); err != nil {
+		logrus.Fatal(err)
+	}
+	if config.Opts.BackendSigningDisabled {
+		logrus.Warn("BACKEND_SIGNING_DISABLED is set, the calls to the backend aren't signed")
+	}
 	database.DbInit()
 	router := InitializeRouter()
 
 	config.CreateMainClientConnection(config.Opts.Main)
 	config.CreateTestClientConnection(config.Opts.Test)
 
-	checkAllAddresses()
-
+	metrics.Register()
+	health.Register()
+	go controller.RunNotificationDispatcher(context.Background())
 	go listenToEthChain(enum.Main)
 	go listenToEthChain(enum.Test)
-	log.Printf("listing on port %v", 9000)
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(9000), router))
+	logrus.WithField("port", 9000).Info("listing on port")
+	logrus.Fatal(http.ListenAndServe(":"+strconv.Itoa(9000), router))
 }
 
 /*
-   Recovery
+   Recovery, if there is no processed block to backfill from
 */
-func checkAllAddresses() {
-	payments := repository.Payment.GetAllOpen()
+func checkAllAddresses(mode enum.Mode) {
+	payments := repository.Payment.GetOpenByMode(mode)
 	for _, s := range payments {
 		client := bc.GetClientByMode(s.Mode)
 		go controller.CheckBalanceStartup(client, &s)
@@ -46,38 +61,16 @@ func checkAllAddresses() {
 }
 
 func listenToEthChain(mode enum.Mode) {
-	headers := make(chan *types.Header)
 	client := bc.GetClientByMode(mode)
-	sub, err := client.SubscribeNewHead(context.Background(), headers)
-	if err != nil {
-		log.Fatal(err)
+	if !controller.Backfill(client, mode) {
+		checkAllAddresses(mode)
 	}
 
-	for {
-		select {
-		case err := <-sub.Err():
-			log.Fatal("Error in websocket", err)
-		case header := <-headers:
-			block, err := client.BlockByHash(context.Background(), header.Hash())
-			if err != nil {
-				log.Printf("Error in getting BlockByHash %v", err)
-			} else {
-				payments := repository.Payment.GetOpenByMode(mode)
-				hash := block.Hash()
-				for _, p := range payments {
-					for _, tx := range block.Transactions() {
-						if tx.To() != nil && tx.To().Hex() == p.Account.Address {
-							controller.CheckBalanceNotify(&p, tx.Value(), block.Number(), &hash)
-						}
-					}
-					controller.CheckPayment(&p, block.Number(), &hash, nil)
-
-				}
-
-				controller.CheckConfirming(client, block.Number(), mode, &hash)
-			}
-		}
-	}
+	// blocks which arrive while the head source reconnects are backfilled with the next head
+	source := bc.NewHeadSource(client, mode)
+	source.Run(context.Background(), func(header *types.Header) {
+		controller.HandleNewHead(client, header, mode)
+	})
 }
 
 func InitializeRouter() *mux.Router {
@@ -89,6 +82,9 @@ func InitializeRouter() *mux.Router {
 	// https://ribice.medium.com/serve-swaggerui-within-your-golang-application-5486748a5ed4
 	sh := http.StripPrefix("/api/swaggerui/", http.FileServer(http.Dir("./swaggerui/")))
 	router.PathPrefix("/api/swaggerui/").Handler(sh)
+	router.Handle("/metrics", metrics.Handler())
+	router.Handle("/healthz", health.LivenessHandler())
+	router.Handle("/readyz", health.ReadinessHandler())
 
 	return router
 }
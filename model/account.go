@@ -2,6 +2,7 @@ package model
 
 import (
 	"crypto/ecdsa"
+	"errors"
 	"ethereum-service/internal/config"
 	"ethereum-service/utils"
 	"log"
@@ -16,21 +17,87 @@ import (
 
 type Account struct {
 	Base
-	PrivateKey string `gorm:"type:varchar"`
-	Address    string `gorm:"type:varchar"`
-	Nonce      uint64 `gorm:"type:bigint;default:0"`
-	Used       bool
-	Payments   []Payment
-	Remainder  *BigInt `gorm:"type:numeric(30);default:0"`
-	Mode       enum.Mode
+	PrivateKey      string `gorm:"type:varchar"`
+	Address         string `gorm:"type:varchar"`
+	Nonce           uint64 `gorm:"type:bigint;default:0"`
+	Used            bool
+	Payments        []Payment
+	Remainder       *BigInt `gorm:"type:numeric(30);default:0"`
+	Mode            enum.Mode
+	DerivationIndex *int64 `gorm:"uniqueIndex"`
 }
 
+var (
+	// DuplicateDerivationIndex another account was created with the derivation index in the meantime
+	DuplicateDerivationIndex = errors.New("an account with the derivation index already exists")
+	// InvalidDerivationIndex the index doesn't fit the non-hardened indexes 0 to 2^31-1 of m/44'/60'/0'/0/index
+	InvalidDerivationIndex = errors.New("the derivation index must be between 0 and 2^31-1")
+)
+
 type IAccountRepository interface {
 	GetFree(mode enum.Mode) (*gorm.DB, *Account)
-	Create(acc *Account) *Account
+	GetNextDerivationIndex() (int64, error)
+	Create(acc *Account) error
 	Update(acc *Account) error
+	Count(mode enum.Mode, used bool) (int64, error)
+}
+
+/*
+	HD accounts only store the derivation index, their key is derived from the master seed on demand.
+	Accounts which were created before the HD wallet still use their encrypted private key.
+*/
+func (a *Account) GetPrivateKey() (*ecdsa.PrivateKey, error) {
+	if a.DerivationIndex == nil {
+		return utils.GetPrivateKey(a.PrivateKey)
+	}
+	index, err := toDerivationIndex(*a.DerivationIndex)
+	if err != nil {
+		return nil, err
+	}
+	return utils.DeriveAccountKey(index)
+}
+
+func (a *Account) IsHDAccount() bool {
+	return a.DerivationIndex != nil
+}
+
+// CreateHDAccount
+/*
+	Creates an account with the address of m/44'/60'/0'/0/index
+*/
+func CreateHDAccount(mode enum.Mode, index int64) (*Account, error) {
+	derivationIndex, err := toDerivationIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := utils.DeriveAccountKey(derivationIndex)
+	if err != nil {
+		return nil, err
+	}
+	account := Account{
+		Address:         crypto.PubkeyToAddress(privateKey.PublicKey).Hex(),
+		Remainder:       NewBigInt(big.NewInt(0)),
+		Used:            true,
+		Mode:            mode,
+		DerivationIndex: &index,
+	}
+	return &account, nil
+}
+
+/*
+	Indexes from 2^31 are hardened and would derive another path, so they are rejected instead of converted.
+*/
+func toDerivationIndex(index int64) (uint32, error) {
+	if index < 0 || index >= 0x80000000 {
+		return 0, InvalidDerivationIndex
+	}
+	return uint32(index), nil
 }
 
+// CreateAccount
+/*
+	Creates an account with a random private key, which is stored encrypted. Only used if no HD wallet is configured.
+*/
 func CreateAccount(mode enum.Mode) *Account {
 	account := Account{}
 	privateKey, err := crypto.GenerateKey()
@@ -0,0 +1,26 @@
+package model
+
+import (
+	"math/big"
+
+	"github.com/CHainGate/backend/pkg/enum"
+)
+
+/*
+	A processed block. Only the most recent blocks per mode are kept to detect chain reorganizations.
+*/
+type Block struct {
+	Base
+	Mode       enum.Mode `gorm:"index:idx_blocks_mode_number"`
+	Number     *BigInt   `gorm:"type:numeric(30);index:idx_blocks_mode_number"`
+	Hash       string
+	ParentHash string
+}
+
+type IBlockRepository interface {
+	Create(block *Block) error
+	GetLatest(mode enum.Mode) (*Block, error)
+	GetByNumber(mode enum.Mode, number *big.Int) (*Block, error)
+	DeleteFrom(mode enum.Mode, number *big.Int) error
+	DeleteBefore(mode enum.Mode, number *big.Int) error
+}
@@ -0,0 +1,103 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Contribution amount which a sender paid to a payment with one transaction
+type Contribution struct {
+	Sender string `json:"sender"`
+	Amount string `json:"amount"`
+	TxHash string `json:"tx_hash"`
+	// LogIndex index of the Transfer event in the block, 0 for an ETH transaction
+	LogIndex uint   `json:"log_index"`
+	BlockNr  uint64 `json:"block_nr"`
+}
+
+// Contributions incoming transactions of a payment. A refund is split between the senders by their contributions.
+type Contributions []Contribution
+
+// SenderAmount sum of the contributions of one sender
+type SenderAmount struct {
+	Sender string
+	Amount *big.Int
+}
+
+func (c Contributions) Value() (driver.Value, error) {
+	if c == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (c *Contributions) Scan(val interface{}) error {
+	switch v := val.(type) {
+	case nil:
+		*c = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, c)
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	default:
+		return fmt.Errorf("contributions: can't convert %T", val)
+	}
+}
+
+/*
+	Adds the amount of an incoming transaction. A transfer which is already added (e.g. a block which is processed again) is ignored and false is returned.
+	A transfer is identified by its transaction hash and log index, because a transaction can transfer tokens several times.
+*/
+func (p *Payment) AddContribution(sender string, amount *big.Int, txHash string, logIndex uint, blockNr uint64) bool {
+	for _, c := range p.Contributions {
+		if c.TxHash == txHash && c.LogIndex == logIndex {
+			return false
+		}
+	}
+	p.Contributions = append(p.Contributions, Contribution{Sender: sender, Amount: amount.String(), TxHash: txHash, LogIndex: logIndex, BlockNr: blockNr})
+	return true
+}
+
+/*
+	Removes the contributions of the blocks after the block number, e.g. when they were reorganized out of the chain.
+*/
+func (p *Payment) RemoveContributionsAfter(blockNr uint64) {
+	var kept Contributions
+	for _, c := range p.Contributions {
+		if c.BlockNr <= blockNr {
+			kept = append(kept, c)
+		}
+	}
+	p.Contributions = kept
+}
+
+/*
+	Returns the sum of the contributions of each sender in the order they paid first.
+*/
+func (p *Payment) GetSenderAmounts() []SenderAmount {
+	var amounts []SenderAmount
+	index := make(map[string]int)
+	for _, c := range p.Contributions {
+		amount, ok := new(big.Int).SetString(c.Amount, 10)
+		if !ok {
+			continue
+		}
+		key := strings.ToLower(c.Sender)
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(amounts)
+			amounts = append(amounts, SenderAmount{Sender: c.Sender, Amount: amount})
+			continue
+		}
+		amounts[i].Amount.Add(amounts[i].Amount, amount)
+	}
+	return amounts
+}
@@ -0,0 +1,67 @@
+package model
+
+import (
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/google/uuid"
+)
+
+type NotificationStatus string
+
+const (
+	// NotificationPending waits to be delivered to the backend
+	NotificationPending NotificationStatus = "pending"
+	// NotificationDelivered is accepted by the backend
+	NotificationDelivered NotificationStatus = "delivered"
+	// NotificationDead couldn't be delivered after the maximal attempts, it is only sent again after a replay
+	NotificationDead NotificationStatus = "dead"
+)
+
+type INotificationRepository interface {
+	Update(notification *Notification) error
+	GetDue(now time.Time, limit int) []Notification
+	GetByPayment(paymentID uuid.UUID, status NotificationStatus) []Notification
+}
+
+// Notification
+/*
+	Outbox of the state updates for the backend. A notification is stored in the same transaction as the new state of the payment,
+	the dispatcher delivers them afterwards in the order of their creation per payment.
+*/
+type Notification struct {
+	Base
+	PaymentID      uuid.UUID `gorm:"type:uuid;index"`
+	PayCurrency    string
+	PayAmount      *BigInt `gorm:"type:numeric(30);default:0"`
+	AmountReceived *BigInt `gorm:"type:numeric(30);default:0"`
+	StateID        enum.State
+	BackendStateID enum.State
+	TxHash         string
+	Status         NotificationStatus `gorm:"type:varchar;index"`
+	Attempts       int
+	NextAttemptAt  time.Time
+	LastError      string
+	DeliveredAt    *time.Time
+}
+
+/*
+	Creates the pending notification of the new state of the payment.
+*/
+func NewNotification(payment *Payment, state PaymentState, txHash string) *Notification {
+	return &Notification{
+		PaymentID:      payment.ID,
+		PayCurrency:    payment.GetPayCurrency(),
+		PayAmount:      state.PayAmount,
+		AmountReceived: state.AmountReceived,
+		StateID:        state.StateID,
+		BackendStateID: state.GetBackendState(),
+		TxHash:         txHash,
+		Status:         NotificationPending,
+		NextAttemptAt:  time.Now(),
+	}
+}
+
+func (n *Notification) GetPaymentState() PaymentState {
+	return PaymentState{PayAmount: n.PayAmount, AmountReceived: n.AmountReceived, StateID: n.StateID, BackendStateID: n.BackendStateID, PaymentID: n.PaymentID}
+}
@@ -0,0 +1,173 @@
+package model
+
+import (
+	"math/big"
+	"strings"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/google/uuid"
+)
+
+type OutgoingTransactionKind string
+
+const (
+	// Forward sends the amount of the payment to the merchant
+	Forward OutgoingTransactionKind = "forward"
+	// Earnings sends the CHainGate earnings to the target wallet
+	Earnings OutgoingTransactionKind = "earnings"
+	// Refund sends an overpayment back to the sender
+	Refund OutgoingTransactionKind = "refund"
+	// GasFunding sends ETH from the gas station to the address of a payment, which pays the gas of its transactions
+	GasFunding OutgoingTransactionKind = "gas_funding"
+)
+
+type OutgoingTransactionStatus string
+
+const (
+	// TxSigned is recorded, but maybe not broadcast yet
+	TxSigned OutgoingTransactionStatus = "signed"
+	// TxSent is accepted by the node
+	TxSent OutgoingTransactionStatus = "sent"
+	// TxMined has a successful receipt
+	TxMined OutgoingTransactionStatus = "mined"
+	// TxConfirmed has enough confirmations
+	TxConfirmed OutgoingTransactionStatus = "confirmed"
+	// TxFailed is reverted or can't be mined anymore
+	TxFailed OutgoingTransactionStatus = "failed"
+)
+
+type IOutgoingTransactionRepository interface {
+	Create(tx *OutgoingTransaction) error
+	Update(tx *OutgoingTransaction) error
+	GetOpen(mode enum.Mode) []OutgoingTransaction
+	GetActiveByPayment(paymentID uuid.UUID, kind OutgoingTransactionKind) (*OutgoingTransaction, error)
+	GetAllActiveByPayment(paymentID uuid.UUID, kind OutgoingTransactionKind) ([]OutgoingTransaction, error)
+}
+
+// OutgoingTransaction
+/*
+	Every transaction from a payment account is recorded before it is broadcast. The tracker rebroadcasts it until it is mined.
+*/
+type OutgoingTransaction struct {
+	Base
+	Mode        enum.Mode
+	PaymentID   *uuid.UUID `gorm:"type:uuid;index"`
+	Payment     *Payment
+	AccountID   *uuid.UUID `gorm:"type:uuid"`
+	Account     *Account
+	Kind        OutgoingTransactionKind   `gorm:"type:varchar"`
+	Status      OutgoingTransactionStatus `gorm:"type:varchar;index"`
+	FromAddress string                    `gorm:"type:varchar"`
+	ToAddress   string                    `gorm:"type:varchar"`
+	Nonce       uint64                    `gorm:"type:bigint"`
+	Hash        string                    `gorm:"type:varchar;index"`
+	RawTx       string                    `gorm:"type:text"`
+	Value       *BigInt                   `gorm:"type:numeric(30);default:0"`
+	GasLimit    uint64                    `gorm:"type:bigint"`
+	GasFeeCap   *BigInt                   `gorm:"type:numeric(30);default:0"`
+	GasTipCap   *BigInt                   `gorm:"type:numeric(30);default:0"`
+	// BaseFee estimated base fee when the transaction was signed
+	BaseFee     *BigInt `gorm:"type:numeric(30);default:0"`
+	BlockNr     *BigInt `gorm:"type:numeric(30);default:0"`
+	SentBlockNr *BigInt `gorm:"type:numeric(30);default:0"`
+	ReplacedTxs string  `gorm:"type:text"`
+	Fee         *BigInt `gorm:"type:numeric(30);default:0"`
+	Error       string
+	// BroadcastAttempts failed broadcasts since the node accepted the transaction the last time
+	BroadcastAttempts int64 `gorm:"type:bigint;default:0"`
+}
+
+/*
+	Sets the signed transaction. It is stored as raw transaction, so it can be rebroadcast exactly as it was signed.
+*/
+func (t *OutgoingTransaction) SetTransaction(tx *types.Transaction) error {
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	t.RawTx = hexutil.Encode(raw)
+	t.Hash = tx.Hash().String()
+	t.Nonce = tx.Nonce()
+	if tx.To() != nil {
+		t.ToAddress = tx.To().Hex()
+	}
+	t.Value = NewBigInt(tx.Value())
+	t.GasLimit = tx.Gas()
+	t.GasFeeCap = NewBigInt(tx.GasFeeCap())
+	t.GasTipCap = NewBigInt(tx.GasTipCap())
+	return nil
+}
+
+func (t *OutgoingTransaction) GetTransaction() (*types.Transaction, error) {
+	raw, err := hexutil.Decode(t.RawTx)
+	if err != nil {
+		return nil, err
+	}
+	tx := new(types.Transaction)
+	if err = tx.UnmarshalBinary(raw); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+/*
+	Replaces the transaction with a transaction with the same nonce. The replaced transaction is kept, because it can still be mined instead.
+*/
+func (t *OutgoingTransaction) Replace(tx *types.Transaction) error {
+	replaced := t.RawTx
+	if err := t.SetTransaction(tx); err != nil {
+		return err
+	}
+	if t.ReplacedTxs != "" {
+		replaced = t.ReplacedTxs + "," + replaced
+	}
+	t.ReplacedTxs = replaced
+	return nil
+}
+
+func (t *OutgoingTransaction) GetReplacedTransactions() ([]*types.Transaction, error) {
+	var txs []*types.Transaction
+	if t.ReplacedTxs == "" {
+		return txs, nil
+	}
+	for _, rawTx := range strings.Split(t.ReplacedTxs, ",") {
+		raw, err := hexutil.Decode(rawTx)
+		if err != nil {
+			return nil, err
+		}
+		tx := new(types.Transaction)
+		if err = tx.UnmarshalBinary(raw); err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+	}
+	return txs, nil
+}
+
+/*
+	Blocks since the transaction was sent or replaced the last time. 0 if it isn't sent yet.
+*/
+func (t *OutgoingTransaction) GetPendingBlocks(currentBlockNr *big.Int) *big.Int {
+	if t.SentBlockNr == nil || t.SentBlockNr.Sign() == 0 {
+		return big.NewInt(0)
+	}
+	return big.NewInt(0).Sub(currentBlockNr, &t.SentBlockNr.Int)
+}
+
+/*
+	Sets the block and the fee, which was paid by the mined transaction.
+*/
+func (t *OutgoingTransaction) SetMined(blockNr *big.Int, fee *big.Int) {
+	t.Status = TxMined
+	t.BlockNr = NewBigInt(blockNr)
+	t.Fee = NewBigInt(fee)
+}
+
+func (t *OutgoingTransaction) GetFee() *big.Int {
+	if t.Fee == nil {
+		return big.NewInt(0)
+	}
+	return &t.Fee.Int
+}
@@ -2,6 +2,7 @@ package model
 
 import (
 	"database/sql/driver"
+	"errors"
 	"fmt"
 	"math/big"
 	"reflect"
@@ -22,28 +23,120 @@ type Base struct {
 
 type IPaymentRepository interface {
 	UpdatePaymentState(payment *Payment)
+	UpdatePaymentStateAndNotify(payment *Payment, notification *Notification) error
+	UpdatePaymentStateIfCurrent(payment *Payment, currentStateID uuid.UUID, notification *Notification) error
 	Create(payment *Payment, finalPaymentAmount *big.Int) (*Payment, error)
 	GetAllOpen() []Payment
 	GetOpenByMode(mode enum.Mode) []Payment
+	GetByID(id uuid.UUID) (*Payment, error)
+	Search(filter PaymentFilter) ([]Payment, *PaymentCursor, error)
+	GetByIdempotencyKey(wallet string, key string, since time.Time) (*Payment, error)
+	ReleaseIdempotencyKey(wallet string, key string, before time.Time) error
+	GetReceiving(mode enum.Mode) []Payment
 	GetConfirming(mode enum.Mode) []Payment
 	GetFinishing(mode enum.Mode) []Payment
+	GetOpenRefunds(mode enum.Mode) []Payment
+	GetRefundState(id uuid.UUID) (RefundStatus, bool, error)
+	GetWatched(mode enum.Mode) []Payment
 }
 
+// StateChanged the stored state of the payment isn't the one it was loaded with anymore
+var StateChanged = errors.New("the state of the payment was changed in the meantime")
+
+// DuplicateIdempotencyKey the merchant already created a payment with the idempotency key
+var DuplicateIdempotencyKey = errors.New("the merchant already created a payment with the idempotency key")
+
+type RefundStatus string
+
+const (
+	// RefundOpen the received funds of an expired or failed payment or the overpayment of a failed refund wait to be refunded
+	RefundOpen RefundStatus = "open"
+	// RefundSent the refund is recorded and sent
+	RefundSent RefundStatus = "sent"
+	// RefundDone the refund is mined and the account is released
+	RefundDone RefundStatus = "done"
+)
+
 type Payment struct {
 	Base
 	Account                   Account
-	AccountID                 uuid.UUID `gorm:"type:uuid"`
+	AccountID                 uuid.UUID `gorm:"type:uuid;index"`
 	MerchantWallet            string
-	Mode                      enum.Mode
-	PriceAmount               float64 `gorm:"type:numeric(30,15);default:0"`
+	Mode                      enum.Mode `gorm:"index"`
+	PriceAmount               float64   `gorm:"type:numeric(30,15);default:0"`
 	PriceCurrency             string
-	CurrentPaymentStateId     *uuid.UUID     `gorm:"type:uuid"`
+	PayCurrency               string
+	TokenContract             string
+	TokenDecimals             uint8          `gorm:"default:18"`
+	TokenRemainder            *BigInt        `gorm:"type:numeric(30);default:0"`
+	CurrentPaymentStateId     *uuid.UUID     `gorm:"type:uuid;index"`
 	CurrentPaymentState       PaymentState   `gorm:"foreignKey:CurrentPaymentStateId"`
 	PaymentStates             []PaymentState `gorm:"<-:false"`
 	LastReceivingBlockNr      *BigInt        `gorm:"type:numeric(30);default:0"`
 	LastReceivingBlockHash    string
 	ForwardingBlockNr         *BigInt `gorm:"type:numeric(30);default:0"`
 	ForwardingTransactionHash string
+	// SenderAddress sender of the last incoming transaction, an overpayment is refunded to it
+	SenderAddress string
+	// Contributions amounts of the incoming transactions per sender, the funds of an unpaid payment are refunded to each sender
+	Contributions         Contributions `gorm:"type:jsonb"`
+	RefundTransactionHash string
+	RefundStatus          RefundStatus `gorm:"type:varchar;index"`
+	// RefundHeld an admin holds the refund for a manual review
+	RefundHeld bool
+	// IdempotencyKey unique per merchant wallet (see idx_payments_merchant_idempotency_key)
+	IdempotencyKey string
+	RequestHash    string
+	ExpiresAt      *time.Time
+	// WatchedUntil the account of the expired payment is watched for late payments until then
+	WatchedUntil *time.Time
+	// QuoteRate amount of the pay currency for one unit of the price currency, locked when the payment was created
+	QuoteRate   float64 `gorm:"type:numeric(36,18);default:0"`
+	QuoteSource string
+	QuoteId     string
+	QuotedAt    *time.Time
+}
+
+// legacyExpiry fixed expiry of the payments, which were created without ExpiresAt
+const legacyExpiry = 15 * time.Minute
+
+/*
+	Token payments are paid with an ERC-20 token instead of native ETH.
+*/
+func (p *Payment) IsTokenPayment() bool {
+	return p.TokenContract != ""
+}
+
+func (p *Payment) GetPayCurrency() string {
+	if p.PayCurrency == "" {
+		return "ETH"
+	}
+	return p.PayCurrency
+}
+
+/*
+	Token balance which was already on the address before the payment was created.
+*/
+func (p *Payment) GetTokenRemainder() *big.Int {
+	if p.TokenRemainder == nil {
+		return big.NewInt(0)
+	}
+	return &p.TokenRemainder.Int
+}
+
+/*
+	Time after which an unpaid payment expires. Payments created before the expiry was stored expire 15 minutes after their creation.
+*/
+func (p *Payment) GetExpiresAt() time.Time {
+	if p.ExpiresAt == nil {
+		return p.CreatedAt.Add(legacyExpiry)
+	}
+	return *p.ExpiresAt
+}
+
+func (p *Payment) ExtendExpiry(extension time.Duration) {
+	expiresAt := p.GetExpiresAt().Add(extension)
+	p.ExpiresAt = &expiresAt
 }
 
 func (p *Payment) GetActiveAmount() *big.Int {
@@ -64,6 +157,7 @@ func (p *Payment) UpdatePaymentState(newState enum.State, balance *big.Int) Paym
 		AmountReceived: NewBigInt(balance),
 		PayAmount:      p.CurrentPaymentState.PayAmount,
 		PaymentID:      p.ID,
+		BackendStateID: BackendState(newState, p.CurrentPaymentState),
 	}
 	p.CurrentPaymentState = state
 	p.PaymentStates = append(p.PaymentStates, state)
@@ -71,6 +165,18 @@ func (p *Payment) UpdatePaymentState(newState enum.State, balance *big.Int) Paym
 	return state
 }
 
+/*
+	Returns when the payment reached the state the last time. It's zero if the payment never reached it or its states weren't loaded.
+*/
+func (p *Payment) GetStateReachedAt(state enum.State) time.Time {
+	for i := len(p.PaymentStates) - 1; i >= 0; i-- {
+		if p.PaymentStates[i].StateID == state {
+			return p.PaymentStates[i].CreatedAt
+		}
+	}
+	return time.Time{}
+}
+
 func (p *Payment) IsNewlyPartlyPaid(balance *big.Int) bool {
 	return p.CurrentPaymentState.IsWaitingForPayment() && balance.Uint64() > 0 && balance.Cmp(&p.CurrentPaymentState.AmountReceived.Int) > 0
 }
@@ -93,6 +199,7 @@ func (p *Payment) AddNewPaymentState(newState enum.State, balance *big.Int, payA
 		AmountReceived: NewBigInt(balance),
 		PayAmount:      NewBigInt(payAmount),
 		PaymentID:      p.ID,
+		BackendStateID: BackendState(newState, p.CurrentPaymentState),
 	}
 	p.CurrentPaymentState = state
 	p.PaymentStates = append(p.PaymentStates, state)
@@ -101,11 +208,22 @@ func (p *Payment) AddNewPaymentState(newState enum.State, balance *big.Int, payA
 
 type PaymentState struct {
 	Base
-	AccountID      uuid.UUID `gorm:"type:uuid;"`
-	PayAmount      *BigInt   `gorm:"type:numeric(30);default:0"`
-	AmountReceived *BigInt   `gorm:"type:numeric(30);default:0"`
-	StateID        enum.State
-	PaymentID      uuid.UUID `gorm:"type:uuid"`
+	AccountID      uuid.UUID  `gorm:"type:uuid;"`
+	PayAmount      *BigInt    `gorm:"type:numeric(30);default:0"`
+	AmountReceived *BigInt    `gorm:"type:numeric(30);default:0"`
+	StateID        enum.State `gorm:"index"`
+	PaymentID      uuid.UUID  `gorm:"type:uuid;index"`
+	BackendStateID enum.State
+}
+
+/*
+	State of the backend for this state, see BackendState. A state without a stored backend state is mapped as if it followed an expired one.
+*/
+func (ps *PaymentState) GetBackendState() enum.State {
+	if ps.BackendStateID != 0 {
+		return ps.BackendStateID
+	}
+	return BackendState(ps.StateID, PaymentState{BackendStateID: enum.Expired})
 }
 
 func (ps *PaymentState) IsWaitingForPayment() bool {
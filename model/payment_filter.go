@@ -0,0 +1,61 @@
+package model
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/google/uuid"
+)
+
+var InvalidCursor = errors.New("invalid cursor")
+
+// PaymentFilter
+/*
+	Filter and page of a payment search. Empty fields don't filter.
+*/
+type PaymentFilter struct {
+	Mode           enum.Mode
+	States         []enum.State
+	MerchantWallet string
+	PayAddress     string
+	CreatedFrom    *time.Time
+	CreatedTo      *time.Time
+	MinPriceAmount float64
+	MaxPriceAmount float64
+	Descending     bool
+	Limit          int
+	Cursor         *PaymentCursor
+}
+
+// PaymentCursor position of the last payment of a page. The next page starts after it.
+type PaymentCursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+func (c *PaymentCursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.CreatedAt.UTC().Format(time.RFC3339Nano) + "," + c.ID.String()))
+}
+
+func DecodePaymentCursor(cursor string) (*PaymentCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, InvalidCursor
+	}
+	parts := strings.Split(string(raw), ",")
+	if len(parts) != 2 {
+		return nil, InvalidCursor
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, InvalidCursor
+	}
+	id, err := uuid.Parse(parts[1])
+	if err != nil {
+		return nil, InvalidCursor
+	}
+	return &PaymentCursor{CreatedAt: createdAt, ID: id}, nil
+}
@@ -0,0 +1,28 @@
+package model
+
+import "time"
+
+// Quote
+/*
+	Conversion of the price of a payment into its pay currency. The quote is locked for the whole lifetime of the payment,
+	so the pay amount never changes and can be audited later.
+*/
+type Quote struct {
+	Id     string
+	Source string
+	// Rate amount of the pay currency for one unit of the price currency
+	Rate     float64
+	Amount   float64
+	QuotedAt time.Time
+}
+
+/*
+	Stores the quote on the payment.
+*/
+func (p *Payment) SetQuote(quote *Quote) {
+	quotedAt := quote.QuotedAt
+	p.QuoteId = quote.Id
+	p.QuoteSource = quote.Source
+	p.QuoteRate = quote.Rate
+	p.QuotedAt = &quotedAt
+}
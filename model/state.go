@@ -0,0 +1,70 @@
+package model
+
+import (
+	"strings"
+
+	"github.com/CHainGate/backend/pkg/enum"
+)
+
+// localStates the states of this service start far after the states of the backend enum, so they don't clash with states the backend adds
+const localStates enum.State = 100
+
+// States of this service, which the backend enum doesn't define. The backend gets them as the state of BackendState.
+const (
+	// Cancelled by the merchant before any funds arrived
+	Cancelled = localStates + 1 + iota
+	// OverpaidRefunded paid more than the tolerance allows, the overpayment is refunded to the sender. The payment continues with Confirmed
+	OverpaidRefunded
+	// Refunded the funds of an expired or failed payment are refunded to the sender
+	Refunded
+	// LatePaid funds arrived after the payment expired, they are refunded when the account isn't watched anymore
+	LatePaid
+)
+
+var stateNames = map[enum.State]string{
+	Cancelled:        "cancelled",
+	OverpaidRefunded: "overpaid_refunded",
+	Refunded:         "refunded",
+	LatePaid:         "late_paid",
+}
+
+// StateName
+/*
+	Name of the state. enum.State.String() panics for the states of this service, therefore always use this for a state of a payment.
+*/
+func StateName(state enum.State) string {
+	if name, ok := stateNames[state]; ok {
+		return name
+	}
+	return state.String()
+}
+
+// BackendState
+/*
+	State which the backend gets for the new state of a payment, the backend only knows the states of its enum.
+	A cancelled payment failed and an overpaid one is paid. A refund or a late payment doesn't change the outcome of the payment,
+	it keeps the backend state of the previous state.
+*/
+func BackendState(state enum.State, previous PaymentState) enum.State {
+	switch state {
+	case Cancelled:
+		return enum.Failed
+	case OverpaidRefunded:
+		return enum.Paid
+	case Refunded, LatePaid:
+		return previous.GetBackendState()
+	}
+	return state
+}
+
+/*
+	Parses the name of a state, including the states of this service.
+*/
+func ParseState(name string) (enum.State, bool) {
+	for state, stateName := range stateNames {
+		if strings.EqualFold(stateName, name) {
+			return state, true
+		}
+	}
+	return enum.ParseStringToStateEnum(name)
+}
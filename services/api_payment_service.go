@@ -11,12 +11,19 @@ package services
 
 import (
 	"context"
+	"errors"
 	"ethereum-service/internal/controller"
+	"ethereum-service/internal/service"
+	"ethereum-service/model"
 	"ethereum-service/openApi"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/CHainGate/backend/pkg/enum"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 // PaymentApiService is a service that implements the logic for the PaymentApiServicer
@@ -36,7 +43,16 @@ func (s *PaymentApiService) CreatePayment(ctx context.Context, paymentRequest op
 	if !ok {
 		return openApi.Response(http.StatusInternalServerError, nil), fmt.Errorf("unable to parse mode")
 	}
-	payment, finalPayAmount, err := controller.CreatePayment(mode, paymentRequest.PriceAmount, paymentRequest.PriceCurrency, paymentRequest.Wallet)
+	payment, finalPayAmount, err := controller.CreatePayment(mode, paymentRequest.PriceAmount, paymentRequest.PriceCurrency, paymentRequest.Wallet, paymentRequest.PayCurrency, int64(paymentRequest.ExpiresIn), paymentRequest.IdempotencyKey)
+	if errors.Is(err, controller.InvalidExpiry) {
+		return openApi.Response(http.StatusBadRequest, nil), err
+	}
+	if errors.Is(err, controller.IdempotencyConflict) || errors.Is(err, controller.IdempotencyInProgress) {
+		return openApi.Response(http.StatusConflict, nil), err
+	}
+	if errors.Is(err, service.ConversionFailed) || errors.Is(err, service.PricesDisagree) {
+		return openApi.Response(http.StatusBadGateway, nil), err
+	}
 	if err != nil {
 		return openApi.Response(http.StatusInternalServerError, nil), err
 	}
@@ -47,8 +63,219 @@ func (s *PaymentApiService) CreatePayment(ctx context.Context, paymentRequest op
 		PriceCurrency: payment.PriceCurrency,
 		PayAddress:    payment.Account.Address,
 		PayAmount:     finalPayAmount.String(),
-		PayCurrency:   "ETH",
-		PaymentState:  payment.CurrentPaymentState.StateID.String(),
+		PayCurrency:   payment.GetPayCurrency(),
+		PaymentState:  model.StateName(payment.CurrentPaymentState.StateID),
+		ExpiresAt:     payment.GetExpiresAt(),
+		Rate:          payment.QuoteRate,
+		QuoteSource:   payment.QuoteSource,
+		QuoteId:       payment.QuoteId,
+		QuotedAt:      payment.QuotedAt,
 	}
 	return openApi.Response(http.StatusCreated, paymentResponse), nil
 }
+
+// GetPayment - get payment with its state history
+func (s *PaymentApiService) GetPayment(ctx context.Context, paymentId string) (openApi.ImplResponse, error) {
+	id, err := uuid.Parse(paymentId)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), fmt.Errorf("invalid payment id %v", paymentId)
+	}
+	payment, err := controller.GetPayment(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return openApi.Response(http.StatusNotFound, nil), fmt.Errorf("payment %v not found", paymentId)
+	}
+	if err != nil {
+		return openApi.Response(http.StatusInternalServerError, nil), err
+	}
+	return openApi.Response(http.StatusOK, toPaymentDetailResponse(payment)), nil
+}
+
+// ListPayments - search payments
+func (s *PaymentApiService) ListPayments(ctx context.Context, mode string, state []string, merchantWallet string, payAddress string, createdFrom string, createdTo string, minPriceAmount float64, maxPriceAmount float64, sort string, limit int32, cursor string) (openApi.ImplResponse, error) {
+	filter, err := toPaymentFilter(mode, state, merchantWallet, payAddress, createdFrom, createdTo, minPriceAmount, maxPriceAmount, sort, limit, cursor)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), err
+	}
+	payments, next, err := controller.SearchPayments(filter)
+	if err != nil {
+		return openApi.Response(http.StatusInternalServerError, nil), err
+	}
+
+	response := openApi.PaymentListResponse{Payments: make([]openApi.PaymentDetailResponse, 0, len(payments))}
+	for i := range payments {
+		response.Payments = append(response.Payments, toPaymentDetailResponse(&payments[i]))
+	}
+	if next != nil {
+		response.NextCursor = next.Encode()
+	}
+	return openApi.Response(http.StatusOK, response), nil
+}
+
+// CancelPayment - cancel waiting payment
+func (s *PaymentApiService) CancelPayment(ctx context.Context, paymentId string) (openApi.ImplResponse, error) {
+	id, err := uuid.Parse(paymentId)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), fmt.Errorf("invalid payment id %v", paymentId)
+	}
+	payment, err := controller.CancelPayment(id)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return openApi.Response(http.StatusNotFound, nil), fmt.Errorf("payment %v not found", paymentId)
+	case errors.Is(err, controller.PaymentNotCancellable) || errors.Is(err, controller.FundsReceived):
+		return openApi.Response(http.StatusConflict, nil), err
+	case err != nil:
+		return openApi.Response(http.StatusInternalServerError, nil), err
+	}
+	return openApi.Response(http.StatusOK, toPaymentDetailResponse(payment)), nil
+}
+
+// HoldRefund - hold refund for manual review
+func (s *PaymentApiService) HoldRefund(ctx context.Context, paymentId string) (openApi.ImplResponse, error) {
+	return holdRefund(paymentId, true)
+}
+
+// ReleaseRefund - release held refund
+func (s *PaymentApiService) ReleaseRefund(ctx context.Context, paymentId string) (openApi.ImplResponse, error) {
+	return holdRefund(paymentId, false)
+}
+
+func holdRefund(paymentId string, hold bool) (openApi.ImplResponse, error) {
+	id, err := uuid.Parse(paymentId)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), fmt.Errorf("invalid payment id %v", paymentId)
+	}
+	payment, err := controller.HoldRefund(id, hold)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return openApi.Response(http.StatusNotFound, nil), fmt.Errorf("payment %v not found", paymentId)
+	case errors.Is(err, controller.RefundAlreadySent) || errors.Is(err, controller.RefundInProgress):
+		return openApi.Response(http.StatusConflict, nil), err
+	case err != nil:
+		return openApi.Response(http.StatusInternalServerError, nil), err
+	}
+	return openApi.Response(http.StatusOK, toPaymentDetailResponse(payment)), nil
+}
+
+// ReplayNotifications - replay dead notifications
+func (s *PaymentApiService) ReplayNotifications(ctx context.Context, paymentId string) (openApi.ImplResponse, error) {
+	id, err := uuid.Parse(paymentId)
+	if err != nil {
+		return openApi.Response(http.StatusBadRequest, nil), fmt.Errorf("invalid payment id %v", paymentId)
+	}
+	notifications, err := controller.ReplayNotifications(id)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return openApi.Response(http.StatusNotFound, nil), fmt.Errorf("payment %v not found", paymentId)
+	case err != nil:
+		return openApi.Response(http.StatusInternalServerError, nil), err
+	}
+	response := openApi.NotificationListResponse{Notifications: make([]openApi.NotificationResponse, 0, len(notifications))}
+	for _, n := range notifications {
+		response.Notifications = append(response.Notifications, openApi.NotificationResponse{
+			NotificationId: n.ID.String(),
+			PaymentState:   model.StateName(n.StateID),
+			Status:         string(n.Status),
+			Attempts:       int32(n.Attempts),
+			LastError:      n.LastError,
+			CreatedAt:      n.CreatedAt,
+		})
+	}
+	return openApi.Response(http.StatusOK, response), nil
+}
+
+func toPaymentFilter(mode string, state []string, merchantWallet string, payAddress string, createdFrom string, createdTo string, minPriceAmount float64, maxPriceAmount float64, sort string, limit int32, cursor string) (model.PaymentFilter, error) {
+	filter := model.PaymentFilter{
+		MerchantWallet: merchantWallet,
+		PayAddress:     payAddress,
+		MinPriceAmount: minPriceAmount,
+		MaxPriceAmount: maxPriceAmount,
+		Limit:          int(limit),
+	}
+	if mode != "" {
+		m, ok := enum.ParseStringToModeEnum(mode)
+		if !ok {
+			return filter, fmt.Errorf("unable to parse mode %v", mode)
+		}
+		filter.Mode = m
+	}
+	for _, st := range state {
+		parsed, ok := model.ParseState(st)
+		if !ok {
+			return filter, fmt.Errorf("unable to parse state %v", st)
+		}
+		filter.States = append(filter.States, parsed)
+	}
+	if createdFrom != "" {
+		from, err := time.Parse(time.RFC3339, createdFrom)
+		if err != nil {
+			return filter, fmt.Errorf("unable to parse created_from %v", createdFrom)
+		}
+		filter.CreatedFrom = &from
+	}
+	if createdTo != "" {
+		to, err := time.Parse(time.RFC3339, createdTo)
+		if err != nil {
+			return filter, fmt.Errorf("unable to parse created_to %v", createdTo)
+		}
+		filter.CreatedTo = &to
+	}
+	switch strings.ToLower(sort) {
+	case "", "desc":
+		filter.Descending = true
+	case "asc":
+	default:
+		return filter, fmt.Errorf("unable to parse sort %v", sort)
+	}
+	if cursor != "" {
+		c, err := model.DecodePaymentCursor(cursor)
+		if err != nil {
+			return filter, err
+		}
+		filter.Cursor = c
+	}
+	return filter, nil
+}
+
+func toPaymentDetailResponse(payment *model.Payment) openApi.PaymentDetailResponse {
+	states := make([]openApi.PaymentStateResponse, 0, len(payment.PaymentStates))
+	for _, state := range payment.PaymentStates {
+		states = append(states, openApi.PaymentStateResponse{
+			PaymentState:   model.StateName(state.StateID),
+			PayAmount:      bigIntString(state.PayAmount),
+			AmountReceived: bigIntString(state.AmountReceived),
+			CreatedAt:      state.CreatedAt,
+		})
+	}
+	return openApi.PaymentDetailResponse{
+		PaymentId:                 payment.ID.String(),
+		Mode:                      payment.Mode.String(),
+		PriceAmount:               payment.PriceAmount,
+		PriceCurrency:             payment.PriceCurrency,
+		PayAddress:                payment.Account.Address,
+		PayAmount:                 bigIntString(payment.CurrentPaymentState.PayAmount),
+		PayCurrency:               payment.GetPayCurrency(),
+		AmountReceived:            bigIntString(payment.CurrentPaymentState.AmountReceived),
+		PaymentState:              model.StateName(payment.CurrentPaymentState.StateID),
+		CreatedAt:                 payment.CreatedAt,
+		UpdatedAt:                 payment.UpdatedAt,
+		ExpiresAt:                 payment.GetExpiresAt(),
+		WatchedUntil:              payment.WatchedUntil,
+		Rate:                      payment.QuoteRate,
+		QuoteSource:               payment.QuoteSource,
+		QuoteId:                   payment.QuoteId,
+		QuotedAt:                  payment.QuotedAt,
+		ReceivingBlockNr:          bigIntString(payment.LastReceivingBlockNr),
+		ForwardingTransactionHash: payment.ForwardingTransactionHash,
+		RefundTransactionHash:     payment.RefundTransactionHash,
+		RefundStatus:              string(payment.RefundStatus),
+		RefundHeld:                payment.RefundHeld,
+		PaymentStates:             states,
+	}
+}
+
+func bigIntString(value *model.BigInt) string {
+	if value == nil {
+		return "0"
+	}
+	return value.String()
+}
@@ -25,9 +25,17 @@ func GetETHFromWEI(amount *big.Int) *big.Float {
 }
 
 func GetWEIFromETH(val *float64) *big.Int {
+	return GetBaseUnitFromAmount(val, 18)
+}
+
+/*
+	Converts an amount into the smallest unit of a currency with the given decimals. E.g. 6 decimals for USDC.
+*/
+func GetBaseUnitFromAmount(val *float64, decimals uint8) *big.Int {
 	bigval := new(big.Float)
 	bigval.SetFloat64(*val)
-	balance := big.NewFloat(0).Mul(bigval, big.NewFloat(1000000000000000000))
+	unit := new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil))
+	balance := big.NewFloat(0).Mul(bigval, unit)
 	final, accur := balance.Int(nil)
 	if accur == big.Below {
 		final.Add(final, big.NewInt(1))
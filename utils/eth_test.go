@@ -33,3 +33,12 @@ func TestGetWEIFromETHRoundUp(t *testing.T) {
 		t.Fatalf(`The calculated ethAmount %v, should be: %v`, ethAmount, shouldWEIAmount)
 	}
 }
+
+func TestGetBaseUnitFromAmount(t *testing.T) {
+	shouldBaseUnitAmount := big.NewInt(12500000)
+	tokenAmount := 12.5
+	baseUnitAmount := GetBaseUnitFromAmount(&tokenAmount, 6)
+	if baseUnitAmount.Cmp(shouldBaseUnitAmount) != 0 {
+		t.Fatalf(`The calculated token amount %v, should be: %v`, baseUnitAmount, shouldBaseUnitAmount)
+	}
+}
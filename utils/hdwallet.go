@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"ethereum-service/internal/config"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/tyler-smith/go-bip39"
+)
+
+var (
+	NoMnemonic     = errors.New("no HD wallet mnemonic configured")
+	InvalidKey     = errors.New("derived key is invalid")
+	masterSeedLock sync.Mutex
+	masterSeeds    = make(map[string][]byte)
+)
+
+// ExtendedKey BIP-32 private extended key https://github.com/bitcoin/bips/blob/master/bip-0032.mediawiki
+type ExtendedKey struct {
+	Key       []byte
+	ChainCode []byte
+}
+
+func NewMasterKey(seed []byte) (*ExtendedKey, error) {
+	mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+	if !isValidPrivateKey(sum[:32]) {
+		return nil, InvalidKey
+	}
+	return &ExtendedKey{Key: sum[:32], ChainCode: sum[32:]}, nil
+}
+
+/*
+	Derives the private child key with the index. Indexes from 0x80000000 are hardened.
+*/
+func (k *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+	var data []byte
+	if index >= 0x80000000 {
+		data = append([]byte{0x00}, k.Key...)
+	} else {
+		privateKey, err := crypto.ToECDSA(k.Key)
+		if err != nil {
+			return nil, err
+		}
+		data = crypto.CompressPubkey(&privateKey.PublicKey)
+	}
+	indexBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(indexBytes, index)
+	data = append(data, indexBytes...)
+
+	mac := hmac.New(sha512.New, k.ChainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+	if !isValidPrivateKey(sum[:32]) {
+		return nil, InvalidKey
+	}
+
+	childKey := new(big.Int).SetBytes(sum[:32])
+	childKey.Add(childKey, new(big.Int).SetBytes(k.Key))
+	childKey.Mod(childKey, crypto.S256().Params().N)
+	if childKey.Sign() == 0 {
+		return nil, InvalidKey
+	}
+	return &ExtendedKey{Key: childKey.FillBytes(make([]byte, 32)), ChainCode: sum[32:]}, nil
+}
+
+func (k *ExtendedKey) Derive(path accounts.DerivationPath) (*ExtendedKey, error) {
+	key := k
+	for _, index := range path {
+		var err error
+		key, err = key.Child(index)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func isValidPrivateKey(key []byte) bool {
+	k := new(big.Int).SetBytes(key)
+	return k.Sign() > 0 && k.Cmp(crypto.S256().Params().N) < 0
+}
+
+/*
+	Derives the private key of m/44'/60'/0'/0/index from the seed.
+*/
+func DeriveKeyFromSeed(seed []byte, index uint32) (*ecdsa.PrivateKey, error) {
+	master, err := NewMasterKey(seed)
+	if err != nil {
+		return nil, err
+	}
+	path := append(accounts.DerivationPath{}, accounts.DefaultRootDerivationPath...)
+	path = append(path, index)
+	key, err := master.Derive(path)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.ToECDSA(key.Key)
+}
+
+// DeriveAccountKey
+/*
+	Derives the private key of an account from the configured master seed. The key is never stored.
+*/
+func DeriveAccountKey(index uint32) (*ecdsa.PrivateKey, error) {
+	seed, err := getMasterSeed(config.Opts.HDMnemonic)
+	if err != nil {
+		return nil, err
+	}
+	return DeriveKeyFromSeed(seed, index)
+}
+
+func IsHDWalletEnabled() bool {
+	return config.Opts.HDMnemonic != ""
+}
+
+func getMasterSeed(mnemonic string) ([]byte, error) {
+	if mnemonic == "" {
+		return nil, NoMnemonic
+	}
+	masterSeedLock.Lock()
+	defer masterSeedLock.Unlock()
+	if seed, ok := masterSeeds[mnemonic]; ok {
+		return seed, nil
+	}
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, "")
+	if err != nil {
+		return nil, err
+	}
+	masterSeeds[mnemonic] = seed
+	return seed, nil
+}
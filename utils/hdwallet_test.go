@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"ethereum-service/internal/config"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// https://github.com/bitcoin/bips/blob/master/bip-0032.mediawiki#test-vector-1
+func TestDeriveBip32TestVector(t *testing.T) {
+	master, err := NewMasterKey(common.FromHex("000102030405060708090a0b0c0d0e0f"))
+	if err != nil {
+		t.Fatalf("Unable to create master key %v", err)
+	}
+	if common.Bytes2Hex(master.Key) != "e8f32e723decf4051aefac8e2c93c9c5b214313817cdb01a1494b917c8436b35" {
+		t.Fatalf(`Master key is %v`, common.Bytes2Hex(master.Key))
+	}
+	child, err := master.Derive(accounts.DerivationPath{0x80000000, 1})
+	if err != nil {
+		t.Fatalf("Unable to derive child key %v", err)
+	}
+	if common.Bytes2Hex(child.Key) != "3c6cb8d0f6a264c91ea8b5030fadaa8e538b020f0a387421a12de9319dc93368" {
+		t.Fatalf(`Key of m/0'/1 is %v`, common.Bytes2Hex(child.Key))
+	}
+}
+
+func TestDeriveAccountKey(t *testing.T) {
+	config.ReadOpts()
+	config.Opts.HDMnemonic = "test test test test test test test test test test test junk"
+	defer func() { config.Opts.HDMnemonic = "" }()
+	key, err := DeriveAccountKey(0)
+	if err != nil {
+		t.Fatalf("Unable to derive account key %v", err)
+	}
+	address := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	if address != "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266" {
+		t.Fatalf(`Address of m/44'/60'/0'/0/0 is %v, but should be %v`, address, "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266")
+	}
+}
+
+func TestDeriveAccountKeyWithoutMnemonic(t *testing.T) {
+	config.ReadOpts()
+	if _, err := DeriveAccountKey(0); err != NoMnemonic {
+		t.Fatalf(`Error is %v, but should be %v`, err, NoMnemonic)
+	}
+}